@@ -7,7 +7,6 @@ import (
 	"archive/zip"
 	"encoding/base64"
 	"fmt"
-	bolt "github.com/coreos/bbolt"
 	"io"
 	"io/ioutil"
 	"karma.run/codec"
@@ -16,16 +15,19 @@ import (
 	"karma.run/kvm"
 	"karma.run/kvm/err"
 	"karma.run/kvm/val"
+	"karma.run/store"
 	"log"
 	"net/http"
 	"os"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 )
 
 func ExportHttpHandler(rw http.ResponseWriter, rq *http.Request) {
 
 	cdc := rq.Context().Value(ContextKeyCodec).(codec.Interface)
-	dtbs := rq.Context().Value(ContextKeyDatabase).(*bolt.DB)
+	dtbs := rq.Context().Value(ContextKeyDatabase).(store.DB)
 	userId := rq.Context().Value(ContextKeyUserId).(string)
 
 	adminId, ke := adminUserIdFromDatabase(dtbs)
@@ -43,19 +45,23 @@ func ExportHttpHandler(rw http.ResponseWriter, rq *http.Request) {
 	}
 
 	e := func() error {
-		zw := zip.NewWriter(rw)
-		fw, e := zw.Create(config.DataFile)
+		tx, e := dtbs.Begin(false)
 		if e != nil {
 			return e
 		}
-		tx, e := dtbs.Begin(false)
+		defer tx.Rollback()
+		wt, ok := tx.(io.WriterTo)
+		if !ok {
+			return fmt.Errorf(`storage engine doesn't support exports`)
+		}
+		zw := zip.NewWriter(rw)
+		fw, e := zw.Create(config.DataFile)
 		if e != nil {
 			return e
 		}
-		defer tx.Rollback()
 		rw.Header().Set(`Content-Type`, `application/zip`)
 		rw.Header().Set(`Content-Disposition`, `attachment; filename="`+config.DataFile+`.zip"`)
-		_, e = tx.WriteTo(fw)
+		_, e = wt.WriteTo(fw)
 		if e != nil {
 			return e
 		}
@@ -69,12 +75,240 @@ func ExportHttpHandler(rw http.ResponseWriter, rq *http.Request) {
 	}
 }
 
+func StatsHttpHandler(rw http.ResponseWriter, rq *http.Request) {
+
+	cdc := rq.Context().Value(ContextKeyCodec).(codec.Interface)
+	dtbs := rq.Context().Value(ContextKeyDatabase).(store.DB)
+	userId := rq.Context().Value(ContextKeyUserId).(string)
+
+	adminId, ke := adminUserIdFromDatabase(dtbs)
+	if ke != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write(cdc.Encode(err.InternalError{`unable to read database`, ke}.Value()))
+		return
+	}
+
+	if string(adminId) != userId {
+		log.Printf(`unauthorized stats request by user %s: %#v`, userId, *rq)
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write(cdc.Encode(err.PermissionDeniedError{}.Value()))
+		return
+	}
+
+	caches := map[string]val.Value{}
+	for name, st := range kvm.CacheStats() {
+		caches[name] = val.StructFromMap(map[string]val.Value{
+			"hits":      val.Int64(st.Hits),
+			"misses":    val.Int64(st.Misses),
+			"evictions": val.Int64(st.Evictions),
+			"entries":   val.Int64(st.Entries),
+			"bytes":     val.Int64(st.Bytes),
+		})
+	}
+
+	caches["rewrite"] = val.StructFromMap(map[string]val.Value{
+		"running":   val.Bool(atomic.LoadInt32(&rewriting) == 1),
+		"records":   val.Int64(atomic.LoadInt64(&rewriteProgress.Records)),
+		"rewritten": val.Int64(atomic.LoadInt64(&rewriteProgress.Rewritten)),
+		"error":     val.String(rewriteFailure()),
+	})
+
+	caches["blobCollection"] = val.StructFromMap(map[string]val.Value{
+		"running":   val.Bool(atomic.LoadInt32(&collectingBlobs) == 1),
+		"collected": val.Int64(atomic.LoadInt64(&collectedBlobs)),
+	})
+
+	rw.Write(cdc.Encode(val.StructFromMap(caches)))
+}
+
+// records per write transaction of a rewrite
+const rewriteBatchSize = 1000
+
+var rewriting int32 // 1 while a rewrite runs
+
+var rewriteProgress kvm.RewriteProgress // of the last rewrite
+
+var rewriteError atomic.Value // string, why the last rewrite failed if it did
+
+func rewriteFailure() string {
+	s, _ := rewriteError.Load().(string)
+	return s
+}
+
+// RewriteHttpHandler starts rewriting all records in the current format, and
+// blobs sealed with the current data key, in the background, see
+// kvm.RewriteRecords. Progress of records, and why the rewrite failed if it
+// did, is reported by stats.
+func RewriteHttpHandler(rw http.ResponseWriter, rq *http.Request) {
+
+	cdc := rq.Context().Value(ContextKeyCodec).(codec.Interface)
+	dtbs := rq.Context().Value(ContextKeyDatabase).(store.DB)
+	userId := rq.Context().Value(ContextKeyUserId).(string)
+
+	adminId, ke := adminUserIdFromDatabase(dtbs)
+	if ke != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write(cdc.Encode(err.InternalError{`unable to read database`, ke}.Value()))
+		return
+	}
+
+	if string(adminId) != userId {
+		log.Printf(`unauthorized rewrite request by user %s: %#v`, userId, *rq)
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write(cdc.Encode(err.PermissionDeniedError{}.Value()))
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&rewriting, 0, 1) {
+		rw.WriteHeader(http.StatusConflict)
+		rw.Write(cdc.Encode(val.String("rewrite already running")))
+		return
+	}
+
+	startRewrite(dtbs)
+
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write(cdc.Encode(val.String("rewrite started")))
+}
+
+// startRewrite runs kvm.RewriteRecords and rewriteBlobs in the background.
+// The caller must have set rewriting, which is reset when done. Failures,
+// panics included, are reported by stats.
+func startRewrite(dtbs store.DB) {
+
+	atomic.StoreInt64(&rewriteProgress.Records, 0)
+	atomic.StoreInt64(&rewriteProgress.Rewritten, 0)
+	rewriteError.Store("")
+
+	go func() {
+		defer atomic.StoreInt32(&rewriting, 0)
+		defer func() {
+			if v := recover(); v != nil {
+				log.Printf("rewrite failed: %v\n%s", v, debug.Stack())
+				rewriteError.Store(fmt.Sprint(v))
+			}
+		}()
+		if e := kvm.RewriteRecords(dtbs, rewriteBatchSize, &rewriteProgress); e != nil {
+			log.Println("rewrite failed:", e)
+			rewriteError.Store(e.Error())
+			return
+		}
+		blobs, e := rewriteBlobs(dtbs)
+		if e != nil {
+			log.Println("rewrite of blobs failed:", e)
+			rewriteError.Store(e.Error())
+			return
+		}
+		log.Printf("rewrite done, rewrote %d of %d records and %d blobs\n", rewriteProgress.Rewritten, rewriteProgress.Records, blobs)
+	}()
+}
+
+// RotateDataKeyHttpHandler adds a new data key to encrypt records and blobs
+// with and starts re-encrypting existing ones in the background, see
+// db.RotateDataKey.
+// Old keys must stay in the key file until the rewrite is done.
+func RotateDataKeyHttpHandler(rw http.ResponseWriter, rq *http.Request) {
+
+	cdc := rq.Context().Value(ContextKeyCodec).(codec.Interface)
+	dtbs := rq.Context().Value(ContextKeyDatabase).(store.DB)
+	userId := rq.Context().Value(ContextKeyUserId).(string)
+
+	adminId, ke := adminUserIdFromDatabase(dtbs)
+	if ke != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write(cdc.Encode(err.InternalError{`unable to read database`, ke}.Value()))
+		return
+	}
+
+	if string(adminId) != userId {
+		log.Printf(`unauthorized data key rotation request by user %s: %#v`, userId, *rq)
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write(cdc.Encode(err.PermissionDeniedError{}.Value()))
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&rewriting, 0, 1) {
+		rw.WriteHeader(http.StatusConflict)
+		rw.Write(cdc.Encode(val.String("rewrite already running")))
+		return
+	}
+
+	if e := db.RotateDataKey(); e != nil {
+		atomic.StoreInt32(&rewriting, 0)
+		log.Println("data key rotation failed:", e)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write(cdc.Encode(err.InternalError{`data key rotation failed`, nil}.Value()))
+		return
+	}
+
+	log.Println("data key rotated, re-encrypting records...")
+
+	startRewrite(dtbs)
+
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write(cdc.Encode(val.String("data key rotated, rewrite started")))
+}
+
+var collectingBlobs int32 // 1 while blobs are collected
+
+var collectedBlobs int64 // by the last collection
+
+// CollectBlobsHttpHandler starts deleting unreferenced blobs in the
+// background, see collectBlobs. The result is reported by stats.
+func CollectBlobsHttpHandler(rw http.ResponseWriter, rq *http.Request) {
+
+	cdc := rq.Context().Value(ContextKeyCodec).(codec.Interface)
+	dtbs := rq.Context().Value(ContextKeyDatabase).(store.DB)
+	userId := rq.Context().Value(ContextKeyUserId).(string)
+
+	adminId, ke := adminUserIdFromDatabase(dtbs)
+	if ke != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write(cdc.Encode(err.InternalError{`unable to read database`, ke}.Value()))
+		return
+	}
+
+	if string(adminId) != userId {
+		log.Printf(`unauthorized blob collection request by user %s: %#v`, userId, *rq)
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write(cdc.Encode(err.PermissionDeniedError{}.Value()))
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&collectingBlobs, 0, 1) {
+		rw.WriteHeader(http.StatusConflict)
+		rw.Write(cdc.Encode(val.String("blob collection already running")))
+		return
+	}
+
+	atomic.StoreInt64(&collectedBlobs, 0)
+
+	go func() {
+		defer atomic.StoreInt32(&collectingBlobs, 0)
+		defer func() {
+			if v := recover(); v != nil {
+				log.Printf("blob collection failed: %v\n%s", v, debug.Stack())
+			}
+		}()
+		n, e := collectBlobs(dtbs)
+		if e != nil {
+			log.Println("blob collection failed:", e)
+			return
+		}
+		atomic.StoreInt64(&collectedBlobs, int64(n))
+		log.Printf("blob collection done, deleted %d blobs\n", n)
+	}()
+
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write(cdc.Encode(val.String("blob collection started")))
+}
+
 const maxImportSize = 1024 * 1024 * 1024 // in bytes
 
 func ImportHttpHandler(rw http.ResponseWriter, rq *http.Request) {
 
 	cdc := rq.Context().Value(ContextKeyCodec).(codec.Interface)
-	dtbs := rq.Context().Value(ContextKeyDatabase).(*bolt.DB)
+	dtbs := rq.Context().Value(ContextKeyDatabase).(store.DB)
 	userId := rq.Context().Value(ContextKeyUserId).(string)
 
 	adminId, ke := adminUserIdFromDatabase(dtbs)
@@ -143,6 +377,7 @@ func ImportHttpHandler(rw http.ResponseWriter, rq *http.Request) {
 		}
 
 		kvm.ClearCompilerCache()
+		kvm.ClearResultCache()
 		return nil
 	})
 
@@ -186,7 +421,7 @@ func ResetHttpHandler(rw http.ResponseWriter, rq *http.Request) {
 	defer resetLock.Unlock() // no concurrent reset requests
 
 	cdc := rq.Context().Value(ContextKeyCodec).(codec.Interface)
-	dtbs := rq.Context().Value(ContextKeyDatabase).(*bolt.DB)
+	dtbs := rq.Context().Value(ContextKeyDatabase).(store.DB)
 	userId := rq.Context().Value(ContextKeyUserId).(string)
 
 	adminId, ke := adminUserIdFromDatabase(dtbs)
@@ -203,7 +438,7 @@ func ResetHttpHandler(rw http.ResponseWriter, rq *http.Request) {
 		return
 	}
 
-	e := dtbs.Update(func(tx *bolt.Tx) error {
+	e := dtbs.Update(func(tx store.Tx) error {
 		_ = tx.DeleteBucket([]byte(`root`))
 		rb, e := tx.CreateBucket([]byte(`root`))
 		if e != nil {
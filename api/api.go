@@ -8,7 +8,6 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
-	bolt "github.com/coreos/bbolt"
 	"io"
 	"karma.run/codec"
 	"karma.run/config"
@@ -19,12 +18,14 @@ import (
 	"karma.run/kvm/mdl"
 	"karma.run/kvm/val"
 	"karma.run/kvm/xpr"
+	"karma.run/store"
 	"log"
 	"net/http"
 	"os"
 	"path"
 	"runtime/debug"
 	"strings"
+	"time"
 
 	_ "net/http/pprof"
 )
@@ -50,16 +51,24 @@ const (
 	AuthPrefix = `auth`
 
 	RestApiPrefix              = `rest`
+	QueryPrefix                = `query`
+	BlobPrefix                 = `blob`
 	ExportPrefix               = `admin/export`
 	ImportPrefix               = `admin/import`
 	ResetPrefix                = `admin/reset`
+	StatsPrefix                = `admin/stats`
+	RewritePrefix              = `admin/rewrite`
+	RotateDataKeyPrefix        = `admin/rotate_data_key`
 	RotateInstanceSecretPrefix = `admin/rotate_instance_secret`
+	CollectBlobsPrefix         = `admin/collect_blobs`
 )
 
 const (
 	SignatureHeader = `X-Karma-Signature`
 	CodecHeader     = `X-Karma-Codec`
 	SecretHeader    = `X-Karma-Secret`
+	ExplainHeader   = `X-Karma-Explain` // "human" for text, anything else for the requested codec
+	ProfileHeader   = `X-Karma-Profile` // if set, responds with {result, profile}
 )
 
 type gzipResponseWriter struct {
@@ -87,7 +96,10 @@ func HttpHandler(rw http.ResponseWriter, rq *http.Request) {
 
 	rw.Header().Set("Content-Type", "text/plain; charset=utf-8") // default, gets overwritten
 
-	if strings.Contains(rq.Header.Get("Accept-Encoding"), "gzip") {
+	// blobs are served with range support, which doesn't mix with compressing on the fly
+	isBlob := strings.HasPrefix(strings.TrimLeft(rq.URL.Path, "/"), BlobPrefix+"/") || strings.Trim(rq.URL.Path, "/") == BlobPrefix
+
+	if !isBlob && strings.Contains(rq.Header.Get("Accept-Encoding"), "gzip") {
 		gz, _ := gzip.NewWriterLevel(rw, gzip.BestSpeed)
 		rw = gzipResponseWriter{rw, gz}
 		rw.Header().Set("Content-Encoding", "gzip")
@@ -179,6 +191,14 @@ func HttpHandler(rw http.ResponseWriter, rq *http.Request) {
 		RestApiHttpHandler(rw, rq)
 		return
 	}
+	if len(path) >= len(QueryPrefix) && path[:len(QueryPrefix)] == QueryPrefix {
+		QueryHttpHandler(rw, rq)
+		return
+	}
+	if isBlob {
+		BlobHttpHandler(rw, rq)
+		return
+	}
 	if len(path) >= len(ResetPrefix) && path[:len(ResetPrefix)] == ResetPrefix {
 		ResetHttpHandler(rw, rq)
 		return
@@ -194,6 +214,26 @@ func HttpHandler(rw http.ResponseWriter, rq *http.Request) {
 		return
 	}
 
+	if len(path) >= len(StatsPrefix) && path[:len(StatsPrefix)] == StatsPrefix {
+		StatsHttpHandler(rw, rq)
+		return
+	}
+
+	if len(path) >= len(RewritePrefix) && path[:len(RewritePrefix)] == RewritePrefix {
+		RewriteHttpHandler(rw, rq)
+		return
+	}
+
+	if len(path) >= len(RotateDataKeyPrefix) && path[:len(RotateDataKeyPrefix)] == RotateDataKeyPrefix {
+		RotateDataKeyHttpHandler(rw, rq)
+		return
+	}
+
+	if len(path) >= len(CollectBlobsPrefix) && path[:len(CollectBlobsPrefix)] == CollectBlobsPrefix {
+		CollectBlobsHttpHandler(rw, rq)
+		return
+	}
+
 	if len(path) > 0 {
 		rw.WriteHeader(http.StatusNotFound)
 		return
@@ -214,13 +254,19 @@ func HttpHandler(rw http.ResponseWriter, rq *http.Request) {
 			case "create",
 				"delete",
 				"update",
-				"createMultiple":
+				"createMultiple",
+				"call": // persisted functions may write
 				txt = TxTypeWrite
 			}
 		}
 		return v
 	})
 
+	explain := rq.Header.Get(ExplainHeader)
+	if explain != "" {
+		txt = TxTypeRead // explained expressions aren't executed
+	}
+
 	tx, e := dtbs.Begin(txt == TxTypeWrite)
 	if e != nil {
 		panic(e)
@@ -260,12 +306,54 @@ func HttpHandler(rw http.ResponseWriter, rq *http.Request) {
 		}
 	}
 
+	if explain != "" {
+		x, ke := vm.Explain(expr, nil, []mdl.Model{}, nil)
+		if ke != nil {
+			writeError(rw, cdc, err.HumanReadableError{ke})
+			return
+		}
+		if explain == "human" {
+			rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			rw.Write([]byte(x.String()))
+			return
+		}
+		rw.Write(cdc.Encode(x.Value()))
+		return
+	}
+
+	cancel, ke := vm.Limit(rq.Context())
+	if ke != nil {
+		writeError(rw, cdc, err.HumanReadableError{ke})
+		return
+	}
+	defer cancel()
+
+	if rq.Header.Get(ProfileHeader) != "" {
+		vm.Profile = kvm.NewProfile()
+	}
+
+	if vm.Parallelism = kvm.NewParallelism(config.MaxParallelism); vm.Parallelism != nil {
+		vm.RootBucket = store.Synchronized(vm.RootBucket)
+	}
+	vm.CacheResults = true
+
+	start := time.Now()
 	res, _, ke := vm.ParseCompileAndExecute(expr, nil, []mdl.Model{}, nil)
+	logSlowQuery(vm.UserID, time.Since(start), func() string {
+		return err.ProgramToHuman(withoutLiterals(expr), 0)
+	})
 	if ke != nil {
 		writeError(rw, cdc, err.HumanReadableError{ke})
 		return
 	}
 
+	if vm.Profile != nil {
+		res = val.StructFromMap(map[string]val.Value{
+			"result":  res,
+			"profile": vm.Profile.Value(),
+		})
+	}
+
 	rw.Write(cdc.Encode(res))
 
 	if tx.Writable() {
@@ -276,6 +364,91 @@ func HttpHandler(rw http.ResponseWriter, rq *http.Request) {
 
 }
 
+// logSlowQuery logs queries running longer than config.SlowQueryThreshold,
+// human is only called if so. It must not contain the literals of the
+// program, see withoutLiterals.
+func logSlowQuery(userId string, d time.Duration, human func() string) {
+	if config.SlowQueryThreshold <= 0 || d < config.SlowQueryThreshold {
+		return
+	}
+	log.Printf("slow query: user %s, %s\n%s\n", userId, d, human())
+}
+
+// literalCases are the cases of the expressions of primitive literals.
+var literalCases = map[string]struct{}{
+	"null": {}, "bool": {}, "dateTime": {}, "duration": {}, "decimal": {},
+	"bytes": {}, "blob": {}, "string": {}, "float": {}, "symbol": {},
+	"int8": {}, "int16": {}, "int32": {}, "int64": {},
+	"uint8": {}, "uint16": {}, "uint32": {}, "uint64": {},
+}
+
+// strippedLiteral replaces literals in withoutLiterals.
+var strippedLiteral = val.Symbol("?")
+
+// withoutLiterals returns program v with its literals replaced, so that it
+// can be logged without the values it carries, e.g. passwords or the values
+// looked up by lookupEncrypted. Names of fields, scopes and cases are kept.
+func withoutLiterals(v val.Value) val.Value {
+	u, ok := v.(val.Union)
+	if !ok {
+		return mapProgramValue(v, withoutLiterals)
+	}
+	if _, ok := literalCases[u.Case]; ok {
+		return val.Union{u.Case, strippedLiteral}
+	}
+	if u.Case == "data" {
+		return val.Union{u.Case, dataWithoutLiterals(u.Value)}
+	}
+	return val.Union{u.Case, mapProgramValue(u.Value, withoutLiterals)}
+}
+
+// dataWithoutLiterals is withoutLiterals for the argument of data, in which
+// every constructor of a primitive value is a literal.
+func dataWithoutLiterals(v val.Value) val.Value {
+	u, ok := v.(val.Union)
+	if !ok {
+		return mapProgramValue(v, dataWithoutLiterals)
+	}
+	if u.Case == "expr" {
+		return val.Union{u.Case, withoutLiterals(u.Value)}
+	}
+	switch u.Value.(type) {
+	case val.Union, val.Struct, val.Map, val.Tuple, val.List:
+		return val.Union{u.Case, mapProgramValue(u.Value, dataWithoutLiterals)}
+	}
+	return val.Union{u.Case, strippedLiteral}
+}
+
+// mapProgramValue returns v with f applied to its elements, v itself if it
+// has none.
+func mapProgramValue(v val.Value, f func(val.Value) val.Value) val.Value {
+	switch v := v.(type) {
+	case val.Struct:
+		return v.Map(func(_ string, w val.Value) val.Value {
+			return f(w)
+		})
+	case val.Map:
+		return v.Map(func(_ string, w val.Value) val.Value {
+			return f(w)
+		})
+	case val.Tuple:
+		out := make(val.Tuple, len(v), len(v))
+		for i, w := range v {
+			out[i] = f(w)
+		}
+		return out
+	case val.List:
+		out := make(val.List, len(v), len(v))
+		for i, w := range v {
+			out[i] = f(w)
+		}
+		return out
+	case val.Union:
+		return f(v)
+	}
+	return v
+}
+
 func writeError(rw http.ResponseWriter, cdc codec.Interface, e err.Error) {
 	rw.WriteHeader(http.StatusBadRequest)
 	rw.Write(cdc.Encode(e.Value()))
@@ -324,7 +497,7 @@ func signatureFromRequest(rq *http.Request) ([]byte, error) {
 	return base64.RawURLEncoding.DecodeString(sig)
 }
 
-func adminUserIdFromDatabase(db *bolt.DB) ([]byte, err.Error) {
+func adminUserIdFromDatabase(db store.DB) ([]byte, err.Error) {
 	tx, e := db.Begin(false)
 	if e != nil {
 		return nil, err.InternalError{`failed opening database transaction`, nil}
@@ -12,7 +12,6 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
-	bolt "github.com/coreos/bbolt"
 	"golang.org/x/crypto/bcrypt"
 	"karma.run/codec"
 	"karma.run/config"
@@ -22,6 +21,7 @@ import (
 	"karma.run/kvm/mdl"
 	"karma.run/kvm/val"
 	"karma.run/kvm/xpr"
+	"karma.run/store"
 	"log"
 	"net/http"
 	"sync"
@@ -46,7 +46,7 @@ func AuthHttpHandler(rw http.ResponseWriter, rq *http.Request) {
 	defer loginLock.Unlock() // no concurrent login attempts to brute-force passwords
 
 	cdc := rq.Context().Value(ContextKeyCodec).(codec.Interface)
-	dtbs := rq.Context().Value(ContextKeyDatabase).(*bolt.DB)
+	dtbs := rq.Context().Value(ContextKeyDatabase).(store.DB)
 
 	hmacKey := []byte(config.InstanceSecret)
 
@@ -0,0 +1,731 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"karma.run/codec"
+	"karma.run/codec/karma.v2"
+	"karma.run/config"
+	"karma.run/definitions"
+	"karma.run/kvm"
+	"karma.run/kvm/err"
+	"karma.run/kvm/val"
+	"karma.run/kvm/xpr"
+	"karma.run/store"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// blobs are stored in BlobBucket, one sub-bucket per blob keyed by the hex
+// encoded sha256 of its content. the sub-bucket holds the content in chunks
+// keyed by their big endian uint64 index, plus the size, content type and
+// unix time of the upload. blobs without a size are being uploaded or were
+// left by a failed upload. with a data key, chunks are sealed with it, see
+// blobChunkAD, and the number of leading chunks sealed is kept too.
+const blobChunkBytes = 256 * 1024 // 256KB
+
+// chunks written per write transaction of an upload
+const blobBatchChunks = 16
+
+// unreferenced blobs uploaded more recently are kept by collectBlobs, as
+// clients upload blobs before writing the objects that reference them.
+const blobCollectionGrace = 24 * time.Hour
+
+var (
+	blobSizeKey        = []byte(`size`)
+	blobContentTypeKey = []byte(`contentType`)
+	blobUploadedKey    = []byte(`uploadedAt`)
+	blobSealedKey      = []byte(`sealedChunks`)
+)
+
+// blobWriting holds a lock per blob being written, so that uploads of the
+// same content don't write the same blob at once, see lockBlob.
+var blobWriting = struct {
+	sync.Mutex
+	locks map[string]*blobLock
+}{locks: map[string]*blobLock{}}
+
+type blobLock struct {
+	sync.Mutex
+	holders int // the writer and those waiting for it
+}
+
+// lockBlob waits until no other upload writes blob id and returns the
+// function to call when done writing it.
+func lockBlob(id string) (unlock func()) {
+	blobWriting.Lock()
+	l, ok := blobWriting.locks[id]
+	if !ok {
+		l = &blobLock{}
+		blobWriting.locks[id] = l
+	}
+	l.holders++
+	blobWriting.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		blobWriting.Lock()
+		if l.holders--; l.holders == 0 {
+			delete(blobWriting.locks, id)
+		}
+		blobWriting.Unlock()
+	}
+}
+
+// blobContentTypes are served as uploaded, all others as
+// application/octet-stream, as types like text/html or image/svg+xml could run
+// scripts of the uploader in the origin of the API.
+var blobContentTypes = map[string]struct{}{
+	"application/octet-stream": {},
+	"application/pdf":          {},
+	"application/zip":          {},
+	"application/json":         {},
+	"text/plain":               {},
+	"text/csv":                 {},
+	"image/png":                {},
+	"image/jpeg":               {},
+	"image/gif":                {},
+	"image/webp":               {},
+	"image/avif":               {},
+	"audio/mpeg":               {},
+	"audio/ogg":                {},
+	"audio/wav":                {},
+	"audio/webm":               {},
+	"video/mp4":                {},
+	"video/ogg":                {},
+	"video/webm":               {},
+	"font/woff":                {},
+	"font/woff2":               {},
+}
+
+// blobContentType returns the media type of Content-Type header h if it is
+// in blobContentTypes, application/octet-stream otherwise.
+func blobContentType(h string) string {
+	t, _, e := mime.ParseMediaType(h)
+	if _, ok := blobContentTypes[t]; e != nil || !ok {
+		return "application/octet-stream"
+	}
+	return t
+}
+
+var errDatabaseUninitialized = errors.New(`database uninitialized`)
+
+// blobChunkAD returns the data chunk i of blob id is sealed along with, so
+// that it can't be moved to another blob or index.
+func blobChunkAD(id string, i uint64) []byte {
+	return append([]byte(id), blobChunkKey(i)...)
+}
+
+func blobChunkKey(i uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, i)
+	return k
+}
+
+func BlobHttpHandler(rw http.ResponseWriter, rq *http.Request) {
+	segments := pathSegments(rq.URL.Path)[1:] // drop "blob" prefix
+	switch {
+	case rq.Method == http.MethodPost && len(segments) == 0: // POST /
+		BlobUploadHttpHandler(rw, rq)
+
+	case (rq.Method == http.MethodGet || rq.Method == http.MethodHead) && len(segments) == 3: // GET /{resource}/{id}/{blob}
+		BlobDownloadHttpHandler(segments[0], segments[1], segments[2], rw, rq)
+
+	default:
+		http.NotFound(rw, rq)
+	}
+}
+
+// POST /
+// streams the request body into a new blob and responds with its id and size.
+// uploading the same content twice yields the same blob, with the content type
+// of the first upload. only the root user and users of --blob-upload-roles may
+// upload blobs.
+func BlobUploadHttpHandler(rw http.ResponseWriter, rq *http.Request) {
+
+	cdc := rq.Context().Value(ContextKeyCodec).(codec.Interface)
+	dtbs := rq.Context().Value(ContextKeyDatabase).(store.DB)
+	uid := rq.Context().Value(ContextKeyUserId).(string)
+
+	allowed, ke := false, err.Error(nil)
+	e := dtbs.View(func(tx store.Tx) error {
+		rb := tx.Bucket([]byte(`root`))
+		if rb == nil {
+			return errDatabaseUninitialized
+		}
+		allowed, ke = (&kvm.VirtualMachine{RootBucket: rb, UserID: uid}).MayUploadBlobs()
+		return nil
+	})
+	if e == errDatabaseUninitialized {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write(cdc.Encode(err.InternalError{Problem: `database uninitialized`}.Value()))
+		return
+	}
+	if e != nil {
+		log.Panicln(e)
+	}
+	if ke != nil {
+		writeError(rw, cdc, err.HumanReadableError{ke})
+		return
+	}
+	if !allowed {
+		log.Printf(`unauthorized blob upload by user %s`, uid)
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write(cdc.Encode(err.PermissionDeniedError{}.Value()))
+		return
+	}
+
+	// the body is buffered in a temporary file so the write transaction
+	// isn't held open for as long as the client takes to upload. with a
+	// data key, it is sealed like the blob's chunks will be.
+	f, e := ioutil.TempFile("", "karma-blob-")
+	if e != nil {
+		log.Panicln(e)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	key, w := karma.CurrentKey(), io.Writer(f)
+	if key != nil {
+		w = &sealingWriter{w: f, key: key}
+	}
+
+	h := sha256.New()
+	size, e := io.Copy(io.MultiWriter(w, h), io.LimitReader(rq.Body, int64(config.BlobMaxBytes)+1))
+	rq.Body.Close()
+	if sw, ok := w.(*sealingWriter); ok && e == nil {
+		e = sw.flush()
+	}
+	if e != nil {
+		writeError(rw, cdc, err.HumanReadableError{err.RequestError{
+			Problem: `failed reading request body`,
+		}})
+		return
+	}
+	if size > int64(config.BlobMaxBytes) {
+		rw.WriteHeader(http.StatusRequestEntityTooLarge)
+		rw.Write(cdc.Encode(err.HumanReadableError{err.RequestError{
+			Problem: fmt.Sprintf(`blob exceeds maximum size of %d bytes`, config.BlobMaxBytes),
+		}}.Value()))
+		return
+	}
+	if _, e := f.Seek(0, io.SeekStart); e != nil {
+		log.Panicln(e)
+	}
+
+	id := hex.EncodeToString(h.Sum(nil))
+
+	r := io.Reader(f)
+	if key != nil {
+		r = &openingReader{r: bufio.NewReader(f)}
+	}
+
+	e = func() error {
+		defer lockBlob(id)()
+		return writeBlob(dtbs, id, r, size, blobContentType(rq.Header.Get("Content-Type")))
+	}()
+	if e == errDatabaseUninitialized {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write(cdc.Encode(err.InternalError{Problem: `database uninitialized`}.Value()))
+		return
+	}
+	if e != nil {
+		log.Panicln(e)
+	}
+
+	rw.Write(cdc.Encode(val.StructFromMap(map[string]val.Value{
+		"id":   val.Blob(id),
+		"size": val.Int64(size),
+	})))
+}
+
+// sealingWriter seals what is written to w in frames of up to blobChunkBytes
+// with key, each prefixed with its length as big endian uint32 and sealed
+// along with its index. flush must be called after the last write.
+type sealingWriter struct {
+	w     io.Writer
+	key   *karma.Key
+	buf   []byte
+	frame uint64
+}
+
+func (s *sealingWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if s.buf == nil {
+			s.buf = make([]byte, 0, blobChunkBytes)
+		}
+		m := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf, p = s.buf[:len(s.buf)+m], p[m:]
+		if len(s.buf) == cap(s.buf) {
+			if e := s.flush(); e != nil {
+				return 0, e
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush writes the buffered bytes as a frame, if there are any.
+func (s *sealingWriter) flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	sealed := s.key.Seal(s.buf, blobChunkKey(s.frame))
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(sealed)))
+	if _, e := s.w.Write(header); e != nil {
+		return e
+	}
+	if _, e := s.w.Write(sealed); e != nil {
+		return e
+	}
+	s.buf, s.frame = s.buf[:0], s.frame+1
+	return nil
+}
+
+// errTruncatedFrame isn't io.ErrUnexpectedEOF, which readers of openingReader take for the end.
+var errTruncatedFrame = errors.New(`truncated sealed frame`)
+
+// openingReader reads the frames written by sealingWriter to r, opened.
+type openingReader struct {
+	r     io.Reader
+	buf   []byte
+	frame uint64
+}
+
+func (o *openingReader) Read(p []byte) (int, error) {
+	if len(o.buf) == 0 {
+		header := make([]byte, 4)
+		if _, e := io.ReadFull(o.r, header); e == io.EOF {
+			return 0, e // after the last frame
+		} else if e != nil {
+			return 0, errTruncatedFrame
+		}
+		sealed := make([]byte, binary.BigEndian.Uint32(header))
+		if _, e := io.ReadFull(o.r, sealed); e != nil {
+			return 0, errTruncatedFrame
+		}
+		opened, e := karma.Open(sealed, blobChunkKey(o.frame))
+		if e != nil {
+			return 0, e
+		}
+		o.buf, o.frame = opened, o.frame+1
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+// blobBucket returns the BlobBucket of tx, creating it if it doesn't exist.
+func blobBucket(tx store.Tx) (store.Bucket, error) {
+	rb := tx.Bucket([]byte(`root`))
+	if rb == nil {
+		return nil, errDatabaseUninitialized
+	}
+	return rb.CreateBucketIfNotExists(definitions.BlobBucketBytes)
+}
+
+// writeBlob writes the content of r as blob id, unless it has been uploaded
+// before. Chunks are written in transactions of up to blobBatchChunks each, so
+// that large blobs don't block other writers for long, and read into a buffer
+// reused once a transaction committed, as Put doesn't copy values. They are
+// sealed with the current data key if there is one. The size is written last.
+// Callers must hold the lock of id, see lockBlob.
+func writeBlob(dtbs store.DB, id string, r io.Reader, size int64, contentType string) error {
+
+	key, uploaded := karma.CurrentKey(), false
+	e := dtbs.Update(func(tx store.Tx) error {
+		bb, e := blobBucket(tx)
+		if e != nil {
+			return e
+		}
+		if b := bb.Bucket([]byte(id)); b != nil {
+			if b.Get(blobSizeKey) != nil { // keeping it from being collected before it is referenced
+				uploaded = true
+				return b.Put(blobUploadedKey, blobChunkKey(uint64(time.Now().Unix())))
+			}
+			if e := bb.DeleteBucket([]byte(id)); e != nil { // left by a failed upload
+				return e
+			}
+		}
+		b, e := bb.CreateBucket([]byte(id))
+		if e != nil {
+			return e
+		}
+		return b.Put(blobUploadedKey, blobChunkKey(uint64(time.Now().Unix())))
+	})
+	if e != nil || uploaded {
+		return e
+	}
+
+	buf := make([]byte, blobBatchChunks*blobChunkBytes)
+	for i, done := uint64(0), false; !done; {
+		e := dtbs.Update(func(tx store.Tx) error {
+			bb, e := blobBucket(tx)
+			if e != nil {
+				return e
+			}
+			b := bb.Bucket([]byte(id))
+			if b == nil {
+				return fmt.Errorf(`blob %s was deleted while uploading it`, id)
+			}
+			for j := 0; j < blobBatchChunks && !done; j++ {
+				chunk := buf[j*blobChunkBytes : (j+1)*blobChunkBytes]
+				n, e := io.ReadFull(r, chunk)
+				if n > 0 {
+					v := chunk[:n]
+					if key != nil {
+						v = key.Seal(v, blobChunkAD(id, i))
+					}
+					if e := b.Put(blobChunkKey(i), v); e != nil {
+						return e
+					}
+					i++
+				}
+				if e == io.EOF || e == io.ErrUnexpectedEOF {
+					done = true
+				} else if e != nil {
+					return e
+				}
+			}
+			if key != nil {
+				if e := b.Put(blobSealedKey, blobChunkKey(i)); e != nil {
+					return e
+				}
+			}
+			if !done {
+				return nil
+			}
+			if e := b.Put(blobContentTypeKey, []byte(contentType)); e != nil {
+				return e
+			}
+			if e := b.Put(blobUploadedKey, blobChunkKey(uint64(time.Now().Unix()))); e != nil {
+				return e
+			}
+			return b.Put(blobSizeKey, blobChunkKey(uint64(size)))
+		})
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// collectBlobs deletes the blobs not referenced by any object that were
+// uploaded more than blobCollectionGrace ago, incomplete ones included, and
+// returns how many it deleted. Any write may reference a blob, so it runs in
+// a single write transaction, during which writers wait.
+func collectBlobs(dtbs store.DB) (int, error) {
+
+	n := 0
+	e := dtbs.Update(func(tx store.Tx) error {
+
+		rb := tx.Bucket([]byte(`root`))
+		if rb == nil {
+			return errDatabaseUninitialized
+		}
+		bb := rb.Bucket(definitions.BlobBucketBytes)
+		if bb == nil {
+			return nil
+		}
+
+		referenced, ke := (&kvm.VirtualMachine{RootBucket: rb}).ReferencedBlobs()
+		if ke != nil {
+			return ke
+		}
+
+		cutoff := uint64(time.Now().Add(-blobCollectionGrace).Unix())
+		unreferenced := [][]byte(nil)
+		e := bb.ForEach(func(k, _ []byte) error {
+			if _, ok := referenced[string(k)]; ok {
+				return nil
+			}
+			// blobs uploaded before upload times were kept have none
+			if at := bb.Bucket(k).Get(blobUploadedKey); at != nil && binary.BigEndian.Uint64(at) > cutoff {
+				return nil
+			}
+			unreferenced = append(unreferenced, append([]byte(nil), k...))
+			return nil
+		})
+		if e != nil {
+			return e
+		}
+
+		for _, k := range unreferenced { // not while iterating
+			if e := bb.DeleteBucket(k); e != nil {
+				return e
+			}
+		}
+		n = len(unreferenced)
+		return nil
+	})
+
+	return n, e
+}
+
+// rewriteBlobs seals the chunks of complete blobs that aren't sealed with the
+// current data key, e.g. after rotating it, in write transactions of up to
+// blobBatchChunks chunks each, and returns how many blobs it changed. It does
+// nothing without a data key.
+func rewriteBlobs(dtbs store.DB) (int, error) {
+
+	key := karma.CurrentKey()
+	if key == nil {
+		return 0, nil
+	}
+
+	ids := []string(nil)
+	e := dtbs.View(func(tx store.Tx) error {
+		rb := tx.Bucket([]byte(`root`))
+		if rb == nil {
+			return errDatabaseUninitialized
+		}
+		bb := rb.Bucket(definitions.BlobBucketBytes)
+		if bb == nil {
+			return nil
+		}
+		return bb.ForEach(func(k, _ []byte) error {
+			if bb.Bucket(k).Get(blobSizeKey) != nil { // uploads in progress seal their chunks themselves
+				ids = append(ids, string(k))
+			}
+			return nil
+		})
+	})
+	if e != nil {
+		return 0, e
+	}
+
+	n := 0
+	for _, id := range ids {
+		rewritten := false
+		for i, done := uint64(0), false; !done; {
+			e := dtbs.Update(func(tx store.Tx) error {
+				bb, e := blobBucket(tx)
+				if e != nil {
+					return e
+				}
+				b := bb.Bucket([]byte(id))
+				if b == nil { // collected meanwhile
+					done = true
+					return nil
+				}
+				sealed := blobSealedChunks(b)
+				for j := 0; j < blobBatchChunks; j, i = j+1, i+1 {
+					bs := b.Get(blobChunkKey(i))
+					if bs == nil {
+						done = true
+						break
+					}
+					if i < sealed {
+						if kid, _ := karma.SealedKeyID(bs); kid == key.ID {
+							continue
+						}
+						if bs, e = karma.Open(bs, blobChunkAD(id, i)); e != nil {
+							return fmt.Errorf("blob %s: %s", id, e)
+						}
+					}
+					if e := b.Put(blobChunkKey(i), key.Seal(bs, blobChunkAD(id, i))); e != nil {
+						return e
+					}
+					rewritten = true
+				}
+				if i > sealed {
+					return b.Put(blobSealedKey, blobChunkKey(i))
+				}
+				return nil
+			})
+			if e != nil {
+				return n, e
+			}
+		}
+		if rewritten {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// CheckBlobDataKeys returns an error if blob chunks are sealed with a data key
+// that isn't loaded, see kvm.CheckDataKeys.
+func CheckBlobDataKeys(dtbs store.DB) error {
+	return dtbs.View(func(tx store.Tx) error {
+		rb := tx.Bucket([]byte(`root`))
+		if rb == nil {
+			return nil
+		}
+		bb := rb.Bucket(definitions.BlobBucketBytes)
+		if bb == nil {
+			return nil
+		}
+		return bb.ForEach(func(id, _ []byte) error {
+			b := bb.Bucket(id)
+			for i, sealed := uint64(0), blobSealedChunks(b); i < sealed; i++ {
+				kid, e := karma.SealedKeyID(b.Get(blobChunkKey(i)))
+				if e != nil {
+					return fmt.Errorf("blob %s: %s", id, e)
+				}
+				if !karma.HasKey(kid) {
+					return fmt.Errorf("blob %s is encrypted with data key %08x, which isn't loaded", id, kid)
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// GET /{resource}/{id}/{blob}
+// serves a blob referenced by the object {resource}/{id}, supporting range requests.
+// reading a blob requires read permission on the object referencing it.
+func BlobDownloadHttpHandler(resource, id, blob string, rw http.ResponseWriter, rq *http.Request) {
+
+	cdc := rq.Context().Value(ContextKeyCodec).(codec.Interface)
+	dtbs := rq.Context().Value(ContextKeyDatabase).(store.DB)
+	uid := rq.Context().Value(ContextKeyUserId).(string)
+
+	tx, e := dtbs.Begin(false)
+	if e != nil {
+		log.Panicln(e)
+	}
+	defer tx.Rollback()
+
+	rb := tx.Bucket([]byte(`root`))
+	if rb == nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write(cdc.Encode(err.InternalError{Problem: `database uninitialized`}.Value()))
+		return
+	}
+
+	vm := &kvm.VirtualMachine{RootBucket: rb, UserID: uid}
+
+	resRef, _, ke := vm.CompileAndExecuteExpression(xpr.Tag{xpr.Literal{val.String(resource)}})
+	if ke != nil {
+		resRef = val.Ref{vm.MetaModelId(), resource}
+	}
+
+	value, _, ke := vm.CompileAndExecuteExpression(xpr.Get{
+		xpr.NewRef{
+			Model: xpr.Literal{val.String(resRef.(val.Ref)[1])},
+			Id:    xpr.Literal{val.String(id)},
+		},
+	})
+	if ke != nil {
+		writeError(rw, cdc, err.HumanReadableError{ke})
+		return
+	}
+
+	blobNotFound := func() {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write(cdc.Encode(err.HumanReadableError{err.RequestError{
+			Problem: fmt.Sprintf(`object %s/%s has no blob %s`, resource, id, blob),
+		}}.Value()))
+	}
+
+	referenced := false
+	value.Transform(func(v val.Value) val.Value {
+		if b, ok := v.(val.Blob); ok && string(b) == blob {
+			referenced = true
+		}
+		return v
+	})
+	if !referenced {
+		blobNotFound()
+		return
+	}
+
+	b := store.Bucket(nil)
+	if bb := rb.Bucket(definitions.BlobBucketBytes); bb != nil {
+		b = bb.Bucket([]byte(blob))
+	}
+	if b == nil || b.Get(blobSizeKey) == nil {
+		blobNotFound()
+		return
+	}
+
+	// checked again for blobs uploaded before content types were
+	rw.Header().Set("Content-Type", blobContentType(string(b.Get(blobContentTypeKey))))
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.Header().Set("Content-Disposition", "attachment")
+	rw.Header().Set("ETag", `"`+blob+`"`)
+	rw.Header().Set("Cache-Control", "private, max-age=31536000, immutable") // content addressed
+
+	http.ServeContent(rw, rq, "", time.Time{}, &blobReader{
+		bucket: b,
+		id:     blob,
+		size:   int64(binary.BigEndian.Uint64(b.Get(blobSizeKey))),
+		sealed: blobSealedChunks(b),
+	})
+}
+
+// blobSealedChunks returns the number of leading chunks of blob bucket b
+// sealed with a data key.
+func blobSealedChunks(b store.Bucket) uint64 {
+	if bs := b.Get(blobSealedKey); bs != nil {
+		return binary.BigEndian.Uint64(bs)
+	}
+	return 0
+}
+
+// blobReader reads a chunked blob, it is only valid as long as its transaction.
+type blobReader struct {
+	bucket store.Bucket
+	id     string
+	size   int64
+	offset int64
+	sealed uint64 // leading chunks
+
+	chunk      []byte // opened, if sealed
+	chunkIndex uint64
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if i := uint64(r.offset / blobChunkBytes); r.chunk == nil || r.chunkIndex != i {
+		chunk := r.bucket.Get(blobChunkKey(i))
+		if i < r.sealed {
+			opened, e := karma.Open(chunk, blobChunkAD(r.id, i))
+			if e != nil {
+				return 0, e
+			}
+			chunk = opened
+		}
+		r.chunk, r.chunkIndex = chunk, i
+	}
+	n := copy(p, r.chunk[r.offset%blobChunkBytes:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return r.offset, errors.New("blobReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return r.offset, errors.New("blobReader.Seek: negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"fmt"
+	"karma.run/codec"
+	"karma.run/config"
+	"karma.run/kvm"
+	"karma.run/kvm/err"
+	"karma.run/kvm/val"
+	"karma.run/store"
+	"log"
+	"net/http"
+	"time"
+)
+
+// POST /query/{tag}
+// runs the persisted query published under tag. the request body holds the
+// arguments, a struct keyed by parameter name.
+func QueryHttpHandler(rw http.ResponseWriter, rq *http.Request) {
+
+	cdc := rq.Context().Value(ContextKeyCodec).(codec.Interface)
+	dtbs := rq.Context().Value(ContextKeyDatabase).(store.DB)
+	uid := rq.Context().Value(ContextKeyUserId).(string)
+
+	if rq.Method != http.MethodPost {
+		writeError(rw, cdc, err.HumanReadableError{err.RequestError{
+			Problem: fmt.Sprintf("invalid HTTP method requested: %s. supported is: POST.", rq.Method),
+		}})
+		return
+	}
+
+	segments := pathSegments(rq.URL.Path)[1:] // drop "query" prefix
+	if len(segments) != 1 {
+		http.NotFound(rw, rq)
+		return
+	}
+
+	tag := segments[0]
+	payload := payloadFromRequest(rq)
+
+	tx, e := dtbs.Begin(false)
+	if e != nil {
+		log.Panicln(e)
+	}
+	defer func() { tx.Rollback() }() // tx may be replaced below
+
+	rb := tx.Bucket([]byte(`root`))
+	if rb == nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write(cdc.Encode(err.InternalError{Problem: `database uninitialized`}.Value()))
+		return
+	}
+
+	vm := &kvm.VirtualMachine{RootBucket: rb, UserID: uid}
+
+	query, ke := vm.Query(tag)
+	if ke != nil {
+		writeQueryError(rw, cdc, ke)
+		return
+	}
+
+	if query.Writes {
+
+		tx.Rollback()
+
+		tx, e = dtbs.Begin(true)
+		if e != nil {
+			log.Panicln(e)
+		}
+
+		vm = &kvm.VirtualMachine{RootBucket: tx.Bucket([]byte(`root`)), UserID: uid}
+
+		if e := vm.UpdateModels(); e != nil {
+			log.Panicln(e)
+		}
+
+		query, ke = vm.Query(tag) // might have changed in between
+		if ke != nil {
+			writeQueryError(rw, cdc, ke)
+			return
+		}
+	}
+
+	args := val.Value(val.NewStruct(0))
+	if len(payload) > 0 || len(query.Parameters) > 0 {
+		args, ke = cdc.Decode(payload, query.ArgumentModel())
+		if ke != nil {
+			writeError(rw, cdc, err.HumanReadableError{ke})
+			return
+		}
+	}
+
+	cancel, ke := vm.Limit(rq.Context())
+	if ke != nil {
+		writeQueryError(rw, cdc, ke)
+		return
+	}
+	defer cancel()
+
+	if rq.Header.Get(ProfileHeader) != "" {
+		vm.Profile = kvm.NewProfile()
+	}
+
+	if vm.Parallelism = kvm.NewParallelism(config.MaxParallelism); vm.Parallelism != nil {
+		vm.RootBucket = store.Synchronized(vm.RootBucket)
+	}
+	vm.CacheResults = true
+
+	start := time.Now()
+	res, ke := vm.ExecuteQuery(query, args.(val.Struct))
+	logSlowQuery(vm.UserID, time.Since(start), func() string {
+		return "query " + tag + ": " + err.ProgramToHuman(withoutLiterals(query.Expression), 0)
+	})
+	if ke != nil {
+		writeQueryError(rw, cdc, ke)
+		return
+	}
+
+	if vm.Profile != nil {
+		res = val.StructFromMap(map[string]val.Value{
+			"result":  res,
+			"profile": vm.Profile.Value(),
+		})
+	}
+
+	if tx.Writable() {
+		if e := tx.Commit(); e != nil {
+			log.Panicln(e)
+		}
+	}
+
+	rw.Write(cdc.Encode(res))
+}
+
+func writeQueryError(rw http.ResponseWriter, cdc codec.Interface, e err.Error) {
+	if _, ok := e.(err.PermissionDeniedError); ok {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write(cdc.Encode(err.HumanReadableError{e}.Value()))
+		return
+	}
+	writeError(rw, cdc, err.HumanReadableError{e})
+}
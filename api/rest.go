@@ -6,13 +6,13 @@ package api
 import (
 	"bytes"
 	"fmt"
-	bolt "github.com/coreos/bbolt"
 	"karma.run/codec"
 	"karma.run/kvm"
 	"karma.run/kvm/err"
 	"karma.run/kvm/mdl"
 	"karma.run/kvm/val"
 	"karma.run/kvm/xpr"
+	"karma.run/store"
 	"log"
 	"net/http"
 	"strconv"
@@ -129,7 +129,7 @@ func RestApiDeleteHttpHandler(rw http.ResponseWriter, rq *http.Request) {
 func RestApiGetResourceHttpHandler(resource string, rw http.ResponseWriter, rq *http.Request) {
 
 	cdc := rq.Context().Value(ContextKeyCodec).(codec.Interface)
-	dtbs := rq.Context().Value(ContextKeyDatabase).(*bolt.DB)
+	dtbs := rq.Context().Value(ContextKeyDatabase).(store.DB)
 	uid := rq.Context().Value(ContextKeyUserId).(string)
 
 	tx, e := dtbs.Begin(false)
@@ -269,13 +269,13 @@ func RestApiGetResourceHttpHandler(resource string, rw http.ResponseWriter, rq *
 func RestApiPutResourceIdHttpHandler(resource, id string, rw http.ResponseWriter, rq *http.Request) {
 
 	cdc := rq.Context().Value(ContextKeyCodec).(codec.Interface)
-	dtbs := rq.Context().Value(ContextKeyDatabase).(*bolt.DB)
+	dtbs := rq.Context().Value(ContextKeyDatabase).(store.DB)
 	uid := rq.Context().Value(ContextKeyUserId).(string)
 
 	outValue := (val.Value)(nil)
 	payload := payloadFromRequest(rq)
 
-	e := dtbs.Batch(func(tx *bolt.Tx) error {
+	e := dtbs.Batch(func(tx store.Tx) error {
 
 		rb := tx.Bucket([]byte(`root`))
 		if rb == nil {
@@ -350,13 +350,13 @@ func RestApiPutResourceIdHttpHandler(resource, id string, rw http.ResponseWriter
 func RestApiPostResourceHttpHandler(resource string, rw http.ResponseWriter, rq *http.Request) {
 
 	cdc := rq.Context().Value(ContextKeyCodec).(codec.Interface)
-	dtbs := rq.Context().Value(ContextKeyDatabase).(*bolt.DB)
+	dtbs := rq.Context().Value(ContextKeyDatabase).(store.DB)
 	uid := rq.Context().Value(ContextKeyUserId).(string)
 
 	outValue := (val.Value)(nil)
 	payload := payloadFromRequest(rq)
 
-	e := dtbs.Batch(func(tx *bolt.Tx) error {
+	e := dtbs.Batch(func(tx store.Tx) error {
 
 		rb := tx.Bucket([]byte(`root`))
 		if rb == nil {
@@ -457,12 +457,12 @@ func RestApiDeleteResourceHttpHandler(resource string, rw http.ResponseWriter, r
 func RestApiDeleteResourceIdHttpHandler(resource, id string, rw http.ResponseWriter, rq *http.Request) {
 
 	cdc := rq.Context().Value(ContextKeyCodec).(codec.Interface)
-	dtbs := rq.Context().Value(ContextKeyDatabase).(*bolt.DB)
+	dtbs := rq.Context().Value(ContextKeyDatabase).(store.DB)
 	uid := rq.Context().Value(ContextKeyUserId).(string)
 
 	outValue := (val.Value)(nil)
 
-	e := dtbs.Batch(func(tx *bolt.Tx) error {
+	e := dtbs.Batch(func(tx store.Tx) error {
 
 		rb := tx.Bucket([]byte(`root`))
 		if rb == nil {
@@ -524,7 +524,7 @@ func RestApiDeleteResourceIdHttpHandler(resource, id string, rw http.ResponseWri
 func RestApiGetResourceIdHttpHandler(resource, id string, rw http.ResponseWriter, rq *http.Request) {
 
 	cdc := rq.Context().Value(ContextKeyCodec).(codec.Interface)
-	dtbs := rq.Context().Value(ContextKeyDatabase).(*bolt.DB)
+	dtbs := rq.Context().Value(ContextKeyDatabase).(store.DB)
 	uid := rq.Context().Value(ContextKeyUserId).(string)
 
 	tx, e := dtbs.Begin(false)
@@ -0,0 +1,240 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package cc
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const cacheShards = 16
+
+// EntryOverhead is added to the size of every entry, for its key and bookkeeping.
+const EntryOverhead = 128
+
+// Cache is an LRU cache bounded by the approximate size of its entries. It is
+// split into shards with a lock each, so that concurrent users rarely wait for
+// each other. Entries may expire after a TTL, and concurrent Loads of the same
+// missing key call the loader only once.
+type Cache struct {
+	shards [cacheShards]cacheShard
+	ttl    time.Duration // 0 means entries don't expire
+
+	hits, misses, evictions int64
+
+	flightLock sync.Mutex
+	flights    map[string]*flight
+}
+
+type cacheShard struct {
+	lock       sync.Mutex
+	store      map[string]*cacheNode
+	head, tail *cacheNode
+	bytes, max int64
+}
+
+type cacheNode struct {
+	key        string
+	value      interface{}
+	bytes      int64
+	expires    time.Time // zero if the entry doesn't expire
+	prev, next *cacheNode
+}
+
+type flight struct {
+	done  sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64 // entries dropped to make room, expired ones included
+	Entries   int64
+	Bytes     int64
+}
+
+// NewCache returns a cache holding about maxBytes. If ttl is positive,
+// entries expire that long after they were set.
+func NewCache(maxBytes int64, ttl time.Duration) *Cache {
+	c := &Cache{ttl: ttl, flights: make(map[string]*flight)}
+	for i := range c.shards {
+		c.shards[i].store = make(map[string]*cacheNode)
+		c.shards[i].max = maxBytes / cacheShards
+	}
+	return c
+}
+
+func (c *Cache) shard(k string) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(k))
+	return &c.shards[h.Sum32()%cacheShards]
+}
+
+func (c *Cache) Get(k string) (interface{}, bool) {
+	s := c.shard(k)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n, ok := s.store[k]
+	if ok && !n.expires.IsZero() && time.Now().After(n.expires) {
+		s.remove(n)
+		atomic.AddInt64(&c.evictions, 1)
+		ok = false
+	}
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+	s.unlink(n)
+	s.push(n)
+	atomic.AddInt64(&c.hits, 1)
+	return n.value, true
+}
+
+// Set stores v under k, bytes being its approximate size. Least recently
+// used entries are evicted as needed; v isn't stored if it doesn't fit at all.
+func (c *Cache) Set(k string, v interface{}, bytes int64) {
+	bytes += EntryOverhead
+	s := c.shard(k)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if n, ok := s.store[k]; ok {
+		s.remove(n)
+	}
+	if bytes > s.max {
+		return
+	}
+	for s.bytes+bytes > s.max {
+		s.remove(s.tail)
+		atomic.AddInt64(&c.evictions, 1)
+	}
+	n := &cacheNode{key: k, value: v, bytes: bytes}
+	if c.ttl > 0 {
+		n.expires = time.Now().Add(c.ttl)
+	}
+	s.store[k] = n
+	s.bytes += bytes
+	s.push(n)
+}
+
+// PanicError is returned by Loads that waited for a call of load that panicked.
+type PanicError struct {
+	Value interface{} // recovered
+}
+
+func (e PanicError) Error() string {
+	return fmt.Sprintf("loading cache entry panicked: %v", e.Value)
+}
+
+// Load returns the value under k, calling load to get and Set it if missing.
+// Concurrent Loads of k wait for the first one's call. Errors aren't cached.
+// If load panics, the Load calling it panics as well, and those waiting for
+// it return PanicError.
+func (c *Cache) Load(k string, load func() (interface{}, int64, error)) (interface{}, error) {
+
+	if v, ok := c.Get(k); ok {
+		return v, nil
+	}
+
+	c.flightLock.Lock()
+	if f, ok := c.flights[k]; ok {
+		c.flightLock.Unlock()
+		f.done.Wait()
+		return f.value, f.err
+	}
+	f := &flight{}
+	f.done.Add(1)
+	c.flights[k] = f
+	c.flightLock.Unlock()
+
+	defer func() {
+		r := recover()
+		if r != nil {
+			f.err = PanicError{r}
+		}
+		c.flightLock.Lock()
+		delete(c.flights, k)
+		c.flightLock.Unlock()
+		f.done.Done()
+		if r != nil {
+			panic(r)
+		}
+	}()
+
+	v, bytes, e := load()
+	if e == nil {
+		c.Set(k, v, bytes)
+	}
+	f.value, f.err = v, e
+	return v, e
+}
+
+func (c *Cache) Remove(k string) {
+	s := c.shard(k)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if n, ok := s.store[k]; ok {
+		s.remove(n)
+	}
+}
+
+func (c *Cache) Clear() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.lock.Lock()
+		s.store, s.head, s.tail, s.bytes = make(map[string]*cacheNode), nil, nil, 0
+		s.lock.Unlock()
+	}
+}
+
+func (c *Cache) Stats() CacheStats {
+	st := CacheStats{
+		Hits:      atomic.LoadInt64(&c.hits),
+		Misses:    atomic.LoadInt64(&c.misses),
+		Evictions: atomic.LoadInt64(&c.evictions),
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.lock.Lock()
+		st.Entries += int64(len(s.store))
+		st.Bytes += s.bytes
+		s.lock.Unlock()
+	}
+	return st
+}
+
+// push inserts n at the head, i.e. as most recently used.
+func (s *cacheShard) push(n *cacheNode) {
+	n.prev, n.next = nil, s.head
+	if s.head != nil {
+		s.head.prev = n
+	}
+	s.head = n
+	if s.tail == nil {
+		s.tail = n
+	}
+}
+
+func (s *cacheShard) unlink(n *cacheNode) {
+	if n.prev != nil {
+		n.prev.next = n.next
+	} else {
+		s.head = n.next
+	}
+	if n.next != nil {
+		n.next.prev = n.prev
+	} else {
+		s.tail = n.prev
+	}
+	n.prev, n.next = nil, nil
+}
+
+func (s *cacheShard) remove(n *cacheNode) {
+	s.unlink(n)
+	delete(s.store, n.key)
+	s.bytes -= n.bytes
+}
@@ -0,0 +1,165 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package cc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sameShard returns n keys that c stores in the same shard.
+func sameShard(c *Cache, n int) []string {
+	keys := []string(nil)
+	for i := 0; len(keys) < n; i++ {
+		k := fmt.Sprintf("key%d", i)
+		if c.shard(k) == c.shard("key0") {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func TestCacheEviction(t *testing.T) {
+
+	const size = 100
+	c := NewCache(cacheShards*3*(size+EntryOverhead), 0) // three entries per shard
+	keys := sameShard(c, 4)
+
+	for _, k := range keys[:3] {
+		c.Set(k, k, size)
+	}
+	if _, ok := c.Get(keys[0]); !ok { // most recently used now
+		t.Fatal("expected an entry to be kept while there is room")
+	}
+	c.Set(keys[3], keys[3], size)
+
+	for i, want := range []bool{true, false, true, true} {
+		if _, ok := c.Get(keys[i]); ok != want {
+			t.Errorf("entry %d: expected present to be %v", i, want)
+		}
+	}
+
+	st := c.Stats()
+	if st.Evictions != 1 || st.Entries != 3 || st.Bytes != 3*(size+EntryOverhead) {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+
+	c.Set("big", "big", 3*size+2*EntryOverhead+1)
+	if _, ok := c.Get("big"); ok {
+		t.Error("expected an entry larger than its shard not to be stored")
+	}
+
+	c.Set(keys[0], keys[0], 3*size+2*EntryOverhead) // fills the shard by itself
+	for i := range keys {
+		if _, ok := c.Get(keys[i]); ok != (i == 0) {
+			t.Errorf("after filling the shard, entry %d: expected present to be %v", i, i == 0)
+		}
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+
+	c := NewCache(1<<20, 20*time.Millisecond)
+	c.Set("k", "v", 1)
+	if v, ok := c.Get("k"); !ok || v != "v" {
+		t.Fatalf("expected entry before its TTL, have %v", v)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := c.Get("k"); ok {
+		t.Error("expected entry to expire after its TTL")
+	}
+	if st := c.Stats(); st.Entries != 0 || st.Bytes != 0 || st.Evictions != 1 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+
+	c = NewCache(1<<20, 0)
+	c.Set("k", "v", 1)
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := c.Get("k"); !ok {
+		t.Error("expected entry without TTL not to expire")
+	}
+}
+
+func TestCacheLoadOnce(t *testing.T) {
+
+	c := NewCache(1<<20, 0)
+	calls, start := int64(0), make(chan struct{})
+	load := func() (interface{}, int64, error) {
+		atomic.AddInt64(&calls, 1)
+		time.Sleep(20 * time.Millisecond)
+		return "v", 1, nil
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if v, e := c.Load("k", load); e != nil || v != "v" {
+				t.Errorf("loaded %v, %v", v, e)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("expected one call of load, have %d", calls)
+	}
+
+	failed := errors.New("failed")
+	if _, e := c.Load("e", func() (interface{}, int64, error) { return nil, 0, failed }); e != failed {
+		t.Errorf("expected the error of load, have %v", e)
+	}
+	if _, ok := c.Get("e"); ok {
+		t.Error("expected errors not to be cached")
+	}
+}
+
+func TestCacheLoadPanic(t *testing.T) {
+
+	c := NewCache(1<<20, 0)
+	started, release := make(chan struct{}), make(chan struct{})
+
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		c.Load("k", func() (interface{}, int64, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	again := errors.New("loaded again")
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, e := c.Load("k", func() (interface{}, int64, error) { return nil, 0, again })
+			errs <- e
+		}()
+	}
+	time.Sleep(20 * time.Millisecond) // for the waiters to find the running load
+	close(release)
+
+	if r := <-panicked; r != "boom" {
+		t.Errorf("expected the loading Load to panic, recovered %v", r)
+	}
+	for i := 0; i < cap(errs); i++ {
+		e := <-errs
+		if pe, ok := e.(PanicError); !ok || pe.Value != "boom" {
+			t.Errorf("expected waiters to return PanicError, have %v", e)
+		}
+	}
+
+	if _, e := c.Load("k", func() (interface{}, int64, error) { return nil, 0, again }); e != again {
+		t.Errorf("expected load to be called again after it panicked, have %v", e)
+	}
+}
@@ -36,6 +36,10 @@ const (
 	TypeUint16   Type = 18
 	TypeUint32   Type = 19
 	TypeUint64   Type = 20
+	TypeDuration Type = 21
+	TypeDecimal  Type = 22
+	TypeBytes    Type = 23
+	TypeBlob     Type = 24
 )
 
 func (t Type) String() string {
@@ -82,6 +86,14 @@ func (t Type) String() string {
 		return "uint32"
 	case TypeUint64:
 		return "uint64"
+	case TypeDuration:
+		return "duration"
+	case TypeDecimal:
+		return "decimal"
+	case TypeBytes:
+		return "bytes"
+	case TypeBlob:
+		return "blob"
 	}
 	return "unknown"
 }
@@ -224,6 +236,22 @@ func encode(v val.Value, buf []byte) []byte {
 	case val.Uint64:
 		buf = append(buf, byte(TypeUint64))
 		return writeUint64(uint64(v), buf)
+
+	case val.Duration:
+		buf = append(buf, byte(TypeDuration))
+		return writeInt64(int64(v), buf)
+
+	case val.Decimal:
+		buf = append(buf, byte(TypeDecimal))
+		return writeString(v.String(), buf)
+
+	case val.Bytes:
+		buf = append(buf, byte(TypeBytes))
+		return writeString(string(v), buf)
+
+	case val.Blob:
+		buf = append(buf, byte(TypeBlob))
+		return writeString(string(v), buf)
 	}
 
 	panic(fmt.Sprintf(`unhandled type: %T`, v))
@@ -430,6 +458,41 @@ func decode(data []byte) (val.Value, []byte, err.Error) {
 		}
 		return val.Uint64(n), data, e
 
+	case TypeDuration:
+		n, data, e := readInt64(data)
+		if e != nil {
+			return nil, data, e
+		}
+		return val.Duration(n), data, e
+
+	case TypeDecimal:
+		s, data, e := readString(data)
+		if e != nil {
+			return nil, data, e
+		}
+		d, ok := val.ParseDecimal(s)
+		if !ok {
+			return nil, data, err.InputParsingError{
+				Problem: fmt.Sprintf(`malformed decimal or scale beyond %d`, val.MaxDecimalScale),
+				Input:   data,
+			}
+		}
+		return d, data, nil
+
+	case TypeBytes:
+		s, data, e := readString(data)
+		if e != nil {
+			return nil, data, e
+		}
+		return val.Bytes(s), data, nil
+
+	case TypeBlob:
+		s, data, e := readString(data)
+		if e != nil {
+			return nil, data, e
+		}
+		return val.Blob(s), data, nil
+
 	case TypeUint32:
 		n, data, e := readUint32(data)
 		if e != nil {
@@ -594,14 +657,14 @@ func readUint64(data []byte) (uint64, []byte, err.Error) {
 	if e != nil {
 		return 0, data, e
 	}
-	return uint64(bs[7])<<56 |
-		uint64(bs[6])<<48 |
-		uint64(bs[5])<<40 |
-		uint64(bs[4])<<32 |
-		uint64(bs[3])<<24 |
-		uint64(bs[2])<<16 |
-		uint64(bs[1])<<8 |
-		uint64(bs[0]), data, e
+	return uint64(bs[0])<<56 |
+		uint64(bs[1])<<48 |
+		uint64(bs[2])<<40 |
+		uint64(bs[3])<<32 |
+		uint64(bs[4])<<24 |
+		uint64(bs[5])<<16 |
+		uint64(bs[6])<<8 |
+		uint64(bs[7]), data, e
 }
 
 func readUint32(data []byte) (uint32, []byte, err.Error) {
@@ -609,10 +672,10 @@ func readUint32(data []byte) (uint32, []byte, err.Error) {
 	if e != nil {
 		return 0, data, e
 	}
-	return uint32(bs[3])<<24 |
-		uint32(bs[2])<<16 |
-		uint32(bs[1])<<8 |
-		uint32(bs[0]), data, e
+	return uint32(bs[0])<<24 |
+		uint32(bs[1])<<16 |
+		uint32(bs[2])<<8 |
+		uint32(bs[3]), data, e
 }
 
 func readUint16(data []byte) (uint16, []byte, err.Error) {
@@ -620,8 +683,8 @@ func readUint16(data []byte) (uint16, []byte, err.Error) {
 	if e != nil {
 		return 0, data, e
 	}
-	return uint16(bs[1])<<8 |
-		uint16(bs[0]), data, e
+	return uint16(bs[0])<<8 |
+		uint16(bs[1]), data, e
 }
 
 func readUint8(data []byte) (uint8, []byte, err.Error) {
@@ -7,6 +7,7 @@ package json
 
 import (
 	"bytes"
+	"encoding/base64"
 	ej "encoding/json"
 	"fmt"
 	"karma.run/codec"
@@ -168,6 +169,27 @@ func encode(value val.Value, cache JSON) JSON {
 		cache = append(cache, JSON(v.Time.Format(mdl.FormatDateTime))...)
 		return append(cache, '"')
 
+	case val.Duration:
+		cache = append(cache, '"')
+		cache = append(cache, JSON(time.Duration(v).String())...)
+		return append(cache, '"')
+
+	case val.Decimal:
+		// as string so clients don't lose precision by reading it as a float
+		cache = append(cache, '"')
+		cache = append(cache, JSON(v.String())...)
+		return append(cache, '"')
+
+	case val.Bytes:
+		cache = append(cache, '"')
+		cache = append(cache, JSON(base64.StdEncoding.EncodeToString(v))...)
+		return append(cache, '"')
+
+	case val.Blob:
+		cache = append(cache, '"')
+		cache = append(cache, JSON(v)...)
+		return append(cache, '"')
+
 	case val.Int8:
 		return append(cache, JSON(strconv.FormatInt(int64(v), 10))...)
 
@@ -384,6 +406,41 @@ func decode(json JSON, model mdl.Model) (val.Value, JSON, err.Error) {
 		}
 		return val.DateTime{t}, json, nil
 
+	case mdl.Duration:
+		str, json, e := readString(json)
+		if e != nil {
+			return nil, json, e
+		}
+		d, e_ := time.ParseDuration(str)
+		if e_ != nil {
+			return nil, json, err.InputParsingError{
+				Problem: `malformed duration format (must be like "1h30m" or "-1.5s")`,
+				Input:   json,
+			}
+		}
+		return val.Duration(d), json, nil
+
+	case mdl.Bytes:
+		str, json, e := readString(json)
+		if e != nil {
+			return nil, json, e
+		}
+		bs, e_ := base64.StdEncoding.DecodeString(str)
+		if e_ != nil {
+			return nil, json, err.InputParsingError{
+				Problem: `malformed bytes (must be base64 encoded)`,
+				Input:   json,
+			}
+		}
+		return val.Bytes(bs), json, nil
+
+	case mdl.Blob:
+		str, json, e := readString(json)
+		if e != nil {
+			return nil, json, e
+		}
+		return val.Blob(str), json, nil
+
 	case mdl.Int8:
 		str := ""
 		if len(json) > 0 && json[0] == '"' {
@@ -656,6 +713,30 @@ func decode(json JSON, model mdl.Model) (val.Value, JSON, err.Error) {
 		}
 		return val.Float(x), json, nil
 
+	case mdl.Decimal:
+		str := ""
+		if len(json) > 0 && json[0] == '"' {
+			n, j, e := readString(json)
+			if e != nil {
+				return nil, j, e
+			}
+			str, json = string(n), j
+		} else {
+			n, j, e := readJsonNumber(json)
+			if e != nil {
+				return nil, j, e
+			}
+			str, json = string(n), j
+		}
+		d, ok := val.ParseDecimal(str)
+		if !ok {
+			return nil, json, err.InputParsingError{
+				Problem: fmt.Sprintf(`malformed decimal or scale beyond %d`, val.MaxDecimalScale),
+				Input:   json,
+			}
+		}
+		return d, json, nil
+
 	case mdl.Any:
 		return nil, json, err.InputParsingError{
 			Problem: `decoding typeless value not possible. This is a bug, please report it.`,
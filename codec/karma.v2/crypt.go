@@ -0,0 +1,188 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package karma
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// MinKeySecretLength is the minimum length of secrets passed to NewKey, in bytes.
+const MinKeySecretLength = 32
+
+// Key is a data key to encrypt records with, using AES-256-GCM.
+type Key struct {
+	ID    uint32 // written to the records encrypted with the key, to find it again
+	aead  cipher.AEAD
+	blind []byte // HMAC key of Blind
+}
+
+// NewKey derives a data key from secret, e.g. one read from a key file.
+func NewKey(secret []byte) (*Key, error) {
+	if len(secret) < MinKeySecretLength {
+		return nil, fmt.Errorf("data key secret must be at least %d bytes long", MinKeySecretLength)
+	}
+	dk, blind := derive(secret, "karma.run data key"), derive(secret, "karma.run blind index key")
+	block, e := aes.NewCipher(dk)
+	if e != nil {
+		return nil, e
+	}
+	aead, e := cipher.NewGCM(block)
+	if e != nil {
+		return nil, e
+	}
+	id := sha256.Sum256(dk)
+	return &Key{ID: binary.BigEndian.Uint32(id[:]), aead: aead, blind: blind}, nil
+}
+
+func derive(secret []byte, label string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// Blind returns a keyed hash of bs, for indexes that find encrypted values
+// by equality without revealing them. It is deterministic, unlike encryption.
+func (k *Key) Blind(bs []byte) []byte {
+	mac := hmac.New(sha256.New, k.blind)
+	mac.Write(bs)
+	return mac.Sum(nil)
+}
+
+var keys = struct {
+	sync.RWMutex
+	current *Key
+	all     []*Key // current first, if any
+	byId    map[uint32]*Key
+}{byId: map[uint32]*Key{}}
+
+// SetKeys makes current the key to encrypt records with, nil for none, and
+// lets Decode and View decrypt records encrypted with current or any of old.
+func SetKeys(current *Key, old ...*Key) error {
+	all, byId := make([]*Key, 0, len(old)+1), map[uint32]*Key{}
+	for _, k := range append([]*Key{current}, old...) {
+		if k == nil {
+			continue
+		}
+		if _, ok := byId[k.ID]; ok {
+			return fmt.Errorf("duplicate data key: %08x", k.ID)
+		}
+		all, byId[k.ID] = append(all, k), k
+	}
+	keys.Lock()
+	keys.current, keys.all, keys.byId = current, all, byId
+	keys.Unlock()
+	return nil
+}
+
+// Keys returns all keys set by SetKeys, the current one first if there is one.
+func Keys() []*Key {
+	keys.RLock()
+	defer keys.RUnlock()
+	return keys.all
+}
+
+// CurrentKey returns the key to encrypt records with, nil if they are not to be encrypted.
+func CurrentKey() *Key {
+	keys.RLock()
+	defer keys.RUnlock()
+	return keys.current
+}
+
+// seal appends the id of k, a nonce and payload encrypted to header, which
+// is authenticated along with the id.
+func (k *Key) seal(header, payload []byte) []byte {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, e := rand.Read(nonce); e != nil {
+		panic(e)
+	}
+	bs := make([]byte, 0, len(header)+4+len(nonce)+len(payload)+k.aead.Overhead())
+	bs = append(bs, header...)
+	bs = binary.BigEndian.AppendUint32(bs, k.ID)
+	authenticated := len(bs)
+	bs = append(bs, nonce...)
+	return k.aead.Seal(bs, nonce, payload, bs[:authenticated])
+}
+
+// open returns the payload of record bs, sealed after a header of length l.
+func open(bs []byte, l int) []byte {
+	if len(bs) < l+4 {
+		panic("malformed encrypted record")
+	}
+	id := binary.BigEndian.Uint32(bs[l:])
+	k := keyWithId(id)
+	if k == nil {
+		panic(fmt.Sprintf("record encrypted with unknown data key: %08x", id))
+	}
+	authenticated, ns := l+4, k.aead.NonceSize()
+	if len(bs) < authenticated+ns {
+		panic("malformed encrypted record")
+	}
+	payload, e := k.aead.Open(nil, bs[authenticated:authenticated+ns], bs[authenticated+ns:], bs[:authenticated])
+	if e != nil {
+		panic(fmt.Sprintf("failed decrypting record: %s", e))
+	}
+	return payload
+}
+
+// keyWithId returns the key set by SetKeys with id, nil if there is none.
+func keyWithId(id uint32) *Key {
+	keys.RLock()
+	defer keys.RUnlock()
+	return keys.byId[id]
+}
+
+// HasKey reports whether SetKeys set a key with id.
+func HasKey(id uint32) bool {
+	return keyWithId(id) != nil
+}
+
+// Seal encrypts bs with k, e.g. a chunk of a blob, authenticating ad along
+// with it, e.g. where it is stored, so that it can't be moved elsewhere.
+// Unlike records, the result has no header.
+func (k *Key) Seal(bs, ad []byte) []byte {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, e := rand.Read(nonce); e != nil {
+		panic(e)
+	}
+	sealed := make([]byte, 0, 4+len(nonce)+len(bs)+k.aead.Overhead())
+	sealed = binary.BigEndian.AppendUint32(sealed, k.ID)
+	sealed = append(sealed, nonce...)
+	return k.aead.Seal(sealed, nonce, bs, append(append([]byte(nil), ad...), sealed[:4]...))
+}
+
+// SealedKeyID returns the id of the key bs was sealed with by Seal.
+func SealedKeyID(bs []byte) (uint32, error) {
+	if len(bs) < 4 {
+		return 0, fmt.Errorf("malformed sealed value")
+	}
+	return binary.BigEndian.Uint32(bs), nil
+}
+
+// Open decrypts bs sealed by Seal with ad, using whichever key set by SetKeys
+// it was sealed with.
+func Open(bs, ad []byte) ([]byte, error) {
+	id, e := SealedKeyID(bs)
+	if e != nil {
+		return nil, e
+	}
+	k := keyWithId(id)
+	if k == nil {
+		return nil, fmt.Errorf("value sealed with unknown data key: %08x", id)
+	}
+	ns := k.aead.NonceSize()
+	if len(bs) < 4+ns {
+		return nil, fmt.Errorf("malformed sealed value")
+	}
+	payload, e := k.aead.Open(nil, bs[4:4+ns], bs[4+ns:], append(append([]byte(nil), ad...), bs[:4]...))
+	if e != nil {
+		return nil, fmt.Errorf("failed decrypting sealed value: %s", e)
+	}
+	return payload, nil
+}
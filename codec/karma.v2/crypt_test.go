@@ -0,0 +1,184 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package karma
+
+import (
+	"bytes"
+	"fmt"
+	"karma.run/kvm/mdl"
+	"karma.run/kvm/val"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T, b byte) *Key {
+	k, e := NewKey(bytes.Repeat([]byte{b}, MinKeySecretLength))
+	if e != nil {
+		t.Fatal(e)
+	}
+	return k
+}
+
+// decodeFailure returns why decoding bs failed, empty if it didn't.
+func decodeFailure(bs []byte, m mdl.Model) (problem string) {
+	defer func() {
+		if r := recover(); r != nil {
+			problem = fmt.Sprint(r)
+		}
+	}()
+	Decode(bs, m)
+	return ""
+}
+
+func TestNewKey(t *testing.T) {
+	if _, e := NewKey(make([]byte, MinKeySecretLength-1)); e == nil {
+		t.Error("expected a short secret to be rejected")
+	}
+	if a, b := testKey(t, 1), testKey(t, 1); a.ID != b.ID {
+		t.Error("expected the same secret to derive the same key")
+	}
+	if a, b := testKey(t, 1), testKey(t, 2); a.ID == b.ID {
+		t.Error("expected different secrets to derive different keys")
+	}
+	if e := SetKeys(testKey(t, 1), testKey(t, 1)); e == nil {
+		t.Error("expected duplicate keys to be rejected")
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+
+	current := testKey(t, 1)
+	if e := SetKeys(current); e != nil {
+		t.Fatal(e)
+	}
+	defer SetKeys(nil)
+
+	for _, compress := range []bool{false, true} {
+		name := fmt.Sprintf("compressed %v", compress)
+		v := testValue(strings.Repeat("secret", 100))
+		bs := EncodeWith(v, testModel, Options{Compress: compress, Key: current})
+
+		h := ReadHeader(bs)
+		if !h.Encrypted || h.Compressed != compress || h.KeyID != current.ID {
+			t.Errorf("%s: read header %+v", name, h)
+		}
+		if bytes.Contains(bs, []byte("secret")) {
+			t.Errorf("%s: record not encrypted", name)
+		}
+		if have, rest := Decode(bs, testModel); len(rest) != 0 || !have.Equals(v) {
+			t.Errorf("%s: decoded value differs", name)
+		}
+		if have := View(bs, testModel).(*Lazy).Field("text"); !have.Equals(v.(val.Struct).Field("text")) {
+			t.Errorf("%s: viewed field differs", name)
+		}
+	}
+}
+
+func TestOpenAfterRotation(t *testing.T) {
+
+	old, current := testKey(t, 1), testKey(t, 2)
+	if e := SetKeys(old); e != nil {
+		t.Fatal(e)
+	}
+	defer SetKeys(nil)
+
+	v := testValue("text")
+	bs := EncodeWith(v, testModel, Options{Key: CurrentKey()})
+
+	if e := SetKeys(current, old); e != nil {
+		t.Fatal(e)
+	}
+	if CurrentKey() != current || len(Keys()) != 2 || !HasKey(old.ID) {
+		t.Fatal("expected the new key to be current and the old one kept")
+	}
+	if h := ReadHeader(bs); h.KeyID != old.ID {
+		t.Errorf("expected the record to name the old key, have %08x", h.KeyID)
+	}
+	if have, _ := Decode(bs, testModel); !have.Equals(v) {
+		t.Error("decoded value differs after rotation")
+	}
+}
+
+func TestOpenFailures(t *testing.T) {
+
+	current := testKey(t, 1)
+	if e := SetKeys(current); e != nil {
+		t.Fatal(e)
+	}
+	defer SetKeys(nil)
+
+	record := EncodeWith(val.String("secret"), mdl.String{}, Options{Key: current})
+
+	cases := []struct {
+		name    string
+		tamper  func(bs []byte)
+		problem string
+	}{
+		{"untouched", func(bs []byte) {}, ""},
+		{"flags", func(bs []byte) { bs[2] |= flagCompressed }, "failed decrypting record"},
+		{"version", func(bs []byte) { bs[1] = Version + 1 }, "unsupported"},
+		{"nonce", func(bs []byte) { bs[headerLength+4] ^= 1 }, "failed decrypting record"},
+		{"ciphertext", func(bs []byte) { bs[len(bs)-20] ^= 1 }, "failed decrypting record"},
+		{"tag", func(bs []byte) { bs[len(bs)-1] ^= 1 }, "failed decrypting record"},
+		{"key id", func(bs []byte) { bs[headerLength] ^= 1 }, "unknown data key"},
+	}
+
+	for _, c := range cases {
+		bs := append([]byte(nil), record...)
+		c.tamper(bs)
+		problem := decodeFailure(bs, mdl.String{})
+		if c.problem == "" && problem != "" {
+			t.Errorf("%s: %s", c.name, problem)
+		}
+		if !strings.Contains(problem, c.problem) {
+			t.Errorf("%s: expected failure %q, have %q", c.name, c.problem, problem)
+		}
+	}
+
+	if problem := decodeFailure(record[:headerLength+2], mdl.String{}); !strings.Contains(problem, "malformed") {
+		t.Errorf("truncated: expected a malformed record, have %q", problem)
+	}
+
+	if e := SetKeys(testKey(t, 2)); e != nil {
+		t.Fatal(e)
+	}
+	if problem := decodeFailure(record, mdl.String{}); !strings.Contains(problem, "unknown data key") {
+		t.Errorf("unknown key: expected failure, have %q", problem)
+	}
+}
+
+func TestSealOpenValues(t *testing.T) {
+
+	old, current := testKey(t, 1), testKey(t, 2)
+	if e := SetKeys(current, old); e != nil {
+		t.Fatal(e)
+	}
+	defer SetKeys(nil)
+
+	ad := []byte("blob/0")
+	for _, k := range []*Key{current, old} {
+		sealed := k.Seal([]byte("secret"), ad)
+		if id, e := SealedKeyID(sealed); e != nil || id != k.ID {
+			t.Errorf("key %08x: read key id %08x, %v", k.ID, id, e)
+		}
+		if bs, e := Open(sealed, ad); e != nil || string(bs) != "secret" {
+			t.Errorf("key %08x: opened %q, %v", k.ID, bs, e)
+		}
+		if _, e := Open(sealed, []byte("blob/1")); e == nil {
+			t.Errorf("key %08x: expected opening with other data to fail", k.ID)
+		}
+		tampered := append([]byte(nil), sealed...)
+		tampered[len(tampered)-1] ^= 1
+		if _, e := Open(tampered, ad); e == nil {
+			t.Errorf("key %08x: expected opening tampered value to fail", k.ID)
+		}
+	}
+
+	sealed := testKey(t, 3).Seal([]byte("secret"), ad)
+	if _, e := Open(sealed, ad); e == nil || !strings.Contains(e.Error(), "unknown data key") {
+		t.Errorf("expected unknown data key, have %v", e)
+	}
+	if _, e := Open(sealed[:3], ad); e == nil {
+		t.Error("expected opening a truncated value to fail")
+	}
+}
@@ -3,16 +3,188 @@
 package karma
 
 import (
+	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"karma.run/kvm/mdl"
 	"karma.run/kvm/val"
 	"math"
 	"time"
 )
 
+// Records start with a header of marker and format version. Those of the first
+// version have no header; they start with the length of their creation time
+// (see kvm.WrapModelInMeta), which is never marker.
+const marker = 0xff
+
+// Version is the format written by Encode. Since version 2, the elements of
+// structs, tuples, lists and maps are preceded by a table of offsets, so that
+// View can find any element without decoding those before it. Since version 3,
+// the header ends with a byte of flags.
+const Version = 3
+
+const (
+	flagCompressed = 1 << iota // the payload is compressed with flate
+	flagEncrypted              // the payload is encrypted, after compression, see Key
+)
+
+// length of the header of records since version 3
+const headerLength = 3
+
+// Options of records written by EncodeWith.
+type Options struct {
+	Compress bool // for large values that compress well, e.g. those with a lot of text
+	Key      *Key // to encrypt the record with, nil to leave it in plaintext
+}
+
 func Encode(v val.Value, m mdl.Model) []byte {
-	return encode(v, m, make([]byte, 0, 1024*4))
+	return encode(v, m, append(make([]byte, 0, 1024*4), marker, Version, 0))
+}
+
+// EncodeWith is Encode with the record compressed and/or encrypted as o says.
+func EncodeWith(v val.Value, m mdl.Model, o Options) []byte {
+	bs := Encode(v, m)
+	if !o.Compress && o.Key == nil {
+		return bs
+	}
+	header, payload := bs[:headerLength], bs[headerLength:]
+	if o.Compress {
+		header[2] |= flagCompressed
+		cs := bytes.NewBuffer(make([]byte, 0, len(bs)/2))
+		w, e := flate.NewWriter(cs, flate.DefaultCompression)
+		if e != nil {
+			panic(e)
+		}
+		if _, e := w.Write(payload); e != nil {
+			panic(e)
+		}
+		if e := w.Close(); e != nil {
+			panic(e)
+		}
+		payload = cs.Bytes()
+	}
+	if o.Key != nil {
+		header[2] |= flagEncrypted
+		return o.Key.seal(header, payload)
+	}
+	return append(header, payload...)
+}
+
+// Header describes how a record is written.
+type Header struct {
+	Version    int
+	Compressed bool
+	Encrypted  bool
+	KeyID      uint32 // of the key the record is encrypted with, if it is
+}
+
+// ReadHeader returns the header of record bs, without decrypting it.
+func ReadHeader(bs []byte) Header {
+	if len(bs) < 2 || bs[0] != marker {
+		return Header{Version: 1}
+	}
+	if bs[1] < 3 {
+		return Header{Version: int(bs[1])}
+	}
+	h := Header{
+		Version:    int(bs[1]),
+		Compressed: bs[2]&flagCompressed != 0,
+		Encrypted:  bs[2]&flagEncrypted != 0,
+	}
+	if h.Encrypted && len(bs) >= headerLength+4 {
+		h.KeyID = binary.BigEndian.Uint32(bs[headerLength:])
+	}
+	return h
+}
+
+// readHeader returns the format version of record bs and its payload,
+// decrypted and decompressed.
+func readHeader(bs []byte) ([]byte, int) {
+	h := ReadHeader(bs)
+	switch {
+	case h.Version > Version:
+		panic(fmt.Sprintf("unsupported format version: %d", h.Version))
+	case h.Version == 1:
+		return bs, h.Version
+	case h.Version == 2:
+		return bs[2:], h.Version
+	}
+	if bs[2]&^(flagCompressed|flagEncrypted) != 0 {
+		panic(fmt.Sprintf("unsupported format flags: %b", bs[2]))
+	}
+	payload := bs[headerLength:]
+	if h.Encrypted {
+		payload = open(bs, headerLength)
+	}
+	if h.Compressed {
+		ds, e := ioutil.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+		if e != nil {
+			panic(fmt.Sprintf("malformed compressed record: %s", e))
+		}
+		payload = ds
+	}
+	return payload, h.Version
+}
+
+// tabled appends n elements written by enc, preceded by a table of their
+// end offsets, relative to the end of the table. Offsets take 1, 2 or 4 bytes,
+// whatever suffices for the last, preceded by a byte telling which.
+func tabled(n int, bs []byte, enc func(i int, bs []byte) []byte) []byte {
+	table := len(bs) + 1
+	bs = append(bs, make([]byte, 1+n*4)...)
+	body := len(bs)
+	for i := 0; i < n; i++ {
+		bs = enc(i, bs)
+		binary.BigEndian.PutUint32(bs[table+i*4:], uint32(len(bs)-body))
+	}
+	size, width := len(bs)-body, 4
+	if size <= math.MaxUint8 {
+		width = 1
+	} else if size <= math.MaxUint16 {
+		width = 2
+	}
+	bs[table-1] = uint8(width)
+	if width < 4 { // narrow the table, moving the elements
+		for i := 0; i < n; i++ {
+			putOffset(bs[table+i*width:], width, binary.BigEndian.Uint32(bs[table+i*4:]))
+		}
+		copy(bs[table+n*width:], bs[body:])
+		bs = bs[:table+n*width+size]
+	}
+	return bs
+}
+
+func putOffset(bs []byte, width int, x uint32) {
+	switch width {
+	case 1:
+		bs[0] = uint8(x)
+	case 2:
+		binary.BigEndian.PutUint16(bs, uint16(x))
+	default:
+		binary.BigEndian.PutUint32(bs, x)
+	}
+}
+
+func readOffset(bs []byte, width int) int {
+	switch width {
+	case 1:
+		return int(bs[0])
+	case 2:
+		return int(binary.BigEndian.Uint16(bs))
+	}
+	return int(binary.BigEndian.Uint32(bs))
+}
+
+// element returns the encoding of element i of n, bs starting at their table.
+func element(bs []byte, n, i int) []byte {
+	width := int(bs[0])
+	table, start := bs[1:], 0
+	if i > 0 {
+		start = readOffset(table[(i-1)*width:], width)
+	}
+	return table[n*width+start : n*width+readOffset(table[i*width:], width)]
 }
 
 func encode(v val.Value, m mdl.Model, bs []byte) []byte {
@@ -36,39 +208,34 @@ func encode(v val.Value, m mdl.Model, bs []byte) []byte {
 	case mdl.List:
 		v := v.(val.List)
 		bs = writeUint32(uint32(len(v)), bs)
-		for _, w := range v {
-			bs = encode(w, m.Elements, bs)
-		}
-		return bs
+		return tabled(len(v), bs, func(i int, bs []byte) []byte {
+			return encode(v[i], m.Elements, bs)
+		})
 
 	case mdl.Map:
 		v := v.(val.Map)
-		bs = writeUint32(uint32(v.Len()), bs)
-		v.ForEach(func(k string, w val.Value) bool {
-			bs = writeString(k, bs)
-			bs = encode(w, m.Elements, bs)
-			return true
+		ks := v.Keys() // sorted, so View can search them
+		bs = writeUint32(uint32(len(ks)), bs)
+		return tabled(len(ks), bs, func(i int, bs []byte) []byte {
+			w, _ := v.Get(ks[i])
+			return encode(w, m.Elements, writeString(ks[i], bs))
 		})
-		return bs
 
 	case mdl.Tuple:
 		v := v.(val.Tuple)
-		for i, w := range v {
-			bs = encode(w, m[i], bs)
-		}
-		return bs
+		return tabled(len(m), bs, func(i int, bs []byte) []byte {
+			return encode(v[i], m[i], bs)
+		})
 
 	case mdl.Struct:
-		v := v.(val.Struct)
-		m.ForEach(func(k string, m mdl.Model) bool {
-			w, ok := v.Get(k)
+		v, ks := v.(val.Struct), m.Keys()
+		return tabled(len(ks), bs, func(i int, bs []byte) []byte {
+			w, ok := v.Get(ks[i])
 			if !ok {
 				w = val.Null // m is elided
 			}
-			bs = encode(w, m, bs)
-			return true
+			return encode(w, m.Field(ks[i]), bs)
 		})
-		return bs
 
 	case mdl.Union:
 		v := v.(val.Union)
@@ -145,15 +312,41 @@ func encode(v val.Value, m mdl.Model, bs []byte) []byte {
 		v := v.(val.Uint64)
 		return writeUint64(uint64(v), bs)
 
+	case mdl.Duration:
+		v := v.(val.Duration)
+		return writeUint64(uint64(v), bs)
+
+	case mdl.Decimal:
+		v := v.(val.Decimal)
+		return writeString(v.String(), bs)
+
+	case mdl.Bytes:
+		v := v.(val.Bytes)
+		return writeString(string(v), bs)
+
+	case mdl.Blob:
+		v := v.(val.Blob)
+		return writeString(string(v), bs)
+
 	}
 	panic(fmt.Sprintf("unhandled model: %T", m))
 }
 
+// Decode decodes record bs, written by Encode in any layout version.
 func Decode(bs []byte, m mdl.Model) (val.Value, []byte) {
-	return decode(bs, m)
+	bs, version := readHeader(bs)
+	return decode(bs, m, version)
 }
 
-func decode(bs []byte, m mdl.Model) (val.Value, []byte) {
+// table skips the offset table of n elements, if format version has them.
+func table(bs []byte, n, version int) []byte {
+	if version < 2 {
+		return bs
+	}
+	return bs[1+n*int(bs[0]):]
+}
+
+func decode(bs []byte, m mdl.Model, version int) (val.Value, []byte) {
 	m = m.Concrete()
 	switch m := m.(type) {
 
@@ -161,13 +354,13 @@ func decode(bs []byte, m mdl.Model) (val.Value, []byte) {
 		if bs[0] == 0 {
 			return val.Null, bs[1:]
 		}
-		return decode(bs[1:], m.Model)
+		return decode(bs[1:], m.Model, version)
 
 	case mdl.Set:
 		l, bs := readUint32(bs)
 		v := make(val.Set, l)
 		for i, l := 0, int(l); i < l; i++ {
-			w, cs := decode(bs, m.Elements)
+			w, cs := decode(bs, m.Elements, version)
 			v[val.Hash(w, nil).Sum64()] = w
 			bs = cs
 		}
@@ -175,19 +368,21 @@ func decode(bs []byte, m mdl.Model) (val.Value, []byte) {
 
 	case mdl.List:
 		l, bs := readUint32(bs)
+		bs = table(bs, int(l), version)
 		v := make(val.List, l, l)
 		for i, l := 0, int(l); i < l; i++ {
-			w, cs := decode(bs, m.Elements)
+			w, cs := decode(bs, m.Elements, version)
 			v[i], bs = w, cs
 		}
 		return v, bs
 
 	case mdl.Map:
 		l, bs := readUint32(bs)
+		bs = table(bs, int(l), version)
 		v := val.NewMap(int(l))
 		for i, l := 0, int(l); i < l; i++ {
 			k, cs := readString(bs)
-			w, cs := decode(cs, m.Elements)
+			w, cs := decode(cs, m.Elements, version)
 			v.Set(k, w)
 			bs = cs
 		}
@@ -195,16 +390,18 @@ func decode(bs []byte, m mdl.Model) (val.Value, []byte) {
 
 	case mdl.Tuple:
 		l := len(m)
+		bs = table(bs, l, version)
 		v := make(val.Tuple, l, l)
 		for i := 0; i < l; i++ {
-			v[i], bs = decode(bs, m[i])
+			v[i], bs = decode(bs, m[i], version)
 		}
 		return v, bs
 
 	case mdl.Struct:
 		v := val.NewStruct(m.Len())
+		bs = table(bs, m.Len(), version)
 		m.ForEach(func(k string, m mdl.Model) bool {
-			w, cs := decode(bs, m)
+			w, cs := decode(bs, m, version)
 			v.Set(k, w)
 			bs = cs
 			return true
@@ -214,7 +411,7 @@ func decode(bs []byte, m mdl.Model) (val.Value, []byte) {
 	case mdl.Union:
 		c, bs := readString(bs)
 		v := val.Union{Case: c}
-		v.Value, bs = decode(bs, m.Case(c))
+		v.Value, bs = decode(bs, m.Case(c), version)
 		return v, bs
 
 	case mdl.Enum:
@@ -279,6 +476,26 @@ func decode(bs []byte, m mdl.Model) (val.Value, []byte) {
 		x, bs := readUint64(bs)
 		return val.Uint64(x), bs
 
+	case mdl.Duration:
+		x, bs := readUint64(bs)
+		return val.Duration(x), bs
+
+	case mdl.Decimal:
+		s, bs := readString(bs)
+		d, ok := val.ParseDecimal(s)
+		if !ok {
+			panic(fmt.Sprintf("malformed decimal: %q", s))
+		}
+		return d, bs
+
+	case mdl.Bytes:
+		s, bs := readString(bs)
+		return val.Bytes(s), bs
+
+	case mdl.Blob:
+		s, bs := readString(bs)
+		return val.Blob(s), bs
+
 	}
 	panic(fmt.Sprintf("unhandled model: %T", m))
 }
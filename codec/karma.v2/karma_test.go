@@ -0,0 +1,256 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package karma
+
+import (
+	"fmt"
+	"karma.run/kvm/mdl"
+	"karma.run/kvm/val"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testModel covers every kind of container, with text of configurable size
+// in all of them, so that their offset tables take 1, 2 or 4 bytes.
+var testModel = mdl.StructFromMap(map[string]mdl.Model{
+	"text":     mdl.String{},
+	"number":   mdl.Int64{},
+	"created":  mdl.DateTime{},
+	"owner":    mdl.Ref{"user"},
+	"maybe":    mdl.NewOptional(mdl.String{}),
+	"nothing":  mdl.NewOptional(mdl.String{}),
+	"choice":   mdl.UnionFromMap(map[string]mdl.Model{"a": mdl.Int64{}, "b": mdl.String{}}),
+	"list":     mdl.List{mdl.String{}},
+	"numbers":  mdl.List{mdl.Int64{}},
+	"map":      mdl.Map{mdl.String{}},
+	"pair":     mdl.Tuple{mdl.String{}, mdl.Bool{}},
+	"nested":   mdl.StructFromMap(map[string]mdl.Model{"text": mdl.String{}, "list": mdl.List{mdl.String{}}}),
+	"children": mdl.List{mdl.StructFromMap(map[string]mdl.Model{"name": mdl.String{}})},
+})
+
+func testValue(text string) val.Value {
+	return val.StructFromMap(map[string]val.Value{
+		"text":     val.String(text),
+		"number":   val.Int64(-42),
+		"created":  val.DateTime{time.Date(2017, 3, 14, 15, 9, 26, 0, time.UTC)},
+		"owner":    val.Ref{"user", "0123456789abcdef"},
+		"maybe":    val.String("present"),
+		"nothing":  val.Null,
+		"choice":   val.Union{"b", val.String(text)},
+		"list":     val.List{val.String("a"), val.String(text), val.String("c")},
+		"numbers":  val.List{},
+		"map":      val.MapFromMap(map[string]val.Value{"x": val.String(text), "y": val.String("why"), "z": val.String("")}),
+		"pair":     val.Tuple{val.String(text), val.Bool(true)},
+		"nested":   val.StructFromMap(map[string]val.Value{"text": val.String(text), "list": val.List{val.String(text)}}),
+		"children": val.List{val.StructFromMap(map[string]val.Value{"name": val.String("first")}), val.StructFromMap(map[string]val.Value{"name": val.String(text)})},
+	})
+}
+
+// widths are text lengths for which the offset tables of the containers
+// holding the text are of the given width.
+var widths = []struct {
+	width int
+	text  int
+}{
+	{1, 10},
+	{2, 1000},
+	{4, 70000},
+}
+
+// layouts encode a value in each format version.
+var layouts = []struct {
+	version int
+	encode  func(val.Value, mdl.Model) []byte
+}{
+	{1, func(v val.Value, m mdl.Model) []byte { return encodeV1(v, m, nil) }},
+	{2, func(v val.Value, m mdl.Model) []byte {
+		return append([]byte{marker, 2}, Encode(v, m)[headerLength:]...) // version 3 only added the flags
+	}},
+	{Version, Encode},
+}
+
+// encodeV1 encodes v in the first layout, without header and offset tables.
+func encodeV1(v val.Value, m mdl.Model, bs []byte) []byte {
+	switch m := m.Concrete().(type) {
+	case mdl.Optional:
+		if v == val.Null {
+			return append(bs, 0)
+		}
+		return encodeV1(v, m.Model, append(bs, 1))
+	case mdl.List:
+		v := v.(val.List)
+		bs = writeUint32(uint32(len(v)), bs)
+		for _, w := range v {
+			bs = encodeV1(w, m.Elements, bs)
+		}
+		return bs
+	case mdl.Map:
+		v := v.(val.Map)
+		bs = writeUint32(uint32(v.Len()), bs)
+		for _, k := range v.Keys() {
+			w, _ := v.Get(k)
+			bs = encodeV1(w, m.Elements, writeString(k, bs))
+		}
+		return bs
+	case mdl.Tuple:
+		for i, w := range v.(val.Tuple) {
+			bs = encodeV1(w, m[i], bs)
+		}
+		return bs
+	case mdl.Struct:
+		for _, k := range m.Keys() {
+			w, _ := v.(val.Struct).Get(k)
+			bs = encodeV1(w, m.Field(k), bs)
+		}
+		return bs
+	case mdl.Union:
+		v := v.(val.Union)
+		return encodeV1(v.Value, m.Case(v.Case), writeString(v.Case, bs))
+	}
+	return encode(v, m, bs) // primitives didn't change
+}
+
+func TestEncodeDecode(t *testing.T) {
+	for _, l := range layouts {
+		for _, w := range widths {
+			name := fmt.Sprintf("version %d, %d byte offsets", l.version, w.width)
+			v := testValue(strings.Repeat("t", w.text))
+			bs := l.encode(v, testModel)
+
+			if h := ReadHeader(bs); h.Version != l.version {
+				t.Errorf("%s: read version %d", name, h.Version)
+			}
+			have, rest := Decode(bs, testModel)
+			if len(rest) != 0 {
+				t.Errorf("%s: %d bytes left", name, len(rest))
+			}
+			if !have.Equals(v) {
+				t.Errorf("%s: decoded value differs", name)
+			}
+		}
+	}
+}
+
+func TestOffsetWidths(t *testing.T) {
+	for _, w := range widths {
+		text := val.String(strings.Repeat("t", w.text))
+		bs := Encode(val.List{text, text}, mdl.List{mdl.String{}})
+		_, table := readUint32(bs[headerLength:])
+		if int(table[0]) != w.width {
+			t.Errorf("text of %d bytes: expected offsets of %d bytes, have %d", w.text, w.width, table[0])
+		}
+	}
+}
+
+func TestView(t *testing.T) {
+	for _, l := range layouts {
+		for _, w := range widths {
+			name := fmt.Sprintf("version %d, %d byte offsets", l.version, w.width)
+			text := val.String(strings.Repeat("t", w.text))
+			v := testValue(string(text))
+			lazy, ok := View(l.encode(v, testModel), testModel).(*Lazy)
+			if !ok {
+				t.Fatalf("%s: expected a view", name)
+			}
+
+			expect := func(what string, have, want val.Value) {
+				if have == nil && want == nil {
+					return
+				}
+				if have == nil || want == nil || !have.Equals(want) {
+					t.Errorf("%s: %s: want %v, have %v", name, what, want, have)
+				}
+			}
+
+			expect("value", lazy.Value(), v)
+			expect("field text", lazy.Field("text"), text)
+			expect("field number", lazy.Field("number"), val.Int64(-42))
+			expect("field created", lazy.Field("created"), v.(val.Struct).Field("created"))
+			expect("field owner", lazy.Field("owner"), val.Ref{"user", "0123456789abcdef"})
+			expect("field maybe", lazy.Field("maybe"), val.String("present"))
+			expect("field nothing", lazy.Field("nothing"), val.Null)
+			expect("field choice", lazy.Field("choice"), val.Union{"b", text})
+			expect("unknown field", lazy.Field("unknown"), nil)
+
+			list := lazy.Field("list").(*Lazy)
+			expect("list index 0", list.Index(0), val.String("a"))
+			expect("list index 1", list.Index(1), text)
+			expect("list index 2", list.Index(2), val.String("c"))
+			expect("list index 3", list.Index(3), nil)
+			expect("list index -1", list.Index(-1), nil)
+			expect("empty list index 0", lazy.Field("numbers").(*Lazy).Index(0), nil)
+
+			pair := lazy.Field("pair").(*Lazy)
+			expect("tuple index 0", pair.Index(0), text)
+			expect("tuple index 1", pair.Index(1), val.Bool(true))
+			expect("tuple index 2", pair.Index(2), nil)
+
+			mp := lazy.Field("map").(*Lazy)
+			for k, want := range map[string]val.Value{"x": text, "y": val.String("why"), "z": val.String("")} {
+				have, ok := mp.Key(k)
+				if !ok {
+					t.Errorf("%s: key %s missing", name, k)
+					continue
+				}
+				expect("key "+k, have, want)
+			}
+			for _, k := range []string{"", "a", "xx", "zz"} {
+				if _, ok := mp.Key(k); ok {
+					t.Errorf("%s: unexpected key %q", name, k)
+				}
+			}
+
+			nested := lazy.Field("nested").(*Lazy)
+			expect("nested field text", nested.Field("text"), text)
+			expect("nested list index 0", nested.Field("list").(*Lazy).Index(0), text)
+
+			child := lazy.Field("children").(*Lazy).Index(1).(*Lazy)
+			expect("child field name", child.Field("name"), text)
+		}
+	}
+}
+
+func TestCompressed(t *testing.T) {
+	for _, w := range widths {
+		v := testValue(strings.Repeat("t", w.text))
+		plain := Encode(v, testModel)
+		bs := EncodeWith(v, testModel, Options{Compress: true})
+		name := fmt.Sprintf("text of %d bytes", w.text)
+
+		if bs[0] != marker || bs[1] != Version || bs[2] != flagCompressed {
+			t.Errorf("%s: unexpected header % x", name, bs[:headerLength])
+		}
+		if h := ReadHeader(bs); !h.Compressed || h.Encrypted || h.Version != Version {
+			t.Errorf("%s: read header %+v", name, h)
+		}
+		if h := ReadHeader(plain); h.Compressed {
+			t.Errorf("%s: uncompressed record read as compressed", name)
+		}
+		if len(bs) >= len(plain) && w.text > 100 {
+			t.Errorf("%s: compressed to %d bytes from %d", name, len(bs), len(plain))
+		}
+
+		if have, rest := Decode(bs, testModel); len(rest) != 0 || !have.Equals(v) {
+			t.Errorf("%s: decoded value differs", name)
+		}
+		lazy := View(bs, testModel).(*Lazy)
+		if have := lazy.Field("text"); have == nil || !have.Equals(v.(val.Struct).Field("text")) {
+			t.Errorf("%s: viewed field differs", name)
+		}
+		if have, ok := lazy.Field("map").(*Lazy).Key("y"); !ok || !have.Equals(val.String("why")) {
+			t.Errorf("%s: viewed key differs", name)
+		}
+	}
+}
+
+func TestUnsupportedFlags(t *testing.T) {
+	bs := Encode(val.String("text"), mdl.String{})
+	bs[2] = 1 << 7
+	defer func() {
+		if recover() == nil {
+			t.Error("expected decoding a record with unsupported flags to fail")
+		}
+	}()
+	Decode(bs, mdl.String{})
+}
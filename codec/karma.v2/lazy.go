@@ -0,0 +1,233 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package karma
+
+import (
+	"encoding/binary"
+	"fmt"
+	"karma.run/kvm/mdl"
+	"karma.run/kvm/val"
+	"sort"
+)
+
+// Lazy is a view of an encoded struct, tuple, list or map that decodes only
+// what is accessed through Field, Key and Index. It implements val.Value by
+// decoding itself entirely. The bytes it views must not change while in use.
+type Lazy struct {
+	bs      []byte    // starting with the value, possibly followed by others
+	model   mdl.Model // concrete
+	version int       // of the format, see Version
+}
+
+// View returns a Lazy of record bs, or its decoded value if m doesn't
+// describe a struct, tuple, list or map.
+func View(bs []byte, m mdl.Model) val.Value {
+	bs, version := readHeader(bs)
+	return view(bs, m, version)
+}
+
+func view(bs []byte, m mdl.Model, version int) val.Value {
+	m = m.Concrete()
+	switch m := m.(type) {
+	case mdl.Optional:
+		if bs[0] == 0 {
+			return val.Null
+		}
+		return view(bs[1:], m.Model, version)
+	case mdl.Struct, mdl.Tuple, mdl.List, mdl.Map:
+		return &Lazy{bs, m, version}
+	}
+	v, _ := decode(bs, m, version)
+	return v
+}
+
+// Value decodes l entirely.
+func (l *Lazy) Value() val.Value {
+	v, _ := decode(l.bs, l.model, l.version)
+	return v
+}
+
+// Field returns field k of a struct like val.Struct.Field, as view.
+func (l *Lazy) Field(k string) val.Value {
+	m := l.model.(mdl.Struct)
+	i, n, bs := 0, m.Len(), l.bs
+	fm := mdl.Model(nil)
+	m.ForEach(func(f string, w mdl.Model) bool {
+		if f == k {
+			fm = w
+			return false
+		}
+		if l.version < 2 {
+			bs = skip(bs, w)
+		}
+		i++
+		return true
+	})
+	if fm == nil {
+		return nil
+	}
+	if l.version >= 2 {
+		bs = element(bs, n, i)
+	}
+	return view(bs, fm, l.version)
+}
+
+// Index returns element i of a tuple or list, as view, or nil if out of range.
+func (l *Lazy) Index(i int) val.Value {
+	bs, n := l.bs, 0
+	model := (func(int) mdl.Model)(nil)
+	switch m := l.model.(type) {
+	case mdl.Tuple:
+		n, model = len(m), func(j int) mdl.Model { return m[j] }
+	case mdl.List:
+		c, cs := readUint32(bs)
+		bs, n, model = cs, int(c), func(int) mdl.Model { return m.Elements }
+	default:
+		panic(fmt.Sprintf("Lazy.Index of %T", m))
+	}
+	if i < 0 || i >= n {
+		return nil
+	}
+	if l.version >= 2 {
+		return view(element(bs, n, i), model(i), l.version)
+	}
+	for j := 0; j < i; j++ {
+		bs = skip(bs, model(j))
+	}
+	return view(bs, model(i), l.version)
+}
+
+// Key returns the element under k of a map like val.Map.Get, as view.
+func (l *Lazy) Key(k string) (val.Value, bool) {
+	em := l.model.(mdl.Map).Elements
+	c, bs := readUint32(l.bs)
+	n := int(c)
+	if l.version < 2 {
+		for i := 0; i < n; i++ {
+			key, cs := readKey(bs)
+			if string(key) == k {
+				return view(cs, em, l.version), true
+			}
+			bs = skip(cs, em)
+		}
+		return nil, false
+	}
+	i := sort.Search(n, func(i int) bool {
+		key, _ := readKey(element(bs, n, i))
+		return string(key) >= k
+	})
+	if i == n {
+		return nil, false
+	}
+	key, cs := readKey(element(bs, n, i))
+	if string(key) != k {
+		return nil, false
+	}
+	return view(cs, em, l.version), true
+}
+
+func (l *Lazy) Copy() val.Value {
+	return l // immutable
+}
+
+func (l *Lazy) Equals(v val.Value) bool {
+	return l.Value().Equals(v)
+}
+
+func (l *Lazy) Transform(f func(val.Value) val.Value) val.Value {
+	return l.Value().Transform(f)
+}
+
+func (*Lazy) Primitive() bool {
+	return false
+}
+
+func (l *Lazy) Type() val.Type {
+	return l.Value().Type()
+}
+
+func readKey(bs []byte) ([]byte, []byte) {
+	l, bs := readUint32(bs)
+	return bs[:l], bs[l:]
+}
+
+// skip returns bs after the value of model m in the first layout.
+func skip(bs []byte, m mdl.Model) []byte {
+	m = m.Concrete()
+	switch m := m.(type) {
+
+	case mdl.Optional:
+		if bs[0] == 0 {
+			return bs[1:]
+		}
+		return skip(bs[1:], m.Model)
+
+	case mdl.Set:
+		l, bs := readUint32(bs)
+		for i := 0; i < int(l); i++ {
+			bs = skip(bs, m.Elements)
+		}
+		return bs
+
+	case mdl.List:
+		l, bs := readUint32(bs)
+		for i := 0; i < int(l); i++ {
+			bs = skip(bs, m.Elements)
+		}
+		return bs
+
+	case mdl.Map:
+		l, bs := readUint32(bs)
+		for i := 0; i < int(l); i++ {
+			_, bs = readKey(bs)
+			bs = skip(bs, m.Elements)
+		}
+		return bs
+
+	case mdl.Tuple:
+		for _, m := range m {
+			bs = skip(bs, m)
+		}
+		return bs
+
+	case mdl.Struct:
+		m.ForEach(func(_ string, m mdl.Model) bool {
+			bs = skip(bs, m)
+			return true
+		})
+		return bs
+
+	case mdl.Union:
+		c, bs := readString(bs)
+		return skip(bs, m.Case(c))
+
+	case mdl.Enum, mdl.String, mdl.Decimal, mdl.Bytes, mdl.Blob:
+		_, bs := readKey(bs)
+		return bs
+
+	case mdl.Ref:
+		return bs[16:]
+
+	case mdl.Null:
+		return bs
+
+	case mdl.Float, mdl.Uint32, mdl.Uint64, mdl.Duration:
+		_, n := binary.Uvarint(bs)
+		return bs[n:]
+
+	case mdl.Int32, mdl.Int64:
+		_, n := binary.Varint(bs)
+		return bs[n:]
+
+	case mdl.Bool, mdl.Int8, mdl.Uint8:
+		return bs[1:]
+
+	case mdl.Int16, mdl.Uint16:
+		return bs[2:]
+
+	case mdl.DateTime:
+		return bs[1+int(bs[0]):]
+
+	}
+	panic(fmt.Sprintf("unhandled model: %T", m))
+}
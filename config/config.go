@@ -5,6 +5,8 @@ package config
 import (
 	"flag"
 	"os"
+	"strconv"
+	"time"
 )
 
 var (
@@ -17,7 +19,23 @@ var (
 	HttpsKeyFile        string
 	InstanceSecret      string
 	DataFile            string = "karma.data" // explicit default
+	DataKeyFile         string = ""           // records aren't encrypted if empty
+	InitDataKeyFile     bool   = false        // see db.LoadDataKeys
+	PlaintextRoles      string = ""           // comma-separated, see kvm.LoadPlaintextRoles
 	UdpBroadcast        string = ""
+	SortSpillItems      int    = 100000  // explicit default
+	SortSpillDir        string = ""      // os.TempDir() if empty
+	BlobMaxBytes        int    = 1 << 30 // explicit default
+	BlobUploadRoles     string = ""      // comma-separated, see kvm.LoadBlobUploadRoles
+
+	// execution limits, 0 is unlimited
+	MaxInstructions    int           = 0
+	MaxExecutionTime   time.Duration = 0
+	MaxAllocationBytes int           = 0
+	RoleLimits         string        = "" // JSON, see kvm.LoadRoleLimits
+
+	SlowQueryThreshold time.Duration = 0 // 0 disables the slow query log
+	MaxParallelism     int           = 0 // off, see kvm.NewParallelism
 )
 
 func init() {
@@ -75,12 +93,90 @@ func init() {
 		getenv("KARMA_DATA_FILE", DataFile),
 		"Path to data file. Defaults to environment variable KARMA_DATA_FILE.",
 	)
+	flag.StringVar(
+		&DataKeyFile,
+		"data-key-file",
+		getenv("KARMA_DATA_KEY_FILE", DataKeyFile),
+		"Path to a file of base64-encoded data key secrets, one per line, to encrypt records and blobs at rest with. The first line's key encrypts, the others only decrypt data not yet rewritten after a rotation. Startup fails if the file doesn't exist, unless --init-data-key-file is set, or if the data file holds data encrypted with keys it lacks. Records aren't encrypted if empty. Defaults to environment variable KARMA_DATA_KEY_FILE.",
+	)
+	flag.BoolVar(
+		&InitDataKeyFile,
+		"init-data-key-file",
+		getenvBool("KARMA_INIT_DATA_KEY_FILE", InitDataKeyFile),
+		"Create --data-key-file with a generated key if it doesn't exist. Defaults to environment variable KARMA_INIT_DATA_KEY_FILE.",
+	)
+	flag.StringVar(
+		&PlaintextRoles,
+		"plaintext-roles",
+		getenv("KARMA_PLAINTEXT_ROLES", PlaintextRoles),
+		`Comma-separated names of the roles whose users read values of models annotated "encrypted" decrypted, e.g. "support,billing". Users of other roles read a placeholder instead. The root user always reads them decrypted. Defaults to environment variable KARMA_PLAINTEXT_ROLES.`,
+	)
 	flag.StringVar(
 		&UdpBroadcast,
 		"udp-broadcast",
 		getenv("KARMA_UDP_BROADCAST", UdpBroadcast),
 		`UDP address to broadcast write events to, e.g. "255.255.255.255:1234"`,
 	)
+	flag.IntVar(
+		&SortSpillItems,
+		"sort-spill-items",
+		getenvInt("KARMA_SORT_SPILL_ITEMS", SortSpillItems),
+		"Number of items above which sorts write sorted runs to temporary files instead of sorting in memory. 0 disables spilling. Defaults to environment variable KARMA_SORT_SPILL_ITEMS.",
+	)
+	flag.StringVar(
+		&SortSpillDir,
+		"sort-spill-dir",
+		getenv("KARMA_SORT_SPILL_DIR", SortSpillDir),
+		"Directory for temporary sort files. Defaults to environment variable KARMA_SORT_SPILL_DIR, then to the system's temporary directory.",
+	)
+	flag.IntVar(
+		&BlobMaxBytes,
+		"blob-max-bytes",
+		getenvInt("KARMA_BLOB_MAX_BYTES", BlobMaxBytes),
+		"Maximum size of uploaded blobs in bytes. Defaults to environment variable KARMA_BLOB_MAX_BYTES.",
+	)
+	flag.StringVar(
+		&BlobUploadRoles,
+		"blob-upload-roles",
+		getenv("KARMA_BLOB_UPLOAD_ROLES", BlobUploadRoles),
+		`Comma-separated names of the roles whose users may upload blobs, e.g. "editor,uploader". The root user always may. Defaults to environment variable KARMA_BLOB_UPLOAD_ROLES.`,
+	)
+	flag.IntVar(
+		&MaxInstructions,
+		"max-instructions",
+		getenvInt("KARMA_MAX_INSTRUCTIONS", MaxInstructions),
+		"Maximum number of instructions a request may execute. 0 is unlimited. Defaults to environment variable KARMA_MAX_INSTRUCTIONS.",
+	)
+	flag.DurationVar(
+		&MaxExecutionTime,
+		"max-execution-time",
+		getenvDuration("KARMA_MAX_EXECUTION_TIME", MaxExecutionTime),
+		"Maximum time a request may execute, e.g. \"30s\". 0 is unlimited. Defaults to environment variable KARMA_MAX_EXECUTION_TIME.",
+	)
+	flag.IntVar(
+		&MaxAllocationBytes,
+		"max-allocation-bytes",
+		getenvInt("KARMA_MAX_ALLOCATION_BYTES", MaxAllocationBytes),
+		"Approximate maximum number of bytes a request may allocate for values. 0 is unlimited. Defaults to environment variable KARMA_MAX_ALLOCATION_BYTES.",
+	)
+	flag.StringVar(
+		&RoleLimits,
+		"role-limits",
+		getenv("KARMA_ROLE_LIMITS", RoleLimits),
+		`Per-role execution limits overriding the global ones, as JSON object keyed by role name, e.g. '{"editor": {"instructions": 1000000, "time": "10s", "allocationBytes": 100000000}}'. Defaults to environment variable KARMA_ROLE_LIMITS.`,
+	)
+	flag.DurationVar(
+		&SlowQueryThreshold,
+		"slow-query-threshold",
+		getenvDuration("KARMA_SLOW_QUERY_THRESHOLD", SlowQueryThreshold),
+		"Log queries taking longer than this, e.g. \"1s\". 0 disables logging. Defaults to environment variable KARMA_SLOW_QUERY_THRESHOLD.",
+	)
+	flag.IntVar(
+		&MaxParallelism,
+		"max-parallelism",
+		getenvInt("KARMA_MAX_PARALLELISM", MaxParallelism),
+		"Maximum number of goroutines a read-only request may use to evaluate mapList and filterList over large models, at most GOMAXPROCS. Values below 2, the default, disable parallel evaluation. Defaults to environment variable KARMA_MAX_PARALLELISM.",
+	)
 }
 
 func getenv(key string, deflt string) string {
@@ -90,3 +186,27 @@ func getenv(key string, deflt string) string {
 	}
 	return v
 }
+
+func getenvInt(key string, deflt int) int {
+	v, e := strconv.Atoi(os.Getenv(key))
+	if e != nil {
+		return deflt
+	}
+	return v
+}
+
+func getenvDuration(key string, deflt time.Duration) time.Duration {
+	v, e := time.ParseDuration(os.Getenv(key))
+	if e != nil {
+		return deflt
+	}
+	return v
+}
+
+func getenvBool(key string, deflt bool) bool {
+	v, e := strconv.ParseBool(os.Getenv(key))
+	if e != nil {
+		return deflt
+	}
+	return v
+}
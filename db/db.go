@@ -5,6 +5,7 @@ package db
 import (
 	bolt "github.com/coreos/bbolt"
 	"karma.run/config"
+	"karma.run/store"
 	"log"
 	"os"
 	"os/signal"
@@ -22,11 +23,11 @@ func init() {
 	go handleSignals()
 }
 
-var database *bolt.DB = nil
+var database store.DB = nil
 
 var mutex = &sync.Mutex{}
 
-func Open() (*bolt.DB, error) {
+func Open() (store.DB, error) {
 
 	mutex.Lock()
 	defer mutex.Unlock()
@@ -36,7 +37,6 @@ func Open() (*bolt.DB, error) {
 		if e != nil {
 			return nil, e
 		}
-		db.MaxBatchSize = 1024 * 10
 		database = db
 		return db, nil
 	}
@@ -64,7 +64,7 @@ func WhileClosed(f func() error) error {
 }
 
 // reloads the underlying database from file
-func Reload() (*bolt.DB, error) {
+func Reload() (store.DB, error) {
 
 	mutex.Lock()
 	defer mutex.Unlock()
@@ -79,12 +79,17 @@ func Reload() (*bolt.DB, error) {
 
 }
 
-func openDatabase(path string) (*bolt.DB, error) {
-	return bolt.Open(path, Perm, &bolt.Options{
+func openDatabase(path string) (store.DB, error) {
+	db, e := bolt.Open(path, Perm, &bolt.Options{
 		InitialMmapSize: InitialMmapSize,
 		Timeout:         time.Second * 3,
 		// MmapFlags:       syscall.MAP_POPULATE,
 	})
+	if e != nil {
+		return nil, e
+	}
+	db.MaxBatchSize = 1024 * 10
+	return store.NewBolt(db), nil
 }
 
 func handleSignals() {
@@ -0,0 +1,161 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"karma.run/codec/karma.v2"
+	"karma.run/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const dataKeySecretLength = 64
+
+var keyMutex = &sync.Mutex{}
+
+// LoadDataKeys reads config.DataKeyFile and makes its keys the ones records
+// are encrypted and decrypted with. If the file doesn't exist, it is created
+// with a generated secret if config.InitDataKeyFile is set, and an error
+// otherwise, as a wrong path would encrypt new records with a key that isn't
+// backed up. It does nothing if config.DataKeyFile is empty.
+func LoadDataKeys() error {
+
+	keyMutex.Lock()
+	defer keyMutex.Unlock()
+
+	if config.DataKeyFile == "" {
+		return nil
+	}
+
+	secrets, e := readDataKeyFile(config.DataKeyFile)
+	if os.IsNotExist(e) && !config.InitDataKeyFile {
+		return fmt.Errorf("%s doesn't exist, see --init-data-key-file to create it", config.DataKeyFile)
+	}
+	if os.IsNotExist(e) {
+		secret, e := generateDataKeySecret()
+		if e != nil {
+			return e
+		}
+		secrets = [][]byte{secret}
+		if e := writeDataKeyFile(config.DataKeyFile, secrets); e != nil {
+			return e
+		}
+	} else if e != nil {
+		return e
+	}
+
+	return setDataKeys(secrets)
+}
+
+// RotateDataKey prepends a generated secret to config.DataKeyFile and makes it
+// the key new records are encrypted with. Existing records stay readable with
+// the old keys until rewritten, see kvm.RewriteRecords.
+func RotateDataKey() error {
+
+	keyMutex.Lock()
+	defer keyMutex.Unlock()
+
+	if config.DataKeyFile == "" {
+		return fmt.Errorf("no data key file configured, see --data-key-file")
+	}
+
+	secrets, e := readDataKeyFile(config.DataKeyFile)
+	if e != nil {
+		return e
+	}
+	secret, e := generateDataKeySecret()
+	if e != nil {
+		return e
+	}
+	secrets = append([][]byte{secret}, secrets...)
+	if e := writeDataKeyFile(config.DataKeyFile, secrets); e != nil {
+		return e
+	}
+
+	return setDataKeys(secrets)
+}
+
+func setDataKeys(secrets [][]byte) error {
+	if len(secrets) == 0 {
+		return fmt.Errorf("data key file contains no keys")
+	}
+	keys := make([]*karma.Key, 0, len(secrets))
+	for i, secret := range secrets {
+		k, e := karma.NewKey(secret)
+		if e != nil {
+			return fmt.Errorf("data key %d: %s", i+1, e)
+		}
+		keys = append(keys, k)
+	}
+	return karma.SetKeys(keys[0], keys[1:]...)
+}
+
+func generateDataKeySecret() ([]byte, error) {
+	bs := make([]byte, dataKeySecretLength)
+	if n, _ := rand.Read(bs); n < len(bs) {
+		return nil, fmt.Errorf("error generating data key: system entropy too low")
+	}
+	return bs, nil
+}
+
+// readDataKeyFile returns the secrets in file path, skipping empty lines and
+// lines starting with #.
+func readDataKeyFile(path string) ([][]byte, error) {
+	bs, e := ioutil.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+	secrets := [][]byte(nil)
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	for l := 1; scanner.Scan(); l++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		secret, e := base64.StdEncoding.DecodeString(line)
+		if e != nil {
+			return nil, fmt.Errorf("%s:%d: data key must be base64-encoded", path, l)
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, scanner.Err()
+}
+
+// writeDataKeyFile replaces file path atomically, so that a crash doesn't
+// lose keys still needed to decrypt records.
+func writeDataKeyFile(path string, secrets [][]byte) error {
+	b := bytes.Buffer{}
+	for _, secret := range secrets {
+		b.WriteString(base64.StdEncoding.EncodeToString(secret))
+		b.WriteByte('\n')
+	}
+	tmp, e := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if e != nil {
+		return e
+	}
+	defer os.Remove(tmp.Name()) // fails after the rename
+	if e := tmp.Chmod(0600); e != nil {
+		tmp.Close()
+		return e
+	}
+	if _, e := tmp.Write(b.Bytes()); e != nil {
+		tmp.Close()
+		return e
+	}
+	if e := tmp.Sync(); e != nil {
+		tmp.Close()
+		return e
+	}
+	if e := tmp.Close(); e != nil {
+		return e
+	}
+	return os.Rename(tmp.Name(), path)
+}
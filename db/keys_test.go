@@ -0,0 +1,129 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package db
+
+import (
+	"io/ioutil"
+	"karma.run/codec/karma.v2"
+	"karma.run/config"
+	"karma.run/kvm/mdl"
+	"karma.run/kvm/val"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func withDataKeyFile(t *testing.T, f func(path string)) {
+
+	dir, e := ioutil.TempDir("", "karma-keys")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(file string, init bool) {
+		config.DataKeyFile, config.InitDataKeyFile = file, init
+	}(config.DataKeyFile, config.InitDataKeyFile)
+	defer karma.SetKeys(nil)
+
+	f(filepath.Join(dir, "keys"))
+}
+
+func TestLoadDataKeys(t *testing.T) {
+	withDataKeyFile(t, func(path string) {
+
+		config.DataKeyFile, config.InitDataKeyFile = path, false
+		if e := LoadDataKeys(); e == nil {
+			t.Fatal("expected a missing data key file to be an error")
+		}
+		if _, e := os.Stat(path); !os.IsNotExist(e) {
+			t.Fatal("expected a missing data key file not to be created")
+		}
+
+		config.InitDataKeyFile = true
+		if e := LoadDataKeys(); e != nil {
+			t.Fatal(e)
+		}
+		fi, e := os.Stat(path)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("expected data key file mode 0600, have %o", fi.Mode().Perm())
+		}
+		first := karma.CurrentKey()
+		if first == nil || len(karma.Keys()) != 1 {
+			t.Fatal("expected one data key to be loaded")
+		}
+
+		karma.SetKeys(nil)
+		if e := LoadDataKeys(); e != nil {
+			t.Fatal(e)
+		}
+		if k := karma.CurrentKey(); k == nil || k.ID != first.ID {
+			t.Error("expected the created data key to be loaded again")
+		}
+	})
+}
+
+func TestRotateDataKey(t *testing.T) {
+	withDataKeyFile(t, func(path string) {
+
+		config.DataKeyFile, config.InitDataKeyFile = path, true
+		if e := LoadDataKeys(); e != nil {
+			t.Fatal(e)
+		}
+		old := karma.CurrentKey()
+		bs := karma.EncodeWith(val.String("secret"), mdl.String{}, karma.Options{Key: old})
+
+		if e := RotateDataKey(); e != nil {
+			t.Fatal(e)
+		}
+		current := karma.CurrentKey()
+		if current == nil || current.ID == old.ID || len(karma.Keys()) != 2 || !karma.HasKey(old.ID) {
+			t.Fatal("expected a new current data key, keeping the old one")
+		}
+		if v, _ := karma.Decode(bs, mdl.String{}); v != val.String("secret") {
+			t.Errorf("expected the old record to stay readable, have %v", v)
+		}
+
+		karma.SetKeys(nil)
+		if e := LoadDataKeys(); e != nil {
+			t.Fatal(e)
+		}
+		if keys := karma.Keys(); len(keys) != 2 || keys[0].ID != current.ID || keys[1].ID != old.ID {
+			t.Error("expected the rotated data key file to hold the new key first")
+		}
+	})
+}
+
+func TestReadDataKeyFile(t *testing.T) {
+	withDataKeyFile(t, func(path string) {
+
+		secret := "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=" // 32 bytes
+		if e := ioutil.WriteFile(path, []byte("# comment\n\n  "+secret+"  \n"), 0600); e != nil {
+			t.Fatal(e)
+		}
+		config.DataKeyFile = path
+		if e := LoadDataKeys(); e != nil {
+			t.Fatal(e)
+		}
+		if len(karma.Keys()) != 1 {
+			t.Errorf("expected one data key, have %d", len(karma.Keys()))
+		}
+
+		if e := ioutil.WriteFile(path, []byte("not base64\n"), 0600); e != nil {
+			t.Fatal(e)
+		}
+		if e := LoadDataKeys(); e == nil {
+			t.Error("expected a malformed data key file to be an error")
+		}
+
+		if e := ioutil.WriteFile(path, []byte("# no keys\n"), 0600); e != nil {
+			t.Fatal(e)
+		}
+		if e := LoadDataKeys(); e == nil {
+			t.Error("expected an empty data key file to be an error")
+		}
+	})
+}
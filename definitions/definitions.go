@@ -19,6 +19,10 @@ const (
 	ExpressionModel = `ExpressionModel`
 	UserModel       = `UserModel`
 	RoleModel       = `RoleModel`
+	QueryModel      = `QueryModel`
+	QueryBucket     = `QueryBucket`
+	BlobBucket      = `BlobBucket`
+	BlindBucket     = `BlindBucket` // blind indexes of encrypted values
 	RootUser        = `RootUser`
 )
 
@@ -35,6 +39,10 @@ var (
 	ExpressionModelBytes = []byte(ExpressionModel)
 	UserModelBytes       = []byte(UserModel)
 	RoleModelBytes       = []byte(RoleModel)
+	QueryModelBytes      = []byte(QueryModel)
+	QueryBucketBytes     = []byte(QueryBucket)
+	BlobBucketBytes      = []byte(BlobBucket)
+	BlindBucketBytes     = []byte(BlindBucket)
 	RootUserBytes        = []byte(RootUser)
 )
 
@@ -67,6 +75,10 @@ func NewMetaModelValue(metaId string) val.Value {
 			"enum":     val.Union{"set", val.Union{"string", val.Struct{}}},
 			"bool":     val.Union{"struct", val.Map{}},
 			"dateTime": val.Union{"struct", val.Map{}},
+			"duration": val.Union{"struct", val.Map{}},
+			"decimal":  val.Union{"struct", val.Map{}},
+			"bytes":    val.Union{"struct", val.Map{}},
+			"blob":     val.Union{"struct", val.Map{}},
 			"float":    val.Union{"struct", val.Map{}},
 			"string":   val.Union{"struct", val.Map{}},
 			"int8":     val.Union{"struct", val.Map{}},
@@ -109,6 +121,15 @@ func NewRoleModelValue(metaId, exprId string) val.Value {
 	})}
 }
 
+// roles == null means any user may run the query
+func NewQueryModelValue(metaId, exprId, roleId string) val.Value {
+	return val.Union{"struct", val.MapFromMap(map[string]val.Value{
+		"tag":        val.Union{"unique", val.Union{"string", val.Struct{}}},
+		"expression": val.Union{"ref", val.Ref{metaId, exprId}},
+		"roles":      val.Union{"optional", val.Union{"list", val.Union{"ref", val.Ref{metaId, roleId}}}},
+	})}
+}
+
 func NewMigrationModelValue(metaId, exprId string) val.Value {
 	return val.Union{"list", val.Union{"struct", val.MapFromMap(map[string]val.Value{
 		"source": val.Union{"ref", val.Ref{metaId, metaId}},
@@ -0,0 +1,166 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"fmt"
+	"karma.run/kvm/err"
+	"karma.run/kvm/val"
+	"log"
+)
+
+// iteratorOf adapts lists and iterator values on the stack to iterator
+func iteratorOf(v val.Value) iterator {
+	switch v := unMeta(v).(type) {
+	case val.List:
+		return newListIterator(v)
+	case iteratorValue:
+		return v.iterator
+	}
+	log.Panicf("iteratorOf: unexpected type: %T", v)
+	return nil
+}
+
+// sumValues adds all numbers yielded by it, starting at zero.
+// integer sums wrap around on overflow, just like addInt64 & co.
+func sumValues(it iterator, zero val.Value) (val.Value, err.Error) {
+	sum := zero
+	e := it.forEach(func(v val.Value) err.Error {
+		sum = addNumbers(sum, unMeta(v))
+		return nil
+	})
+	return sum, e
+}
+
+func avgValues(it iterator) (val.Value, err.Error) {
+	sum, n := float64(0), 0
+	e := it.forEach(func(v val.Value) err.Error {
+		sum += numberToFloat(unMeta(v))
+		n++
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+	if n == 0 {
+		return nil, err.ExecutionError{
+			Problem: `avg: empty list`,
+		}
+	}
+	return val.Float(sum / float64(n)), nil
+}
+
+// extremeValue returns the smallest number yielded by it if max is false, the largest otherwise
+func extremeValue(it iterator, max bool) (val.Value, err.Error) {
+	out := val.Value(nil)
+	e := it.forEach(func(v val.Value) err.Error {
+		v = unMeta(v)
+		if out == nil || (!max && lessNumbers(v, out)) || (max && lessNumbers(out, v)) {
+			out = v
+		}
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+	if out == nil {
+		name := "min"
+		if max {
+			name = "max"
+		}
+		return nil, err.ExecutionError{
+			Problem: fmt.Sprintf(`%s: empty list`, name),
+		}
+	}
+	return out, nil
+}
+
+func countDistinctValues(it iterator) (val.Value, err.Error) {
+	seen := make(map[uint64]struct{}, 64)
+	e := it.forEach(func(v val.Value) err.Error {
+		seen[val.Hash(unMeta(v), nil).Sum64()] = struct{}{}
+		return nil
+	})
+	return val.Int64(len(seen)), e
+}
+
+func addNumbers(a, b val.Value) val.Value {
+	switch a := a.(type) {
+	case val.Float:
+		return a + b.(val.Float)
+	case val.Int8:
+		return a + b.(val.Int8)
+	case val.Int16:
+		return a + b.(val.Int16)
+	case val.Int32:
+		return a + b.(val.Int32)
+	case val.Int64:
+		return a + b.(val.Int64)
+	case val.Uint8:
+		return a + b.(val.Uint8)
+	case val.Uint16:
+		return a + b.(val.Uint16)
+	case val.Uint32:
+		return a + b.(val.Uint32)
+	case val.Uint64:
+		return a + b.(val.Uint64)
+	case val.Decimal:
+		return a.Add(b.(val.Decimal))
+	}
+	log.Panicf("addNumbers: unexpected type: %T", a)
+	return nil
+}
+
+func lessNumbers(a, b val.Value) bool {
+	switch a := a.(type) {
+	case val.Float:
+		return a < b.(val.Float)
+	case val.Int8:
+		return a < b.(val.Int8)
+	case val.Int16:
+		return a < b.(val.Int16)
+	case val.Int32:
+		return a < b.(val.Int32)
+	case val.Int64:
+		return a < b.(val.Int64)
+	case val.Uint8:
+		return a < b.(val.Uint8)
+	case val.Uint16:
+		return a < b.(val.Uint16)
+	case val.Uint32:
+		return a < b.(val.Uint32)
+	case val.Uint64:
+		return a < b.(val.Uint64)
+	case val.Decimal:
+		return a.Cmp(b.(val.Decimal)) < 0
+	}
+	log.Panicf("lessNumbers: unexpected type: %T", a)
+	return false
+}
+
+func numberToFloat(v val.Value) float64 {
+	switch v := v.(type) {
+	case val.Float:
+		return float64(v)
+	case val.Int8:
+		return float64(v)
+	case val.Int16:
+		return float64(v)
+	case val.Int32:
+		return float64(v)
+	case val.Int64:
+		return float64(v)
+	case val.Uint8:
+		return float64(v)
+	case val.Uint16:
+		return float64(v)
+	case val.Uint32:
+		return float64(v)
+	case val.Uint64:
+		return float64(v)
+	case val.Decimal:
+		return v.Float()
+	}
+	log.Panicf("numberToFloat: unexpected type: %T", v)
+	return 0
+}
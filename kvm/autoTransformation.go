@@ -45,6 +45,11 @@ func _findAutoTransformation(source, target mdl.Model) (xpr.Expression, err.Path
 		}
 	}
 
+	// numbers convert to decimals exactly, floats to their shortest representation (NaN and infinities fail)
+	if _, ok := target.(mdl.Decimal); ok && isNumericModel(source) {
+		return xpr.ToDecimal{xpr.Scope("source")}, nil
+	}
+
 	switch source := source.(type) {
 
 	case mdl.Optional:
@@ -325,6 +330,21 @@ func _findAutoTransformation(source, target mdl.Model) (xpr.Expression, err.Path
 		// TODO: numeric conversion functions
 		return nil, NewAutoTransformationError(`source is dateTime but target is not`, source, target)
 
+	case mdl.Duration:
+		return nil, NewAutoTransformationError(`source is duration but target is not`, source, target)
+
+	case mdl.Decimal:
+		if _, ok := target.(mdl.Float); ok {
+			return xpr.ToFloat{xpr.Scope("source")}, nil
+		}
+		return nil, NewAutoTransformationError(`source is decimal but target is neither decimal nor float`, source, target)
+
+	case mdl.Bytes:
+		return nil, NewAutoTransformationError(`source is bytes but target is not`, source, target)
+
+	case mdl.Blob:
+		return nil, NewAutoTransformationError(`source is blob but target is not`, source, target)
+
 	case mdl.Bool:
 		// TODO: numeric conversion functions
 		return nil, NewAutoTransformationError(`source is bool but target is not`, source, target)
@@ -0,0 +1,82 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"karma.run/kvm/err"
+	"karma.run/kvm/mdl"
+	"karma.run/kvm/val"
+)
+
+// blobUploadRoles are the names of the roles whose users may upload blobs,
+// see LoadBlobUploadRoles.
+var blobUploadRoles = map[string]struct{}{}
+
+// LoadBlobUploadRoles parses a comma-separated list of role names like
+// "editor,uploader" whose users may upload blobs.
+func LoadBlobUploadRoles(s string) {
+	blobUploadRoles = parseRoleNames(s)
+}
+
+// MayUploadBlobs reports whether vm's user may upload blobs, which the root
+// user always may.
+func (vm *VirtualMachine) MayUploadBlobs() (bool, err.Error) {
+	if vm.UserID == vm.RootUserId() {
+		return true, nil
+	}
+	return vm.hasRoleIn(blobUploadRoles)
+}
+
+// hasBlobs reports whether values of m may contain blobs.
+func hasBlobs(m mdl.Model) bool {
+	found := false
+	m.Traverse(nil, func(_ []string, m mdl.Model) {
+		if _, ok := m.(mdl.Blob); ok {
+			found = true
+		}
+	})
+	return found
+}
+
+// ReferencedBlobs returns the ids of the blobs referenced by any object,
+// encrypted values included. It reads every object of models with blobs.
+func (vm VirtualMachine) ReferencedBlobs() (map[string]struct{}, err.Error) {
+
+	mids := []string(nil)
+	meta := vm.MetaModelId()
+	e := vm.RootBucket.Bucket([]byte(meta)).ForEach(func(k, _ []byte) error {
+		mids = append(mids, string(k))
+		return nil
+	})
+	if e != nil {
+		return nil, err.InternalError{Problem: e.Error()}
+	}
+
+	blobs := map[string]struct{}{}
+	for _, mid := range mids {
+		if mid == meta {
+			continue
+		}
+		m, e := vm.Model(mid)
+		if e != nil {
+			return nil, e
+		}
+		if !hasBlobs(m.Model) || vm.RootBucket.Bucket([]byte(mid)) == nil {
+			continue
+		}
+		e = vm.plaintext().newBucketDecodingIterator(m).forEach(func(v val.Value) err.Error {
+			v.(val.Meta).Value.Transform(func(v val.Value) val.Value {
+				if b, ok := v.(val.Blob); ok {
+					blobs[string(b)] = struct{}{}
+				}
+				return v
+			})
+			return nil
+		})
+		if e != nil {
+			return nil, e
+		}
+	}
+
+	return blobs, nil
+}
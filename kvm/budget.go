@@ -0,0 +1,290 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"context"
+	"encoding/json"
+	"karma.run/config"
+	"karma.run/kvm/err"
+	"karma.run/kvm/val"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Limits bound the resources a single request may use. Zero means unlimited.
+type Limits struct {
+	Instructions    int64         // executed instructions
+	Time            time.Duration // wall-clock time
+	AllocationBytes int64         // approximate bytes allocated for values
+}
+
+// GlobalLimits are the limits of roles which have none configured.
+func GlobalLimits() Limits {
+	return Limits{
+		Instructions:    int64(config.MaxInstructions),
+		Time:            config.MaxExecutionTime,
+		AllocationBytes: int64(config.MaxAllocationBytes),
+	}
+}
+
+// roleLimits maps role names to their limits, see LoadRoleLimits.
+var roleLimits = map[string]Limits{}
+
+// LoadRoleLimits parses per-role limits from JSON like
+// {"editor": {"instructions": 1000000, "time": "10s", "allocationBytes": 100000000}}
+// absent fields fall back to the global limits.
+func LoadRoleLimits(s string) error {
+	if s == "" {
+		roleLimits = map[string]Limits{}
+		return nil
+	}
+	parsed := map[string]struct {
+		Instructions    *int64  `json:"instructions"`
+		Time            *string `json:"time"`
+		AllocationBytes *int64  `json:"allocationBytes"`
+	}{}
+	if e := json.Unmarshal([]byte(s), &parsed); e != nil {
+		return e
+	}
+	limits := make(map[string]Limits, len(parsed))
+	for role, p := range parsed {
+		l := GlobalLimits()
+		if p.Instructions != nil {
+			l.Instructions = *p.Instructions
+		}
+		if p.Time != nil {
+			d, e := time.ParseDuration(*p.Time)
+			if e != nil {
+				return e
+			}
+			l.Time = d
+		}
+		if p.AllocationBytes != nil {
+			l.AllocationBytes = *p.AllocationBytes
+		}
+		limits[role] = l
+	}
+	roleLimits = limits
+	return nil
+}
+
+// roleNames returns the names of the roles of vm's user. Like
+// checkQueryRoles, it reads the user and roles without checking permissions,
+// as they decide what the user may do, not what it may read.
+func (vm *VirtualMachine) roleNames() ([]string, err.Error) {
+	user, e := vm.get(vm.UserModelId(), vm.UserID)
+	if e != nil {
+		return nil, e
+	}
+	roles := user.Value.(val.Struct).Field("roles").(val.List)
+	names := make([]string, len(roles))
+	for i, ref := range roles {
+		role, e := vm.get(vm.RoleModelId(), ref.(val.Ref)[1])
+		if e != nil {
+			return nil, e
+		}
+		names[i] = string(role.Value.(val.Struct).Field("name").(val.String))
+	}
+	return names, nil
+}
+
+// parseRoleNames parses a comma-separated list of role names like
+// "admin,support".
+func parseRoleNames(s string) map[string]struct{} {
+	roles := map[string]struct{}{}
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			roles[name] = struct{}{}
+		}
+	}
+	return roles
+}
+
+// hasRoleIn reports whether vm's user has one of roles.
+func (vm *VirtualMachine) hasRoleIn(roles map[string]struct{}) (bool, err.Error) {
+	if len(roles) == 0 {
+		return false, nil
+	}
+	names, e := vm.roleNames()
+	if e != nil {
+		return false, e
+	}
+	for _, name := range names {
+		if _, ok := roles[name]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// most generous of two limits, zero being unlimited
+func looserLimit(a, b int64) int64 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// approximate size of a value slot in a composite value
+const valueBytes = 16
+
+// approximateBytes estimates the memory held by v.
+func approximateBytes(v val.Value) int64 {
+	switch v := v.(type) {
+	case val.Meta:
+		return 4*valueBytes + approximateBytes(v.Value)
+	case val.Union:
+		return valueBytes + int64(len(v.Case)) + approximateBytes(v.Value)
+	case val.Tuple:
+		n := int64(0)
+		for _, w := range v {
+			n += approximateBytes(w)
+		}
+		return n
+	case val.List:
+		n := int64(0)
+		for _, w := range v {
+			n += approximateBytes(w)
+		}
+		return n
+	case val.Set:
+		n := int64(0)
+		for _, w := range v {
+			n += valueBytes + approximateBytes(w)
+		}
+		return n
+	case val.Struct:
+		n := int64(0)
+		v.ForEach(func(k string, w val.Value) bool {
+			n += valueBytes + int64(len(k)) + approximateBytes(w)
+			return true
+		})
+		return n
+	case val.Map:
+		n := int64(0)
+		v.ForEach(func(k string, w val.Value) bool {
+			n += valueBytes + int64(len(k)) + approximateBytes(w)
+			return true
+		})
+		return n
+	case val.String:
+		return valueBytes + int64(len(v))
+	case val.Symbol:
+		return valueBytes + int64(len(v))
+	case val.Blob:
+		return valueBytes + int64(len(v))
+	case val.Bytes:
+		return valueBytes + int64(len(v))
+	case val.Ref:
+		return valueBytes + int64(len(v[0])+len(v[1]))
+	}
+	return valueBytes
+}
+
+// how many instructions to run between looking at the context
+const budgetContextInterval = 256
+
+// Budget tracks the resources spent by a VirtualMachine against its Limits.
+// It is shared by the goroutines of parallel evaluation.
+type Budget struct {
+	Limits
+	ctx          context.Context
+	instructions int64
+	allocated    int64
+}
+
+func NewBudget(ctx context.Context, limits Limits) *Budget {
+	return &Budget{Limits: limits, ctx: ctx}
+}
+
+func (b *Budget) step() err.Error {
+	n := atomic.AddInt64(&b.instructions, 1)
+	if b.Instructions > 0 && n > b.Instructions {
+		return err.BudgetExceededError{Limit: "instructions"}
+	}
+	if n%budgetContextInterval == 0 {
+		return b.checkContext()
+	}
+	return nil
+}
+
+func (b *Budget) allocate(bytes int64) err.Error {
+	n := atomic.AddInt64(&b.allocated, bytes)
+	if b.AllocationBytes > 0 && n > b.AllocationBytes {
+		return err.BudgetExceededError{Limit: "allocationBytes"}
+	}
+	return b.checkContext()
+}
+
+func (b *Budget) checkContext() err.Error {
+	if b.ctx == nil {
+		return nil
+	}
+	select {
+	case <-b.ctx.Done():
+		if b.ctx.Err() == context.DeadlineExceeded {
+			return err.BudgetExceededError{Limit: "time"}
+		}
+		return err.RequestError{Problem: `request canceled`}
+	default:
+		return nil
+	}
+}
+
+// allocate charges bytes against vm's budget, if any.
+func (vm VirtualMachine) allocate(bytes int64) err.Error {
+	if vm.Budget == nil {
+		return nil
+	}
+	return vm.Budget.allocate(bytes)
+}
+
+// Limit sets vm's budget to the limits of its user's roles, the most generous
+// one winning if there are several. Roles without configured limits have the
+// global ones. Execution also stops when ctx is done. The returned function
+// must be called to release the resources of the budget's context.
+func (vm *VirtualMachine) Limit(ctx context.Context) (context.CancelFunc, err.Error) {
+	limits, e := vm.userLimits()
+	if e != nil {
+		return nil, e
+	}
+	cancel := context.CancelFunc(func() {})
+	if limits.Time > 0 {
+		ctx, cancel = context.WithTimeout(ctx, limits.Time)
+	}
+	vm.Budget = NewBudget(ctx, limits)
+	return cancel, nil
+}
+
+func (vm *VirtualMachine) userLimits() (Limits, err.Error) {
+	if vm.UserID == "" || len(roleLimits) == 0 {
+		return GlobalLimits(), nil
+	}
+	roles, e := vm.roleNames()
+	if e != nil {
+		return Limits{}, e
+	}
+	if len(roles) == 0 {
+		return GlobalLimits(), nil
+	}
+	limits := Limits{}
+	for i, name := range roles {
+		l, ok := roleLimits[name]
+		if !ok {
+			l = GlobalLimits()
+		}
+		if i == 0 {
+			limits = l
+			continue
+		}
+		limits.Instructions = looserLimit(limits.Instructions, l.Instructions)
+		limits.Time = time.Duration(looserLimit(int64(limits.Time), int64(l.Time)))
+		limits.AllocationBytes = looserLimit(limits.AllocationBytes, l.AllocationBytes)
+	}
+	return limits, nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"karma.run/codec/json"
+	"karma.run/kvm/err"
+	"karma.run/kvm/val"
+	"karma.run/kvm/xpr"
+	"testing"
+)
+
+func TestCallDeletedFunction(t *testing.T) {
+
+	withTestVirtualMachine(t, func(vm *VirtualMachine) {
+
+		fv, e := json.Decode(json.JSON(`{"function":[["x"],[{"scope":"x"}]]}`), xpr.LanguageModel, nil)
+		if e != nil {
+			t.Fatal(e)
+		}
+		mid, id := vm.ExpressionModelId(), "deletedfunction0" // ids are 16 bytes
+		if ke := vm.Write(mid, map[string]val.Meta{id: vm.WrapValueInMeta(fv, id, mid)}); ke != nil {
+			t.Fatal(ke.String())
+		}
+
+		call := xpr.NewFunction(nil, xpr.Call{
+			Function:  xpr.Literal{val.Ref{mid, id}},
+			Arguments: []xpr.Expression{xpr.Literal{val.Int64(1)}},
+		})
+		typed, ke := vm.TypeFunction(call, nil, AnyModel)
+		if ke != nil {
+			t.Fatal(ke.String())
+		}
+
+		if ke := vm.Delete(mid, id); ke != nil {
+			t.Fatal(ke.String())
+		}
+
+		if _, ke := vm.compile(typed); ke == nil {
+			t.Error("expected an error compiling a call of a deleted function")
+		} else if _, ok := ke.(err.ObjectNotFoundError); !ok {
+			t.Errorf("expected an object not found error, got %s", ke.String())
+		}
+	})
+}
@@ -4,6 +4,7 @@ package kvm
 
 import (
 	"fmt"
+	"karma.run/kvm/err"
 	"karma.run/kvm/inst"
 	"karma.run/kvm/mdl"
 	"karma.run/kvm/val"
@@ -11,6 +12,27 @@ import (
 	"regexp"
 )
 
+// compilationFailure is panicked by CompileExpression if a program typed fine can't
+// be compiled after all, e.g. as a function it calls was deleted in between.
+type compilationFailure struct {
+	err.Error
+}
+
+// compile is CompileFunction returning the error of programs that can't be compiled after all.
+func (vm VirtualMachine) compile(f xpr.TypedFunction) (is inst.Sequence, e err.Error) {
+	defer func() {
+		if r := recover(); r != nil {
+			failure, ok := r.(compilationFailure)
+			if !ok {
+				panic(r)
+			}
+			is, e = nil, failure.Error
+		}
+	}()
+	return vm.CompileFunction(f), nil
+}
+
+// CompileFunction panics if f can't be compiled, see compile.
 func (vm VirtualMachine) CompileFunction(f xpr.TypedFunction) inst.Sequence {
 
 	expressions := f.Expressions()
@@ -423,6 +445,170 @@ func (vm VirtualMachine) CompileExpression(typed xpr.TypedExpression, prev inst.
 		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
 		return append(prev, inst.All{})
 
+	case xpr.StringToUpper:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.StringToUpper{})
+
+	case xpr.TrimString:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.TrimString{})
+
+	case xpr.ParseInt64:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.ParseInt64{})
+
+	case xpr.ParseFloat:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.ParseFloat{})
+
+	case xpr.Substring:
+		prev = vm.CompileExpression(node.String.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Offset.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Length.(xpr.TypedExpression), prev)
+		return append(prev, inst.Substring{})
+
+	case xpr.StringReplace:
+		prev = vm.CompileExpression(node.String.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Search.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Replacement.(xpr.TypedExpression), prev)
+		return append(prev, inst.StringReplace{})
+
+	case xpr.SplitString:
+		prev = vm.CompileExpression(node.String.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Separator.(xpr.TypedExpression), prev)
+		return append(prev, inst.SplitString{})
+
+	case xpr.PadString:
+		prev = vm.CompileExpression(node.String.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Width.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Padding.(xpr.TypedExpression), prev)
+		return append(prev, inst.PadString{node.Left})
+
+	case xpr.RepeatString:
+		prev = vm.CompileExpression(node.String.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Count.(xpr.TypedExpression), prev)
+		return append(prev, inst.RepeatString{})
+
+	case xpr.StringStartsWith:
+		prev = vm.CompileExpression(node.String.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Prefix.(xpr.TypedExpression), prev)
+		return append(prev, inst.StringStartsWith{})
+
+	case xpr.StringEndsWith:
+		prev = vm.CompileExpression(node.String.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Suffix.(xpr.TypedExpression), prev)
+		return append(prev, inst.StringEndsWith{})
+
+	case xpr.ReplaceRegex:
+		regex := node.Regex
+		if node.MultiLine {
+			regex = `(?m)` + regex
+		}
+		if node.CaseInsensitive {
+			regex = `(?i)` + regex
+		}
+		r := regexp.MustCompile(regex) // compilation previously checked
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Replacement.(xpr.TypedExpression), prev)
+		return append(prev, inst.ReplaceRegex{r})
+
+	case xpr.NormalizeString:
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		return append(prev, inst.NormalizeString{normalizationForms[node.Form]})
+
+	case xpr.IntegerOperation:
+		prev = vm.CompileExpression(node.Left.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Right.(xpr.TypedExpression), prev)
+		return append(prev, inst.IntegerOperation{node.Op, node.Type, node.Checked})
+
+	case xpr.AbsInteger:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.AbsInteger{node.Type, node.Checked})
+
+	case xpr.ToIntegerChecked:
+		prev = vm.CompileExpression(node.Expression.(xpr.TypedExpression), prev)
+		return append(prev, inst.ToIntegerChecked{node.Type})
+
+	case xpr.ToDecimal:
+		prev = vm.CompileExpression(node.Expression.(xpr.TypedExpression), prev)
+		return append(prev, inst.ToDecimal{})
+
+	case xpr.AddDecimal:
+		prev = vm.CompileExpression(node[0].(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node[1].(xpr.TypedExpression), prev)
+		return append(prev, inst.AddDecimal{})
+
+	case xpr.SubDecimal:
+		prev = vm.CompileExpression(node[0].(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node[1].(xpr.TypedExpression), prev)
+		return append(prev, inst.SubDecimal{})
+
+	case xpr.MulDecimal:
+		prev = vm.CompileExpression(node[0].(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node[1].(xpr.TypedExpression), prev)
+		return append(prev, inst.MulDecimal{})
+
+	case xpr.DivDecimal:
+		prev = vm.CompileExpression(node[0].(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node[1].(xpr.TypedExpression), prev)
+		return append(prev, inst.DivideDecimal{})
+
+	case xpr.GtDecimal:
+		prev = vm.CompileExpression(node[0].(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node[1].(xpr.TypedExpression), prev)
+		return append(prev, inst.GreaterDecimal{})
+
+	case xpr.LtDecimal:
+		prev = vm.CompileExpression(node[0].(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node[1].(xpr.TypedExpression), prev)
+		return append(prev, inst.LessDecimal{})
+
+	case xpr.RoundDecimal:
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Scale.(xpr.TypedExpression), prev)
+		return append(prev, inst.RoundDecimal{val.RoundingMode(node.Mode)})
+
+	case xpr.ParseDuration:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.ParseDuration{})
+
+	case xpr.AddDuration:
+		prev = vm.CompileExpression(node.DateTime.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Duration.(xpr.TypedExpression), prev)
+		return append(prev, inst.AddDuration{})
+
+	case xpr.SubDuration:
+		prev = vm.CompileExpression(node.DateTime.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Duration.(xpr.TypedExpression), prev)
+		return append(prev, inst.SubDuration{})
+
+	case xpr.DateTimeDiff:
+		prev = vm.CompileExpression(node[0].(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node[1].(xpr.TypedExpression), prev)
+		return append(prev, inst.DateTimeDiff{})
+
+	case xpr.TruncateDateTime:
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Zone.(xpr.TypedExpression), prev)
+		return append(prev, inst.TruncateDateTime{node.Unit})
+
+	case xpr.ExtractDateTime:
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Zone.(xpr.TypedExpression), prev)
+		return append(prev, inst.ExtractDateTime{node.Component})
+
+	case xpr.FormatDateTime:
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Layout.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Zone.(xpr.TypedExpression), prev)
+		return append(prev, inst.FormatDateTime{})
+
+	case xpr.ParseDateTime:
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Layout.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Zone.(xpr.TypedExpression), prev)
+		return append(prev, inst.ParseDateTime{})
+
 	case xpr.StringToLower:
 		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
 		return append(prev, inst.StringToLower{})
@@ -479,12 +665,43 @@ func (vm VirtualMachine) CompileExpression(typed xpr.TypedExpression, prev inst.
 			Else: vm.CompileExpression(node.Else.(xpr.TypedExpression), nil),
 		})
 
+	case xpr.Try:
+		var errors map[string]struct{}
+		if len(node.Errors) > 0 {
+			errors = make(map[string]struct{}, len(node.Errors))
+			for _, k := range node.Errors {
+				errors[k] = struct{}{}
+			}
+		}
+		return append(prev, inst.Try{
+			Value:  vm.CompileExpression(node.Value.(xpr.TypedExpression), nil),
+			Catch:  vm.CompileFunction(node.Catch.(xpr.TypedFunction)),
+			Errors: errors,
+		})
+
+	case xpr.OrElse:
+		return append(prev, inst.OrElse{
+			Value:   vm.CompileExpression(node[0].(xpr.TypedExpression), nil),
+			Default: vm.CompileExpression(node[1].(xpr.TypedExpression), nil),
+		})
+
 	case xpr.With:
 		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
 		return append(prev, inst.With{
 			vm.CompileFunction(node.Return.(xpr.TypedFunction)),
 		})
 
+	case xpr.Call:
+		id := node.Function.(xpr.TypedExpression).Actual.(ConstantModel).Value.(val.Ref)[1]
+		entry, e := vm.callable(id, nil)
+		if e != nil {
+			panic(compilationFailure{e}) // typed fine above, so the function must have vanished in between
+		}
+		for _, arg := range node.Arguments {
+			prev = vm.CompileExpression(arg.(xpr.TypedExpression), prev)
+		}
+		return append(prev, inst.Call{len(node.Arguments), entry.program})
+
 	case xpr.Update:
 		prev = vm.CompileExpression(node.Ref.(xpr.TypedExpression), prev)
 		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
@@ -513,6 +730,118 @@ func (vm VirtualMachine) CompileExpression(typed xpr.TypedExpression, prev inst.
 		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
 		return append(prev, inst.AssertCase{node.Case})
 
+	case xpr.AnyList:
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		return append(prev, inst.AnyList{
+			vm.CompileFunction(node.Predicate.(xpr.TypedFunction)),
+		})
+
+	case xpr.EveryList:
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		return append(prev, inst.EveryList{
+			vm.CompileFunction(node.Predicate.(xpr.TypedFunction)),
+		})
+
+	case xpr.TakeWhileList:
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		return append(prev, inst.TakeWhileList{
+			vm.CompileFunction(node.Predicate.(xpr.TypedFunction)),
+		})
+
+	case xpr.ZipLists:
+		prev = vm.CompileExpression(node[0].(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node[1].(xpr.TypedExpression), prev)
+		return append(prev, inst.ZipLists{})
+
+	case xpr.ChunkList:
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Size.(xpr.TypedExpression), prev)
+		return append(prev, inst.ChunkList{})
+
+	case xpr.DistinctList:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.DistinctList{})
+
+	case xpr.FlattenList:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.FlattenList{})
+
+	case xpr.IndexOf:
+		prev = vm.CompileExpression(node.In.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		return append(prev, inst.IndexOf{})
+
+	case xpr.Range:
+		prev = vm.CompileExpression(node.From.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.To.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Step.(xpr.TypedExpression), prev)
+		return append(prev, inst.Range{})
+
+	case xpr.InSet:
+		prev = vm.CompileExpression(node.In.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		return append(prev, inst.InSet{})
+
+	case xpr.SetUnion:
+		prev = vm.CompileExpression(node[0].(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node[1].(xpr.TypedExpression), prev)
+		return append(prev, inst.SetUnion{})
+
+	case xpr.SetIntersection:
+		prev = vm.CompileExpression(node[0].(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node[1].(xpr.TypedExpression), prev)
+		return append(prev, inst.SetIntersection{})
+
+	case xpr.SetDifference:
+		prev = vm.CompileExpression(node[0].(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node[1].(xpr.TypedExpression), prev)
+		return append(prev, inst.SetDifference{})
+
+	case xpr.IsSubset:
+		prev = vm.CompileExpression(node[0].(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node[1].(xpr.TypedExpression), prev)
+		return append(prev, inst.IsSubset{})
+
+	case xpr.ListToSet:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.ListToSet{})
+
+	case xpr.SetToList:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.SetToList{})
+
+	case xpr.MapKeys:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.MapKeys{})
+
+	case xpr.MapValues:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.MapValues{})
+
+	case xpr.MapEntries:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.MapEntries{})
+
+	case xpr.MergeMaps:
+		prev = vm.CompileExpression(node.Left.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Right.(xpr.TypedExpression), prev)
+		merge := inst.MergeMaps{}
+		if node.Conflict != nil {
+			merge.Conflict = vm.CompileFunction(node.Conflict.(xpr.TypedFunction))
+		}
+		return append(prev, merge)
+
+	case xpr.FilterMap:
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		return append(prev, inst.FilterMap{
+			vm.CompileFunction(node.Filter.(xpr.TypedFunction)),
+		})
+
+	case xpr.RemoveKey:
+		prev = vm.CompileExpression(node.In.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Name.(xpr.TypedExpression), prev)
+		return append(prev, inst.RemoveKey{})
+
 	case xpr.IsCase:
 		prev = vm.CompileExpression(node.Case.(xpr.TypedExpression), prev)
 		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
@@ -805,6 +1134,89 @@ func (vm VirtualMachine) CompileExpression(typed xpr.TypedExpression, prev inst.
 			vm.CompileFunction(node.Order.(xpr.TypedFunction)),
 		})
 
+	case xpr.TopN:
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.N.(xpr.TypedExpression), prev)
+		return append(prev, inst.TopN{
+			vm.CompileFunction(node.Key.(xpr.TypedFunction)),
+		})
+
+	case xpr.GroupBy:
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		return append(prev, inst.GroupBy{
+			vm.CompileFunction(node.Key.(xpr.TypedFunction)),
+		})
+
+	case xpr.Sum:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.Sum{typed.Actual.Zero()})
+
+	case xpr.Avg:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.Avg{})
+
+	case xpr.Min:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.Min{})
+
+	case xpr.Max:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.Max{})
+
+	case xpr.CountDistinct:
+		prev = vm.CompileExpression(node.Argument.(xpr.TypedExpression), prev)
+		return append(prev, inst.CountDistinct{})
+
+	case xpr.HashJoin:
+		prev = vm.CompileExpression(node.Left.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Right.(xpr.TypedExpression), prev)
+		return append(prev, inst.HashJoin{
+			LeftKey:  vm.CompileFunction(node.LeftKey.(xpr.TypedFunction)),
+			RightKey: vm.CompileFunction(node.RightKey.(xpr.TypedFunction)),
+			Merge:    node.Merge,
+		})
+
+	case xpr.LookupEncrypted:
+		mref := node.In.(xpr.TypedExpression).Actual.(ConstantModel).Value.(val.Ref)
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		return append(prev, inst.LookupEncrypted{In: mref[1], Path: node.Path})
+
+	case xpr.RefJoin:
+		mref := node.In.(xpr.TypedExpression).Actual.(ConstantModel).Value.(val.Ref)
+		prev = vm.CompileExpression(node.Left.(xpr.TypedExpression), prev)
+		return append(prev, inst.RefJoin{
+			In:        mref[1],
+			Referrers: node.Via == "referrers",
+			Merge:     node.Merge,
+		})
+
+	case filterFirst:
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		return append(prev, inst.FilterFirst{
+			vm.CompileFunction(node.Filter.(xpr.TypedFunction)),
+		})
+
+	case filterLength:
+		prev = vm.CompileExpression(node.Value.(xpr.TypedExpression), prev)
+		return append(prev, inst.FilterLength{
+			vm.CompileFunction(node.Filter.(xpr.TypedFunction)),
+		})
+
+	case sliceAll:
+		prev = vm.CompileExpression(node.Model.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Offset.(xpr.TypedExpression), prev)
+		prev = vm.CompileExpression(node.Length.(xpr.TypedExpression), prev)
+		return append(prev, inst.SliceAll{})
+
+	case hoisted:
+		for i, name := range node.Names {
+			prev = append(prev, inst.DefineLazy{
+				Name:       name,
+				Expression: vm.CompileExpression(node.Values[i].(xpr.TypedExpression), nil),
+			})
+		}
+		return vm.CompileExpression(node.Body.(xpr.TypedExpression), prev)
+
 	}
 	panic(fmt.Sprintf("unhandled case: %T", typed.Expression))
 
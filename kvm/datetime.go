@@ -0,0 +1,94 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"fmt"
+	"karma.run/cc"
+	"karma.run/kvm/err"
+	"karma.run/kvm/val"
+	"karma.run/kvm/xpr"
+	"log"
+	"time"
+)
+
+// loaded from the local tzdata, see time.LoadLocation
+var locationCache = cc.NewLru(256)
+
+func loadLocation(name string) (*time.Location, err.Error) {
+	if item, ok := locationCache.Get(name); ok {
+		return item.(*time.Location), nil
+	}
+	loc, e := time.LoadLocation(name)
+	if e != nil {
+		return nil, err.ExecutionError{
+			Problem: fmt.Sprintf(`unknown time zone: %q`, name),
+		}
+	}
+	locationCache.Set(name, loc)
+	return loc, nil
+}
+
+// typeZone types the zone argument of node, constant zones are checked at compile time.
+func (vm VirtualMachine) typeZone(zone xpr.Expression, scope *ModelScope, node xpr.Expression) (xpr.TypedExpression, err.Error) {
+	typed, e := vm.TypeExpression(zone, scope, StringModel)
+	if e != nil {
+		return typed, e
+	}
+	if c, ok := typed.Actual.(ConstantModel); ok {
+		if _, e := loadLocation(string(c.Value.(val.String))); e != nil {
+			return typed, err.CompilationError{
+				Problem: e.(err.ExecutionError).Problem,
+				Program: xpr.ValueFromExpression(node),
+			}
+		}
+	}
+	return typed, nil
+}
+
+// truncateDateTime rounds t down to the start of its unit in loc. weeks start on monday.
+func truncateDateTime(t time.Time, unit string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	y, m, d := t.Date()
+	switch unit {
+	case "minute":
+		return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, loc)
+	case "hour":
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, loc)
+	case "day":
+		return time.Date(y, m, d, 0, 0, 0, 0, loc)
+	case "week":
+		return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, loc)
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, loc)
+	case "year":
+		return time.Date(y, time.January, 1, 0, 0, 0, 0, loc)
+	}
+	log.Panicf("truncateDateTime: unexpected unit: %s", unit)
+	return t
+}
+
+// dateTimeComponent extracts component of t in loc. weekdays are numbered 1 (monday) to 7 (sunday).
+func dateTimeComponent(t time.Time, component string, loc *time.Location) int64 {
+	t = t.In(loc)
+	switch component {
+	case "year":
+		return int64(t.Year())
+	case "month":
+		return int64(t.Month())
+	case "day":
+		return int64(t.Day())
+	case "hour":
+		return int64(t.Hour())
+	case "minute":
+		return int64(t.Minute())
+	case "second":
+		return int64(t.Second())
+	case "weekday":
+		return int64((int(t.Weekday())+6)%7 + 1)
+	case "yearDay":
+		return int64(t.YearDay())
+	}
+	log.Panicf("dateTimeComponent: unexpected component: %s", component)
+	return 0
+}
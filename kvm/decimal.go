@@ -0,0 +1,58 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"fmt"
+	"karma.run/kvm/err"
+	"karma.run/kvm/val"
+	"log"
+)
+
+// minimum number of fractional digits of divDecimal results
+const minDecimalDivisionScale = 16
+
+func decimalDivisionScale(a, b val.Decimal) int32 {
+	s := int32(minDecimalDivisionScale)
+	if a.Scale > s {
+		s = a.Scale
+	}
+	if b.Scale > s {
+		s = b.Scale
+	}
+	return s
+}
+
+// checkDecimalScale returns an error if the scale of a decimal made by
+// instruction name is beyond val.MaxDecimalScale.
+func checkDecimalScale(name string, scale int64) err.Error {
+	if scale < -val.MaxDecimalScale || scale > val.MaxDecimalScale {
+		return err.ExecutionError{
+			Problem: fmt.Sprintf(`%s: scale out of range: %d, at most %d either way`, name, scale, val.MaxDecimalScale),
+		}
+	}
+	return nil
+}
+
+// toDecimal converts any number to a decimal, exactly for integers.
+// floats are converted to the shortest decimal that reads back as the same float.
+func toDecimal(v val.Value) (val.Decimal, err.Error) {
+	switch v := v.(type) {
+	case val.Decimal:
+		return v, nil
+	case val.Int8, val.Int16, val.Int32, val.Int64:
+		return val.DecimalFromInt64(integerToInt64(v)), nil
+	case val.Uint8, val.Uint16, val.Uint32, val.Uint64:
+		return val.DecimalFromUint64(integerToUint64(v)), nil
+	case val.Float:
+		d, ok := val.DecimalFromFloat(float64(v))
+		if !ok {
+			return val.Decimal{}, err.ExecutionError{
+				Problem: fmt.Sprintf(`toDecimal: %v is not a finite number`, v),
+			}
+		}
+		return d, nil
+	}
+	log.Panicf("toDecimal: unexpected type: %T", v)
+	return val.Decimal{}, nil
+}
@@ -0,0 +1,453 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"bytes"
+	"fmt"
+	"karma.run/codec/karma.v2"
+	"karma.run/definitions"
+	"karma.run/kvm/err"
+	"karma.run/kvm/mdl"
+	"karma.run/kvm/val"
+	"log"
+)
+
+// EncryptedAnnotation on a model stores its values encrypted on their own,
+// with the current data key, inside records that may be encrypted as a whole
+// too. Only the root user and the roles given to LoadPlaintextRoles read them
+// decrypted, all others read a placeholder, see redacted, and can't write it
+// over the values, see keepRedacted. Encrypted values reachable from the root
+// of an object through struct fields only are found by equality with the
+// lookupEncrypted expression, through a blind index. Only users reading them
+// decrypted may use it, as it would reveal them to others by guessing.
+const EncryptedAnnotation = "encrypted"
+
+// RedactedString is read instead of encrypted strings by roles not allowed to
+// read them. Other values read as the zero value of their model.
+const RedactedString = "[redacted]"
+
+// plaintextRoles are the names of the roles reading encrypted values
+// decrypted, see LoadPlaintextRoles.
+var plaintextRoles = map[string]struct{}{}
+
+// LoadPlaintextRoles parses a comma-separated list of role names like
+// "admin,support" whose users read encrypted values decrypted.
+func LoadPlaintextRoles(s string) {
+	plaintextRoles = parseRoleNames(s)
+}
+
+// redacts reports whether vm's user reads encrypted values redacted.
+func (vm *VirtualMachine) redacts() (bool, err.Error) {
+	if vm.UserID == vm.RootUserId() {
+		return false, nil
+	}
+	plaintext, e := vm.hasRoleIn(plaintextRoles)
+	return !plaintext, e
+}
+
+// plaintext returns vm reading encrypted values decrypted regardless of its
+// user's roles, for reads that don't leave the database.
+func (vm VirtualMachine) plaintext() VirtualMachine {
+	vm.redact = false
+	return vm
+}
+
+// storedModel returns m with the values annotated EncryptedAnnotation as
+// bytes, as they are stored, or nil if there are none.
+func storedModel(m mdl.Model) mdl.Model {
+	encrypted := false
+	m.Traverse(nil, func(_ []string, m mdl.Model) {
+		if a, ok := m.(mdl.Annotation); ok && a.Value == EncryptedAnnotation {
+			encrypted = true
+		}
+	})
+	if !encrypted {
+		return nil
+	}
+	return m.Copy().Transform(func(m mdl.Model) mdl.Model {
+		if a, ok := m.(mdl.Annotation); ok && a.Value == EncryptedAnnotation {
+			return mdl.Bytes{}
+		}
+		return m
+	})
+}
+
+// storage returns the model the values of m are stored as.
+func (m BucketModel) storage() mdl.Model {
+	if m.stored != nil {
+		return m.stored
+	}
+	return m.Model
+}
+
+// checkEncryptable returns an error if values of m are to be encrypted but
+// there is no data key to encrypt them with.
+func checkEncryptable(m BucketModel) err.Error {
+	if m.stored != nil && karma.CurrentKey() == nil {
+		return err.ExecutionError{
+			Problem: fmt.Sprintf(`model %s has encrypted values but there is no data key, see --data-key-file`, m.Bucket),
+		}
+	}
+	return nil
+}
+
+// mapEncrypted returns v of model m with the values annotated
+// EncryptedAnnotation replaced by f, which gets their unannotated model.
+func mapEncrypted(m mdl.Model, v val.Value, f func(mdl.Model, val.Value) val.Value) val.Value {
+	switch m := m.(type) {
+
+	case mdl.Annotation:
+		if m.Value == EncryptedAnnotation {
+			return f(m.Model, v)
+		}
+		return mapEncrypted(m.Model, v, f)
+
+	case BucketModel:
+		return mapEncrypted(m.Model, v, f)
+
+	case *mdl.Recursion:
+		return mapEncrypted(m.Model, v, f)
+
+	case mdl.Unique:
+		return mapEncrypted(m.Model, v, f)
+
+	case mdl.Optional:
+		if v == val.Null {
+			return v
+		}
+		return mapEncrypted(m.Model, v, f)
+
+	case mdl.Struct:
+		if s, ok := v.(val.Struct); ok {
+			c := val.NewStruct(s.Len())
+			s.ForEach(func(k string, w val.Value) bool {
+				if fm, ok := m.Get(k); ok {
+					w = mapEncrypted(fm, w, f)
+				}
+				c.Set(k, w)
+				return true
+			})
+			return c
+		}
+
+	case mdl.Union:
+		if u, ok := v.(val.Union); ok {
+			if cm, ok := m.Get(u.Case); ok {
+				return val.Union{u.Case, mapEncrypted(cm, u.Value, f)}
+			}
+		}
+
+	case mdl.Tuple:
+		if t, ok := v.(val.Tuple); ok && len(t) == len(m) {
+			c := make(val.Tuple, len(t))
+			for i, w := range t {
+				c[i] = mapEncrypted(m[i], w, f)
+			}
+			return c
+		}
+
+	case mdl.List:
+		if l, ok := v.(val.List); ok {
+			c := make(val.List, len(l))
+			for i, w := range l {
+				c[i] = mapEncrypted(m.Elements, w, f)
+			}
+			return c
+		}
+
+	case mdl.Set:
+		if s, ok := v.(val.Set); ok {
+			c := make(val.Set, len(s))
+			for _, w := range s {
+				w = mapEncrypted(m.Elements, w, f)
+				c[val.Hash(w, nil).Sum64()] = w
+			}
+			return c
+		}
+
+	case mdl.Map:
+		if l, ok := v.(val.Map); ok {
+			c := val.NewMap(l.Len())
+			l.ForEach(func(k string, w val.Value) bool {
+				c.Set(k, mapEncrypted(m.Elements, w, f))
+				return true
+			})
+			return c
+		}
+
+	}
+	return v
+}
+
+// sealValues encrypts the values of v annotated EncryptedAnnotation in m
+// with key, each as a record of its own.
+func sealValues(m mdl.Model, v val.Value, key *karma.Key) val.Value {
+	return mapEncrypted(m, v, func(m mdl.Model, v val.Value) val.Value {
+		return val.Bytes(karma.EncodeWith(v, m, karma.Options{Key: key}))
+	})
+}
+
+// openValues decrypts the values of v sealed by sealValues, or replaces them
+// with placeholders if redact is set.
+func openValues(m mdl.Model, v val.Value, redact bool) val.Value {
+	return mapEncrypted(m, v, func(m mdl.Model, v val.Value) val.Value {
+		if redact {
+			return redacted(m)
+		}
+		d, _ := karma.Decode([]byte(v.(val.Bytes)), m)
+		return d
+	})
+}
+
+// redacted returns the placeholder of values of model m read redacted.
+func redacted(m mdl.Model) val.Value {
+	if _, ok := m.Concrete().(mdl.String); ok {
+		return val.String(RedactedString)
+	}
+	return m.Zero()
+}
+
+// keepRedacted returns v of model m with the encrypted values equal to their
+// placeholder replaced by those at the same place in old, the stored value in
+// plaintext. Users reading encrypted values redacted write placeholders back
+// when updating objects they read, which must not overwrite the values they
+// stand for. Those users thus can't set encrypted values to their placeholder.
+func keepRedacted(m mdl.Model, v, old val.Value) val.Value {
+	switch m := m.(type) {
+
+	case mdl.Annotation:
+		if m.Value == EncryptedAnnotation {
+			if v.Equals(redacted(m.Model)) {
+				return old
+			}
+			return v
+		}
+		return keepRedacted(m.Model, v, old)
+
+	case BucketModel:
+		return keepRedacted(m.Model, v, old)
+
+	case *mdl.Recursion:
+		return keepRedacted(m.Model, v, old)
+
+	case mdl.Unique:
+		return keepRedacted(m.Model, v, old)
+
+	case mdl.Optional:
+		if v == val.Null || old == val.Null {
+			return v
+		}
+		return keepRedacted(m.Model, v, old)
+
+	case mdl.Struct:
+		s, ok := v.(val.Struct)
+		o, oldOk := old.(val.Struct)
+		if ok && oldOk {
+			c := val.NewStruct(s.Len())
+			s.ForEach(func(k string, w val.Value) bool {
+				fm, ok := m.Get(k)
+				ow, oldOk := o.Get(k)
+				if ok && oldOk {
+					w = keepRedacted(fm, w, ow)
+				}
+				c.Set(k, w)
+				return true
+			})
+			return c
+		}
+
+	case mdl.Union:
+		u, ok := v.(val.Union)
+		o, oldOk := old.(val.Union)
+		if ok && oldOk && u.Case == o.Case {
+			if cm, ok := m.Get(u.Case); ok {
+				return val.Union{u.Case, keepRedacted(cm, u.Value, o.Value)}
+			}
+		}
+
+	case mdl.Tuple:
+		t, ok := v.(val.Tuple)
+		o, oldOk := old.(val.Tuple)
+		if ok && oldOk && len(t) == len(m) && len(o) == len(m) {
+			c := make(val.Tuple, len(t))
+			for i, w := range t {
+				c[i] = keepRedacted(m[i], w, o[i])
+			}
+			return c
+		}
+
+	case mdl.List:
+		l, ok := v.(val.List)
+		o, oldOk := old.(val.List)
+		if ok && oldOk {
+			c := make(val.List, len(l))
+			for i, w := range l {
+				if i < len(o) {
+					w = keepRedacted(m.Elements, w, o[i])
+				}
+				c[i] = w
+			}
+			return c
+		}
+
+	case mdl.Map:
+		l, ok := v.(val.Map)
+		o, oldOk := old.(val.Map)
+		if ok && oldOk {
+			c := val.NewMap(l.Len())
+			l.ForEach(func(k string, w val.Value) bool {
+				if ow, ok := o.Get(k); ok {
+					w = keepRedacted(m.Elements, w, ow)
+				}
+				c.Set(k, w)
+				return true
+			})
+			return c
+		}
+
+	}
+	return v
+}
+
+// encryptedAt returns the model of the encrypted value at path of struct
+// fields in m, if there is one.
+func encryptedAt(m mdl.Model, path []string) (mdl.Model, bool) {
+	seen := map[*mdl.Recursion]struct{}{} // since the last field, against cycles of wrappers
+	for {
+		switch w := m.(type) {
+		case mdl.Annotation:
+			if w.Value == EncryptedAnnotation {
+				return w.Model, len(path) == 0
+			}
+			m = w.Model
+		case BucketModel:
+			m = w.Model
+		case mdl.Unique:
+			m = w.Model
+		case mdl.Optional:
+			m = w.Model
+		case *mdl.Recursion:
+			if _, ok := seen[w]; ok {
+				return nil, false
+			}
+			seen[w] = struct{}{}
+			m = w.Model
+		case mdl.Struct:
+			if len(path) == 0 {
+				return nil, false
+			}
+			f, ok := w.Get(path[0])
+			if !ok {
+				return nil, false
+			}
+			m, path, seen = f, path[1:], map[*mdl.Recursion]struct{}{}
+		default:
+			return nil, false
+		}
+	}
+}
+
+// forEachEncrypted calls f with the path of struct fields to and the value
+// of every encrypted value of v, of model m, found by encryptedAt.
+func forEachEncrypted(m mdl.Model, v val.Value, path []string, f func([]string, val.Value)) {
+	switch m := m.(type) {
+	case mdl.Annotation:
+		if m.Value == EncryptedAnnotation {
+			f(path, v)
+			return
+		}
+		forEachEncrypted(m.Model, v, path, f)
+	case BucketModel:
+		forEachEncrypted(m.Model, v, path, f)
+	case *mdl.Recursion:
+		forEachEncrypted(m.Model, v, path, f)
+	case mdl.Unique:
+		forEachEncrypted(m.Model, v, path, f)
+	case mdl.Optional:
+		if v != val.Null {
+			forEachEncrypted(m.Model, v, path, f)
+		}
+	case mdl.Struct:
+		if s, ok := v.(val.Struct); ok {
+			m.ForEach(func(k string, fm mdl.Model) bool {
+				if w, ok := s.Get(k); ok {
+					forEachEncrypted(fm, w, append(path[:len(path):len(path)], k), f)
+				}
+				return true
+			})
+		}
+	}
+}
+
+// blindIndexKey returns the key of the blind index entries of plaintext v at
+// path under data key k, which is followed by the ids of the objects.
+func blindIndexKey(path []string, v val.Value, k *karma.Key) []byte {
+	return append(hashStringSlice(path), k.Blind(val.Hash(unMeta(v), nil).Sum(nil))...)
+}
+
+// indexEncrypted replaces the blind index entries of object id of model m
+// with plaintext value old by those of plaintext value new, either being nil
+// if there is none. Old entries are removed for every known data key, new
+// ones written for the current one.
+func (vm VirtualMachine) indexEncrypted(mid, id string, m mdl.Model, old, new val.Value) {
+
+	ib, e := vm.RootBucket.CreateBucketIfNotExists(definitions.BlindBucketBytes)
+	if e != nil {
+		log.Panicln(e)
+	}
+	bk, e := ib.CreateBucketIfNotExists([]byte(mid))
+	if e != nil {
+		log.Panicln(e)
+	}
+
+	if old != nil {
+		forEachEncrypted(m, old, nil, func(path []string, v val.Value) {
+			for _, k := range karma.Keys() {
+				if e := bk.Delete(append(blindIndexKey(path, v, k), id...)); e != nil {
+					log.Panicln(e)
+				}
+			}
+		})
+	}
+
+	if new != nil {
+		key := karma.CurrentKey()
+		forEachEncrypted(m, new, nil, func(path []string, v val.Value) {
+			if e := bk.Put(append(blindIndexKey(path, v, key), id...), []byte{}); e != nil {
+				log.Panicln(e)
+			}
+		})
+	}
+}
+
+// lookupEncrypted returns the ids of the objects of model mid whose encrypted
+// value at path equals v, under any known data key.
+func (vm VirtualMachine) lookupEncrypted(mid string, path []string, v val.Value) []string {
+
+	ids := []string(nil)
+
+	ib := vm.RootBucket.Bucket(definitions.BlindBucketBytes)
+	if ib == nil {
+		return ids
+	}
+	bk := ib.Bucket([]byte(mid))
+	if bk == nil {
+		return ids
+	}
+
+	seen := map[string]struct{}{} // while rewriting records after a rotation
+	for _, key := range karma.Keys() {
+		prefix := blindIndexKey(path, v, key)
+		c := bk.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			id := string(k[len(prefix):])
+			if _, ok := seen[id]; !ok {
+				seen[id] = struct{}{}
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids
+}
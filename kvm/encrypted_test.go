@@ -0,0 +1,322 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"bytes"
+	"karma.run/codec/karma.v2"
+	"karma.run/kvm/err"
+	"karma.run/kvm/mdl"
+	"karma.run/kvm/val"
+	"karma.run/kvm/xpr"
+	"testing"
+)
+
+func encryptedModel(m val.Value) val.Value {
+	return val.Union{"annotation", val.StructFromMap(map[string]val.Value{
+		"value": val.String(EncryptedAnnotation),
+		"model": m,
+	})}
+}
+
+// secretModel and the ids of the test objects, users and roles. Ids are 16
+// bytes, as refs store them.
+const (
+	secretModel  = "secretmodel00000"
+	secretObject = "secretobject0000"
+	otherObject  = "secretobject0001"
+	readerUser   = "readeruser000000"
+	readerRole   = "readerrole000000"
+	adminUser    = "adminuser0000000"
+	adminRole    = "adminrole0000000"
+)
+
+// withEncryptedValues runs f with vm as root user and objects of secretModel
+// written, readable decrypted by users of role "admin" only.
+func withEncryptedValues(t *testing.T, f func(vm *VirtualMachine)) {
+
+	k, e := karma.NewKey(bytes.Repeat([]byte{7}, karma.MinKeySecretLength))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := karma.SetKeys(k); e != nil {
+		t.Fatal(e)
+	}
+	defer karma.SetKeys(nil)
+
+	LoadPlaintextRoles("admin")
+	defer LoadPlaintextRoles("")
+
+	withTestVirtualMachine(t, func(vm *VirtualMachine) {
+
+		write := func(mid, id string, v val.Value) {
+			if ke := vm.Write(mid, map[string]val.Meta{id: vm.WrapValueInMeta(v, id, mid)}); ke != nil {
+				t.Fatalf("writing %s/%s: %s", mid, id, ke.String())
+			}
+		}
+
+		allow, ke := vm.Parse(xpr.ValueFromFunction(xpr.NewFunction([]string{"v"}, xpr.Literal{val.Bool(true)})), nil, nil, nil)
+		if ke != nil {
+			t.Fatal(ke.String())
+		}
+		write(vm.ExpressionModelId(), "allowpermission0", xpr.ValueFromFunction(allow))
+		permission := val.Ref{vm.ExpressionModelId(), "allowpermission0"}
+		for id, name := range map[string]string{readerRole: "reader", adminRole: "admin"} {
+			write(vm.RoleModelId(), id, val.StructFromMap(map[string]val.Value{
+				"name": val.String(name),
+				"permissions": val.StructFromMap(map[string]val.Value{
+					"create": permission, "read": permission, "update": permission, "delete": permission,
+				}),
+			}))
+		}
+		for id, role := range map[string]string{readerUser: readerRole, adminUser: adminRole} {
+			write(vm.UserModelId(), id, val.StructFromMap(map[string]val.Value{
+				"username": val.String(id),
+				"password": val.String(""),
+				"roles":    val.List{val.Ref{vm.RoleModelId(), role}},
+			}))
+		}
+
+		write(vm.MetaModelId(), secretModel, val.Union{"struct", val.MapFromMap(map[string]val.Value{
+			"name":   val.Union{"string", val.Struct{}},
+			"secret": encryptedModel(val.Union{"string", val.Struct{}}),
+			"pin":    encryptedModel(val.Union{"int64", val.Struct{}}),
+		})})
+		write(secretModel, secretObject, secretValue("first", "s3cret", 1234))
+		write(secretModel, otherObject, secretValue("second", "other", 5))
+
+		f(vm)
+	})
+}
+
+func secretValue(name, secret string, pin int64) val.Value {
+	return val.StructFromMap(map[string]val.Value{
+		"name":   val.String(name),
+		"secret": val.String(secret),
+		"pin":    val.Int64(pin),
+	})
+}
+
+// asUser returns vm acting as user id, with its permissions loaded.
+func asUser(t *testing.T, vm *VirtualMachine, id string) *VirtualMachine {
+	user := *vm
+	user.UserID, user.permissions, user.redact = id, nil, false
+	if ke := user.lazyLoadPermissions(); ke != nil {
+		t.Fatal(ke.String())
+	}
+	return &user
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	withEncryptedValues(t, func(vm *VirtualMachine) {
+
+		m, ke := vm.Model(secretModel)
+		if ke != nil {
+			t.Fatal(ke.String())
+		}
+		if m.stored == nil {
+			t.Fatal("expected a stored model")
+		}
+		stored := m.stored.Concrete().(mdl.Struct)
+		for _, f := range []string{"secret", "pin"} {
+			if _, ok := stored.Field(f).(mdl.Bytes); !ok {
+				t.Errorf("expected field %s to be stored as bytes, have %T", f, stored.Field(f))
+			}
+		}
+		if _, ok := stored.Field("name").Concrete().(mdl.String); !ok {
+			t.Errorf("expected field name to be stored as is, have %T", stored.Field("name"))
+		}
+
+		bs := vm.RootBucket.Bucket([]byte(secretModel)).Get([]byte(secretObject))
+		if bytes.Contains(bs, []byte("s3cret")) {
+			t.Error("encrypted value stored in plaintext")
+		}
+	})
+}
+
+func TestEncryptedRedacted(t *testing.T) {
+	withEncryptedValues(t, func(vm *VirtualMachine) {
+
+		cases := []struct {
+			name string
+			vm   *VirtualMachine
+			want val.Value
+		}{
+			{"root", vm, secretValue("first", "s3cret", 1234)},
+			{"admin", asUser(t, vm, adminUser), secretValue("first", "s3cret", 1234)},
+			{"reader", asUser(t, vm, readerUser), secretValue("first", RedactedString, 0)},
+		}
+
+		for _, c := range cases {
+			redacts, ke := c.vm.redacts()
+			if ke != nil {
+				t.Fatal(ke.String())
+			}
+			if want := c.name == "reader"; redacts != want {
+				t.Errorf("%s: expected redacts to be %v", c.name, want)
+			}
+			have, ke := c.vm.Get(secretModel, secretObject)
+			if ke != nil {
+				t.Fatalf("%s: %s", c.name, ke.String())
+			}
+			if !have.Value.Equals(c.want) {
+				t.Errorf("%s: want %v, have %v", c.name, c.want, have.Value)
+			}
+		}
+	})
+}
+
+func TestEncryptedKeepRedacted(t *testing.T) {
+	withEncryptedValues(t, func(vm *VirtualMachine) {
+
+		reader := asUser(t, vm, readerUser)
+
+		mv, ke := reader.Get(secretModel, secretObject)
+		if ke != nil {
+			t.Fatal(ke.String())
+		}
+		mv.Value.(val.Struct).Set("name", val.String("renamed"))
+		if ke := reader.Write(secretModel, map[string]val.Meta{secretObject: mv}); ke != nil {
+			t.Fatal(ke.String())
+		}
+		have, ke := vm.Get(secretModel, secretObject)
+		if ke != nil {
+			t.Fatal(ke.String())
+		}
+		if want := secretValue("renamed", "s3cret", 1234); !have.Value.Equals(want) {
+			t.Errorf("writing back placeholders: want %v, have %v", want, have.Value)
+		}
+
+		mv.Value = secretValue("renamed", "new secret", 0)
+		if ke := reader.Write(secretModel, map[string]val.Meta{secretObject: mv}); ke != nil {
+			t.Fatal(ke.String())
+		}
+		have, ke = vm.Get(secretModel, secretObject)
+		if ke != nil {
+			t.Fatal(ke.String())
+		}
+		if want := secretValue("renamed", "new secret", 1234); !have.Value.Equals(want) {
+			t.Errorf("writing a new value: want %v, have %v", want, have.Value)
+		}
+	})
+}
+
+func TestLookupEncrypted(t *testing.T) {
+	withEncryptedValues(t, func(vm *VirtualMachine) {
+
+		lookup := func(vm *VirtualMachine, path string, v val.Value) (val.Value, err.Error) {
+			f := xpr.NewFunction(nil, xpr.LookupEncrypted{
+				In:    xpr.Literal{val.Ref{vm.MetaModelId(), secretModel}},
+				Path:  []string{path},
+				Value: xpr.Literal{v},
+			})
+			typed, ke := vm.TypeFunction(f, nil, AnyModel)
+			if ke != nil {
+				return nil, ke
+			}
+			is, ke := vm.compile(typed)
+			if ke != nil {
+				return nil, ke
+			}
+			user := *vm
+			user.permissions, user.redact = nil, false // loaded again on execution, as for each request
+			return user.executeEagerly(is, nil)
+		}
+
+		cases := []struct {
+			name  string
+			path  string
+			value val.Value
+			ids   []string
+		}{
+			{"string", "secret", val.String("s3cret"), []string{secretObject}},
+			{"int64", "pin", val.Int64(5), []string{otherObject}},
+			{"no match", "secret", val.String("s3cret "), nil},
+			{"placeholder", "secret", val.String(RedactedString), nil},
+		}
+
+		for _, user := range []struct {
+			name string
+			vm   *VirtualMachine
+		}{{"root", vm}, {"admin", asUser(t, vm, adminUser)}} {
+			for _, c := range cases {
+				res, ke := lookup(user.vm, c.path, c.value)
+				if ke != nil {
+					t.Errorf("%s, %s: %s", user.name, c.name, ke.String())
+					continue
+				}
+				ids := []string(nil)
+				for _, v := range res.(val.List) {
+					ids = append(ids, v.(val.Meta).Id[1])
+				}
+				if len(ids) != len(c.ids) || (len(ids) > 0 && ids[0] != c.ids[0]) {
+					t.Errorf("%s, %s: want %v, have %v", user.name, c.name, c.ids, ids)
+				}
+			}
+		}
+
+		_, ke := lookup(asUser(t, vm, readerUser), "secret", val.String("s3cret"))
+		if _, ok := ke.(err.PermissionDeniedError); !ok {
+			t.Errorf("reader: expected permission to be denied, have %v", ke)
+		}
+	})
+}
+
+func TestSealOpenEncryptedValues(t *testing.T) {
+
+	k, e := karma.NewKey(bytes.Repeat([]byte{7}, karma.MinKeySecretLength))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := karma.SetKeys(k); e != nil {
+		t.Fatal(e)
+	}
+	defer karma.SetKeys(nil)
+
+	secret := mdl.Annotation{Model: mdl.String{}, Value: EncryptedAnnotation}
+	pin := mdl.Annotation{Model: mdl.Int64{}, Value: EncryptedAnnotation}
+	m := mdl.StructFromMap(map[string]mdl.Model{
+		"list":     mdl.List{secret},
+		"map":      mdl.Map{pin},
+		"optional": mdl.Optional{secret},
+		"absent":   mdl.Optional{secret},
+		"union":    mdl.UnionFromMap(map[string]mdl.Model{"a": secret}),
+		"tuple":    mdl.Tuple{mdl.String{}, pin},
+	})
+	v := val.StructFromMap(map[string]val.Value{
+		"list":     val.List{val.String("a"), val.String("b")},
+		"map":      val.MapFromMap(map[string]val.Value{"x": val.Int64(1)}),
+		"optional": val.String("c"),
+		"absent":   val.Null,
+		"union":    val.Union{"a", val.String("d")},
+		"tuple":    val.Tuple{val.String("e"), val.Int64(2)},
+	})
+	redacted := val.StructFromMap(map[string]val.Value{
+		"list":     val.List{val.String(RedactedString), val.String(RedactedString)},
+		"map":      val.MapFromMap(map[string]val.Value{"x": val.Int64(0)}),
+		"optional": val.String(RedactedString),
+		"absent":   val.Null,
+		"union":    val.Union{"a", val.String(RedactedString)},
+		"tuple":    val.Tuple{val.String("e"), val.Int64(0)},
+	})
+
+	sealed := sealValues(m, v, k)
+	if _, ok := sealed.(val.Struct).Field("list").(val.List)[0].(val.Bytes); !ok {
+		t.Errorf("expected sealed values to be bytes, have %v", sealed)
+	}
+	if storedModel(m) == nil {
+		t.Error("expected a stored model")
+	}
+	if storedModel(mdl.List{mdl.String{}}) != nil {
+		t.Error("expected no stored model without encrypted values")
+	}
+	if have := openValues(m, sealed, false); !have.Equals(v) {
+		t.Errorf("opened: want %v, have %v", v, have)
+	}
+	if have := openValues(m, sealed, true); !have.Equals(redacted) {
+		t.Errorf("redacted: want %v, have %v", redacted, have)
+	}
+	if have := keepRedacted(m, redacted, v); !have.Equals(v) {
+		t.Errorf("kept: want %v, have %v", v, have)
+	}
+}
@@ -171,6 +171,14 @@ func valueToHuman(v val.Value, indent int) string {
 
 	case val.DateTime:
 		return v.Format(time.RFC3339)
+	case val.Duration:
+		return time.Duration(v).String()
+	case val.Decimal:
+		return v.String()
+	case val.Bytes:
+		return fmt.Sprintf(`<%d bytes>`, len(v))
+	case val.Blob:
+		return fmt.Sprintf(`blob(%s)`, string(v))
 	case val.Float:
 		return fmt.Sprintf(`%f`, v)
 	case val.String:
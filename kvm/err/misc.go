@@ -176,6 +176,30 @@ func (e ExecutionError) Child() Error {
 	return e.Child_
 }
 
+// BudgetExceededError is returned when execution exceeds one of its limits,
+// Limit is "instructions", "time" or "allocationBytes".
+type BudgetExceededError struct {
+	Limit string
+}
+
+func (e BudgetExceededError) Value() val.Union {
+	return val.Union{"budgetExceededError", val.String(e.Limit)}
+}
+func (e BudgetExceededError) Error() string {
+	return e.String()
+}
+func (e BudgetExceededError) String() string {
+	out := "Budget Exceeded Error\n"
+	out += "=====================\n"
+	out += "Limit\n"
+	out += "-----\n"
+	out += e.Limit + "\n\n"
+	return out
+}
+func (e BudgetExceededError) Child() Error {
+	return nil
+}
+
 type DatabaseDoesNotExistError struct {
 	Name string
 }
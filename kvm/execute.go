@@ -5,6 +5,7 @@ package kvm
 import (
 	"fmt"
 	"github.com/kr/pretty"
+	"karma.run/codec/karma.v2"
 	"karma.run/common"
 	"karma.run/definitions"
 	"karma.run/kvm/err"
@@ -13,10 +14,12 @@ import (
 	"karma.run/kvm/val"
 	"karma.run/kvm/xpr"
 	"log"
+	"math"
 	"math/rand"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -56,6 +59,43 @@ func (s *ValueScope) Child() *ValueScope {
 	return c
 }
 
+// lazyValue is a scope entry defined by inst.DefineLazy, evaluated by the
+// first inst.Scope reading it. errors are kept just like values.
+type lazyValue struct {
+	program inst.Sequence
+	scope   *ValueScope
+	value   val.Value
+	err     err.Error
+	once    sync.Once // forced by the goroutines of parallel evaluation, too
+}
+
+func (v *lazyValue) force(vm VirtualMachine) (val.Value, err.Error) {
+	v.once.Do(func() {
+		v.value, v.err = vm.executeEagerly(v.program, v.scope.Child())
+	})
+	return v.value, v.err
+}
+
+func (*lazyValue) Equals(v val.Value) bool {
+	panic("lazyValue.Equals called")
+}
+
+func (v *lazyValue) Copy() val.Value {
+	return v
+}
+
+func (*lazyValue) Type() val.Type {
+	panic("lazyValue.Type called")
+}
+
+func (v *lazyValue) Transform(f func(val.Value) val.Value) val.Value {
+	panic("lazyValue.Transform called")
+}
+
+func (*lazyValue) Primitive() bool {
+	return false
+}
+
 type Stack []val.Value
 
 func NewStack(capacity int) *Stack {
@@ -67,7 +107,13 @@ func (s *Stack) Push(v val.Value) {
 	(*s) = append((*s), v)
 }
 
+// Pop returns the top value, decoded if it is a view, see viewing.
 func (s *Stack) Pop() val.Value {
+	return decoded(s.popView())
+}
+
+// popView is Pop for instructions that handle views.
+func (s *Stack) popView() val.Value {
 	l := s.Len()
 	v := (*s)[l-1]
 	(*s) = (*s)[:l-1]
@@ -85,6 +131,34 @@ func (s Stack) Peek() val.Value {
 	return s[len(s)-1]
 }
 
+// catchable reports whether e may be caught by try or orElse,
+// cases restricts the catchable errors further unless it is nil.
+func catchable(e err.Error, cases map[string]struct{}) bool {
+	k := e.Value().Case
+	if _, ok := CatchableErrorModels[k]; !ok {
+		return false
+	}
+	if cases == nil {
+		return true
+	}
+	_, ok := cases[k]
+	return ok
+}
+
+// executeEagerly is like Execute but reads iterator results into a list,
+// so that errors raised while iterating surface here and not later.
+// side effects of a failed program are not undone, see xpr.Try.
+func (vm VirtualMachine) executeEagerly(program inst.Sequence, scope *ValueScope) (val.Value, err.Error) {
+	v, e := vm.Execute(program, scope)
+	if e != nil {
+		return nil, e
+	}
+	if iv, ok := v.(iteratorValue); ok {
+		return iteratorToList(iv.iterator)
+	}
+	return v, nil
+}
+
 // scope may be nil, that's fine -- will be allocated when needed.
 func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args ...val.Value) (val.Value, err.Error) {
 
@@ -105,26 +179,42 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 		return nil, e
 	}
 
+	started := time.Time{} // of the previous instruction, when profiling
+
 	for pc, pl := 0, len(program); pc < pl; pc++ {
 
+		if vm.Profile != nil {
+			now := time.Now()
+			if pc > 0 {
+				vm.Profile.record(program, pc-1, now.Sub(started), stack)
+			}
+			started = now
+		}
+
 		// { // debug
 		// 	fmt.Printf("stack.Peek(): %T %v\n", stack.Peek(), stack.Peek())
 		// 	fmt.Printf("instruction: %T %v\n\n", program[pc], program[pc])
 		// }
 
+		if vm.Budget != nil {
+			if e := vm.Budget.step(); e != nil {
+				return nil, e
+			}
+		}
+
 		switch it := program[pc].(type) {
 
 		case inst.Sequence:
 			log.Panicln("vm.Execute: nested inst.Sequence")
 
 		case inst.Pop:
-			stack.Pop()
+			stack.popView()
 
 		case inst.Define:
 			if scope == nil {
 				scope = NewValueScope()
 			}
-			scope.Set(string(it), stack.Pop())
+			scope.Set(string(it), stack.popView())
 			stack.Push(val.Null)
 
 		case inst.Scope:
@@ -134,8 +224,21 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 					Problem: fmt.Sprintf(`not in scope: "%s"`, it),
 				}
 			}
+			if lv, ok := v.(*lazyValue); ok {
+				w, e := lv.force(vm)
+				if e != nil {
+					return nil, e
+				}
+				v = w
+			}
 			stack.Push(v)
 
+		case inst.DefineLazy:
+			if scope == nil {
+				scope = NewValueScope()
+			}
+			scope.Set(it.Name, &lazyValue{program: it.Expression, scope: scope})
+
 		case inst.CurrentUser:
 			stack.Push(val.Ref{vm.UserModelId(), vm.UserID})
 
@@ -155,6 +258,32 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 			}
 			stack.Push(v)
 
+		case inst.Try:
+			v, e := vm.executeEagerly(it.Value, scope.Child())
+			if e != nil {
+				if !catchable(e, it.Errors) {
+					return nil, e
+				}
+				v, e = vm.Execute(it.Catch, scope.Child(), e.Value())
+				if e != nil {
+					return nil, e
+				}
+			}
+			stack.Push(v)
+
+		case inst.OrElse:
+			v, e := vm.executeEagerly(it.Value, scope.Child())
+			if e != nil {
+				if !catchable(e, nil) {
+					return nil, e
+				}
+				v, e = vm.Execute(it.Default, scope.Child())
+				if e != nil {
+					return nil, e
+				}
+			}
+			stack.Push(v)
+
 		case inst.SubstringIndex:
 			search := unMeta(stack.Pop()).(val.String)
 			stryng := unMeta(stack.Pop()).(val.String)
@@ -163,6 +292,9 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 			))
 
 		case inst.BuildList:
+			if e := vm.allocate(int64(it.Length) * valueBytes); e != nil {
+				return nil, e
+			}
 			ls := make(val.List, it.Length, it.Length)
 			for i := it.Length - 1; i > -1; i-- {
 				ls[i] = stack.Pop()
@@ -170,6 +302,9 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 			stack.Push(ls)
 
 		case inst.BuildSet:
+			if e := vm.allocate(int64(it.Length) * valueBytes); e != nil {
+				return nil, e
+			}
 			st := make(val.Set, it.Length)
 			for i := it.Length - 1; i > -1; i-- {
 				v := stack.Pop()
@@ -178,6 +313,9 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 			stack.Push(st)
 
 		case inst.BuildTuple:
+			if e := vm.allocate(int64(it.Length) * valueBytes); e != nil {
+				return nil, e
+			}
 			tp := make(val.Tuple, it.Length, it.Length)
 			for i := it.Length - 1; i > -1; i-- {
 				tp[i] = stack.Pop()
@@ -185,6 +323,9 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 			stack.Push(tp)
 
 		case inst.BuildMap:
+			if e := vm.allocate(int64(it.Length) * valueBytes); e != nil {
+				return nil, e
+			}
 			mp := val.NewMap(it.Length)
 			for i, l := 0, it.Length; i < l; i++ {
 				v := stack.Pop()
@@ -194,6 +335,9 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 			stack.Push(mp)
 
 		case inst.BuildStruct:
+			if e := vm.allocate(int64(len(it.Keys)) * valueBytes); e != nil {
+				return nil, e
+			}
 			st := val.NewStruct(len(it.Keys))
 			for i := len(it.Keys) - 1; i > -1; i-- {
 				st.Set(it.Keys[i], stack.Pop())
@@ -215,11 +359,13 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 
 		case inst.TagExists:
 			tag := unMeta(stack.Pop()).(val.String)
+			vm.read(vm.TagModelId())
 			mid := vm.RootBucket.Bucket(definitions.TagBucketBytes).Get([]byte(tag))
 			stack.Push(val.Bool(mid != nil))
 
 		case inst.Tag:
 			tag := unMeta(stack.Pop()).(val.String)
+			vm.read(vm.TagModelId())
 			mid := vm.RootBucket.Bucket(definitions.TagBucketBytes).Get([]byte(tag))
 			if mid == nil {
 				return nil, err.ExecutionError{
@@ -241,6 +387,9 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 				}
 				out += v.(val.String)
 			}
+			if e := vm.allocate(int64(len(out))); e != nil {
+				return nil, e
+			}
 			stack.Push(out)
 
 		case inst.ExtractStrings:
@@ -439,14 +588,48 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 			if e != nil {
 				return nil, e
 			}
-			model := vm.WrapModelInMeta(mid, m.Model)
-			bucket := vm.RootBucket.Bucket([]byte(mid))
-			iter := iterator(newBucketDecodingIterator(bucket, model))
-			if vm.permissions != nil && vm.permissions.read != nil {
+			vm.read(mid)
+			bi := vm.newBucketDecodingIterator(m)
+			bi.budget, bi.profile = vm.Budget, vm.Profile
+			iter := iterator(bi)
+			if vm.permissions != nil && vm.permissions.read != nil && !grantsAll(vm.permissions.read) {
 				iter = vm.newReadPermissionFilterIterator(iter)
 			}
 			stack.Push(iteratorValue{iter})
 
+		case inst.SliceAll:
+			length := int(unMeta(stack.Pop()).(val.Int64))
+			offset := int(unMeta(stack.Pop()).(val.Int64))
+			mid := (unMeta(stack.Pop())).(val.Ref)[1]
+			m, e := vm.Model(mid)
+			if e != nil {
+				return nil, e
+			}
+			if length < 0 {
+				return nil, err.ExecutionError{
+					Problem: `slice: negative length`,
+				}
+			}
+			if offset < 0 {
+				return nil, err.ExecutionError{
+					Problem: `slice: negative offset`,
+				}
+			}
+			if length == 0 {
+				stack.Push(iteratorValue{newListIterator(nil)})
+				break
+			}
+			vm.read(mid)
+			bi := vm.newBucketDecodingIterator(m)
+			bi.budget, bi.profile = vm.Budget, vm.Profile
+			if vm.permissions != nil && vm.permissions.read != nil && !grantsAll(vm.permissions.read) {
+				// which objects are skipped depends on the permission to read them
+				stack.Push(iteratorValue{newLimitIterator(vm.newReadPermissionFilterIterator(bi), offset, length)})
+				break
+			}
+			bi.offset, bi.limit = offset, length
+			stack.Push(iteratorValue{bi})
+
 		case inst.LeftFoldList:
 			init := stack.Pop()
 			list := stack.Pop()
@@ -523,6 +706,98 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 			s := unMeta(stack.Pop()).(val.String)
 			stack.Push(val.String(strings.ToLower(string(s))))
 
+		case inst.StringToUpper:
+			s := unMeta(stack.Pop()).(val.String)
+			stack.Push(val.String(strings.ToUpper(string(s))))
+
+		case inst.TrimString:
+			s := unMeta(stack.Pop()).(val.String)
+			stack.Push(val.String(strings.TrimSpace(string(s))))
+
+		case inst.ParseInt64:
+			s := unMeta(stack.Pop()).(val.String)
+			i, e := strconv.ParseInt(strings.TrimSpace(string(s)), 10, 64)
+			if e != nil {
+				return nil, err.ExecutionError{
+					Problem: fmt.Sprintf(`parseInt64: invalid int64: %q`, s),
+				}
+			}
+			stack.Push(val.Int64(i))
+
+		case inst.ParseFloat:
+			s := unMeta(stack.Pop()).(val.String)
+			f, e := strconv.ParseFloat(strings.TrimSpace(string(s)), 64)
+			if e != nil {
+				return nil, err.ExecutionError{
+					Problem: fmt.Sprintf(`parseFloat: invalid float: %q`, s),
+				}
+			}
+			stack.Push(val.Float(f))
+
+		case inst.StringReplace:
+			replacement := unMeta(stack.Pop()).(val.String)
+			search := unMeta(stack.Pop()).(val.String)
+			s := unMeta(stack.Pop()).(val.String)
+			stack.Push(val.String(strings.Replace(string(s), string(search), string(replacement), -1)))
+
+		case inst.ReplaceRegex:
+			replacement := unMeta(stack.Pop()).(val.String)
+			s := unMeta(stack.Pop()).(val.String)
+			stack.Push(val.String(it.Regex.ReplaceAllString(string(s), string(replacement))))
+
+		case inst.SplitString:
+			separator := unMeta(stack.Pop()).(val.String)
+			s := unMeta(stack.Pop()).(val.String)
+			parts := strings.Split(string(s), string(separator))
+			ls := make(val.List, len(parts), len(parts))
+			for i, part := range parts {
+				ls[i] = val.String(part)
+			}
+			stack.Push(ls)
+
+		case inst.PadString:
+			padding := unMeta(stack.Pop()).(val.String)
+			width := unMeta(stack.Pop()).(val.Int64)
+			s := unMeta(stack.Pop()).(val.String)
+			if width > 0 {
+				if e := vm.allocate(int64(width)); e != nil {
+					return nil, e
+				}
+			}
+			stack.Push(val.String(padString(string(s), int(width), string(padding), it.Left)))
+
+		case inst.RepeatString:
+			count := unMeta(stack.Pop()).(val.Int64)
+			s := unMeta(stack.Pop()).(val.String)
+			if count < 0 {
+				return nil, err.ExecutionError{
+					Problem: fmt.Sprintf(`repeatString: negative count: %d`, count),
+				}
+			}
+			if len(s) > 0 && int64(count) > math.MaxInt64/int64(len(s)) {
+				return nil, err.ExecutionError{
+					Problem: `repeatString: result too long`,
+				}
+			}
+			if e := vm.allocate(int64(len(s)) * int64(count)); e != nil {
+				return nil, e
+			}
+			stack.Push(val.String(strings.Repeat(string(s), int(count))))
+
+		case inst.StringStartsWith:
+			prefix := unMeta(stack.Pop()).(val.String)
+			s := unMeta(stack.Pop()).(val.String)
+			stack.Push(val.Bool(strings.HasPrefix(string(s), string(prefix))))
+
+		case inst.StringEndsWith:
+			suffix := unMeta(stack.Pop()).(val.String)
+			s := unMeta(stack.Pop()).(val.String)
+			stack.Push(val.Bool(strings.HasSuffix(string(s), string(suffix))))
+
+		case inst.NormalizeString:
+			s := unMeta(stack.Pop()).(val.String)
+			stack.Push(val.String(it.Form.String(string(s))))
+
 		case inst.ReverseList:
 
 			var out val.List
@@ -554,6 +829,17 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 			}
 			stack.Push(w)
 
+		case inst.Call:
+			args := make([]val.Value, it.Arity, it.Arity)
+			for i := it.Arity - 1; i > -1; i-- {
+				args[i] = stack.Pop()
+			}
+			w, e := vm.Execute(it.Expression, nil, args...)
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(w)
+
 		case inst.MapEnum:
 			symbol := unMeta(stack.Pop()).(val.Symbol)
 			if mapped, ok := it.Mapping[string(symbol)]; ok {
@@ -581,9 +867,17 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 				stack.Push(cp)
 
 			case iteratorValue:
+				sub, _ := vm.viewing(ls.iterator)
+				if pi, ok := vm.parallel(sub, true, func(vm VirtualMachine, i int, v val.Value) (val.Value, bool, err.Error) {
+					mapped, e := vm.Execute(it.Expression, scope.Child(), val.Int64(i), v)
+					return mapped, true, e
+				}); ok {
+					stack.Push(iteratorValue{pi})
+					break
+				}
 				i := val.Int64(-1)
 				stack.Push(iteratorValue{
-					newMappingIterator(ls.iterator, func(v val.Value) (val.Value, err.Error) {
+					newMappingIterator(sub, func(v val.Value) (val.Value, err.Error) {
 						i++
 						return vm.Execute(it.Expression, scope.Child(), i, v)
 					}),
@@ -653,6 +947,8 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 			todo := make([]val.Ref, 0, 1024)
 			todo = append(todo, unMeta(stack.Pop()).(val.Ref))
 
+			vm.read(anyModel)
+
 			for len(todo) > 0 {
 
 				vertex := todo[0]
@@ -767,6 +1063,7 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 
 			from := unMeta(stack.Pop()).(val.Ref)
 
+			vm.read(anyModel)
 			gb := vm.RootBucket.Bucket(definitions.GraphBucketBytes)
 			if gb == nil {
 				log.Panicln("Graph bucket missing!")
@@ -816,6 +1113,7 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 
 			of := unMeta(stack.Pop()).(val.Ref)
 
+			vm.read(anyModel)
 			pb := vm.RootBucket.Bucket(definitions.PhargBucketBytes)
 			if pb == nil {
 				log.Panicln("Pharg bucket missing!")
@@ -878,17 +1176,32 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 				stack.Push(cp)
 
 			case iteratorValue:
+				sub, viewed := vm.viewing(ls.iterator)
+				if pi, ok := vm.parallel(sub, false, func(vm VirtualMachine, i int, v val.Value) (val.Value, bool, err.Error) {
+					keep, e := vm.Execute(it.Expression, scope.Child(), val.Uint64(i), v)
+					if e != nil || !bool(keep.(val.Bool)) {
+						return nil, false, e
+					}
+					return decoded(v), true, nil
+				}); ok {
+					stack.Push(iteratorValue{pi})
+					break
+				}
 				i := 0
-				stack.Push(iteratorValue{
-					newFilterIterator(ls.iterator, func(value val.Value) (bool, err.Error) {
-						v, e := vm.Execute(it.Expression, scope.Child(), val.Uint64(i), value)
-						if e != nil {
-							return false, e
-						}
-						i++
-						return bool(v.(val.Bool)), nil
-					}),
+				var fi iterator = newFilterIterator(sub, func(value val.Value) (bool, err.Error) {
+					v, e := vm.Execute(it.Expression, scope.Child(), val.Uint64(i), value)
+					if e != nil {
+						return false, e
+					}
+					i++
+					return bool(v.(val.Bool)), nil
 				})
+				if viewed {
+					fi = newMappingIterator(fi, func(v val.Value) (val.Value, err.Error) {
+						return decoded(v), nil // only the elements kept
+					})
+				}
+				stack.Push(iteratorValue{fi})
 
 			default:
 				log.Panicf("unexpected type on stack: %T", ls)
@@ -926,6 +1239,65 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 				log.Panicf("unexpected type on stack: %T", ls)
 			}
 
+		case inst.FilterFirst:
+			out, i := val.Value(nil), 0
+			stop := &err.ExecutionError{} // placeholder
+			e := iteratorOf(stack.Pop()).forEach(func(v val.Value) err.Error {
+				keep, e := vm.Execute(it.Expression, scope.Child(), val.Uint64(i), v)
+				if e != nil {
+					return e
+				}
+				i++
+				if keep.(val.Bool) {
+					out = v
+					return stop
+				}
+				return nil // continue
+			})
+			if e == stop {
+				e = nil
+			}
+			if e != nil {
+				return nil, e
+			}
+			if out == nil {
+				return nil, err.ExecutionError{
+					Problem: fmt.Sprintf("first: empty list"),
+				}
+			}
+			stack.Push(out)
+
+		case inst.FilterLength:
+			keep := parallelFunc(func(vm VirtualMachine, i int, v val.Value) (val.Value, bool, err.Error) {
+				keep, e := vm.Execute(it.Expression, scope.Child(), val.Uint64(i), v)
+				if e != nil {
+					return nil, false, e
+				}
+				return v, bool(keep.(val.Bool)), nil
+			})
+			iter, _ := vm.viewing(iteratorOf(stack.Pop()))
+			if pi, ok := vm.parallel(iter, false, keep); ok {
+				iter, keep = pi, func(vm VirtualMachine, i int, v val.Value) (val.Value, bool, err.Error) {
+					return v, true, nil // filtered already
+				}
+			}
+			count, i := 0, 0
+			e := iter.forEach(func(v val.Value) err.Error {
+				_, k, e := keep(vm, i, v)
+				if e != nil {
+					return e
+				}
+				i++
+				if k {
+					count++
+				}
+				return nil
+			})
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(val.Int64(count))
+
 		case inst.InList:
 
 			vl := unMeta(stack.Pop())
@@ -963,8 +1335,426 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 			}
 
 		case inst.DateTimeNow:
+			vm.volatile()
 			stack.Push(val.DateTime{time.Now()})
 
+		case inst.DateTimeDiff:
+			rhs := unMeta(stack.Pop()).(val.DateTime) // order matters
+			lhs := unMeta(stack.Pop()).(val.DateTime) // order matters
+			stack.Push(val.Duration(lhs.Time.Sub(rhs.Time)))
+
+		case inst.AddDuration:
+			d := unMeta(stack.Pop()).(val.Duration)
+			t := unMeta(stack.Pop()).(val.DateTime)
+			stack.Push(val.DateTime{t.Time.Add(time.Duration(d))})
+
+		case inst.SubDuration:
+			d := unMeta(stack.Pop()).(val.Duration)
+			t := unMeta(stack.Pop()).(val.DateTime)
+			stack.Push(val.DateTime{t.Time.Add(-time.Duration(d))})
+
+		case inst.IntegerOperation:
+			rhs := unMeta(stack.Pop())
+			lhs := unMeta(stack.Pop())
+			v, e := integerOperation(it.Op, it.Type, it.Checked, lhs, rhs)
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(v)
+
+		case inst.AbsInteger:
+			v, e := absInteger(unMeta(stack.Pop()), it.Type, it.Checked)
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(v)
+
+		case inst.ToIntegerChecked:
+			v, e := toIntegerChecked(unMeta(stack.Pop()), it.Type)
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(v)
+
+		case inst.ToDecimal:
+			d, e := toDecimal(unMeta(stack.Pop()))
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(d)
+
+		case inst.AddDecimal:
+			rhs := unMeta(stack.Pop()).(val.Decimal)
+			lhs := unMeta(stack.Pop()).(val.Decimal)
+			stack.Push(lhs.Add(rhs))
+
+		case inst.SubDecimal:
+			rhs := unMeta(stack.Pop()).(val.Decimal)
+			lhs := unMeta(stack.Pop()).(val.Decimal)
+			stack.Push(lhs.Sub(rhs))
+
+		case inst.MulDecimal:
+			rhs := unMeta(stack.Pop()).(val.Decimal)
+			lhs := unMeta(stack.Pop()).(val.Decimal)
+			d := lhs.Mul(rhs)
+			if e := checkDecimalScale(`mulDecimal`, int64(d.Scale)); e != nil {
+				return nil, e
+			}
+			stack.Push(d)
+
+		case inst.DivideDecimal:
+			rhs := unMeta(stack.Pop()).(val.Decimal)
+			lhs := unMeta(stack.Pop()).(val.Decimal)
+			q, ok := lhs.Quo(rhs, decimalDivisionScale(lhs, rhs), val.RoundHalfEven)
+			if !ok {
+				return nil, err.ExecutionError{
+					Problem: `divDecimal: division by zero`,
+				}
+			}
+			stack.Push(q)
+
+		case inst.GreaterDecimal:
+			rhs := unMeta(stack.Pop()).(val.Decimal)
+			lhs := unMeta(stack.Pop()).(val.Decimal)
+			stack.Push(val.Bool(lhs.Cmp(rhs) > 0))
+
+		case inst.LessDecimal:
+			rhs := unMeta(stack.Pop()).(val.Decimal)
+			lhs := unMeta(stack.Pop()).(val.Decimal)
+			stack.Push(val.Bool(lhs.Cmp(rhs) < 0))
+
+		case inst.RoundDecimal:
+			scale := unMeta(stack.Pop()).(val.Int64)
+			d := unMeta(stack.Pop()).(val.Decimal)
+			if e := checkDecimalScale(`roundDecimal`, int64(scale)); e != nil {
+				return nil, e
+			}
+			stack.Push(d.Round(int32(scale), it.Mode))
+
+		case inst.AnyList, inst.EveryList:
+			// any stops at the first true, every at the first false
+			until, predicate := true, inst.Sequence(nil)
+			switch it := it.(type) {
+			case inst.AnyList:
+				predicate = it.Expression
+			case inst.EveryList:
+				until, predicate = false, it.Expression
+			}
+			found, i := false, int64(0)
+			stop := &err.ExecutionError{} // placeholder
+			e := iteratorOf(stack.Pop()).forEach(func(v val.Value) err.Error {
+				r, e := vm.Execute(predicate, scope.Child(), val.Int64(i), v)
+				if e != nil {
+					return e
+				}
+				i++
+				if bool(unMeta(r).(val.Bool)) == until {
+					found = true
+					return stop
+				}
+				return nil // continue
+			})
+			if e == stop {
+				e = nil
+			}
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(val.Bool(found == until))
+
+		case inst.TakeWhileList:
+			v, e := listOrIterator(stack.Pop(), func(sub iterator) iterator {
+				return newTakeWhileIterator(sub, func(i int, v val.Value) (bool, err.Error) {
+					r, e := vm.Execute(it.Expression, scope.Child(), val.Int64(i), v)
+					if e != nil {
+						return false, e
+					}
+					return bool(unMeta(r).(val.Bool)), nil
+				})
+			})
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(v)
+
+		case inst.ZipLists:
+			rhs, e := iteratorToList(iteratorOf(stack.Pop())) // order matters
+			if e != nil {
+				return nil, e
+			}
+			v, e := listOrIterator(stack.Pop(), func(sub iterator) iterator {
+				return newZipIterator(sub, rhs)
+			})
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(v)
+
+		case inst.ChunkList:
+			size := unMeta(stack.Pop()).(val.Int64)
+			if size < 1 {
+				return nil, err.ExecutionError{
+					Problem: fmt.Sprintf(`chunkList: size must be positive, have: %d`, size),
+				}
+			}
+			v, e := listOrIterator(stack.Pop(), func(sub iterator) iterator {
+				return newChunkIterator(sub, int(size))
+			})
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(v)
+
+		case inst.DistinctList:
+			v, e := listOrIterator(stack.Pop(), func(sub iterator) iterator {
+				return newDistinctIterator(sub)
+			})
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(v)
+
+		case inst.FlattenList:
+			v, e := listOrIterator(stack.Pop(), func(sub iterator) iterator {
+				return newFlattenIterator(sub)
+			})
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(v)
+
+		case inst.IndexOf:
+			vl := unMeta(stack.Pop())
+			index, i := int64(-1), int64(0)
+			stop := &err.ExecutionError{} // placeholder
+			e := iteratorOf(stack.Pop()).forEach(func(v val.Value) err.Error {
+				if v.Equals(vl) {
+					index = i
+					return stop
+				}
+				i++
+				return nil // continue
+			})
+			if e == stop {
+				e = nil
+			}
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(val.Int64(index))
+
+		case inst.Range:
+			step := unMeta(stack.Pop()).(val.Int64)
+			to := unMeta(stack.Pop()).(val.Int64)
+			from := unMeta(stack.Pop()).(val.Int64)
+			if step == 0 {
+				return nil, err.ExecutionError{
+					Problem: `range: step must not be zero`,
+				}
+			}
+			stack.Push(iteratorValue{newRangeIterator(int64(from), int64(to), int64(step))})
+
+		case inst.InSet:
+			v := unMeta(stack.Pop())
+			s := unMeta(stack.Pop()).(val.Set)
+			_, ok := s[val.Hash(v, nil).Sum64()]
+			stack.Push(val.Bool(ok))
+
+		case inst.SetUnion:
+			rhs := unMeta(stack.Pop()).(val.Set) // order matters
+			lhs := unMeta(stack.Pop()).(val.Set) // order matters
+			c := make(val.Set, len(lhs)+len(rhs))
+			for k, v := range lhs {
+				c[k] = v
+			}
+			for k, v := range rhs {
+				c[k] = v
+			}
+			stack.Push(c)
+
+		case inst.SetIntersection:
+			rhs := unMeta(stack.Pop()).(val.Set) // order matters
+			lhs := unMeta(stack.Pop()).(val.Set) // order matters
+			c := make(val.Set)
+			for k, v := range lhs {
+				if _, ok := rhs[k]; ok {
+					c[k] = v
+				}
+			}
+			stack.Push(c)
+
+		case inst.SetDifference:
+			rhs := unMeta(stack.Pop()).(val.Set) // order matters
+			lhs := unMeta(stack.Pop()).(val.Set) // order matters
+			c := make(val.Set, len(lhs))
+			for k, v := range lhs {
+				if _, ok := rhs[k]; !ok {
+					c[k] = v
+				}
+			}
+			stack.Push(c)
+
+		case inst.IsSubset:
+			rhs := unMeta(stack.Pop()).(val.Set) // order matters
+			lhs := unMeta(stack.Pop()).(val.Set) // order matters
+			subset := val.Bool(len(lhs) <= len(rhs))
+			for k, _ := range lhs {
+				if !subset {
+					break
+				}
+				_, subset = rhs[k]
+			}
+			stack.Push(subset)
+
+		case inst.ListToSet:
+			c := make(val.Set)
+			e := iteratorOf(stack.Pop()).forEach(func(v val.Value) err.Error {
+				c[val.Hash(v, nil).Sum64()] = v
+				return nil
+			})
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(c)
+
+		case inst.SetToList:
+			s := unMeta(stack.Pop()).(val.Set)
+			// sets are unordered, sorting by hash at least makes the order stable
+			ks := s.Keys()
+			sort.Slice(ks, func(i, j int) bool { return ks[i] < ks[j] })
+			ls := make(val.List, len(ks))
+			for i, k := range ks {
+				ls[i] = s[k]
+			}
+			stack.Push(ls)
+
+		case inst.MapKeys:
+			m := unMeta(stack.Pop()).(val.Map)
+			ls := make(val.List, 0, m.Len())
+			m.ForEach(func(k string, _ val.Value) bool {
+				ls = append(ls, val.String(k))
+				return true
+			})
+			stack.Push(ls)
+
+		case inst.MapValues:
+			m := unMeta(stack.Pop()).(val.Map)
+			ls := make(val.List, 0, m.Len())
+			m.ForEach(func(_ string, v val.Value) bool {
+				ls = append(ls, v)
+				return true
+			})
+			stack.Push(ls)
+
+		case inst.MapEntries:
+			m := unMeta(stack.Pop()).(val.Map)
+			ls := make(val.List, 0, m.Len())
+			m.ForEach(func(k string, v val.Value) bool {
+				ls = append(ls, val.StructFromMap(map[string]val.Value{
+					"key":   val.String(k),
+					"value": v,
+				}))
+				return true
+			})
+			stack.Push(ls)
+
+		case inst.MergeMaps:
+			rhs := unMeta(stack.Pop()).(val.Map) // order matters
+			lhs := unMeta(stack.Pop()).(val.Map) // order matters
+			out := lhs.Copy().(val.Map)
+			e := (err.Error)(nil)
+			rhs.ForEach(func(k string, r val.Value) bool {
+				if l, ok := out.Get(k); ok && it.Conflict != nil {
+					r, e = vm.Execute(it.Conflict, scope.Child(), val.String(k), l, r)
+					if e != nil {
+						return false
+					}
+				}
+				out.Set(k, r)
+				return true
+			})
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(out)
+
+		case inst.FilterMap:
+			m := unMeta(stack.Pop()).(val.Map)
+			out := val.NewMap(m.Len())
+			e := (err.Error)(nil)
+			m.ForEach(func(k string, v val.Value) bool {
+				keep, e_ := vm.Execute(it.Expression, scope.Child(), val.String(k), v)
+				if e_ != nil {
+					e = e_
+					return false
+				}
+				if unMeta(keep).(val.Bool) {
+					out.Set(k, v)
+				}
+				return true
+			})
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(out)
+
+		case inst.RemoveKey:
+			k := unMeta(stack.Pop()).(val.String)
+			in := unMeta(stack.Pop()).(val.Map)
+			out := in.Copy().(val.Map)
+			out.Delete(string(k))
+			stack.Push(out)
+
+		case inst.ParseDuration:
+			s := unMeta(stack.Pop()).(val.String)
+			d, e := time.ParseDuration(strings.TrimSpace(string(s)))
+			if e != nil {
+				return nil, err.ExecutionError{
+					Problem: fmt.Sprintf(`parseDuration: invalid duration: %q`, s),
+				}
+			}
+			stack.Push(val.Duration(d))
+
+		case inst.TruncateDateTime:
+			loc, e := loadLocation(string(unMeta(stack.Pop()).(val.String)))
+			if e != nil {
+				return nil, e
+			}
+			t := unMeta(stack.Pop()).(val.DateTime)
+			stack.Push(val.DateTime{truncateDateTime(t.Time, it.Unit, loc)})
+
+		case inst.ExtractDateTime:
+			loc, e := loadLocation(string(unMeta(stack.Pop()).(val.String)))
+			if e != nil {
+				return nil, e
+			}
+			t := unMeta(stack.Pop()).(val.DateTime)
+			stack.Push(val.Int64(dateTimeComponent(t.Time, it.Component, loc)))
+
+		case inst.FormatDateTime:
+			loc, e := loadLocation(string(unMeta(stack.Pop()).(val.String)))
+			if e != nil {
+				return nil, e
+			}
+			layout := unMeta(stack.Pop()).(val.String)
+			t := unMeta(stack.Pop()).(val.DateTime)
+			stack.Push(val.String(t.Time.In(loc).Format(string(layout))))
+
+		case inst.ParseDateTime:
+			loc, e := loadLocation(string(unMeta(stack.Pop()).(val.String)))
+			if e != nil {
+				return nil, e
+			}
+			layout := unMeta(stack.Pop()).(val.String)
+			s := unMeta(stack.Pop()).(val.String)
+			t, e_ := time.ParseInLocation(string(layout), string(s), loc)
+			if e_ != nil {
+				return nil, err.ExecutionError{
+					Problem: fmt.Sprintf(`parseDateTime: %q does not match layout %q`, s, layout),
+				}
+			}
+			stack.Push(val.DateTime{t})
+
 		case inst.OrList:
 
 			switch ls := unMeta(stack.Pop()).(type) {
@@ -1010,10 +1800,11 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 
 		case inst.AllReferrers:
 			v := unMeta(stack.Pop()).(val.Ref)
+			vm.read(anyModel)
 			bucket := vm.RootBucket.Bucket(definitions.PhargBucketBytes).Bucket(encodeVertex(v[0], v[1]))
 			ls := (val.List)(nil)
 			if bucket != nil {
-				ls = make(val.List, 0, bucket.Stats().KeyN)
+				ls = make(val.List, 0, bucket.KeyN())
 				e := bucket.ForEach(func(k, _ []byte) error {
 					m, i := decodeVertex(k)
 					ls = append(ls, val.Ref{m, i})
@@ -1186,8 +1977,16 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 
 		case inst.Key:
 			k := unMeta(stack.Pop()).(val.String)
-			m := unMeta(stack.Pop()).(val.Map)
-			if v, ok := m.Get(string(k)); ok {
+			v, ok := val.Value(nil), false
+			switch m := unMeta(stack.popView()).(type) {
+			case *karma.Lazy:
+				v, ok = m.Key(string(k))
+			case val.Map:
+				v, ok = m.Get(string(k))
+			default:
+				log.Panicf("Execute: Key: unexpected type on stack: %T", m)
+			}
+			if ok {
 				stack.Push(v)
 			} else {
 				stack.Push(val.Null)
@@ -1212,7 +2011,14 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 			stack.Push(val.String(b))
 
 		case inst.IndexTuple:
-			stack.Push(unMeta(stack.Pop()).(val.Tuple)[it.Number])
+			switch v := unMeta(stack.popView()).(type) {
+			case *karma.Lazy:
+				stack.Push(v.Index(it.Number))
+			case val.Tuple:
+				stack.Push(v[it.Number])
+			default:
+				log.Panicf("Execute: IndexTuple: unexpected type on stack: %T", v)
+			}
 
 		case inst.SetField:
 			in := unMeta(stack.Pop()).(val.Struct)
@@ -1227,13 +2033,20 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 			stack.Push(out)
 
 		case inst.Field:
-			stack.Push(unMeta(stack.Pop()).(val.Struct).Field(it.Key))
+			switch v := unMeta(stack.popView()).(type) {
+			case *karma.Lazy:
+				stack.Push(v.Field(it.Key))
+			case val.Struct:
+				stack.Push(v.Field(it.Key))
+			default:
+				log.Panicf("Execute: Field: unexpected type on stack: %T", v)
+			}
 
 		case inst.Metarialize:
 			stack.Push(MaterializeMeta(stack.Pop().(val.Meta)))
 
 		case inst.Meta:
-			mv := stack.Pop().(val.Meta)
+			mv := stack.popView().(val.Meta)
 			switch it.Key {
 			case "id":
 				stack.Push(mv.Id)
@@ -1247,138 +2060,170 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 
 		case inst.MemSortFunction:
 
-			list := (val.List)(nil)
-
-			switch ls := unMeta(stack.Pop()).(type) {
-			case val.List:
-				list = ls.Copy().(val.List)
-			case iteratorValue:
-				l, e := iteratorToList(ls.iterator)
+			s := newSorter(vm.spills, func(a, b sortItem) (bool, err.Error) {
+				v, e := vm.Execute(it.Less, scope, a.value, b.value)
 				if e != nil {
-					return nil, e
+					return false, e
 				}
-				list = l
-			default:
-				log.Panicf("Execute: MemSortFunction: unexpected type on stack: %T.", ls)
-			}
+				return bool(v.(val.Bool)), nil
+			})
 
-			errout := (err.Error)(nil)
-			sort.Slice(list, func(i, j int) bool {
-				v, e := vm.Execute(it.Less, scope, list[i], list[j])
-				if e != nil {
-					if errout == nil {
-						errout = e
-					}
-					return false
-				}
-				return bool(v.(val.Bool))
+			e := iteratorOf(stack.Pop()).forEach(func(item val.Value) err.Error {
+				return s.add(val.Null, item)
 			})
+			if e != nil {
+				s.close()
+				return nil, e
+			}
 
-			stack.Push(list)
+			sorted, e := s.result()
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(sorted)
 
 		case inst.MemSort:
 
-			type sortable struct {
-				comparable, value val.Value
+			less := (func(a, b val.Value) bool)(nil)
+			s := newSorter(vm.spills, func(a, b sortItem) (bool, err.Error) {
+				return less(a.key, b.key), nil
+			})
+
+			e := iteratorOf(stack.Pop()).forEach(func(item val.Value) err.Error {
+				comparable, e := vm.Execute(it.Expression, scope.Child(), item)
+				if e != nil {
+					return e // TODO: add context
+				}
+				if less == nil {
+					less = sortKeyLess(comparable)
+				}
+				return s.add(comparable, item)
+			})
+			if e != nil {
+				s.close()
+				return nil, e
 			}
 
-			expr := it.Expression
-			temp := make([]sortable, 0, 1024)
+			sorted, e := s.result()
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(sorted)
 
-			switch ls := unMeta(stack.Pop()).(type) {
-			case val.List:
-				for _, item := range ls {
-					comparable, e := vm.Execute(expr, scope.Child(), item)
-					if e != nil {
-						return nil, e // TODO: add context
-					}
-					temp = append(temp, sortable{comparable, item})
-				}
-			case iteratorValue:
-				e := ls.iterator.forEach(func(item val.Value) err.Error {
-					comparable, e := vm.Execute(expr, scope.Child(), item)
-					if e != nil {
-						return e
-					}
-					temp = append(temp, sortable{comparable, item})
-					return nil // continue
-				})
+		case inst.TopN:
+			n := unMeta(stack.Pop()).(val.Int64)
+			top, e := topNItems(iteratorOf(stack.Pop()), int(n), func(v val.Value) (val.Value, err.Error) {
+				return vm.Execute(it.Expression, scope.Child(), v)
+			})
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(top)
+
+		case inst.GroupBy:
+			groups := val.NewMap(16)
+			e := iteratorOf(stack.Pop()).forEach(func(item val.Value) err.Error {
+				key, e := vm.Execute(it.Expression, scope.Child(), item)
 				if e != nil {
-					return nil, e // TODO: add context
+					return e
 				}
-			default:
-				log.Panicf("Execute: MemSort: unexpected type on stack: %T.", ls)
+				k := string(unMeta(key).(val.String))
+				group, _ := groups.Get(k)
+				if group == nil {
+					group = make(val.List, 0, 8)
+				}
+				groups.Set(k, append(group.(val.List), item))
+				return nil
+			})
+			if e != nil {
+				return nil, e
 			}
+			stack.Push(groups)
 
-			if len(temp) == 0 {
+		case inst.Sum:
+			v, e := sumValues(iteratorOf(stack.Pop()), it.Zero)
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(v)
 
-				stack.Push(make(val.List, 0, 0))
+		case inst.Avg:
+			v, e := avgValues(iteratorOf(stack.Pop()))
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(v)
 
-			} else {
+		case inst.Min:
+			v, e := extremeValue(iteratorOf(stack.Pop()), false)
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(v)
 
-				var lessFunc func(i, j int) bool
+		case inst.Max:
+			v, e := extremeValue(iteratorOf(stack.Pop()), true)
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(v)
 
-				switch temp[0].comparable.(type) {
-				case val.Float:
-					lessFunc = func(i, j int) bool {
-						return temp[i].comparable.(val.Float) < temp[j].comparable.(val.Float)
-					}
-				case val.Bool:
-					lessFunc = func(i, j int) bool {
-						return bool(!temp[i].comparable.(val.Bool) && temp[j].comparable.(val.Bool))
-					}
-				case val.String:
-					lessFunc = func(i, j int) bool {
-						return temp[i].comparable.(val.String) < temp[j].comparable.(val.String)
-					}
-				case val.DateTime:
-					lessFunc = func(i, j int) bool {
-						return temp[i].comparable.(val.DateTime).Time.Before(
-							temp[j].comparable.(val.DateTime).Time,
-						)
-					}
-				case val.Int8:
-					lessFunc = func(i, j int) bool {
-						return temp[i].comparable.(val.Int8) < temp[j].comparable.(val.Int8)
-					}
-				case val.Int16:
-					lessFunc = func(i, j int) bool {
-						return temp[i].comparable.(val.Int16) < temp[j].comparable.(val.Int16)
-					}
-				case val.Int32:
-					lessFunc = func(i, j int) bool {
-						return temp[i].comparable.(val.Int32) < temp[j].comparable.(val.Int32)
-					}
-				case val.Int64:
-					lessFunc = func(i, j int) bool {
-						return temp[i].comparable.(val.Int64) < temp[j].comparable.(val.Int64)
-					}
-				case val.Uint8:
-					lessFunc = func(i, j int) bool {
-						return temp[i].comparable.(val.Uint8) < temp[j].comparable.(val.Uint8)
-					}
-				case val.Uint16:
-					lessFunc = func(i, j int) bool {
-						return temp[i].comparable.(val.Uint16) < temp[j].comparable.(val.Uint16)
-					}
-				case val.Uint32:
-					lessFunc = func(i, j int) bool {
-						return temp[i].comparable.(val.Uint32) < temp[j].comparable.(val.Uint32)
-					}
-				case val.Uint64:
-					lessFunc = func(i, j int) bool {
-						return temp[i].comparable.(val.Uint64) < temp[j].comparable.(val.Uint64)
-					}
-				}
+		case inst.CountDistinct:
+			v, e := countDistinctValues(iteratorOf(stack.Pop()))
+			if e != nil {
+				return nil, e
+			}
+			stack.Push(v)
+
+		case inst.HashJoin:
+			right, left := iteratorOf(stack.Pop()), iteratorOf(stack.Pop())
+			stack.Push(iteratorValue{
+				newHashJoinIterator(left, right,
+					func(v val.Value) (val.Value, err.Error) {
+						return vm.Execute(it.LeftKey, scope.Child(), v)
+					},
+					func(v val.Value) (val.Value, err.Error) {
+						return vm.Execute(it.RightKey, scope.Child(), v)
+					},
+					func(l, r val.Value) val.Value {
+						return joinValues(l, r, it.Merge)
+					},
+				),
+			})
 
-				sort.Slice(temp, lessFunc)
+		case inst.RefJoin:
+			stack.Push(iteratorValue{
+				newRefJoinIterator(iteratorOf(stack.Pop()),
+					func(v val.Value) ([]val.Value, err.Error) {
+						return vm.adjacentObjects(v.(val.Meta).Id, it.In, it.Referrers)
+					},
+					func(l, r val.Value) val.Value {
+						return joinValues(l, r, it.Merge)
+					},
+				),
+			})
 
-				out := make(val.List, len(temp), len(temp))
-				for i, sortable := range temp {
-					out[i] = sortable.value
+		case inst.LookupEncrypted:
+			if vm.redact { // comparing values is reading them
+				return nil, err.PermissionDeniedError{err.ExecutionError{
+					Problem: `lookupEncrypted: only users reading encrypted values decrypted may look them up`,
+				}}
+			}
+			value := unMeta(stack.Pop())
+			vm.read(it.In)
+			found := val.List(nil)
+			for _, id := range vm.lookupEncrypted(it.In, it.Path, value) {
+				v, e := vm.get(it.In, id)
+				if e != nil {
+					return nil, e
 				}
-				stack.Push(out)
+				found = append(found, v)
+			}
+			iter := iterator(newListIterator(found))
+			if vm.permissions != nil && vm.permissions.read != nil && !grantsAll(vm.permissions.read) {
+				iter = vm.newReadPermissionFilterIterator(iter)
 			}
+			stack.Push(iteratorValue{iter})
 
 		case inst.Deref:
 			rf := unMeta(stack.Pop()).(val.Ref)
@@ -1883,6 +2728,10 @@ func (vm VirtualMachine) Execute(program inst.Sequence, scope *ValueScope, args
 
 	}
 
+	if vm.Profile != nil {
+		vm.Profile.record(program, len(program)-1, time.Since(started), stack)
+	}
+
 	if stack.Len() != 1 {
 		log.Panicf("Execute: stack had %d elements after execution.", stack.Len())
 	}
@@ -0,0 +1,389 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"fmt"
+	"karma.run/kvm/err"
+	"karma.run/kvm/inst"
+	"karma.run/kvm/mdl"
+	"karma.run/kvm/val"
+	"karma.run/kvm/xpr"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Explanation describes how a program would be executed, without executing it.
+type Explanation struct {
+	Function     xpr.TypedFunction
+	Instructions inst.Sequence
+	Scans        []Scan
+	Cost         Cost
+	metaId       string
+}
+
+// Scan is a full iteration over the objects of a model.
+type Scan struct {
+	Model   string
+	Objects int // number of objects in the model's bucket, -1 unless the user may read all objects
+	Nested  bool
+}
+
+// Cost is a rough estimate of the work a program does.
+type Cost struct {
+	Instructions int // compiled instructions, nested sequences included
+	ObjectReads  int // objects decoded by scans, nested scans assumed to run once per scanned object, -1 if a scan's objects aren't counted
+}
+
+// Explain types and compiles v like ParseAndCompile, bypassing the compiler cache,
+// and lists the buckets the compiled program scans. Function is as typed, Instructions
+// are optimized. Objects are only counted if the user may read all of them, as the
+// counts would tell others how many objects they can't read.
+func (vm VirtualMachine) Explain(v val.Value, scope *ModelScope, parameters []mdl.Model, expect mdl.Model) (Explanation, err.Error) {
+
+	if e := vm.lazyLoadPermissions(); e != nil {
+		return Explanation{}, e
+	}
+
+	typed, e := vm.Parse(v, scope, parameters, expect)
+	if e != nil {
+		return Explanation{}, e
+	}
+
+	instructions, e := vm.compile(vm.Optimize(typed))
+	if e != nil {
+		return Explanation{}, e
+	}
+
+	x := Explanation{
+		Function:     typed,
+		Instructions: instructions,
+		metaId:       vm.MetaModelId(),
+	}
+
+	x.Cost.Instructions = vm.explainScans(x.Instructions, false, &x.Scans)
+
+	outer := 0
+	for _, s := range x.Scans {
+		if s.Objects < 0 {
+			x.Cost.ObjectReads = -1
+			return x, nil
+		}
+		if !s.Nested {
+			outer += s.Objects
+		}
+	}
+	for _, s := range x.Scans {
+		if s.Nested {
+			x.Cost.ObjectReads += s.Objects * outer
+		} else {
+			x.Cost.ObjectReads += s.Objects
+		}
+	}
+
+	return x, nil
+}
+
+// explainScans collects the scans of is and returns its instruction count.
+// an inst.All or inst.SliceAll scans the model that its constant argument refers to.
+func (vm VirtualMachine) explainScans(is inst.Sequence, nested bool, scans *[]Scan) int {
+	counted := vm.permissions == nil || vm.permissions.read == nil || grantsAll(vm.permissions.read)
+	count := len(is)
+	for pc, it := range is {
+		model := -1 // position of the constant model of a scan
+		switch it.(type) {
+		case inst.All:
+			model = pc - 1
+		case inst.SliceAll:
+			model = pc - 3 // followed by constant offset and length
+		}
+		if model >= 0 {
+			if ct, ok := is[model].(inst.Constant); ok {
+				if ref, ok := ct.Value.(val.Ref); ok {
+					s := Scan{Model: ref[1], Nested: nested, Objects: -1}
+					if counted {
+						s.Objects = 0
+						if bk := vm.RootBucket.Bucket([]byte(ref[1])); bk != nil {
+							s.Objects = bk.KeyN()
+						}
+					}
+					*scans = append(*scans, s)
+				}
+			}
+		}
+		forEachSequence(reflect.ValueOf(it), func(sub inst.Sequence) {
+			count += vm.explainScans(sub, true, scans)
+		})
+	}
+	return count
+}
+
+func forEachSequence(rv reflect.Value, f func(inst.Sequence)) {
+	switch rv.Kind() {
+	case reflect.Struct:
+		for i := 0; i < rv.NumField(); i++ {
+			forEachSequence(rv.Field(i), f)
+		}
+	case reflect.Map:
+		for _, k := range rv.MapKeys() {
+			forEachSequence(rv.MapIndex(k), f)
+		}
+	case reflect.Slice:
+		if sub, ok := rv.Interface().(inst.Sequence); ok {
+			f(sub)
+		}
+	}
+}
+
+// explained is the common form of typed expressions and instructions,
+// rendered by both Value and String.
+type explained struct {
+	name      string
+	model     mdl.Model // nil for instructions and untyped expressions
+	constant  bool
+	value     val.Value // for leaves
+	arguments []explainedArgument
+}
+
+type explainedArgument struct {
+	key  string // empty for positional arguments
+	node explained
+}
+
+func explainExpression(x xpr.Expression) explained {
+	n := explained{}
+	if t, ok := x.(xpr.TypedExpression); ok {
+		n.model = t.Actual
+		_, n.constant = t.Actual.(ConstantModel)
+		x = t.Expression
+	}
+	if u, ok := xpr.ValueFromExpression(x).(val.Union); ok {
+		n.name = u.Case
+	} else {
+		n.name = reflect.TypeOf(x).Name()
+	}
+	n.arguments, n.value = explainArguments(reflect.ValueOf(x))
+	return n
+}
+
+func explainFunction(f xpr.Function) explained {
+	n := explained{name: "function(" + strings.Join(f.Parameters(), ", ") + ")"}
+	if t, ok := f.(xpr.TypedFunction); ok {
+		n.model = t.Actual
+	}
+	for _, x := range f.Expressions() {
+		n.arguments = append(n.arguments, explainedArgument{"", explainExpression(x)})
+	}
+	return n
+}
+
+func explainInstruction(i inst.Instruction) explained {
+	n := explained{name: reflect.TypeOf(i).Name()}
+	n.arguments, n.value = explainArguments(reflect.ValueOf(i))
+	return n
+}
+
+func explainSequence(is inst.Sequence) explained {
+	n := explained{name: "sequence"}
+	for _, i := range is {
+		n.arguments = append(n.arguments, explainedArgument{"", explainInstruction(i)})
+	}
+	return n
+}
+
+var (
+	expressionType  = reflect.TypeOf((*xpr.Expression)(nil)).Elem()
+	functionType    = reflect.TypeOf((*xpr.Function)(nil)).Elem()
+	valueType       = reflect.TypeOf((*val.Value)(nil)).Elem()
+	sequenceType    = reflect.TypeOf(inst.Sequence(nil))
+	instructionType = reflect.TypeOf((*inst.Instruction)(nil)).Elem()
+)
+
+// explainArguments splits the fields of rv into sub-expressions, functions and
+// sequences on one hand and plain values, returned as leaf value, on the other.
+func explainArguments(rv reflect.Value) ([]explainedArgument, val.Value) {
+
+	args, leaves := []explainedArgument(nil), val.NewStruct(0)
+
+	add := func(key string, v reflect.Value) {
+		if v.Kind() == reflect.Interface && v.IsNil() {
+			return
+		}
+		switch {
+		case v.Type() == sequenceType:
+			args = append(args, explainedArgument{key, explainSequence(v.Interface().(inst.Sequence))})
+		case v.Type().Implements(functionType) && !v.Type().Implements(expressionType):
+			args = append(args, explainedArgument{key, explainFunction(v.Interface().(xpr.Function))})
+		case v.Type().Implements(expressionType) && !v.Type().Implements(valueType):
+			args = append(args, explainedArgument{key, explainExpression(v.Interface().(xpr.Expression))})
+		case v.Type().Implements(instructionType):
+			args = append(args, explainedArgument{key, explainInstruction(v.Interface().(inst.Instruction))})
+		case v.Type().Implements(valueType):
+			leaves.Set(key, v.Interface().(val.Value))
+		case structural(v.Type()):
+			sub, leaf := explainArguments(v)
+			name := "list"
+			if v.Kind() == reflect.Map {
+				name = "map"
+			}
+			args = append(args, explainedArgument{key, explained{name: name, value: leaf, arguments: sub}})
+		default:
+			leaves.Set(key, val.String(fmt.Sprint(v.Interface())))
+		}
+	}
+
+	switch rv.Kind() {
+	case reflect.Struct:
+		for i := 0; i < rv.NumField(); i++ {
+			if rv.Type().Field(i).PkgPath != "" {
+				continue // unexported
+			}
+			add(strings.ToLower(rv.Type().Field(i).Name[:1])+rv.Type().Field(i).Name[1:], rv.Field(i))
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			add(fmt.Sprint(i), rv.Index(i))
+		}
+	case reflect.Map:
+		ks := rv.MapKeys()
+		sort.Slice(ks, func(i, j int) bool { return fmt.Sprint(ks[i].Interface()) < fmt.Sprint(ks[j].Interface()) })
+		for _, k := range ks {
+			add(fmt.Sprint(k.Interface()), rv.MapIndex(k))
+		}
+	default:
+		return nil, val.String(fmt.Sprint(rv.Interface()))
+	}
+
+	if leaves.Len() == 0 {
+		return args, nil
+	}
+	if leaves.Len() == 1 && len(args) == 0 {
+		leaf := val.Value(nil)
+		leaves.ForEach(func(_ string, v val.Value) bool {
+			leaf = v
+			return false
+		})
+		return nil, leaf // e.g. the value of a literal or a constant
+	}
+	return args, leaves
+}
+
+// structural reports whether t is a container of expressions, functions or instructions.
+func structural(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array:
+		e := t.Elem()
+		return e == sequenceType || e.Implements(expressionType) || e.Implements(functionType) || e.Implements(instructionType) || structural(e)
+	}
+	return false
+}
+
+func (n explained) Value(metaId string) val.Value {
+	s := val.StructFromMap(map[string]val.Value{
+		"name": val.String(n.name),
+	})
+	if n.model != nil {
+		s.Set("model", mdl.ValueFromModel(metaId, n.model, nil))
+		s.Set("constant", val.Bool(n.constant))
+	}
+	if n.value != nil {
+		s.Set("value", n.value)
+	}
+	if len(n.arguments) > 0 {
+		args := make(val.List, len(n.arguments), len(n.arguments))
+		for i, a := range n.arguments {
+			arg := a.node.Value(metaId).(val.Struct)
+			if a.key != "" {
+				arg.Set("key", val.String(a.key))
+			}
+			args[i] = arg
+		}
+		s.Set("arguments", args)
+	}
+	return s
+}
+
+func (n explained) human(key string, indent int) string {
+	out := strings.Repeat("  ", indent)
+	if key != "" {
+		out += key + ": "
+	}
+	out += n.name
+	if n.value != nil {
+		out += " " + err.ValueToHuman(n.value)
+	}
+	if n.model != nil {
+		out += " :: " + strings.Replace(mdl.ModelToHuman(n.model), "\n", "\n"+strings.Repeat("  ", indent+2), -1)
+		if n.constant {
+			out += " (constant)"
+		}
+	}
+	out += "\n"
+	for _, a := range n.arguments {
+		out += a.node.human(a.key, indent+1)
+	}
+	return out
+}
+
+func (x Explanation) Value() val.Value {
+	scans := make(val.List, len(x.Scans), len(x.Scans))
+	for i, s := range x.Scans {
+		scan := val.StructFromMap(map[string]val.Value{
+			"model":  val.Ref{x.metaId, s.Model},
+			"nested": val.Bool(s.Nested),
+		})
+		if s.Objects >= 0 {
+			scan.Set("objects", val.Int64(s.Objects))
+		}
+		scans[i] = scan
+	}
+	cost := val.StructFromMap(map[string]val.Value{
+		"instructions": val.Int64(x.Cost.Instructions),
+	})
+	if x.Cost.ObjectReads >= 0 {
+		cost.Set("objectReads", val.Int64(x.Cost.ObjectReads))
+	}
+	return val.StructFromMap(map[string]val.Value{
+		"function":     explainFunction(x.Function).Value(x.metaId),
+		"instructions": explainSequence(x.Instructions).Value(x.metaId),
+		"scans":        scans,
+		"cost":         cost,
+	})
+}
+
+func (x Explanation) String() string {
+	out := "Program\n"
+	out += "=======\n"
+	out += err.ProgramToHuman(xpr.ValueFromFunction(x.Function), 0) + "\n\n"
+	out += "Typed\n"
+	out += "=====\n"
+	out += explainFunction(x.Function).human("", 0) + "\n"
+	out += "Instructions\n"
+	out += "============\n"
+	out += explainSequence(x.Instructions).human("", 0) + "\n"
+	out += "Scans\n"
+	out += "=====\n"
+	if len(x.Scans) == 0 {
+		out += "none\n"
+	}
+	for _, s := range x.Scans {
+		nested := ""
+		if s.Nested {
+			nested = ", nested"
+		}
+		if s.Objects < 0 {
+			out += fmt.Sprintf("model %s%s\n", s.Model, nested)
+		} else {
+			out += fmt.Sprintf("model %s: %d objects%s\n", s.Model, s.Objects, nested)
+		}
+	}
+	out += "\n"
+	out += "Cost\n"
+	out += "====\n"
+	out += fmt.Sprintf("instructions: %d\n", x.Cost.Instructions)
+	if x.Cost.ObjectReads >= 0 {
+		out += fmt.Sprintf("object reads: %d\n", x.Cost.ObjectReads)
+	}
+	return out
+}
@@ -3,6 +3,7 @@
 package inst
 
 import (
+	"golang.org/x/text/unicode/norm"
 	"karma.run/kvm/val"
 	"regexp"
 )
@@ -22,8 +23,110 @@ type Substring struct{}
 type DateTimeNow struct{}
 
 type DateTimeDiff struct{}
+type AddDuration struct{}
+type SubDuration struct{}
+type ParseDuration struct{}
+type FormatDateTime struct{}
+type ParseDateTime struct{}
+
+type TruncateDateTime struct {
+	Unit string
+}
+
+type ExtractDateTime struct {
+	Component string
+}
+
+// see xpr.IntegerOperation
+type IntegerOperation struct {
+	Op      string
+	Type    string
+	Checked bool
+}
+
+type AbsInteger struct {
+	Type    string
+	Checked bool
+}
+
+type ToIntegerChecked struct {
+	Type string
+}
+
+type ToDecimal struct{}
+type AddDecimal struct{}
+type SubDecimal struct{}
+type MulDecimal struct{}
+type DivideDecimal struct{}
+type GreaterDecimal struct{}
+type LessDecimal struct{}
+
+type RoundDecimal struct {
+	Mode val.RoundingMode
+}
+
+type SetUnion struct{}
+type SetIntersection struct{}
+type SetDifference struct{}
+type IsSubset struct{}
+type InSet struct{}
+type ListToSet struct{}
+type SetToList struct{}
+
+type MapKeys struct{}
+type MapValues struct{}
+type MapEntries struct{}
+type RemoveKey struct{}
+
+type MergeMaps struct {
+	Conflict Sequence // nil if right wins
+}
+
+type FilterMap struct {
+	Expression Sequence
+}
+
+type AnyList struct {
+	Expression Sequence
+}
+
+type EveryList struct {
+	Expression Sequence
+}
+
+type TakeWhileList struct {
+	Expression Sequence
+}
+
+type ZipLists struct{}
+type ChunkList struct{}
+type DistinctList struct{}
+type FlattenList struct{}
+type IndexOf struct{}
+type Range struct{}
 
 type StringToLower struct{}
+type StringToUpper struct{}
+type TrimString struct{}
+type ParseInt64 struct{}
+type ParseFloat struct{}
+type StringReplace struct{}
+type SplitString struct{}
+type RepeatString struct{}
+type StringStartsWith struct{}
+type StringEndsWith struct{}
+
+type PadString struct {
+	Left bool
+}
+
+type ReplaceRegex struct {
+	Regex *regexp.Regexp
+}
+
+type NormalizeString struct {
+	Form norm.Form
+}
 
 type AssertPresent struct{}
 
@@ -95,6 +198,36 @@ type If struct {
 	Then, Else Sequence
 }
 
+type Try struct {
+	Value, Catch Sequence
+	Errors       map[string]struct{} // nil catches all catchable errors
+}
+
+type OrElse struct {
+	Value, Default Sequence
+}
+
+// instructions below are only emitted by the optimizer, see kvm.VirtualMachine.Optimize
+
+// FilterFirst is First applied to Filter, stopping at the first match.
+type FilterFirst struct {
+	Expression Sequence
+}
+
+// FilterLength is Length applied to Filter, counting without collecting.
+type FilterLength struct {
+	Expression Sequence
+}
+
+// SliceAll is Slice applied to All, skipping objects without decoding them.
+type SliceAll struct{}
+
+// DefineLazy defines Name as the value of Expression, evaluated on first use.
+type DefineLazy struct {
+	Name       string
+	Expression Sequence
+}
+
 type AssertCase struct {
 	Case string
 }
@@ -333,10 +466,53 @@ type MemSort struct {
 	Expression Sequence
 }
 
+type TopN struct {
+	Expression Sequence
+}
+
+type GroupBy struct {
+	Expression Sequence
+}
+
+type Sum struct {
+	Zero val.Value // result for empty lists, determines number type
+}
+
+type Avg struct{}
+
+type Min struct{}
+
+type Max struct{}
+
+type CountDistinct struct{}
+
+type HashJoin struct {
+	LeftKey  Sequence
+	RightKey Sequence
+	Merge    bool
+}
+
+type RefJoin struct {
+	In        string
+	Referrers bool // referred if false
+	Merge     bool
+}
+
+type LookupEncrypted struct {
+	In   string
+	Path []string
+}
+
 type With struct {
 	Expression Sequence
 }
 
+// Call pops Arity arguments and runs Expression on them in a fresh scope
+type Call struct {
+	Arity      int
+	Expression Sequence
+}
+
 type SubstringIndex struct{}
 
 type MemSortFunction struct {
@@ -502,6 +678,7 @@ func (MapSet) _inst()            {}
 func (IsCase) _inst()            {}
 func (PresentOrConstant) _inst() {}
 func (MemSort) _inst()           {}
+func (TopN) _inst()              {}
 func (ReverseList) _inst()       {}
 func (StringToLower) _inst()     {}
 func (ConcatLists) _inst()       {}
@@ -509,6 +686,7 @@ func (SearchAllRegex) _inst()    {}
 func (SearchRegex) _inst()       {}
 func (ToString) _inst()          {}
 func (With) _inst()              {}
+func (Call) _inst()              {}
 func (AllReferrers) _inst()      {}
 func (BuildSet) _inst()          {}
 func (Scope) _inst()             {}
@@ -519,3 +697,70 @@ func (MemSortFunction) _inst()   {}
 func (LeftFoldList) _inst()      {}
 func (RightFoldList) _inst()     {}
 func (MapEnum) _inst()           {}
+func (GroupBy) _inst()           {}
+func (Sum) _inst()               {}
+func (Avg) _inst()               {}
+func (Min) _inst()               {}
+func (Max) _inst()               {}
+func (CountDistinct) _inst()     {}
+func (HashJoin) _inst()          {}
+func (RefJoin) _inst()           {}
+func (LookupEncrypted) _inst()   {}
+func (StringToUpper) _inst()     {}
+func (TrimString) _inst()        {}
+func (ParseInt64) _inst()        {}
+func (ParseFloat) _inst()        {}
+func (StringReplace) _inst()     {}
+func (SplitString) _inst()       {}
+func (RepeatString) _inst()      {}
+func (StringStartsWith) _inst()  {}
+func (StringEndsWith) _inst()    {}
+func (PadString) _inst()         {}
+func (ReplaceRegex) _inst()      {}
+func (NormalizeString) _inst()   {}
+func (AddDuration) _inst()       {}
+func (SubDuration) _inst()       {}
+func (ParseDuration) _inst()     {}
+func (TruncateDateTime) _inst()  {}
+func (ExtractDateTime) _inst()   {}
+func (FormatDateTime) _inst()    {}
+func (ParseDateTime) _inst()     {}
+func (IntegerOperation) _inst()  {}
+func (AbsInteger) _inst()        {}
+func (ToIntegerChecked) _inst()  {}
+func (ToDecimal) _inst()         {}
+func (AddDecimal) _inst()        {}
+func (SubDecimal) _inst()        {}
+func (MulDecimal) _inst()        {}
+func (DivideDecimal) _inst()     {}
+func (GreaterDecimal) _inst()    {}
+func (LessDecimal) _inst()       {}
+func (RoundDecimal) _inst()      {}
+func (SetUnion) _inst()          {}
+func (SetIntersection) _inst()   {}
+func (SetDifference) _inst()     {}
+func (IsSubset) _inst()          {}
+func (InSet) _inst()             {}
+func (ListToSet) _inst()         {}
+func (SetToList) _inst()         {}
+func (MapKeys) _inst()           {}
+func (MapValues) _inst()         {}
+func (MapEntries) _inst()        {}
+func (RemoveKey) _inst()         {}
+func (MergeMaps) _inst()         {}
+func (FilterMap) _inst()         {}
+func (AnyList) _inst()           {}
+func (EveryList) _inst()         {}
+func (TakeWhileList) _inst()     {}
+func (ZipLists) _inst()          {}
+func (ChunkList) _inst()         {}
+func (DistinctList) _inst()      {}
+func (FlattenList) _inst()       {}
+func (IndexOf) _inst()           {}
+func (Range) _inst()             {}
+func (Try) _inst()               {}
+func (OrElse) _inst()            {}
+func (FilterFirst) _inst()       {}
+func (FilterLength) _inst()      {}
+func (SliceAll) _inst()          {}
+func (DefineLazy) _inst()        {}
@@ -0,0 +1,362 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"fmt"
+	"karma.run/kvm/err"
+	"karma.run/kvm/mdl"
+	"karma.run/kvm/val"
+	"log"
+	"math"
+	"math/bits"
+)
+
+var integerModels = map[string]mdl.Model{
+	"int8":   Int8Model,
+	"int16":  Int16Model,
+	"int32":  Int32Model,
+	"int64":  Int64Model,
+	"uint8":  Uint8Model,
+	"uint16": Uint16Model,
+	"uint32": Uint32Model,
+	"uint64": Uint64Model,
+}
+
+var integerBits = map[string]uint{
+	"int8":   8,
+	"int16":  16,
+	"int32":  32,
+	"int64":  64,
+	"uint8":  8,
+	"uint16": 16,
+	"uint32": 32,
+	"uint64": 64,
+}
+
+func signedBounds(bits uint) (int64, int64) {
+	return -1 << (bits - 1), 1<<(bits-1) - 1
+}
+
+func unsignedBound(bits uint) uint64 {
+	return math.MaxUint64 >> (64 - bits)
+}
+
+func integerOverflow(op, t string) err.Error {
+	return err.ExecutionError{
+		Problem: fmt.Sprintf(`%s: %s overflow`, op, t),
+	}
+}
+
+func integerToInt64(v val.Value) int64 {
+	switch v := v.(type) {
+	case val.Int8:
+		return int64(v)
+	case val.Int16:
+		return int64(v)
+	case val.Int32:
+		return int64(v)
+	case val.Int64:
+		return int64(v)
+	}
+	log.Panicf("integerToInt64: unexpected type: %T", v)
+	return 0
+}
+
+func integerToUint64(v val.Value) uint64 {
+	switch v := v.(type) {
+	case val.Uint8:
+		return uint64(v)
+	case val.Uint16:
+		return uint64(v)
+	case val.Uint32:
+		return uint64(v)
+	case val.Uint64:
+		return uint64(v)
+	}
+	log.Panicf("integerToUint64: unexpected type: %T", v)
+	return 0
+}
+
+// integerValue truncates i to t, wrapping around like go does
+func integerValue(i uint64, t string) val.Value {
+	switch t {
+	case "int8":
+		return val.Int8(i)
+	case "int16":
+		return val.Int16(i)
+	case "int32":
+		return val.Int32(i)
+	case "int64":
+		return val.Int64(i)
+	case "uint8":
+		return val.Uint8(i)
+	case "uint16":
+		return val.Uint16(i)
+	case "uint32":
+		return val.Uint32(i)
+	case "uint64":
+		return val.Uint64(i)
+	}
+	log.Panicf("integerValue: unexpected type: %s", t)
+	return nil
+}
+
+// integerOperation applies op to lhs and rhs, both of integer type t.
+// unless checked, results wrap around on overflow. division by zero is always an error.
+func integerOperation(op, t string, checked bool, lhs, rhs val.Value) (val.Value, err.Error) {
+	if t[0] == 'u' {
+		r, e := unsignedOperation(op, t, checked, integerToUint64(lhs), integerToUint64(rhs))
+		if e != nil {
+			return nil, e
+		}
+		return integerValue(r, t), nil
+	}
+	r, e := signedOperation(op, t, checked, integerToInt64(lhs), integerToInt64(rhs))
+	if e != nil {
+		return nil, e
+	}
+	return integerValue(uint64(r), t), nil
+}
+
+func signedOperation(op, t string, checked bool, a, b int64) (int64, err.Error) {
+
+	n := integerBits[t]
+	min, max := signedBounds(n)
+
+	// r is computed in 64 bits, narrower results are exact and checked against the bounds below
+	var r int64
+	overflow := false
+
+	switch op {
+	case "add":
+		r = a + b
+		overflow = (b > 0 && r < a) || (b < 0 && r > a)
+	case "sub":
+		r = a - b
+		overflow = (b > 0 && r > a) || (b < 0 && r < a)
+	case "mul":
+		r = a * b
+		overflow = a != 0 && (r/a != b || (a == -1 && b == math.MinInt64))
+	case "div", "mod":
+		if b == 0 {
+			return 0, err.ExecutionError{
+				Problem: fmt.Sprintf(`%s: division by zero`, op),
+			}
+		}
+		if op == "mod" {
+			return a % b, nil
+		}
+		r = a / b
+		overflow = a == min && b == -1
+	case "pow":
+		if b < 0 {
+			return 0, err.ExecutionError{
+				Problem: fmt.Sprintf(`pow: negative exponent: %d`, b),
+			}
+		}
+		r = 1
+		for base := a; b > 0; b >>= 1 {
+			if b&1 == 1 {
+				p := r * base
+				overflow = overflow || (r != 0 && (p/r != base || p < min || p > max))
+				r = p
+			}
+			if b > 1 {
+				q := base * base
+				overflow = overflow || (base != 0 && (q/base != base || q < min || q > max))
+				base = q
+			}
+		}
+	case "shiftLeft", "shiftRight":
+		if b < 0 {
+			return 0, err.ExecutionError{
+				Problem: fmt.Sprintf(`%s: negative shift count: %d`, op, b),
+			}
+		}
+		if op == "shiftRight" {
+			return a >> uint64(b), nil
+		}
+		r = a << uint64(b)
+		overflow = a != 0 && (uint64(b) >= uint64(n) || r>>uint64(b) != a)
+	case "min":
+		if a < b {
+			return a, nil
+		}
+		return b, nil
+	case "max":
+		if a > b {
+			return a, nil
+		}
+		return b, nil
+	case "bitAnd":
+		return a & b, nil
+	case "bitOr":
+		return a | b, nil
+	case "bitXor":
+		return a ^ b, nil
+	default:
+		log.Panicf("signedOperation: unexpected operation: %s", op)
+	}
+
+	if checked && (overflow || r < min || r > max) {
+		return 0, integerOverflow(op, t)
+	}
+	return r, nil
+}
+
+func unsignedOperation(op, t string, checked bool, a, b uint64) (uint64, err.Error) {
+
+	n := integerBits[t]
+	max := unsignedBound(n)
+
+	var r uint64
+	overflow := false
+
+	switch op {
+	case "add":
+		r = a + b
+		overflow = r < a
+	case "sub":
+		r = a - b
+		overflow = a < b
+	case "mul":
+		var hi uint64
+		hi, r = bits.Mul64(a, b)
+		overflow = hi != 0
+	case "div", "mod":
+		if b == 0 {
+			return 0, err.ExecutionError{
+				Problem: fmt.Sprintf(`%s: division by zero`, op),
+			}
+		}
+		if op == "mod" {
+			return a % b, nil
+		}
+		return a / b, nil
+	case "pow":
+		r = 1
+		for base := a; b > 0; b >>= 1 {
+			if b&1 == 1 {
+				hi, p := bits.Mul64(r, base)
+				overflow = overflow || hi != 0 || p > max
+				r = p
+			}
+			if b > 1 {
+				hi, q := bits.Mul64(base, base)
+				overflow = overflow || hi != 0 || q > max
+				base = q
+			}
+		}
+	case "shiftLeft":
+		r = a << b
+		overflow = a != 0 && (b >= uint64(n) || r>>b != a)
+	case "shiftRight":
+		return a >> b, nil
+	case "min":
+		if a < b {
+			return a, nil
+		}
+		return b, nil
+	case "max":
+		if a > b {
+			return a, nil
+		}
+		return b, nil
+	case "bitAnd":
+		return a & b, nil
+	case "bitOr":
+		return a | b, nil
+	case "bitXor":
+		return a ^ b, nil
+	default:
+		log.Panicf("unsignedOperation: unexpected operation: %s", op)
+	}
+
+	if checked && (overflow || r > max) {
+		return 0, integerOverflow(op, t)
+	}
+	return r, nil
+}
+
+func absInteger(v val.Value, t string, checked bool) (val.Value, err.Error) {
+	i := integerToInt64(v)
+	if i >= 0 {
+		return v, nil
+	}
+	if min, _ := signedBounds(integerBits[t]); checked && i == min {
+		return nil, integerOverflow("abs", t)
+	}
+	return integerValue(uint64(-i), t), nil
+}
+
+// toIntegerChecked converts any number to integer type t, failing if the value is not
+// integral or does not fit instead of truncating like convertNumericType does.
+func toIntegerChecked(v val.Value, t string) (val.Value, err.Error) {
+
+	n := integerBits[t]
+	signed := t[0] != 'u'
+
+	fail := func() err.Error {
+		return err.ExecutionError{
+			Problem: fmt.Sprintf(`%v does not fit in %s`, v, t),
+		}
+	}
+
+	switch v := v.(type) {
+	case val.Int8, val.Int16, val.Int32, val.Int64:
+		i := integerToInt64(v)
+		if signed {
+			if min, max := signedBounds(n); i < min || i > max {
+				return nil, fail()
+			}
+		} else if i < 0 || uint64(i) > unsignedBound(n) {
+			return nil, fail()
+		}
+		return integerValue(uint64(i), t), nil
+
+	case val.Uint8, val.Uint16, val.Uint32, val.Uint64:
+		u := integerToUint64(v)
+		if signed {
+			if _, max := signedBounds(n); u > uint64(max) {
+				return nil, fail()
+			}
+		} else if u > unsignedBound(n) {
+			return nil, fail()
+		}
+		return integerValue(u, t), nil
+
+	case val.Float:
+		f := float64(v)
+		if math.IsNaN(f) || math.Trunc(f) != f {
+			return nil, fail()
+		}
+		if signed {
+			// bounds are powers of two, so exact in float64
+			if f < -math.Ldexp(1, int(n-1)) || f >= math.Ldexp(1, int(n-1)) {
+				return nil, fail()
+			}
+			return integerValue(uint64(int64(f)), t), nil
+		}
+		if f < 0 || f >= math.Ldexp(1, int(n)) {
+			return nil, fail()
+		}
+		return integerValue(uint64(f), t), nil
+
+	case val.Decimal:
+		if !v.IsInteger() {
+			return nil, fail()
+		}
+		i := v.Integer()
+		if i.IsInt64() {
+			return toIntegerChecked(val.Int64(i.Int64()), t)
+		}
+		if i.IsUint64() {
+			return toIntegerChecked(val.Uint64(i.Uint64()), t)
+		}
+		return nil, fail()
+	}
+
+	log.Panicf("toIntegerChecked: unexpected type: %T", v)
+	return nil, nil
+}
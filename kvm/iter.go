@@ -4,12 +4,14 @@
 package kvm
 
 import (
-	bolt "github.com/coreos/bbolt"
+	"crypto/sha256"
 	"karma.run/cc"
 	"karma.run/codec/karma.v2"
 	"karma.run/kvm/err"
 	"karma.run/kvm/mdl"
 	"karma.run/kvm/val"
+	"karma.run/store"
+	"math"
 )
 
 // adapter for iterators that implements val.Value
@@ -206,36 +208,79 @@ func (i filterIterator) length() int {
 	return -1
 }
 
-var decoderCache = cc.NewLru(1024 * 10)
+// decoded objects of small buckets, keyed by a hash of their encoding
+var decoderCache = cc.NewCache(64<<20, 0)
+
+// approximate ratio of the memory held by a decoded object to its encoding
+const decodedBytesFactor = 4
 
 // bucketDecodingIterator yields val.Refs to the elements in a bucket
 type bucketDecodingIterator struct {
-	bucket *bolt.Bucket
-	model  mdl.Model
+	bucket  store.Bucket
+	model   mdl.Model
+	name    string       // of the bucket, for profiling
+	budget  *Budget      // charged for every decoded element, may be nil
+	profile *Profile     // may be nil
+	offset  int          // elements skipped without decoding them
+	limit   int          // maximum number of elements yielded, 0 is unlimited
+	from    []byte       // key to start at instead of the first one, see partition
+	cursor  store.Cursor // created up front by partition, nil to create one
+	view    bool         // yield views of values instead of decoding them, see viewing
+	values  mdl.Model    // of the objects if some of their values are encrypted, nil if none
+	redact  bool         // encrypted values instead of decrypting them, see openValues
 }
 
-func newBucketDecodingIterator(bucket *bolt.Bucket, model mdl.Model) bucketDecodingIterator {
-	return bucketDecodingIterator{bucket, model}
+// newBucketDecodingIterator returns an iterator over the objects of m,
+// decoding them as vm.decode does.
+func (vm VirtualMachine) newBucketDecodingIterator(m BucketModel) bucketDecodingIterator {
+	it := bucketDecodingIterator{
+		bucket: vm.RootBucket.Bucket([]byte(m.Bucket)),
+		model:  vm.WrapModelInMeta(m.Bucket, m.storage()),
+		name:   m.Bucket,
+	}
+	if m.stored != nil {
+		it.values, it.redact = m.Model, vm.redact
+	}
+	return it
 }
 
 func (i bucketDecodingIterator) forEach(f func(val.Value) err.Error) err.Error {
-	c := i.bucket.Cursor()
+	c := i.cursor
+	if c == nil {
+		c = i.bucket.Cursor()
+	}
 	mv := val.Meta{}
-	n := i.bucket.Stats().KeyN
-	for k, bs := c.First(); k != nil; k, bs = c.Next() {
-		if n > 1024 {
+	n := i.bucket.KeyN()
+	k, bs := i.first(c)
+	for yielded := 0; k != nil && (i.limit == 0 || yielded < i.limit); k, bs = c.Next() {
+		yielded++
+		if i.budget != nil {
+			if e := i.budget.allocate(int64(len(bs))); e != nil {
+				return e
+			}
+		}
+		if i.profile != nil {
+			i.profile.decode(i.name)
+		}
+		if n > 1024 && i.view {
+			mv = viewMeta(karma.View(bs, i.model).(*karma.Lazy))
+		} else if n > 1024 {
 			v, _ := karma.Decode(bs, i.model)
 			mv = DematerializeMeta(v.(val.Struct))
 		} else {
-			cacheKey := string(bs)
+			sum := sha256.Sum256(bs)
+			cacheKey := string(sum[:])
 			if c, ok := decoderCache.Get(cacheKey); ok {
 				mv = c.(val.Meta).Copy().(val.Meta)
 			} else {
 				v, _ := karma.Decode(bs, i.model)
 				mv = DematerializeMeta(v.(val.Struct))
-				decoderCache.Set(cacheKey, mv.Copy())
+				decoderCache.Set(cacheKey, mv.Copy(), int64(len(bs))*decodedBytesFactor)
 			}
 		}
+		if i.values != nil {
+			mv.Value = openValues(i.values, mv.Value, i.redact)
+		}
 		if e := f(mv); e != nil {
 			return e
 		}
@@ -243,6 +288,384 @@ func (i bucketDecodingIterator) forEach(f func(val.Value) err.Error) err.Error {
 	return nil
 }
 
+// first positions c at the first element of i.
+func (i bucketDecodingIterator) first(c store.Cursor) ([]byte, []byte) {
+	k, bs := []byte(nil), []byte(nil)
+	if i.from != nil {
+		k, bs = c.Seek(i.from)
+	} else {
+		k, bs = c.First()
+	}
+	for skipped := 0; k != nil && skipped < i.offset; skipped++ {
+		k, bs = c.Next()
+	}
+	return k, bs
+}
+
+// viewing makes it yield views of the values in large buckets, which decode
+// only the fields, keys and tuple elements accessed. Only instructions that
+// handle views get them, all others decode them when popping them off the
+// stack. Views are only made in read-only transactions, as the bytes they view
+// must not change, and not of objects with encrypted values, which are opened
+// when decoding them. viewing reports whether it changed it.
+func (vm VirtualMachine) viewing(it iterator) (iterator, bool) {
+	bi, ok := it.(bucketDecodingIterator)
+	if !ok || bi.values != nil || vm.RootBucket.Tx().Writable() {
+		return it, false
+	}
+	bi.view = true
+	return bi, true
+}
+
+// viewMeta is DematerializeMeta for views, it decodes all but the value.
+func viewMeta(l *karma.Lazy) val.Meta {
+	return val.Meta{
+		Id:      l.Field("id").(val.Ref),
+		Model:   l.Field("model").(val.Ref),
+		Created: l.Field("created").(val.DateTime),
+		Updated: l.Field("updated").(val.DateTime),
+		Value:   l.Field("value"),
+	}
+}
+
+// decoded returns v decoded if it is a view or the meta value of one.
+func decoded(v val.Value) val.Value {
+	switch w := v.(type) {
+	case *karma.Lazy:
+		return w.Value()
+	case val.Meta:
+		if l, ok := w.Value.(*karma.Lazy); ok {
+			w.Value = l.Value()
+			return w
+		}
+	}
+	return v
+}
+
+// partition splits i into n iterators over consecutive key ranges of about
+// equal length, returning them with the index of their first element in i.
+// Each gets its own cursor, as creating cursors isn't safe for concurrent use.
+func (i bucketDecodingIterator) partition(n int) ([]bucketDecodingIterator, []int) {
+	total := i.length()
+	ps, starts := make([]bucketDecodingIterator, 0, n), make([]int, 0, n)
+	c := i.bucket.Cursor()
+	k, _ := i.first(c)
+	for p, start := 0, 0; p < n && k != nil; p++ {
+		size := total / n
+		if p < total%n {
+			size++
+		}
+		if size == 0 {
+			break
+		}
+		q := i
+		q.from, q.offset, q.limit, q.cursor = k, 0, size, i.bucket.Cursor()
+		ps, starts = append(ps, q), append(starts, start)
+		for j := 0; j < size && k != nil; j++ {
+			k, _ = c.Next()
+		}
+		start += size
+	}
+	return ps, starts
+}
+
 func (i bucketDecodingIterator) length() int {
-	return i.bucket.Stats().KeyN
+	if i.from != nil {
+		return i.limit // only set by partition
+	}
+	n := i.bucket.KeyN() - i.offset
+	if n < 0 {
+		n = 0
+	}
+	if i.limit > 0 && n > i.limit {
+		n = i.limit
+	}
+	return n
+}
+
+type hashJoinEntry struct {
+	key   val.Value
+	value val.Value
+}
+
+// hashJoinIterator yields the joined elements of left and right with equal keys.
+// right is read into a hash table on each forEach, left is streamed.
+type hashJoinIterator struct {
+	left, right       iterator
+	leftKey, rightKey func(val.Value) (val.Value, err.Error)
+	join              func(l, r val.Value) val.Value
+}
+
+func newHashJoinIterator(left, right iterator, leftKey, rightKey func(val.Value) (val.Value, err.Error), join func(l, r val.Value) val.Value) hashJoinIterator {
+	return hashJoinIterator{left, right, leftKey, rightKey, join}
+}
+
+func (i hashJoinIterator) forEach(f func(val.Value) err.Error) err.Error {
+	n := i.right.length()
+	if n < 0 {
+		n = 64
+	}
+	table := make(map[uint64][]hashJoinEntry, n)
+	e := i.right.forEach(func(v val.Value) err.Error {
+		k, e := i.rightKey(v)
+		if e != nil {
+			return e
+		}
+		k = unMeta(k)
+		h := val.Hash(k, nil).Sum64()
+		table[h] = append(table[h], hashJoinEntry{k, v})
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+	return i.left.forEach(func(v val.Value) err.Error {
+		k, e := i.leftKey(v)
+		if e != nil {
+			return e
+		}
+		k = unMeta(k)
+		for _, entry := range table[val.Hash(k, nil).Sum64()] {
+			if !entry.key.Equals(k) {
+				continue // hash collision
+			}
+			if e := f(i.join(v, entry.value)); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+func (i hashJoinIterator) length() int {
+	return -1
+}
+
+// refJoinIterator yields each element of left joined with each of its adjacent values
+type refJoinIterator struct {
+	left     iterator
+	adjacent func(val.Value) ([]val.Value, err.Error)
+	join     func(l, r val.Value) val.Value
+}
+
+func newRefJoinIterator(left iterator, adjacent func(val.Value) ([]val.Value, err.Error), join func(l, r val.Value) val.Value) refJoinIterator {
+	return refJoinIterator{left, adjacent, join}
+}
+
+func (i refJoinIterator) forEach(f func(val.Value) err.Error) err.Error {
+	return i.left.forEach(func(v val.Value) err.Error {
+		rs, e := i.adjacent(v)
+		if e != nil {
+			return e
+		}
+		for _, r := range rs {
+			if e := f(i.join(v, r)); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+func (i refJoinIterator) length() int {
+	return -1
+}
+
+// listOrIterator applies wrap to lists and iterator values alike.
+// lists are evaluated right away so they stay lists, iterators stay lazy.
+func listOrIterator(v val.Value, wrap func(iterator) iterator) (val.Value, err.Error) {
+	if ls, ok := unMeta(v).(val.List); ok {
+		return iteratorToList(wrap(newListIterator(ls)))
+	}
+	return iteratorValue{wrap(iteratorOf(v))}, nil
+}
+
+// distinctIterator skips values equal to one yielded before
+type distinctIterator struct {
+	sub iterator
+}
+
+func newDistinctIterator(sub iterator) distinctIterator {
+	return distinctIterator{sub}
+}
+
+func (i distinctIterator) forEach(f func(val.Value) err.Error) err.Error {
+	seen := make(map[uint64]struct{})
+	return i.sub.forEach(func(v val.Value) err.Error {
+		h := val.Hash(v, nil).Sum64()
+		if _, ok := seen[h]; ok {
+			return nil // continue
+		}
+		seen[h] = struct{}{}
+		return f(v)
+	})
+}
+
+func (i distinctIterator) length() int {
+	return -1
+}
+
+// flattenIterator yields the elements of each list yielded by sub
+type flattenIterator struct {
+	sub iterator
+}
+
+func newFlattenIterator(sub iterator) flattenIterator {
+	return flattenIterator{sub}
+}
+
+func (i flattenIterator) forEach(f func(val.Value) err.Error) err.Error {
+	return i.sub.forEach(func(v val.Value) err.Error {
+		return iteratorOf(v).forEach(f)
+	})
+}
+
+func (i flattenIterator) length() int {
+	return -1
+}
+
+// zipIterator pairs up the elements of left and right, it stops at the end of the shorter one
+type zipIterator struct {
+	left  iterator
+	right val.List
+}
+
+func newZipIterator(left iterator, right val.List) zipIterator {
+	return zipIterator{left, right}
+}
+
+func (i zipIterator) forEach(f func(val.Value) err.Error) err.Error {
+	n := 0
+	stop := &err.ExecutionError{} // placeholder
+	e := i.left.forEach(func(v val.Value) err.Error {
+		if n == len(i.right) {
+			return stop
+		}
+		n++
+		return f(val.Tuple{v, i.right[n-1]})
+	})
+	if e == stop {
+		e = nil
+	}
+	return e
+}
+
+func (i zipIterator) length() int {
+	l := i.left.length()
+	if l == -1 {
+		return -1
+	}
+	if l > len(i.right) {
+		return len(i.right)
+	}
+	return l
+}
+
+// chunkIterator yields lists of size elements, the last one may be shorter
+type chunkIterator struct {
+	sub  iterator
+	size int
+}
+
+func newChunkIterator(sub iterator, size int) chunkIterator {
+	return chunkIterator{sub, size}
+}
+
+func (i chunkIterator) forEach(f func(val.Value) err.Error) err.Error {
+	chunk := make(val.List, 0, i.size)
+	e := i.sub.forEach(func(v val.Value) err.Error {
+		chunk = append(chunk, v)
+		if len(chunk) < i.size {
+			return nil // continue
+		}
+		full := chunk
+		chunk = make(val.List, 0, i.size)
+		return f(full)
+	})
+	if e != nil {
+		return e
+	}
+	if len(chunk) > 0 {
+		return f(chunk)
+	}
+	return nil
+}
+
+func (i chunkIterator) length() int {
+	l := i.sub.length()
+	if l == -1 {
+		return -1
+	}
+	return (l + i.size - 1) / i.size
+}
+
+// rangeIterator yields from, from+step, ... up to but excluding to
+type rangeIterator struct {
+	from, to, step int64
+}
+
+func newRangeIterator(from, to, step int64) rangeIterator {
+	return rangeIterator{from, to, step}
+}
+
+func (i rangeIterator) forEach(f func(val.Value) err.Error) err.Error {
+	for n, l := 0, i.length(); n < l; n++ {
+		if e := f(val.Int64(i.from + int64(n)*i.step)); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (i rangeIterator) length() int {
+	if (i.step > 0 && i.from >= i.to) || (i.step < 0 && i.from <= i.to) {
+		return 0
+	}
+	// distance computed in uint64, it may not fit in int64
+	d, s := uint64(i.to-i.from), uint64(i.step)
+	if i.step < 0 {
+		d, s = uint64(i.from-i.to), uint64(-i.step)
+	}
+	n := d / s
+	if d%s != 0 {
+		n++
+	}
+	if n > math.MaxInt {
+		return math.MaxInt
+	}
+	return int(n)
+}
+
+// takeWhileIterator yields values of sub until fnc returns false for one
+type takeWhileIterator struct {
+	sub iterator
+	fnc func(int, val.Value) (bool, err.Error)
+}
+
+func newTakeWhileIterator(sub iterator, f func(int, val.Value) (bool, err.Error)) takeWhileIterator {
+	return takeWhileIterator{sub, f}
+}
+
+func (i takeWhileIterator) forEach(f func(val.Value) err.Error) err.Error {
+	n := 0
+	stop := &err.ExecutionError{} // placeholder
+	e := i.sub.forEach(func(v val.Value) err.Error {
+		take, e := i.fnc(n, v)
+		if e != nil {
+			return e
+		}
+		if !take {
+			return stop
+		}
+		n++
+		return f(v)
+	})
+	if e == stop {
+		e = nil
+	}
+	return e
+}
+
+func (i takeWhileIterator) length() int {
+	return -1
 }
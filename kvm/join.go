@@ -0,0 +1,107 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"fmt"
+	"karma.run/definitions"
+	"karma.run/kvm/err"
+	"karma.run/kvm/mdl"
+	"karma.run/kvm/val"
+	"karma.run/kvm/xpr"
+	"log"
+)
+
+// joinModel is the element model of a join between elements of models left and right.
+// name and node are used for error reporting only.
+func joinModel(left, right mdl.Model, merge bool, name string, node xpr.Expression) (mdl.Model, err.Error) {
+	if !merge {
+		return mdl.Tuple{left, right}, nil
+	}
+	ls, lok := left.Concrete().(mdl.Struct)
+	rs, rok := right.Concrete().(mdl.Struct)
+	if !lok || !rok {
+		return nil, err.CompilationError{
+			Problem: fmt.Sprintf(`%s: merge requires both sides to be lists of structs`, name),
+			Program: xpr.ValueFromExpression(node),
+		}
+	}
+	merged := mdl.NewStruct(ls.Len() + rs.Len())
+	ls.ForEach(func(k string, m mdl.Model) bool {
+		merged.Set(k, m)
+		return true
+	})
+	rs.ForEach(func(k string, m mdl.Model) bool {
+		merged.Set(k, m) // right wins
+		return true
+	})
+	return merged, nil
+}
+
+// joinValues pairs l and r in a tuple, or merges their fields if merge is set.
+// on conflicting field names, r's value wins.
+func joinValues(l, r val.Value, merge bool) val.Value {
+	if !merge {
+		return val.Tuple{l, r}
+	}
+	ls, rs := unMeta(l).(val.Struct), unMeta(r).(val.Struct)
+	merged := val.NewStruct(ls.Len() + rs.Len())
+	ls.ForEach(func(k string, v val.Value) bool {
+		merged.Set(k, v)
+		return true
+	})
+	rs.ForEach(func(k string, v val.Value) bool {
+		merged.Set(k, v)
+		return true
+	})
+	return merged
+}
+
+// adjacentObjects returns the objects in model in that refer to of (referrers),
+// or that of refers to (!referrers). objects the user may not read are skipped.
+func (vm VirtualMachine) adjacentObjects(of val.Ref, in string, referrers bool) ([]val.Value, err.Error) {
+
+	bucket := definitions.GraphBucketBytes
+	if referrers {
+		bucket = definitions.PhargBucketBytes
+	}
+
+	vm.read(anyModel)
+
+	gb := vm.RootBucket.Bucket(bucket)
+	if gb == nil {
+		log.Panicf("%s bucket missing!", bucket)
+	}
+
+	kb := gb.Bucket(encodeVertex(of[0], of[1]))
+	if kb == nil {
+		return nil, nil
+	}
+
+	ids := make([]string, 0, 32)
+
+	e := kb.ForEach(func(key, _ []byte) error {
+		if m, i := decodeVertex(key); m == in {
+			ids = append(ids, i)
+		}
+		return nil
+	})
+
+	if e != nil {
+		log.Panicln(e)
+	}
+
+	objects := make([]val.Value, 0, len(ids))
+	for _, id := range ids {
+		mv, e := vm.Get(in, id)
+		if e != nil {
+			if _, ok := e.(err.PermissionDeniedError); ok {
+				continue
+			}
+			return nil, e
+		}
+		objects = append(objects, mv)
+	}
+
+	return objects, nil
+}
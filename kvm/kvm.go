@@ -6,7 +6,6 @@ package kvm
 import (
 	"bytes"
 	"fmt"
-	bolt "github.com/coreos/bbolt"
 	"hash"
 	"hash/fnv" // FNV-1 has a very low collision rate
 	"karma.run/cc"
@@ -19,8 +18,10 @@ import (
 	"karma.run/kvm/mdl"
 	"karma.run/kvm/val"
 	"karma.run/kvm/xpr"
+	"karma.run/store"
 	"log"
 	"net"
+	"reflect"
 	"time"
 )
 
@@ -44,11 +45,19 @@ func init() {
 const SeparatorByte = '~'
 
 type VirtualMachine struct {
-	UserID     string
-	RootBucket *bolt.Bucket
+	UserID      string
+	RootBucket  store.Bucket
+	Budget      *Budget      // nil is unlimited, see Limit
+	Profile     *Profile     // nil disables profiling
+	Parallelism *Parallelism // nil executes sequentially
+
+	CacheResults bool // of read-only programs, see cachedResult
 
 	permissions    *permissions
+	redact         bool // encrypted values instead of decrypting them, see EncryptedAnnotation
 	permRecursions map[string]struct{}
+	reads          *readSet    // nil unless caching results
+	spills         *sortSpills // of the current request, nil outside of one
 
 	cache struct {
 		UserModelId       string
@@ -57,6 +66,7 @@ type VirtualMachine struct {
 		MetaModelId       string
 		TagModelId        string
 		MigrationModelId  string
+		QueryModelId      string
 	}
 }
 
@@ -70,7 +80,8 @@ func (vm VirtualMachine) isDefaultModelId(mid string) bool {
 		mid == vm.MigrationModelId() ||
 		mid == vm.RoleModelId() ||
 		mid == vm.TagModelId() ||
-		mid == vm.UserModelId()
+		mid == vm.UserModelId() ||
+		mid == vm.QueryModelId()
 }
 
 func (vm *VirtualMachine) UserModelId() string {
@@ -127,13 +138,43 @@ func (vm *VirtualMachine) MigrationModelId() string {
 	return s
 }
 
+func (vm *VirtualMachine) QueryModelId() string {
+	if vm.cache.QueryModelId != "" {
+		return vm.cache.QueryModelId
+	}
+	s := string(vm.RootBucket.Get(definitions.QueryModelBytes))
+	vm.cache.QueryModelId = s
+	return s
+}
+
 func (vm VirtualMachine) ParseCompileAndExecute(v val.Value, scope *ModelScope, parameters []mdl.Model, expect mdl.Model, arguments ...val.Value) (val.Value, mdl.Model, err.Error) {
 
+	if scope != nil || expect != nil {
+		return vm.parseCompileAndExecute(v, scope, parameters, expect, arguments...)
+	}
+
+	key := "program/" + string(val.Hash(v, nil).Sum(nil)) + string(val.Hash(val.List(arguments), nil).Sum(nil))
+	return vm.cachedResult(key, func(vm VirtualMachine) (val.Value, mdl.Model, err.Error) {
+		return vm.parseCompileAndExecute(v, scope, parameters, expect, arguments...)
+	})
+}
+
+func (vm VirtualMachine) parseCompileAndExecute(v val.Value, scope *ModelScope, parameters []mdl.Model, expect mdl.Model, arguments ...val.Value) (val.Value, mdl.Model, err.Error) {
+
+	if vm.spills == nil {
+		vm.spills = &sortSpills{}
+		defer vm.spills.close()
+	}
+
 	instructions, model, e := vm.ParseAndCompile(v, scope, parameters, expect)
 	if e != nil {
 		return nil, nil, e
 	}
 
+	if vm.Profile != nil {
+		vm.Profile.Label(instructions, "program")
+	}
+
 	v, e = vm.Execute(instructions, nil, arguments...)
 	if e != nil {
 		return nil, nil, e
@@ -145,6 +186,11 @@ func (vm VirtualMachine) ParseCompileAndExecute(v val.Value, scope *ModelScope,
 
 func (vm VirtualMachine) CompileAndExecuteExpression(expression xpr.Expression) (val.Value, mdl.Model, err.Error) {
 
+	if vm.spills == nil {
+		vm.spills = &sortSpills{}
+		defer vm.spills.close()
+	}
+
 	fun := xpr.NewFunction(nil, expression)
 
 	typed, e := vm.TypeFunction(fun, nil, AnyModel)
@@ -152,7 +198,12 @@ func (vm VirtualMachine) CompileAndExecuteExpression(expression xpr.Expression)
 		return nil, nil, e
 	}
 
-	value, e := vm.Execute(vm.CompileFunction(typed), nil)
+	program, e := vm.compile(vm.Optimize(typed))
+	if e != nil {
+		return nil, nil, e
+	}
+
+	value, e := vm.Execute(program, nil)
 	if e != nil {
 		return nil, nil, e
 	}
@@ -165,20 +216,23 @@ func (vm VirtualMachine) ParseAndCompile(v val.Value, scope *ModelScope, paramet
 
 	cacheKey := vm.MetaModelId() + string(val.Hash(v, nil).Sum(nil))
 
-	if item, ok := compilerCache.Get(cacheKey); ok {
-		entry := item.(compilerCacheEntry)
-		return entry.i, entry.m, entry.e
-	}
-
-	typed, e := vm.Parse(v, scope, parameters, expect)
-	if e != nil {
-		compilerCache.Set(cacheKey, compilerCacheEntry{nil, nil, e})
-		return nil, nil, e
+	item, e := compilerCache.Load(cacheKey, func() (interface{}, int64, error) {
+		typed, e := vm.Parse(v, scope, parameters, expect)
+		if e != nil {
+			return compilerCacheEntry{nil, nil, e}, 0, nil // errors are cached as well
+		}
+		instructions, e := vm.compile(vm.Optimize(typed))
+		if e != nil {
+			return compilerCacheEntry{nil, nil, e}, 0, nil
+		}
+		return compilerCacheEntry{instructions, typed.Actual, nil}, sequenceBytes(instructions), nil
+	})
+	if e != nil { // a concurrent compilation panicked
+		return nil, nil, err.InternalError{Problem: e.Error()}
 	}
 
-	instructions, model := vm.CompileFunction(typed), typed.Actual
-	compilerCache.Set(cacheKey, compilerCacheEntry{instructions, model, nil})
-	return instructions, model, nil
+	entry := item.(compilerCacheEntry)
+	return entry.i, entry.m, entry.e
 
 }
 
@@ -203,14 +257,90 @@ type compilerCacheEntry struct {
 	e err.Error
 }
 
-var compilerCache = cc.NewLru(1024)
+var compilerCache = cc.NewCache(32<<20, 0)
+
+// approximate size of a compiled instruction
+const instructionBytes = 64
+
+// sequenceBytes estimates the memory held by is, including nested sequences.
+func sequenceBytes(is inst.Sequence) int64 {
+	n := int64(len(is)) * instructionBytes
+	for _, it := range is {
+		forEachSequence(reflect.ValueOf(it), func(sub inst.Sequence) {
+			n += sequenceBytes(sub)
+		})
+	}
+	return n
+}
 
 // clears compiler cache (for all databases)
 func ClearCompilerCache() {
 	compilerCache.Clear()
 }
 
+type callCacheEntry struct {
+	function xpr.TypedFunction
+	program  inst.Sequence
+}
+
+// persisted functions typed against their own signature, see xpr.Call
+var callCache = cc.NewLru(1024)
+
+// callable returns the persisted function id typed against its own signature, compiled.
+// It does not check read permissions. scope is only consulted to detect recursive calls.
+func (vm VirtualMachine) callable(id string, scope *ModelScope) (callCacheEntry, err.Error) {
+
+	cacheKey := vm.MetaModelId() + "/" + id
+
+	if item, ok := callCache.Get(cacheKey); ok {
+		return item.(callCacheEntry), nil
+	}
+
+	mv, e := vm.get(vm.ExpressionModelId(), id)
+	if e != nil {
+		return callCacheEntry{}, e
+	}
+
+	if scope.calling(id) {
+		return callCacheEntry{}, err.CompilationError{
+			Problem: `call: recursive calls are not supported`,
+			Program: mv.Value,
+		}
+	}
+
+	typed, e := vm.TypeFunction(xpr.FunctionFromValue(mv.Value), scope.callee(id), AnyModel)
+	if e != nil {
+		return callCacheEntry{}, e
+	}
+
+	program, e := vm.compile(vm.Optimize(typed))
+	if e != nil {
+		return callCacheEntry{}, e
+	}
+
+	entry := callCacheEntry{typed, program}
+	callCache.Set(cacheKey, entry)
+	return entry, nil
+}
+
+// drops all compiled artifacts that may have inlined a persisted function
+func (vm VirtualMachine) invalidateCallables() {
+	callCache.Clear()
+	compilerCache.Clear()
+}
+
 func convertNumericType(v val.Value, m mdl.Model) val.Value {
+	if d, ok := v.(val.Decimal); ok {
+		if _, ok := m.Concrete().(mdl.Float); ok {
+			return val.Float(d.Float())
+		}
+		// truncated towards zero, then converted like integers are
+		if i := d.Integer(); i.IsUint64() {
+			v = val.Uint64(i.Uint64())
+		} else {
+			v = val.Int64(i.Int64())
+		}
+	}
 	switch m.Concrete().(type) {
 
 	case mdl.Int8:
@@ -428,6 +558,7 @@ func stringSliceToList(ss []string) val.List {
 type BucketModel struct {
 	mdl.Model
 	Bucket string
+	stored mdl.Model // Model as values are stored, nil if the same, see storedModel
 }
 
 // convenience for dynamic compilation of constant values
@@ -610,19 +741,85 @@ func (vm VirtualMachine) newReadPermissionFilterIterator(sub iterator) iterator
 	})
 }
 
+// grantsAll reports whether permission is constantly true, as for admins.
+func grantsAll(permission inst.Sequence) bool {
+	last := len(permission) - 1
+	if last < 0 {
+		return false
+	}
+	for _, it := range permission[:last] {
+		switch it.(type) {
+		case inst.Define, inst.Pop: // parameters
+		default:
+			return false
+		}
+	}
+	ct, ok := permission[last].(inst.Constant)
+	return ok && ct.Value == val.Bool(true)
+}
+
 func (vm VirtualMachine) UpdateModels() error {
 
 	meta := vm.MetaModelId()
 
 	v := vm.WrapValueInMeta(definitions.NewMetaModelValue(meta), meta, meta)
-	if e := vm.RootBucket.Bucket([]byte(meta)).Put([]byte(meta), karma.Encode(MaterializeMeta(v), vm.WrapModelInMeta(meta, vm.MetaModel()))); e != nil {
+	if e := vm.RootBucket.Bucket([]byte(meta)).Put([]byte(meta), vm.encode(v, BucketModel{Model: vm.MetaModel(), Bucket: meta})); e != nil {
 		return e
 	}
 
 	expr := vm.ExpressionModelId()
 
 	v = vm.WrapValueInMeta(mdl.ValueFromModel(meta, xpr.LanguageModel, nil), expr, meta)
-	if e := vm.RootBucket.Bucket([]byte(meta)).Put([]byte(expr), karma.Encode(MaterializeMeta(v), vm.WrapModelInMeta(meta, vm.MetaModel()))); e != nil {
+	if e := vm.RootBucket.Bucket([]byte(meta)).Put([]byte(expr), vm.encode(v, BucketModel{Model: vm.MetaModel(), Bucket: meta})); e != nil {
+		return e
+	}
+
+	if vm.QueryModelId() == "" { // databases initialized before stored queries existed
+		if e := vm.initQueryModel(); e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+func (vm VirtualMachine) initQueryModel() error {
+
+	db, meta := vm.RootBucket, vm.MetaModelId()
+
+	if _, e := db.CreateBucketIfNotExists(definitions.QueryBucketBytes); e != nil {
+		return e
+	}
+
+	id, e := vm.Execute(inst.Sequence{
+		inst.CreateMultiple{meta, map[string]inst.Sequence{
+			"self": {
+				inst.Constant{
+					definitions.NewQueryModelValue(meta, vm.ExpressionModelId(), vm.RoleModelId()),
+				},
+			},
+		}},
+		inst.Field{Key: "self"},
+	}, nil)
+	if e != nil {
+		return e
+	}
+
+	if e := db.Put(definitions.QueryModelBytes, []byte(id.(val.Ref)[1])); e != nil {
+		return e
+	}
+
+	_, e = vm.Execute(inst.Sequence{
+		inst.CreateMultiple{vm.TagModelId(), map[string]inst.Sequence{
+			"_query": inst.Sequence{
+				inst.Constant{val.StructFromMap(map[string]val.Value{
+					"tag":   val.String("_query"),
+					"model": id,
+				})},
+			},
+		}},
+	}, nil)
+	if e != nil {
 		return e
 	}
 
@@ -655,7 +852,7 @@ func (vm VirtualMachine) InitDB() error {
 
 	{ // create meta model
 		v := vm.WrapValueInMeta(definitions.NewMetaModelValue(meta), meta, meta)
-		if e := db.Bucket([]byte(meta)).Put([]byte(meta), karma.Encode(MaterializeMeta(v), vm.WrapModelInMeta(meta, vm.MetaModel()))); e != nil {
+		if e := db.Bucket([]byte(meta)).Put([]byte(meta), vm.encode(v, BucketModel{Model: vm.MetaModel(), Bucket: meta})); e != nil {
 			return e
 		}
 	}
@@ -736,6 +933,10 @@ func (vm VirtualMachine) InitDB() error {
 			return e
 		}
 
+		if e := vm.initQueryModel(); e != nil {
+			return e
+		}
+
 	}
 
 	{ // create default tags
@@ -864,6 +1065,8 @@ func (vm VirtualMachine) Get(mid, oid string) (val.Meta, err.Error) {
 
 func (vm VirtualMachine) get(mid, oid string) (val.Meta, err.Error) {
 
+	vm.read(mid)
+
 	bk := vm.RootBucket.Bucket([]byte(mid))
 	if bk == nil {
 		return val.Meta{}, err.ModelNotFoundError{
@@ -885,13 +1088,15 @@ func (vm VirtualMachine) get(mid, oid string) (val.Meta, err.Error) {
 		}
 	}
 
-	vl, _ := karma.Decode(dt, vm.WrapModelInMeta(mid, m.Model))
-	mv := DematerializeMeta(vl.(val.Struct))
+	if e := vm.allocate(int64(len(dt))); e != nil {
+		return val.Meta{}, e
+	}
 
-	return mv, nil
+	return vm.decode(dt, m), nil
 
 }
 func (vm VirtualMachine) exists(mid, oid string) bool {
+	vm.read(mid)
 	bk := vm.RootBucket.Bucket([]byte(mid))
 	if bk == nil {
 		return false
@@ -899,38 +1104,46 @@ func (vm VirtualMachine) exists(mid, oid string) bool {
 	return (nil != bk.Get([]byte(oid)))
 }
 
-const ModelCacheCapacity = 512
+const ModelCacheBytes = 32 << 20
 
-var ModelCache = cc.NewLru(ModelCacheCapacity)
+// decoded models by metaId/mid. Concurrent misses for the same model decode it only once.
+var ModelCache = cc.NewCache(ModelCacheBytes, 0)
 
 func (vm VirtualMachine) Model(mid string) (BucketModel, err.Error) {
 
 	metaId := vm.MetaModelId()
 	cacheKey := metaId + "/" + mid // metaId is distinct for every database
 
-	if m, ok := ModelCache.Get(cacheKey); ok {
-		return BucketModel{Bucket: mid, Model: m.(mdl.Model)}, nil
-	}
+	vm.read(metaId)
 
-	bs := vm.RootBucket.Bucket([]byte(metaId)).Get([]byte(mid))
-	if bs == nil {
-		return BucketModel{}, err.ModelNotFoundError{
-			err.ObjectNotFoundError{
-				Ref: val.Ref{vm.MetaModelId(), mid},
-			},
+	m, e := ModelCache.Load(cacheKey, func() (interface{}, int64, error) {
+
+		bs := vm.RootBucket.Bucket([]byte(metaId)).Get([]byte(mid))
+		if bs == nil {
+			return nil, 0, err.ModelNotFoundError{
+				err.ObjectNotFoundError{
+					Ref: val.Ref{vm.MetaModelId(), mid},
+				},
+			}
 		}
-	}
 
-	mv, _ := karma.Decode(bs, vm.WrapModelInMeta(metaId, vm.MetaModel()))
+		mv, _ := karma.Decode(bs, vm.WrapModelInMeta(metaId, vm.MetaModel()))
 
-	m, e := mdl.ModelFromValue(vm.MetaModelId(), unMeta(DematerializeMeta(mv.(val.Struct))).(val.Union), nil)
-	if e != nil {
-		log.Panicln("failed decoding persisted model", e.Error(), mid)
-	}
+		m, e := mdl.ModelFromValue(vm.MetaModelId(), unMeta(DematerializeMeta(mv.(val.Struct))).(val.Union), nil)
+		if e != nil {
+			log.Panicln("failed decoding persisted model", e.Error(), mid)
+		}
 
-	ModelCache.Set(cacheKey, m)
+		return BucketModel{Model: m, Bucket: mid, stored: storedModel(m)}, int64(len(bs)) * decodedBytesFactor, nil
+	})
+	if ke, ok := e.(err.Error); ok {
+		return BucketModel{}, ke
+	}
+	if e != nil { // a concurrent load panicked
+		return BucketModel{}, err.InternalError{Problem: e.Error()}
+	}
 
-	return BucketModel{Model: m, Bucket: mid}, nil // note: m.Copy _is_ necessary.
+	return m.(BucketModel), nil // note: m.Copy _is_ necessary.
 }
 
 func (vm VirtualMachine) MetaModel() mdl.Model {
@@ -943,6 +1156,8 @@ func (vm VirtualMachine) MetaModel() mdl.Model {
 
 func (vm VirtualMachine) InRefs(mid, id string) []val.Ref {
 
+	vm.read(anyModel)
+
 	out := ([]val.Ref)(nil)
 
 	if bk := vm.RootBucket.Bucket(definitions.PhargBucketBytes).Bucket(encodeVertex(mid, id)); bk != nil {
@@ -977,7 +1192,9 @@ func (vm VirtualMachine) Delete(mid, id string) err.Error {
 
 	db := vm.RootBucket
 
-	v, e := vm.Get(mid, id)
+	vm.written(mid)
+
+	v, e := vm.plaintext().Get(mid, id) // indexes are of the plaintext
 	if e != nil {
 		if _, ok := e.(err.ObjectNotFoundError); ok {
 			return nil
@@ -1061,6 +1278,10 @@ func (vm VirtualMachine) Delete(mid, id string) err.Error {
 
 		}
 
+		if m.stored != nil {
+			vm.indexEncrypted(mid, id, m.Model, v.Value, nil)
+		}
+
 	}
 
 	{ // delete object itself
@@ -1080,10 +1301,16 @@ func (vm VirtualMachine) Delete(mid, id string) err.Error {
 			log.Panicln(e)
 		}
 
-		if e := db.DeleteBucket([]byte(id)); e != nil && e != bolt.ErrBucketNotFound {
+		if e := db.DeleteBucket([]byte(id)); e != nil && e != store.ErrBucketNotFound {
 			log.Panicln(e)
 		}
 
+		if ib := db.Bucket(definitions.BlindBucketBytes); ib != nil {
+			if e := ib.DeleteBucket([]byte(id)); e != nil && e != store.ErrBucketNotFound {
+				log.Panicln(e)
+			}
+		}
+
 	}
 
 	if mid == vm.TagModelId() {
@@ -1096,6 +1323,16 @@ func (vm VirtualMachine) Delete(mid, id string) err.Error {
 
 	}
 
+	if mid == vm.QueryModelId() {
+
+		tag := v.Value.(val.Struct).Field("tag").(val.String)
+
+		if e := db.Bucket(definitions.QueryBucketBytes).Delete([]byte(tag)); e != nil {
+			log.Panicln(e)
+		}
+
+	}
+
 	if mid == vm.MigrationModelId() {
 
 		// FIXME: deleting a migration can break another migration-path involving relocateRef
@@ -1131,6 +1368,10 @@ func (vm VirtualMachine) Delete(mid, id string) err.Error {
 		ModelCache.Remove(mid + "/" + id)
 	}
 
+	if mid == vm.ExpressionModelId() {
+		vm.invalidateCallables()
+	}
+
 	if udpConn != nil {
 		_, _ = udpConn.Write([]byte(mid + "/" + id))
 	}
@@ -1144,6 +1385,8 @@ func (vm VirtualMachine) Write(mid string, values map[string]val.Meta) err.Error
 
 	db := vm.RootBucket
 
+	vm.written(mid)
+
 	for id, v := range values {
 
 		md, e := vm.Model(mid)
@@ -1151,6 +1394,16 @@ func (vm VirtualMachine) Write(mid string, values map[string]val.Meta) err.Error
 			return e
 		}
 
+		if e := checkEncryptable(md); e != nil {
+			return e
+		}
+
+		if md.stored != nil && vm.redact {
+			if ov, e := vm.plaintext().get(mid, id); e == nil {
+				v.Value = keepRedacted(md.Model, v.Value, ov.Value)
+			}
+		}
+
 		if mid == vm.ExpressionModelId() {
 			fun, e := vm.Parse(v.Value, nil, nil, nil)
 			if e != nil {
@@ -1296,6 +1549,28 @@ func (vm VirtualMachine) Write(mid string, values map[string]val.Meta) err.Error
 
 		}
 
+		if mid == vm.ExpressionModelId() {
+			vm.invalidateCallables()
+		}
+
+		if mid == vm.QueryModelId() {
+
+			qb := db.Bucket(definitions.QueryBucketBytes)
+
+			if old, e := vm.get(mid, id); e == nil { // tag may have changed
+				if e := qb.Delete([]byte(old.Value.(val.Struct).Field("tag").(val.String))); e != nil {
+					log.Panicln(e)
+				}
+			}
+
+			tag := v.Value.(val.Struct).Field("tag").(val.String)
+
+			if e := qb.Put([]byte(tag), []byte(id)); e != nil {
+				log.Panicln(e)
+			}
+
+		}
+
 		if mid == vm.TagModelId() {
 
 			o := v.Value.(val.Struct)
@@ -1416,7 +1691,10 @@ func (vm VirtualMachine) Write(mid string, values map[string]val.Meta) err.Error
 					return e
 				}
 
-				instructions := vm.CompileFunction(typedFun)
+				instructions, e := vm.compile(typedFun)
+				if e != nil {
+					return e
+				}
 
 				{ // migration path index
 					migBucket, e := migs.CreateBucketIfNotExists([]byte(sourceMID))
@@ -1435,21 +1713,27 @@ func (vm VirtualMachine) Write(mid string, values map[string]val.Meta) err.Error
 					}
 				}
 
-				sourceBucket := db.Bucket([]byte(sourceModel.Bucket))
 				targetBucket := db.Bucket([]byte(targetModel.Bucket))
 
-				decodeModel := vm.WrapModelInMeta(sourceMID, sourceModel.Unwrap())
-				e = newBucketDecodingIterator(sourceBucket, decodeModel).forEach(func(v val.Value) err.Error {
+				vm.written(targetMID)
+
+				if e := checkEncryptable(targetModel); e != nil {
+					return e
+				}
+
+				e = vm.plaintext().newBucketDecodingIterator(sourceModel).forEach(func(v val.Value) err.Error {
 					mv := v.(val.Meta)
 					migrated, e := vm.Execute(instructions, nil, mv.Value)
 					if e != nil {
 						return e
 					}
-					encodeValue := MaterializeMeta(vm.WrapValueInMeta(unMeta(migrated), mv.Id[1], targetMID))
-					encodeModel := vm.WrapModelInMeta(targetMID, targetModel.Unwrap())
-					if e := targetBucket.Put([]byte(mv.Id[1]), karma.Encode(encodeValue, encodeModel)); e != nil {
+					encodeValue := vm.WrapValueInMeta(unMeta(migrated), mv.Id[1], targetMID)
+					if e := targetBucket.Put([]byte(mv.Id[1]), vm.encode(encodeValue, targetModel)); e != nil {
 						panic(e)
 					}
+					if targetModel.stored != nil {
+						vm.indexEncrypted(targetMID, mv.Id[1], targetModel.Model, nil, encodeValue.Value)
+					}
 					return nil
 				})
 				if e != nil {
@@ -1460,8 +1744,16 @@ func (vm VirtualMachine) Write(mid string, values map[string]val.Meta) err.Error
 
 		}
 
+		if md.stored != nil { // the old entries of the blind index are found by the old value
+			old := val.Value(nil)
+			if ov, e := vm.plaintext().get(mid, id); e == nil {
+				old = ov.Value
+			}
+			vm.indexEncrypted(mid, id, md.Model, old, v.Value)
+		}
+
 		// actual persistence of the value
-		if e := db.Bucket([]byte(mid)).Put([]byte(id), karma.Encode(MaterializeMeta(v), vm.WrapModelInMeta(mid, md.Model))); e != nil {
+		if e := db.Bucket([]byte(mid)).Put([]byte(id), vm.encode(v, md)); e != nil {
 			log.Panicln(e)
 		}
 
@@ -1621,7 +1913,10 @@ func (vm VirtualMachine) applyMigrationTree(id string, tree map[string]*migratio
 		if e != nil {
 			log.Panicln(e)
 		}
-		instructions := vm.CompileFunction(typedFun)
+		instructions, e := vm.compile(typedFun)
+		if e != nil {
+			log.Panicln(e)
+		}
 
 		vl, e := vm.Execute(instructions, nil, node.InValue)
 		if e != nil {
@@ -1793,11 +2088,20 @@ func (vm *VirtualMachine) lazyLoadPermissions() err.Error {
 		delete: inst.Sequence{inst.Constant{val.Bool(true)}},
 	}
 	ps, e := vm.permissionsForUserId(vm.UserID)
+	if e == nil {
+		vm.redact, e = vm.redacts()
+	}
 	vm.permissions = nil
 	if e != nil {
 		return e
 	}
 	vm.permissions = ps
+	if vm.Profile != nil {
+		vm.Profile.Label(ps.create, "create permission")
+		vm.Profile.Label(ps.read, "read permission")
+		vm.Profile.Label(ps.update, "update permission")
+		vm.Profile.Label(ps.delete, "delete permission")
+	}
 	return nil
 }
 
@@ -199,6 +199,18 @@ func ValueFromModel(metaId string, model Model, recursions map[*Recursion]struct
 	case DateTime:
 		return val.Union{"dateTime", val.Struct{}}
 
+	case Duration:
+		return val.Union{"duration", val.Struct{}}
+
+	case Decimal:
+		return val.Union{"decimal", val.Struct{}}
+
+	case Bytes:
+		return val.Union{"bytes", val.Struct{}}
+
+	case Blob:
+		return val.Union{"blob", val.Struct{}}
+
 	case Bool:
 		return val.Union{"bool", val.Struct{}}
 
@@ -445,6 +457,18 @@ func ModelFromValue(metaId string, u val.Union, recursions map[string]*Recursion
 	case "dateTime":
 		return DateTime{}, nil
 
+	case "duration":
+		return Duration{}, nil
+
+	case "decimal":
+		return Decimal{}, nil
+
+	case "bytes":
+		return Bytes{}, nil
+
+	case "blob":
+		return Blob{}, nil
+
 	case "bool":
 		return Bool{}, nil
 
@@ -655,6 +655,131 @@ func (m DateTime) Equals(n Model) bool {
 	return ok
 }
 
+type Duration struct{}
+
+func (r Duration) Zero() val.Value {
+	return val.Duration(0)
+}
+
+func (m Duration) Transform(f func(Model) Model) Model {
+	return f(m)
+}
+
+func (o Duration) TraverseValue(j val.Value, f func(val.Value, Model)) {
+	f(j, o)
+}
+
+func (o Duration) Copy() Model {
+	return o
+}
+
+func (r Duration) Traverse(p []string, f func([]string, Model)) {
+	f(p, r)
+}
+
+func (m Duration) Concrete() Model {
+	return m
+}
+
+func (m Duration) Equals(n Model) bool {
+	_, ok := n.(Duration)
+	return ok
+}
+
+type Decimal struct{}
+
+func (r Decimal) Zero() val.Value {
+	return val.DecimalFromInt64(0)
+}
+
+func (m Decimal) Transform(f func(Model) Model) Model {
+	return f(m)
+}
+
+func (o Decimal) TraverseValue(j val.Value, f func(val.Value, Model)) {
+	f(j, o)
+}
+
+func (o Decimal) Copy() Model {
+	return o
+}
+
+func (r Decimal) Traverse(p []string, f func([]string, Model)) {
+	f(p, r)
+}
+
+func (m Decimal) Concrete() Model {
+	return m
+}
+
+func (m Decimal) Equals(n Model) bool {
+	_, ok := n.(Decimal)
+	return ok
+}
+
+type Bytes struct{}
+
+func (r Bytes) Zero() val.Value {
+	return val.Bytes{}
+}
+
+func (m Bytes) Transform(f func(Model) Model) Model {
+	return f(m)
+}
+
+func (o Bytes) TraverseValue(j val.Value, f func(val.Value, Model)) {
+	f(j, o)
+}
+
+func (o Bytes) Copy() Model {
+	return o
+}
+
+func (r Bytes) Traverse(p []string, f func([]string, Model)) {
+	f(p, r)
+}
+
+func (m Bytes) Concrete() Model {
+	return m
+}
+
+func (m Bytes) Equals(n Model) bool {
+	_, ok := n.(Bytes)
+	return ok
+}
+
+// Blob references content stored outside of the value, see val.Blob.
+type Blob struct{}
+
+func (r Blob) Zero() val.Value {
+	panic("Zero called on mdl.Blob")
+}
+
+func (m Blob) Transform(f func(Model) Model) Model {
+	return f(m)
+}
+
+func (o Blob) TraverseValue(j val.Value, f func(val.Value, Model)) {
+	f(j, o)
+}
+
+func (o Blob) Copy() Model {
+	return o
+}
+
+func (r Blob) Traverse(p []string, f func([]string, Model)) {
+	f(p, r)
+}
+
+func (m Blob) Concrete() Model {
+	return m
+}
+
+func (m Blob) Equals(n Model) bool {
+	_, ok := n.(Blob)
+	return ok
+}
+
 type Tuple []Model
 
 func (r Tuple) Zero() val.Value {
@@ -944,6 +1069,22 @@ func (DateTime) Nullable() bool {
 	return false
 }
 
+func (Duration) Nullable() bool {
+	return false
+}
+
+func (Decimal) Nullable() bool {
+	return false
+}
+
+func (Bytes) Nullable() bool {
+	return false
+}
+
+func (Blob) Nullable() bool {
+	return false
+}
+
 func (Bool) Nullable() bool {
 	return false
 }
@@ -1032,6 +1173,22 @@ func (DateTime) Zeroable() bool {
 	return true
 }
 
+func (Duration) Zeroable() bool {
+	return true
+}
+
+func (Decimal) Zeroable() bool {
+	return true
+}
+
+func (Bytes) Zeroable() bool {
+	return true
+}
+
+func (Blob) Zeroable() bool {
+	return false
+}
+
 func (Bool) Zeroable() bool {
 	return true
 }
@@ -1104,6 +1261,22 @@ func (m DateTime) Unwrap() Model {
 	return m
 }
 
+func (m Duration) Unwrap() Model {
+	return m
+}
+
+func (m Decimal) Unwrap() Model {
+	return m
+}
+
+func (m Bytes) Unwrap() Model {
+	return m
+}
+
+func (m Blob) Unwrap() Model {
+	return m
+}
+
 func (m Bool) Unwrap() Model {
 	return m
 }
@@ -97,6 +97,14 @@ func modelToHuman(m Model, indent int, r map[*Recursion]struct{}) string {
 		return "bool"
 	case DateTime:
 		return "dateTime"
+	case Duration:
+		return "duration"
+	case Decimal:
+		return "decimal"
+	case Bytes:
+		return "bytes"
+	case Blob:
+		return "blob"
 	case Int8:
 		return "int8"
 	case Int16:
@@ -66,6 +66,22 @@ func (DateTime) ValueType() val.Type {
 	return val.TypeDateTime
 }
 
+func (Duration) ValueType() val.Type {
+	return val.TypeDuration
+}
+
+func (Decimal) ValueType() val.Type {
+	return val.TypeDecimal
+}
+
+func (Bytes) ValueType() val.Type {
+	return val.TypeBytes
+}
+
+func (Blob) ValueType() val.Type {
+	return val.TypeBlob
+}
+
 func (Null) ValueType() val.Type {
 	return val.TypeNull
 }
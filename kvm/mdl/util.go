@@ -66,6 +66,14 @@ func TightestModelForValue(v val.Value) Model {
 		return Bool{}
 	case val.DateTime:
 		return DateTime{}
+	case val.Duration:
+		return Duration{}
+	case val.Decimal:
+		return Decimal{}
+	case val.Bytes:
+		return Bytes{}
+	case val.Blob:
+		return Blob{}
 	case val.Float:
 		return Float{}
 	case val.String:
@@ -196,6 +196,30 @@ func (m DateTime) Validate(v val.Value, p err.ErrorPath) err.Error {
 	}
 	return nil
 }
+func (m Duration) Validate(v val.Value, p err.ErrorPath) err.Error {
+	if _, ok := v.(val.Duration); !ok {
+		return ValidationError{m, v, p}
+	}
+	return nil
+}
+func (m Decimal) Validate(v val.Value, p err.ErrorPath) err.Error {
+	if _, ok := v.(val.Decimal); !ok {
+		return ValidationError{m, v, p}
+	}
+	return nil
+}
+func (m Bytes) Validate(v val.Value, p err.ErrorPath) err.Error {
+	if _, ok := v.(val.Bytes); !ok {
+		return ValidationError{m, v, p}
+	}
+	return nil
+}
+func (m Blob) Validate(v val.Value, p err.ErrorPath) err.Error {
+	if b, ok := v.(val.Blob); !ok || !b.Valid() {
+		return ValidationError{m, v, p}
+	}
+	return nil
+}
 func (m Bool) Validate(v val.Value, p err.ErrorPath) err.Error {
 	if _, ok := v.(val.Bool); !ok {
 		return ValidationError{m, v, p}
@@ -0,0 +1,481 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"fmt"
+	"karma.run/kvm/inst"
+	"karma.run/kvm/mdl"
+	"karma.run/kvm/val"
+	"karma.run/kvm/xpr"
+	"reflect"
+)
+
+// Optimize rewrites f, as returned by TypeFunction, into an equivalent function that executes faster:
+//   - expressions whose arguments are constant are evaluated, unless they depend on
+//     the database, the current user or the time,
+//   - branches of if and switchCase that can't be taken are dropped,
+//   - first(filterList), length(filterList) and slice(all) are fused into instructions
+//     that stop early, count without collecting or skip objects without decoding them,
+//   - loop-invariant expressions are hoisted out of mapList functions and evaluated
+//     lazily, at most once per mapList.
+//
+// The fused forms don't evaluate filters beyond the element they stop at, so they may
+// succeed where the original program would have failed later on, never the other way round.
+func (vm VirtualMachine) Optimize(f xpr.TypedFunction) xpr.TypedFunction {
+	o := &optimizer{vm: vm}
+	o.vm.UserID, o.vm.Budget, o.vm.Profile = "", nil, nil // folding mustn't depend on them
+	return o.function(f)
+}
+
+// limits for evaluating constant expressions at compile time,
+// expressions exceeding them are left to be evaluated at run time.
+const (
+	foldInstructions    = 100000
+	foldAllocationBytes = 1 << 20
+)
+
+// prefix of the scope names of hoisted expressions, not expected in user programs
+const hoistedPrefix = "\x00hoisted"
+
+// impureInstructions read the database or depend on the user or the time.
+var impureInstructions = map[reflect.Type]struct{}{
+	reflect.TypeOf(inst.All{}):             struct{}{},
+	reflect.TypeOf(inst.AllReferrers{}):    struct{}{},
+	reflect.TypeOf(inst.Call{}):            struct{}{},
+	reflect.TypeOf(inst.CreateMultiple{}):  struct{}{},
+	reflect.TypeOf(inst.CurrentUser{}):     struct{}{},
+	reflect.TypeOf(inst.DateTimeNow{}):     struct{}{},
+	reflect.TypeOf(inst.Delete{}):          struct{}{},
+	reflect.TypeOf(inst.Deref{}):           struct{}{},
+	reflect.TypeOf(inst.GraphFlow{}):       struct{}{},
+	reflect.TypeOf(inst.LookupEncrypted{}): struct{}{},
+	reflect.TypeOf(inst.MapSet{}):          struct{}{},
+	reflect.TypeOf(inst.RefJoin{}):         struct{}{},
+	reflect.TypeOf(inst.Referred{}):        struct{}{},
+	reflect.TypeOf(inst.Referrers{}):       struct{}{},
+	reflect.TypeOf(inst.RelocateRef{}):     struct{}{},
+	reflect.TypeOf(inst.ResolveAllRefs{}):  struct{}{},
+	reflect.TypeOf(inst.ResolveRefs{}):     struct{}{},
+	reflect.TypeOf(inst.SliceAll{}):        struct{}{},
+	reflect.TypeOf(inst.StringToRef{}):     struct{}{},
+	reflect.TypeOf(inst.Tag{}):             struct{}{},
+	reflect.TypeOf(inst.TagExists{}):       struct{}{},
+	reflect.TypeOf(inst.TraverseGraph{}):   struct{}{},
+	reflect.TypeOf(inst.Update{}):          struct{}{},
+}
+
+func pure(program inst.Sequence) bool {
+	for _, it := range program {
+		if _, ok := impureInstructions[reflect.TypeOf(it)]; ok {
+			return false
+		}
+		p := true
+		forEachSequence(reflect.ValueOf(it), func(sub inst.Sequence) {
+			p = p && pure(sub)
+		})
+		if !p {
+			return false
+		}
+	}
+	return true
+}
+
+// expressions produced by the optimizer, compiled to the instructions of the same name
+
+type filterFirst struct {
+	Value  xpr.Expression
+	Filter xpr.Function
+}
+
+func (x filterFirst) Transform(f func(xpr.Expression) xpr.Expression) xpr.Expression {
+	return f(filterFirst{x.Value.Transform(f), x.Filter})
+}
+
+type filterLength struct {
+	Value  xpr.Expression
+	Filter xpr.Function
+}
+
+func (x filterLength) Transform(f func(xpr.Expression) xpr.Expression) xpr.Expression {
+	return f(filterLength{x.Value.Transform(f), x.Filter})
+}
+
+type sliceAll struct {
+	Model, Offset, Length xpr.Expression
+}
+
+func (x sliceAll) Transform(f func(xpr.Expression) xpr.Expression) xpr.Expression {
+	return f(sliceAll{x.Model.Transform(f), x.Offset.Transform(f), x.Length.Transform(f)})
+}
+
+// hoisted makes Values available to Body as Names, evaluated lazily.
+type hoisted struct {
+	Names  []string
+	Values []xpr.Expression
+	Body   xpr.Expression
+}
+
+func (x hoisted) Transform(f func(xpr.Expression) xpr.Expression) xpr.Expression {
+	values := make([]xpr.Expression, len(x.Values), len(x.Values))
+	for i, v := range x.Values {
+		values[i] = v.Transform(f)
+	}
+	return f(hoisted{x.Names, values, x.Body.Transform(f)})
+}
+
+type optimizer struct {
+	vm      VirtualMachine
+	hoisted int // number of hoisted expressions so far, for unique names
+}
+
+func (o *optimizer) function(f xpr.TypedFunction) xpr.TypedFunction {
+	return mapFunction(f, o.expression)
+}
+
+// expression optimizes x bottom-up.
+func (o *optimizer) expression(x xpr.TypedExpression) xpr.TypedExpression {
+	if _, ok := x.Actual.(ConstantModel); ok {
+		return x
+	}
+	x.Expression = mapChildren(reflect.ValueOf(x.Expression), o.expression, o.function).Interface().(xpr.Expression)
+	return o.fold(o.rewrite(x))
+}
+
+func (o *optimizer) rewrite(x xpr.TypedExpression) xpr.TypedExpression {
+
+	switch node := x.Expression.(type) {
+
+	case xpr.If:
+		ca, ok := node.Condition.(xpr.TypedExpression).Actual.(ConstantModel)
+		if !ok {
+			break
+		}
+		branch := node.Else.(xpr.TypedExpression)
+		if ca.Value.(val.Bool) {
+			branch = node.Then.(xpr.TypedExpression)
+		}
+		if !definesScope(branch) { // branches have their own scope
+			return branch
+		}
+
+	case xpr.SwitchCase:
+		ca, ok := node.Value.(xpr.TypedExpression).Actual.(ConstantModel)
+		if !ok {
+			break
+		}
+		u := unMeta(ca.Value).(val.Union)
+		f, ok := node.Cases[u.Case]
+		if !ok {
+			break // fails at run time
+		}
+		model := mdl.Model(AnyModel)
+		if um, ok := ca.Model.Concrete().(mdl.Union); ok {
+			model = um.Case(u.Case)
+		}
+		value := xpr.TypedExpression{xpr.Literal{u.Value}, model, ConstantModel{model, u.Value}}
+		return xpr.TypedExpression{xpr.With{value, f}, x.Expected, x.Actual}
+
+	case xpr.First:
+		if fl, ok := computed(node.Argument).(xpr.FilterList); ok {
+			return xpr.TypedExpression{filterFirst{fl.Value, fl.Filter}, x.Expected, x.Actual}
+		}
+
+	case xpr.Length:
+		if fl, ok := computed(node.Argument).(xpr.FilterList); ok {
+			return xpr.TypedExpression{filterLength{fl.Value, fl.Filter}, x.Expected, x.Actual}
+		}
+
+	case xpr.Slice:
+		if all, ok := computed(node.Value).(xpr.All); ok {
+			return xpr.TypedExpression{sliceAll{all.Argument, node.Offset, node.Length}, x.Expected, x.Actual}
+		}
+
+	case xpr.MapList:
+		return o.hoist(x, node)
+
+	}
+
+	return x
+}
+
+// computed returns the expression computing x, nil if x is constant.
+func computed(x xpr.Expression) xpr.Expression {
+	t := x.(xpr.TypedExpression)
+	if _, ok := t.Actual.(ConstantModel); ok {
+		return nil
+	}
+	return t.Expression
+}
+
+// fold replaces x by its value if its arguments are constant and evaluating it
+// doesn't depend on anything else. x is left as it is if evaluation fails.
+func (o *optimizer) fold(x xpr.TypedExpression) xpr.TypedExpression {
+
+	if _, ok := x.Actual.(ConstantModel); ok {
+		return x
+	}
+	if _, ok := x.Expression.(xpr.Define); ok {
+		return x // needed for its effect on the scope
+	}
+
+	constant := true
+	visitChildren(reflect.ValueOf(x.Expression), func(sub xpr.TypedExpression) bool {
+		_, ok := sub.Actual.(ConstantModel)
+		constant = constant && ok
+		return false
+	}, nil)
+	if !constant {
+		return x
+	}
+
+	program := o.vm.CompileExpression(x, nil)
+	if !pure(program) {
+		return x
+	}
+
+	vm := o.vm
+	vm.Budget = NewBudget(nil, Limits{Instructions: foldInstructions, AllocationBytes: foldAllocationBytes})
+	v, e := vm.Execute(program, nil)
+	if e != nil {
+		return x
+	}
+	if _, ok := v.(iteratorValue); ok {
+		return x // lazy for a reason, e.g. a long range
+	}
+
+	x.Actual = ConstantModel{x.Actual, v}
+	return x
+}
+
+// writes reports whether x may write to the database. calls are assumed to.
+func writes(x xpr.TypedExpression) bool {
+	found := false
+	visitChildren(reflect.ValueOf([]xpr.Expression{x}), func(sub xpr.TypedExpression) bool {
+		switch sub.Expression.(type) {
+		case xpr.Create, xpr.CreateMultiple, xpr.Update, xpr.Delete, xpr.Call:
+			found = true
+		}
+		return !found
+	}, func(f xpr.TypedFunction) bool {
+		return !found
+	})
+	return found
+}
+
+// hoist moves the loop-invariant expressions of node's function out of it.
+// expressions are invariant if they refer to neither the function's parameters
+// nor to anything defined in it. mapLists writing to the database are left alone.
+func (o *optimizer) hoist(x xpr.TypedExpression, node xpr.MapList) xpr.TypedExpression {
+
+	mapping := node.Mapping.(xpr.TypedFunction)
+
+	bound, writes := make(map[string]struct{}), false
+	for _, p := range mapping.Parameters() {
+		bound[p] = struct{}{}
+	}
+	for _, sub := range mapping.Expressions() {
+		visitChildren(reflect.ValueOf([]xpr.Expression{sub}), func(sub xpr.TypedExpression) bool {
+			switch n := sub.Expression.(type) {
+			case xpr.Define:
+				bound[n.Name] = struct{}{}
+			case hoisted:
+				for _, name := range n.Names {
+					bound[name] = struct{}{}
+				}
+			case xpr.Create, xpr.CreateMultiple, xpr.Update, xpr.Delete, xpr.Call:
+				writes = true
+			}
+			return true
+		}, func(f xpr.TypedFunction) bool {
+			for _, p := range f.Parameters() {
+				bound[p] = struct{}{}
+			}
+			return true
+		})
+	}
+	if writes {
+		return x
+	}
+
+	names, values := []string(nil), []xpr.Expression(nil)
+
+	var replace func(xpr.TypedExpression) xpr.TypedExpression
+	replace = func(sub xpr.TypedExpression) xpr.TypedExpression {
+		if !invariant(sub, bound) {
+			sub.Expression = mapChildren(reflect.ValueOf(sub.Expression), replace, func(f xpr.TypedFunction) xpr.TypedFunction {
+				return mapFunction(f, replace)
+			}).Interface().(xpr.Expression)
+			return sub
+		}
+		name := fmt.Sprintf("%s%d", hoistedPrefix, o.hoisted)
+		o.hoisted++
+		names, values = append(names, name), append(values, sub)
+		return xpr.TypedExpression{xpr.Scope(name), sub.Expected, sub.Actual}
+	}
+
+	mapping = mapFunction(mapping, replace)
+	if len(names) == 0 {
+		return x
+	}
+
+	body := xpr.TypedExpression{xpr.MapList{node.Value, mapping}, x.Expected, x.Actual}
+	return xpr.TypedExpression{hoisted{names, values, body}, x.Expected, x.Actual}
+}
+
+// invariant reports whether x is worth hoisting and independent of bound.
+func invariant(x xpr.TypedExpression, bound map[string]struct{}) bool {
+	if _, ok := x.Actual.(ConstantModel); ok {
+		return false
+	}
+	switch x.Expression.(type) {
+	case xpr.Scope, xpr.Literal, xpr.Define, xpr.DateTimeNow:
+		return false
+	}
+	ok := true
+	visitChildren(reflect.ValueOf(x.Expression), func(sub xpr.TypedExpression) bool {
+		switch sub.Expression.(type) {
+		case xpr.Define, xpr.DateTimeNow:
+			ok = false
+		}
+		return ok
+	}, nil)
+	return ok && !refersTo(x, bound)
+}
+
+// refersTo reports whether x reads any of names from its scope,
+// not counting the parameters of functions in x.
+func refersTo(x xpr.TypedExpression, names map[string]struct{}) bool {
+	if s, ok := x.Expression.(xpr.Scope); ok {
+		_, found := names[string(s)]
+		return found
+	}
+	found := false
+	visitChildren(reflect.ValueOf(x.Expression), func(sub xpr.TypedExpression) bool {
+		found = found || refersTo(sub, names)
+		return false
+	}, func(f xpr.TypedFunction) bool {
+		inner := make(map[string]struct{}, len(names))
+		for k := range names {
+			inner[k] = struct{}{}
+		}
+		for _, p := range f.Parameters() {
+			delete(inner, p)
+		}
+		for _, sub := range f.Expressions() {
+			found = found || refersTo(sub.(xpr.TypedExpression), inner)
+		}
+		return false
+	})
+	return found
+}
+
+// definesScope reports whether x defines anything in its scope, i.e. outside of functions.
+func definesScope(x xpr.TypedExpression) bool {
+	defines := false
+	visitChildren(reflect.ValueOf([]xpr.Expression{x}), func(sub xpr.TypedExpression) bool {
+		if _, ok := sub.Expression.(xpr.Define); ok {
+			defines = true
+		}
+		return !defines
+	}, func(xpr.TypedFunction) bool {
+		return false
+	})
+	return defines
+}
+
+func mapFunction(f xpr.TypedFunction, fx func(xpr.TypedExpression) xpr.TypedExpression) xpr.TypedFunction {
+	xs := f.Expressions()
+	mapped := make([]xpr.Expression, len(xs), len(xs))
+	for i, x := range xs {
+		mapped[i] = fx(x.(xpr.TypedExpression))
+	}
+	f.Function = xpr.NewFunction(f.Parameters(), mapped...)
+	return f
+}
+
+// mapChildren returns a copy of rv with fx applied to the typed expressions in it
+// and ff to the typed functions, without descending into them.
+func mapChildren(rv reflect.Value, fx func(xpr.TypedExpression) xpr.TypedExpression, ff func(xpr.TypedFunction) xpr.TypedFunction) reflect.Value {
+
+	if !containsExpressions(rv.Type()) {
+		return rv
+	}
+
+	switch rv.Kind() {
+	case reflect.Interface:
+		switch x := rv.Interface().(type) {
+		case xpr.TypedExpression:
+			return reflect.ValueOf(fx(x))
+		case xpr.TypedFunction:
+			return reflect.ValueOf(ff(x))
+		}
+	case reflect.Struct:
+		cp := reflect.New(rv.Type()).Elem()
+		cp.Set(rv)
+		for i := 0; i < rv.NumField(); i++ {
+			if rv.Type().Field(i).PkgPath == "" { // exported
+				cp.Field(i).Set(mapChildren(rv.Field(i), fx, ff))
+			}
+		}
+		return cp
+	case reflect.Array:
+		cp := reflect.New(rv.Type()).Elem()
+		for i := 0; i < rv.Len(); i++ {
+			cp.Index(i).Set(mapChildren(rv.Index(i), fx, ff))
+		}
+		return cp
+	case reflect.Slice:
+		if rv.IsNil() {
+			return rv
+		}
+		cp := reflect.MakeSlice(rv.Type(), rv.Len(), rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			cp.Index(i).Set(mapChildren(rv.Index(i), fx, ff))
+		}
+		return cp
+	case reflect.Map:
+		if rv.IsNil() {
+			return rv
+		}
+		cp := reflect.MakeMapWithSize(rv.Type(), rv.Len())
+		for _, k := range rv.MapKeys() {
+			cp.SetMapIndex(k, mapChildren(rv.MapIndex(k), fx, ff))
+		}
+		return cp
+	}
+	return rv
+}
+
+// visitChildren calls fx for the typed expressions in rv and ff for the typed functions,
+// descending into them if they return true. ff may be nil to skip functions.
+func visitChildren(rv reflect.Value, fx func(xpr.TypedExpression) bool, ff func(xpr.TypedFunction) bool) {
+	mapChildren(rv, func(x xpr.TypedExpression) xpr.TypedExpression {
+		if fx(x) {
+			visitChildren(reflect.ValueOf(x.Expression), fx, ff)
+		}
+		return x
+	}, func(f xpr.TypedFunction) xpr.TypedFunction {
+		if ff != nil && ff(f) {
+			visitChildren(reflect.ValueOf(f.Expressions()), fx, ff)
+		}
+		return f
+	})
+}
+
+// containsExpressions reports whether values of type t may hold expressions or functions.
+func containsExpressions(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Interface:
+		return t == expressionType || t == functionType
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if containsExpressions(t.Field(i).Type) {
+				return true
+			}
+		}
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return containsExpressions(t.Elem())
+	}
+	return false
+}
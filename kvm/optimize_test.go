@@ -0,0 +1,197 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"karma.run/codec/json"
+	"karma.run/kvm/err"
+	"karma.run/kvm/inst"
+	"karma.run/kvm/val"
+	"karma.run/kvm/xpr"
+	"karma.run/store"
+	"reflect"
+	"testing"
+)
+
+// optimizerCases run against a fresh database as the root user. optimized names
+// an instruction the optimized program must contain, empty if it should be a constant.
+var optimizerCases = []struct {
+	name      string
+	program   string
+	optimized interface{}
+}{
+	{
+		name:      "fold arithmetic",
+		program:   `{"addInt64":[{"int64":1},{"mulInt64":[{"int64":2},{"int64":3}]}]}`,
+		optimized: nil,
+	},
+	{
+		name:      "fold list functions",
+		program:   `{"length":{"filterList":[{"data":{"list":[{"int64":3},{"int64":5},{"int64":8}]}},{"function":[["i","v"],[{"gtInt64":[{"scope":"v"},{"int64":4}]}]]}]}}`,
+		optimized: nil,
+	},
+	{
+		name:      "keep failing constants",
+		program:   `{"slice":{"value":{"data":{"list":[{"int64":1}]}},"offset":{"int64":-1},"length":{"int64":1}}}`,
+		optimized: inst.Slice{},
+	},
+	{
+		name:      "drop else branch",
+		program:   `{"if":{"condition":{"bool":true},"then":{"int64":1},"else":{"length":{"all":{"tag":{"string":"_tag"}}}}}}`,
+		optimized: nil,
+	},
+	{
+		name:      "drop then branch",
+		program:   `{"if":{"condition":{"bool":false},"then":{"int64":1},"else":{"length":{"all":{"tag":{"string":"_tag"}}}}}}`,
+		optimized: inst.All{},
+	},
+	{
+		name:      "drop switch cases",
+		program:   `{"switchCase":[{"data":{"union":["a",{"int64":1}]}},{"a":{"function":[["v"],[{"addInt64":[{"scope":"v"},{"length":{"all":{"tag":{"string":"_tag"}}}}]}]]},"b":{"function":[["v"],[{"int64":0}]]}}]}`,
+		optimized: inst.With{},
+	},
+	{
+		name:      "fuse first and filterList",
+		program:   `{"first":{"filterList":[{"all":{"tag":{"string":"_tag"}}},{"function":[["i","v"],[{"equal":[{"field":["tag",{"scope":"v"}]},{"string":"_user"}]}]]}]}}`,
+		optimized: inst.FilterFirst{},
+	},
+	{
+		name:      "fuse first and filterList without match",
+		program:   `{"first":{"filterList":[{"all":{"tag":{"string":"_tag"}}},{"function":[["i","v"],[{"bool":false}]]}]}}`,
+		optimized: inst.FilterFirst{},
+	},
+	{
+		name:      "fuse length and filterList",
+		program:   `{"length":{"filterList":[{"all":{"tag":{"string":"_tag"}}},{"function":[["i","v"],[{"not":{"equal":[{"field":["tag",{"scope":"v"}]},{"string":"_user"}]}}]]}]}}`,
+		optimized: inst.FilterLength{},
+	},
+	{
+		name:      "fuse slice and all",
+		program:   `{"slice":{"value":{"all":{"tag":{"string":"_tag"}}},"offset":{"int64":2},"length":{"int64":3}}}`,
+		optimized: inst.SliceAll{},
+	},
+	{
+		name:      "fuse slice and all past the end",
+		program:   `{"slice":{"value":{"all":{"tag":{"string":"_tag"}}},"offset":{"int64":100},"length":{"int64":3}}}`,
+		optimized: inst.SliceAll{},
+	},
+	{
+		name:      "fuse slice and all with negative offset",
+		program:   `{"slice":{"value":{"all":{"tag":{"string":"_tag"}}},"offset":{"int64":-1},"length":{"int64":3}}}`,
+		optimized: inst.SliceAll{},
+	},
+	{
+		name:      "hoist out of mapList",
+		program:   `{"mapList":[{"all":{"tag":{"string":"_tag"}}},{"function":[["i","v"],[{"addInt64":[{"scope":"i"},{"length":{"all":{"tag":{"string":"_user"}}}}]}]]}]}`,
+		optimized: inst.DefineLazy{},
+	},
+	{
+		name:      "hoist out of mapList over nothing",
+		program:   `{"mapList":[{"data":{"list":[]}},{"function":[["i","v"],[{"first":{"filterList":[{"all":{"tag":{"string":"_tag"}}},{"function":[["j","w"],[{"bool":false}]]}]}}]]}]}`,
+		optimized: inst.DefineLazy{},
+	},
+	{
+		name:      "hoist failing out of mapList",
+		program:   `{"mapList":[{"all":{"tag":{"string":"_tag"}}},{"function":[["i","v"],[{"first":{"filterList":[{"all":{"tag":{"string":"_tag"}}},{"function":[["j","w"],[{"bool":false}]]}]}}]]}]}`,
+		optimized: inst.DefineLazy{},
+	},
+	{
+		name:      "hoist out of nested mapList",
+		program:   `{"mapList":[{"all":{"tag":{"string":"_tag"}}},{"function":[["i","v"],[{"mapList":[{"all":{"tag":{"string":"_user"}}},{"function":[["j","w"],[{"data":{"list":[{"expr":{"scope":"i"}},{"expr":{"length":{"all":{"tag":{"string":"_role"}}}}}]}}]]}]}]]}]}`,
+		optimized: inst.DefineLazy{},
+	},
+	{
+		name:      "don't hoist dependent expressions",
+		program:   `{"mapList":[{"all":{"tag":{"string":"_tag"}}},{"function":[["i","v"],[{"define":["t",{"field":["tag",{"scope":"v"}]}]},{"filterList":[{"all":{"tag":{"string":"_tag"}}},{"function":[["j","w"],[{"equal":[{"field":["tag",{"scope":"w"}]},{"scope":"t"}]}]]}]}]]}]}`,
+		optimized: inst.MapList{},
+	},
+}
+
+func TestOptimize(t *testing.T) {
+
+	withTestVirtualMachine(t, func(vm *VirtualMachine) {
+
+		for _, c := range optimizerCases {
+
+			v, e := json.Decode(json.JSON(`{"function":[[],[`+c.program+`]]}`), xpr.LanguageModel, nil)
+			if e != nil {
+				t.Fatalf("%s: %v", c.name, e)
+			}
+
+			typed, ke := vm.Parse(v, nil, nil, nil)
+			if ke != nil {
+				t.Fatalf("%s: %s", c.name, ke.String())
+			}
+
+			plain, optimized := vm.CompileFunction(typed), vm.CompileFunction(vm.Optimize(typed))
+
+			if c.optimized == nil {
+				if _, ok := optimized[0].(inst.Constant); !ok || len(optimized) != 1 {
+					t.Errorf("%s: expected a constant, got %#v", c.name, optimized)
+				}
+			} else if !containsInstruction(optimized, reflect.TypeOf(c.optimized)) {
+				t.Errorf("%s: expected %T in %#v", c.name, c.optimized, optimized)
+			}
+
+			want, we := executeForTest(vm, plain)
+			have, he := executeForTest(vm, optimized)
+
+			if (we == nil) != (he == nil) {
+				t.Errorf("%s: errors differ, want %v, have %v", c.name, we, he)
+				continue
+			}
+			if we != nil {
+				if we.Value().Case != he.Value().Case {
+					t.Errorf("%s: errors differ, want %s, have %s", c.name, we.String(), he.String())
+				}
+				continue
+			}
+			if w, h := string(json.Encode(want)), string(json.Encode(have)); w != h {
+				t.Errorf("%s: results differ, want %s, have %s", c.name, w, h)
+			}
+		}
+	})
+}
+
+func executeForTest(vm *VirtualMachine, program inst.Sequence) (val.Value, err.Error) {
+	v, e := vm.Execute(program, nil)
+	if e != nil {
+		return nil, e
+	}
+	return slurpIterators(v)
+}
+
+func containsInstruction(program inst.Sequence, t reflect.Type) bool {
+	found := false
+	for _, it := range program {
+		found = found || reflect.TypeOf(it) == t
+		forEachSequence(reflect.ValueOf(it), func(sub inst.Sequence) {
+			found = found || containsInstruction(sub, t)
+		})
+	}
+	return found
+}
+
+// withTestVirtualMachine runs f in a write transaction on a fresh database, as the root user.
+func withTestVirtualMachine(t *testing.T, f func(vm *VirtualMachine)) {
+
+	db := store.NewMemory()
+	defer db.Close()
+
+	e := db.Update(func(tx store.Tx) error {
+		rb, e := tx.CreateBucket([]byte(`root`))
+		if e != nil {
+			return e
+		}
+		if ke := (&VirtualMachine{RootBucket: rb}).InitDB(); ke != nil {
+			return ke
+		}
+		vm := &VirtualMachine{RootBucket: rb}
+		vm.UserID = vm.RootUserId()
+		f(vm)
+		return nil
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"fmt"
+	"karma.run/kvm/err"
+	"karma.run/kvm/val"
+	"log"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// elements per goroutine below which evaluation stays sequential
+const parallelMinimum = 1024
+
+// results a goroutine may compute ahead of the consumer
+const parallelBuffer = 64
+
+// Parallelism bounds the goroutines a single request may use to evaluate
+// mapList and filterList over buckets in parallel. Nested evaluations share
+// the bound and run sequentially if it is used up. The goroutines share the
+// transaction of the request, so RootBucket must be store.Synchronized.
+type Parallelism struct {
+	slots chan struct{}
+}
+
+// NewParallelism allows up to limit goroutines, but no more than GOMAXPROCS.
+// It returns nil, disabling parallel evaluation, if that is less than 2.
+func NewParallelism(limit int) *Parallelism {
+	if n := runtime.GOMAXPROCS(0); limit > n {
+		limit = n
+	}
+	if limit < 2 {
+		return nil
+	}
+	return &Parallelism{slots: make(chan struct{}, limit)}
+}
+
+// acquire takes up to n slots without blocking and returns how many it got.
+func (p *Parallelism) acquire(n int) int {
+	for i := 0; i < n; i++ {
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			return i
+		}
+	}
+	return n
+}
+
+func (p *Parallelism) release(n int) {
+	for i := 0; i < n; i++ {
+		<-p.slots
+	}
+}
+
+// parallelFunc maps the element v at index i, reporting whether to yield the result.
+type parallelFunc func(vm VirtualMachine, i int, v val.Value) (val.Value, bool, err.Error)
+
+// parallelIterator applies fnc to the elements of a bucket, partitioned by key
+// range across goroutines. Results are yielded in bucket order.
+type parallelIterator struct {
+	sub     bucketDecodingIterator
+	vm      VirtualMachine
+	fnc     parallelFunc
+	mapping bool // fnc yields every element, so the length is known
+}
+
+// parallel returns a parallelIterator applying fnc to sub if vm may evaluate
+// in parallel: only in read-only transactions, without profiling and only over
+// objects that aren't subject to read permissions, as the index of an object
+// would depend on the permissions of those before it.
+func (vm VirtualMachine) parallel(sub iterator, mapping bool, fnc parallelFunc) (iterator, bool) {
+	bi, ok := sub.(bucketDecodingIterator)
+	if !ok || vm.Parallelism == nil || vm.Profile != nil || vm.RootBucket.Tx().Writable() {
+		return nil, false
+	}
+	return parallelIterator{bi, vm, fnc, mapping}, true
+}
+
+type parallelResult struct {
+	value val.Value
+	err   err.Error
+}
+
+func (i parallelIterator) forEach(f func(val.Value) err.Error) err.Error {
+
+	total := i.sub.length()
+	n := i.vm.Parallelism.acquire(total / parallelMinimum)
+	defer i.vm.Parallelism.release(n)
+
+	if n < 2 {
+		index := 0
+		return i.sub.forEach(func(v val.Value) err.Error {
+			w, keep, e := i.fnc(i.vm, index, v)
+			index++
+			if e != nil {
+				return e
+			}
+			if !keep {
+				return nil
+			}
+			return f(w)
+		})
+	}
+
+	partitions, starts := i.sub.partition(n)
+	results := make([]chan parallelResult, len(partitions))
+	done := make(chan struct{})
+	stop := &err.ExecutionError{} // placeholder
+	wg := sync.WaitGroup{}
+
+	defer wg.Wait()
+	defer close(done)
+
+	for p := range partitions {
+		results[p] = make(chan parallelResult, parallelBuffer)
+		wg.Add(1)
+		go func(p int, vm VirtualMachine) {
+			defer wg.Done()
+			defer close(results[p])
+			index := starts[p]
+			send := func(r parallelResult) err.Error {
+				select {
+				case results[p] <- r:
+					return nil
+				case <-done:
+					return stop
+				}
+			}
+			defer func() {
+				if v := recover(); v != nil {
+					send(parallelResult{err: recovered(v)})
+				}
+			}()
+			e := partitions[p].forEach(func(v val.Value) err.Error {
+				select {
+				case <-done:
+					return stop
+				default:
+				}
+				w, keep, e := i.fnc(vm, index, v)
+				index++
+				if e != nil {
+					return e
+				}
+				if !keep {
+					return nil
+				}
+				return send(parallelResult{value: w})
+			})
+			if e != nil && e != stop {
+				send(parallelResult{err: e})
+			}
+		}(p, i.vm.worker())
+	}
+
+	for _, rs := range results {
+		for r := range rs {
+			if r.err != nil {
+				return r.err
+			}
+			if e := f(r.value); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+func (i parallelIterator) length() int {
+	if i.mapping {
+		return i.sub.length()
+	}
+	return -1
+}
+
+// recovered returns the error a worker panicked with, logging other values.
+func recovered(v interface{}) err.Error {
+	if e, ok := v.(err.Error); ok {
+		return e
+	}
+	log.Printf("parallel evaluation panicked: %v\n%s", v, debug.Stack())
+	return err.InternalError{Problem: fmt.Sprintf(`parallel evaluation: %v`, v)}
+}
+
+// worker returns a copy of vm for use by another goroutine.
+func (vm VirtualMachine) worker() VirtualMachine {
+	if vm.permRecursions != nil {
+		rs := make(map[string]struct{}, len(vm.permRecursions))
+		for k := range vm.permRecursions {
+			rs[k] = struct{}{}
+		}
+		vm.permRecursions = rs
+	}
+	return vm
+}
@@ -0,0 +1,156 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"fmt"
+	"karma.run/kvm/err"
+	"karma.run/kvm/inst"
+	"karma.run/kvm/val"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Profile records per instruction statistics while a VirtualMachine executes.
+// Times are inclusive, i.e. an instruction applying a function includes the
+// time spent in it. Work done by lazy iterators is attributed to the
+// instruction consuming them.
+type Profile struct {
+	entries   map[profileKey]*ProfileEntry
+	sequences map[*inst.Instruction]string
+	decoded   map[string]int64 // bucket -> decoded objects
+}
+
+type profileKey struct {
+	sequence *inst.Instruction // first instruction of the sequence
+	pc       int
+}
+
+type ProfileEntry struct {
+	Sequence    string // label of the sequence, "#n" if unlabeled
+	PC          int
+	Instruction inst.Instruction
+	Calls       int64
+	Time        time.Duration
+	Items       int64 // elements of produced lists and iterators
+}
+
+func NewProfile() *Profile {
+	return &Profile{
+		entries:   make(map[profileKey]*ProfileEntry),
+		sequences: make(map[*inst.Instruction]string),
+		decoded:   make(map[string]int64),
+	}
+}
+
+// Label names sequence in the profile, e.g. "program" or "read permission".
+// Sequences shared by several labels, like identical permissions, get all of them.
+func (p *Profile) Label(sequence inst.Sequence, label string) {
+	if len(sequence) == 0 {
+		return
+	}
+	if l, ok := p.sequences[&sequence[0]]; ok && l != label {
+		label = l + ", " + label
+	}
+	p.sequences[&sequence[0]] = label
+}
+
+func (p *Profile) entry(program inst.Sequence, pc int) *ProfileEntry {
+	k := profileKey{&program[0], pc}
+	if e, ok := p.entries[k]; ok {
+		return e
+	}
+	label, ok := p.sequences[k.sequence]
+	if !ok {
+		label = fmt.Sprintf("#%d", len(p.sequences))
+		p.sequences[k.sequence] = label
+	}
+	e := &ProfileEntry{Sequence: label, PC: pc, Instruction: program[pc]}
+	p.entries[k] = e
+	return e
+}
+
+// record accounts one execution of program[pc] that took d and left stack behind.
+func (p *Profile) record(program inst.Sequence, pc int, d time.Duration, stack *Stack) {
+	e := p.entry(program, pc)
+	e.Calls++
+	e.Time += d
+	switch program[pc].(type) {
+	case inst.Pop, inst.Define:
+		return // these don't produce values
+	}
+	switch v := stack.Peek().(type) {
+	case val.List:
+		e.Items += int64(len(v))
+	case iteratorValue:
+		(*stack)[stack.Len()-1] = iteratorValue{countingIterator{v.iterator, &e.Items}}
+	}
+}
+
+func (p *Profile) decode(bucket string) {
+	p.decoded[bucket]++
+}
+
+// Entries returns the recorded entries, the most expensive first.
+func (p *Profile) Entries() []ProfileEntry {
+	es := make([]ProfileEntry, 0, len(p.entries))
+	for _, e := range p.entries {
+		es = append(es, *e)
+	}
+	sort.Slice(es, func(i, j int) bool {
+		if es[i].Time != es[j].Time {
+			return es[i].Time > es[j].Time
+		}
+		if es[i].Sequence != es[j].Sequence {
+			return es[i].Sequence < es[j].Sequence
+		}
+		return es[i].PC < es[j].PC
+	})
+	return es
+}
+
+// Decoded returns the number of objects decoded per bucket.
+func (p *Profile) Decoded() map[string]int64 {
+	return p.decoded
+}
+
+func (p *Profile) Value() val.Value {
+	es := p.Entries()
+	ls := make(val.List, len(es), len(es))
+	for i, e := range es {
+		ls[i] = val.StructFromMap(map[string]val.Value{
+			"sequence":    val.String(e.Sequence),
+			"pc":          val.Int64(e.PC),
+			"instruction": val.String(reflect.TypeOf(e.Instruction).Name()),
+			"calls":       val.Int64(e.Calls),
+			"time":        val.Duration(e.Time),
+			"items":       val.Int64(e.Items),
+		})
+	}
+	dc := val.NewMap(len(p.decoded))
+	for k, n := range p.decoded {
+		dc.Set(k, val.Int64(n))
+	}
+	return val.StructFromMap(map[string]val.Value{
+		"instructions": ls,
+		"decoded":      dc,
+	})
+}
+
+// countingIterator counts the elements passing through it.
+type countingIterator struct {
+	sub   iterator
+	count *int64
+}
+
+func (i countingIterator) forEach(f func(val.Value) err.Error) err.Error {
+	return i.sub.forEach(func(v val.Value) err.Error {
+		*i.count++
+		return f(v)
+	})
+}
+
+func (i countingIterator) length() int {
+	return i.sub.length()
+}
@@ -0,0 +1,153 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"fmt"
+	"karma.run/definitions"
+	"karma.run/kvm/err"
+	"karma.run/kvm/inst"
+	"karma.run/kvm/mdl"
+	"karma.run/kvm/val"
+)
+
+// Query is a persisted function from ExpressionModel, published under a tag via QueryModel.
+type Query struct {
+	Tag        string
+	Parameters []string
+	Models     []mdl.Model // parameter models, as inferred from the function's signature
+	Writes     bool        // whether running the query may need a writable transaction
+	Expression val.Value   // the query's function, as stored
+	program    inst.Sequence
+}
+
+// ArgumentModel is the model of a query's arguments: a struct keyed by parameter name.
+func (q Query) ArgumentModel() mdl.Model {
+	fields := make(map[string]mdl.Model, len(q.Parameters))
+	for i, param := range q.Parameters {
+		fields[param] = q.Models[i]
+	}
+	return mdl.StructFromMap(fields)
+}
+
+// Query loads the query published under tag, checking that the current user may run it.
+// Running a query does not require read permission on its expression.
+func (vm *VirtualMachine) Query(tag string) (Query, err.Error) {
+
+	id := vm.RootBucket.Bucket(definitions.QueryBucketBytes).Get([]byte(tag))
+	if id == nil {
+		return Query{}, err.ExecutionError{
+			Problem: fmt.Sprintf(`query not found: %s`, tag),
+		}
+	}
+
+	qv, e := vm.get(vm.QueryModelId(), string(id))
+	if e != nil {
+		return Query{}, e
+	}
+
+	query := qv.Value.(val.Struct)
+
+	if roles := query.Field("roles"); roles != val.Null && vm.UserID != vm.RootUserId() {
+		if e := vm.checkQueryRoles(roles.(val.List)); e != nil {
+			return Query{}, e
+		}
+	}
+
+	expr := query.Field("expression").(val.Ref)[1]
+
+	fv, e := vm.get(vm.ExpressionModelId(), expr)
+	if e != nil {
+		return Query{}, e
+	}
+
+	entry, e := vm.callable(expr, nil)
+	if e != nil {
+		return Query{}, e
+	}
+
+	params := entry.function.Parameters()
+	models := make([]mdl.Model, len(params), len(params))
+	for i, _ := range params {
+		models[i] = AnyModel // argument is unused
+		if m := entry.function.Arguments[i]; m != nil {
+			models[i] = UnwrapConstant(UnwrapBucket(m))
+		}
+	}
+
+	return Query{
+		Tag:        tag,
+		Parameters: params,
+		Models:     models,
+		Writes:     functionWrites(fv.Value),
+		Expression: fv.Value,
+		program:    entry.program,
+	}, nil
+}
+
+// ExecuteQuery runs q with arguments as decoded against q.ArgumentModel().
+func (vm VirtualMachine) ExecuteQuery(q Query, arguments val.Struct) (val.Value, err.Error) {
+
+	args := make([]val.Value, len(q.Parameters), len(q.Parameters))
+	for i, param := range q.Parameters {
+		args[i] = arguments.Field(param)
+	}
+
+	if vm.Profile != nil {
+		vm.Profile.Label(q.program, "query "+q.Tag)
+	}
+
+	// the expression is part of the key as the query might have been changed
+	key := "query/" + q.Tag + "/" + string(val.Hash(q.Expression, nil).Sum(nil)) + string(val.Hash(arguments, nil).Sum(nil))
+	v, _, e := vm.cachedResult(key, func(vm VirtualMachine) (val.Value, mdl.Model, err.Error) {
+		if vm.spills == nil {
+			vm.spills = &sortSpills{}
+			defer vm.spills.close()
+		}
+		v, e := vm.Execute(q.program, nil, args...)
+		if e != nil {
+			return nil, nil, e
+		}
+		v, e = slurpIterators(v)
+		return v, nil, e
+	})
+	return v, e
+}
+
+func (vm *VirtualMachine) checkQueryRoles(roles val.List) err.Error {
+
+	user, e := vm.get(vm.UserModelId(), vm.UserID)
+	if e != nil {
+		return e
+	}
+
+	for _, have := range user.Value.(val.Struct).Field("roles").(val.List) {
+		for _, want := range roles {
+			if have.Equals(want) {
+				return nil
+			}
+		}
+	}
+
+	return err.PermissionDeniedError{}
+}
+
+// functionWrites reports whether a persisted function may write to the database.
+// Calls to other persisted functions are assumed to write.
+func functionWrites(v val.Value) bool {
+	writes := false
+	v.Transform(func(v val.Value) val.Value {
+		if u, ok := v.(val.Union); ok {
+			switch u.Case {
+			case "create",
+				"delete",
+				"update",
+				"createMultiple",
+				"call":
+				writes = true
+			}
+		}
+		return v
+	})
+	return writes
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"karma.run/cc"
+	"karma.run/kvm/err"
+	"karma.run/kvm/mdl"
+	"karma.run/kvm/val"
+	"sync"
+	"sync/atomic"
+)
+
+// anyModel stands for all models as read dependency, e.g. of programs looking
+// at the graph of references, which changes with writes to any model.
+const anyModel = "*"
+
+// modelVersions maps metaId/mid to the id of the last committed transaction
+// that wrote to the model. Transaction ids grow with every commit, so a result
+// computed in a transaction is current as long as none of the models it read
+// has a larger version.
+var modelVersions = struct {
+	sync.RWMutex
+	m map[string]int
+}{m: map[string]int{}}
+
+// results of read-only programs, see cachedResult
+var resultCache = cc.NewCache(64<<20, 0)
+
+var resultCacheHits, resultCacheMisses int64
+
+type resultCacheEntry struct {
+	value val.Value
+	model mdl.Model
+	tx    int      // id of the transaction the result was computed in
+	reads []string // metaId/mid of the models read
+}
+
+// resultCacheStats counts entries that were stale when looked up as misses.
+func resultCacheStats() cc.CacheStats {
+	st := resultCache.Stats()
+	st.Hits = atomic.LoadInt64(&resultCacheHits)
+	st.Misses = atomic.LoadInt64(&resultCacheMisses)
+	return st
+}
+
+// CacheStats returns the statistics of the caches shared by all databases, by name.
+func CacheStats() map[string]cc.CacheStats {
+	return map[string]cc.CacheStats{
+		"resultCache":   resultCacheStats(),
+		"compilerCache": compilerCache.Stats(),
+		"modelCache":    ModelCache.Stats(),
+		"decoderCache":  decoderCache.Stats(),
+	}
+}
+
+// clears result cache (for all databases), e.g. after replacing the data file
+func ClearResultCache() {
+	resultCache.Clear()
+	modelVersions.Lock()
+	modelVersions.m = map[string]int{}
+	modelVersions.Unlock()
+}
+
+// readSet collects the models a program reads. It is shared by the
+// goroutines of parallel evaluation.
+type readSet struct {
+	sync.Mutex
+	models   map[string]struct{}
+	volatile bool // the result depends on more than the data, e.g. on the time
+}
+
+// read records that vm reads from model mid, if it caches results.
+func (vm VirtualMachine) read(mid string) {
+	if vm.reads == nil {
+		return
+	}
+	vm.reads.Lock()
+	vm.reads.models[mid] = struct{}{}
+	vm.reads.Unlock()
+}
+
+// volatile marks vm's result as not cacheable, if it caches results.
+func (vm VirtualMachine) volatile() {
+	if vm.reads == nil {
+		return
+	}
+	vm.reads.Lock()
+	vm.reads.volatile = true
+	vm.reads.Unlock()
+}
+
+// written bumps the version of model mid once the current transaction commits.
+func (vm VirtualMachine) written(mid string) {
+	tx, metaId := vm.RootBucket.Tx(), vm.MetaModelId()
+	id := tx.ID() // the transaction is closed by the time it commits
+	tx.OnCommit(func() {
+		modelVersions.Lock()
+		modelVersions.m[metaId+"/"+mid] = id
+		modelVersions.m[metaId+"/"+anyModel] = id
+		modelVersions.Unlock()
+	})
+}
+
+// cachedResult returns the result of run from the result cache if none of
+// the models it read has been written since, or calls run and caches its
+// result. key identifies the program and its arguments; the current user is
+// added as permissions depend on it. Only successful results computed in
+// read-only transactions are cached, and only if vm.CacheResults is set.
+func (vm VirtualMachine) cachedResult(key string, run func(vm VirtualMachine) (val.Value, mdl.Model, err.Error)) (val.Value, mdl.Model, err.Error) {
+
+	tx := vm.RootBucket.Tx()
+	if !vm.CacheResults || vm.Profile != nil || tx.Writable() {
+		return run(vm)
+	}
+
+	metaId := vm.MetaModelId()
+	cacheKey := metaId + "/" + vm.UserID + "/" + key // metaId is distinct for every database
+
+	if item, ok := resultCache.Get(cacheKey); ok {
+		entry := item.(resultCacheEntry)
+		if current(entry) {
+			atomic.AddInt64(&resultCacheHits, 1)
+			return entry.value.Copy(), entry.model, nil
+		}
+		resultCache.Remove(cacheKey)
+	}
+	atomic.AddInt64(&resultCacheMisses, 1)
+
+	vm.reads = &readSet{models: map[string]struct{}{
+		vm.UserModelId(): {}, // permissions are loaded from the user and their roles
+		vm.RoleModelId(): {},
+	}}
+
+	v, m, e := run(vm)
+	if e != nil || vm.reads.volatile {
+		return v, m, e
+	}
+
+	reads := make([]string, 0, len(vm.reads.models))
+	for mid := range vm.reads.models {
+		reads = append(reads, metaId+"/"+mid)
+	}
+
+	resultCache.Set(cacheKey, resultCacheEntry{v.Copy(), m, tx.ID(), reads}, approximateBytes(v))
+	return v, m, nil
+}
+
+func current(entry resultCacheEntry) bool {
+	modelVersions.RLock()
+	defer modelVersions.RUnlock()
+	for _, k := range entry.reads {
+		if modelVersions.m[k] > entry.tx {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,648 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	bin "encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"karma.run/codec/binary"
+	"karma.run/codec/karma.v2"
+	"karma.run/config"
+	"karma.run/kvm/err"
+	"karma.run/kvm/val"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sortItem is a value to sort along with its sort key, if any
+type sortItem struct {
+	key, value val.Value
+}
+
+// sorter sorts items in memory until there are more than config.SortSpillItems of them.
+// from then on, sorted runs are written to temporary files and merged lazily on iteration.
+type sorter struct {
+	less   func(a, b sortItem) (bool, err.Error)
+	items  []sortItem
+	runs   []*sortRun
+	spills *sortSpills // nil outside of requests, see sortSpills
+	errout err.Error
+}
+
+func newSorter(spills *sortSpills, less func(a, b sortItem) (bool, err.Error)) *sorter {
+	return &sorter{less: less, items: make([]sortItem, 0, 1024), spills: spills}
+}
+
+// sortSpills are the runs spilled by the sorts of a request. they stay open until
+// the request ends, as its program may read a sorted result any number of times.
+// runs spilled outside of requests are closed by their finalizer.
+type sortSpills struct {
+	lock sync.Mutex // parallel workers sort concurrently
+	runs []*sortRun
+}
+
+func (s *sortSpills) add(run *sortRun) {
+	s.lock.Lock()
+	s.runs = append(s.runs, run)
+	s.lock.Unlock()
+}
+
+// close closes all runs, for when the request ends
+func (s *sortSpills) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, run := range s.runs {
+		run.close()
+	}
+	s.runs = nil
+}
+
+func (s *sorter) add(key, value val.Value) err.Error {
+	s.items = append(s.items, sortItem{key, value})
+	if config.SortSpillItems > 0 && len(s.items) >= config.SortSpillItems {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *sorter) sortItems() err.Error {
+	sort.SliceStable(s.items, func(i, j int) bool {
+		if s.errout != nil {
+			return false
+		}
+		less, e := s.less(s.items[i], s.items[j])
+		if e != nil {
+			s.errout = e
+		}
+		return less
+	})
+	return s.errout
+}
+
+func (s *sorter) spill() err.Error {
+	if e := s.sortItems(); e != nil {
+		return e
+	}
+	run, e := writeSortRun(s.items)
+	if e != nil {
+		return e
+	}
+	s.runs = append(s.runs, run)
+	if s.spills != nil {
+		s.spills.add(run)
+	}
+	s.items = s.items[:0]
+	return nil
+}
+
+// close closes the runs spilled so far, for when sorting fails
+func (s *sorter) close() {
+	for _, run := range s.runs {
+		run.close()
+	}
+}
+
+// result is a list if all items fit into memory, an iterator merging all runs otherwise.
+// runs are closed if it fails.
+func (s *sorter) result() (val.Value, err.Error) {
+	if e := s.sortItems(); e != nil {
+		s.close()
+		return nil, e
+	}
+	if len(s.runs) == 0 {
+		out := make(val.List, len(s.items), len(s.items))
+		for i, item := range s.items {
+			out[i] = item.value
+		}
+		return out, nil
+	}
+	return iteratorValue{newSortMergeIterator(s.runs, s.items, s.less)}, nil
+}
+
+// sortRun is a sorted sequence of length-prefixed, binary-encoded items in a temporary file.
+// if there is a data key, items are sealed with it, as they may be decrypted records.
+type sortRun struct {
+	file   *os.File
+	size   int64
+	length int
+	sealed bool
+	closed bool
+}
+
+// close closes and removes the run's file
+func (r *sortRun) close() {
+	if r.closed {
+		return
+	}
+	r.closed = true
+	runtime.SetFinalizer(r, nil)
+	r.file.Close()
+	os.Remove(r.file.Name())
+}
+
+func writeSortRun(items []sortItem) (*sortRun, err.Error) {
+
+	f, e := ioutil.TempFile(config.SortSpillDir, "karma_sort_")
+	if e != nil {
+		return nil, err.InternalError{Problem: fmt.Sprintf(`sort: creating temporary file: %s`, e.Error())}
+	}
+
+	os.Remove(f.Name()) // where supported, the file lives on until closed
+
+	dataKey := karma.CurrentKey()
+	run := &sortRun{file: f, length: len(items), sealed: dataKey != nil}
+	runtime.SetFinalizer(run, (*sortRun).close) // for runs spilled outside of requests
+
+	w := bufio.NewWriter(f)
+	header := make([]byte, 4, 4)
+
+	for i, item := range items {
+		value, ke := spillValue(item.value)
+		if ke != nil {
+			run.close()
+			return nil, ke
+		}
+		key, _ := spillValue(item.key) // keys are primitive
+		bs := binary.Encode(val.Tuple{key, value})
+		if dataKey != nil {
+			bs = dataKey.Seal(bs, sortRunAD(i))
+		}
+		bin.BigEndian.PutUint32(header, uint32(len(bs)))
+		w.Write(header)
+		w.Write(bs)
+		run.size += int64(len(header) + len(bs))
+	}
+
+	if e := w.Flush(); e != nil {
+		run.close()
+		return nil, err.InternalError{Problem: fmt.Sprintf(`sort: writing temporary file: %s`, e.Error())}
+	}
+
+	return run, nil
+}
+
+// sortRunAD is authenticated along with the i-th item of a sealed run, so that items can't be reordered
+func sortRunAD(i int) []byte {
+	ad := make([]byte, 8, 8)
+	bin.BigEndian.PutUint64(ad, uint64(i))
+	return ad
+}
+
+// reader returns a function yielding the run's items in order, independent of other readers
+func (r *sortRun) reader() func() (sortItem, err.Error) {
+	rd := bufio.NewReader(io.NewSectionReader(r.file, 0, r.size))
+	header := make([]byte, 4, 4)
+	i := 0
+	return func() (sortItem, err.Error) {
+		if _, e := io.ReadFull(rd, header); e != nil {
+			return sortItem{}, err.InternalError{Problem: fmt.Sprintf(`sort: reading temporary file: %s`, e.Error())}
+		}
+		bs := make([]byte, bin.BigEndian.Uint32(header))
+		if _, e := io.ReadFull(rd, bs); e != nil {
+			return sortItem{}, err.InternalError{Problem: fmt.Sprintf(`sort: reading temporary file: %s`, e.Error())}
+		}
+		if r.sealed {
+			opened, e := karma.Open(bs, sortRunAD(i))
+			if e != nil {
+				return sortItem{}, err.InternalError{Problem: fmt.Sprintf(`sort: reading temporary file: %s`, e.Error())}
+			}
+			bs = opened
+		}
+		i++
+		v, ke := binary.Decode(bs, nil)
+		if ke != nil {
+			return sortItem{}, ke
+		}
+		t := v.(val.Tuple)
+		return sortItem{unspillValue(t[0]), unspillValue(t[1])}, nil
+	}
+}
+
+// sortMergeIterator merges sorted runs on disk and a final sorted run in memory
+type sortMergeIterator struct {
+	runs []*sortRun
+	tail []sortItem
+	less func(a, b sortItem) (bool, err.Error)
+}
+
+func newSortMergeIterator(runs []*sortRun, tail []sortItem, less func(a, b sortItem) (bool, err.Error)) sortMergeIterator {
+	return sortMergeIterator{runs, tail, less}
+}
+
+// forEach may be called any number of times until the request ends, see sortSpills
+func (i sortMergeIterator) forEach(f func(val.Value) err.Error) err.Error {
+
+	for _, run := range i.runs {
+		if run.closed {
+			return err.InternalError{Problem: `sort: reading a spilled result after its request ended`}
+		}
+	}
+
+	type source struct {
+		next      func() (sortItem, err.Error)
+		remaining int
+	}
+
+	sources := make([]source, 0, len(i.runs)+1)
+	for _, run := range i.runs {
+		sources = append(sources, source{run.reader(), run.length})
+	}
+	tail := i.tail
+	sources = append(sources, source{func() (sortItem, err.Error) {
+		item := tail[0]
+		tail = tail[1:]
+		return item, nil
+	}, len(tail)})
+
+	h := &sortMergeHeap{less: i.less}
+	for n, _ := range sources {
+		if sources[n].remaining == 0 {
+			continue
+		}
+		item, e := sources[n].next()
+		if e != nil {
+			return e
+		}
+		sources[n].remaining--
+		heap.Push(h, sortMergeHead{item, n})
+	}
+
+	for h.Len() > 0 {
+		if h.errout != nil {
+			return h.errout
+		}
+		head := h.heads[0]
+		if e := f(head.item.value); e != nil {
+			return e
+		}
+		src := &sources[head.source]
+		if src.remaining == 0 {
+			heap.Pop(h)
+			continue
+		}
+		item, e := src.next()
+		if e != nil {
+			return e
+		}
+		src.remaining--
+		h.heads[0].item = item
+		heap.Fix(h, 0)
+	}
+
+	return h.errout
+}
+
+func (i sortMergeIterator) length() int {
+	n := len(i.tail)
+	for _, run := range i.runs {
+		n += run.length
+	}
+	return n
+}
+
+type sortMergeHead struct {
+	item   sortItem
+	source int // index of run, ties are broken by it to keep the sort stable
+}
+
+type sortMergeHeap struct {
+	heads  []sortMergeHead
+	less   func(a, b sortItem) (bool, err.Error)
+	errout err.Error
+}
+
+func (h *sortMergeHeap) Len() int {
+	return len(h.heads)
+}
+
+func (h *sortMergeHeap) Less(i, j int) bool {
+	a, b := h.heads[i], h.heads[j]
+	if h.errout != nil {
+		return a.source < b.source
+	}
+	less, e := h.less(a.item, b.item)
+	if e != nil {
+		h.errout = e
+	}
+	if less {
+		return true
+	}
+	greater, e := h.less(b.item, a.item)
+	if e != nil {
+		h.errout = e
+	}
+	return !greater && a.source < b.source
+}
+
+func (h *sortMergeHeap) Swap(i, j int) {
+	h.heads[i], h.heads[j] = h.heads[j], h.heads[i]
+}
+
+func (h *sortMergeHeap) Push(x interface{}) {
+	h.heads = append(h.heads, x.(sortMergeHead))
+}
+
+func (h *sortMergeHeap) Pop() interface{} {
+	last := h.heads[len(h.heads)-1]
+	h.heads = h.heads[:len(h.heads)-1]
+	return last
+}
+
+// topNItems keeps the n items with the greatest keys, ordered greatest first.
+// items with equal keys keep their relative order.
+func topNItems(it iterator, n int, key func(val.Value) (val.Value, err.Error)) (val.List, err.Error) {
+
+	if n <= 0 {
+		return make(val.List, 0, 0), nil
+	}
+
+	h := &topNHeap{}
+	seq := 0
+
+	e := it.forEach(func(v val.Value) err.Error {
+		k, e := key(v)
+		if e != nil {
+			return e
+		}
+		item := topNItem{sortItem{k, v}, seq}
+		seq++
+		if h.less == nil {
+			h.less = sortKeyLess(k)
+		}
+		if h.Len() < n {
+			heap.Push(h, item)
+		} else if h.lessItems(h.items[0], item) {
+			h.items[0] = item
+			heap.Fix(h, 0)
+		}
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	out := make(val.List, h.Len(), h.Len())
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = heap.Pop(h).(topNItem).value
+	}
+	return out, nil
+}
+
+type topNItem struct {
+	sortItem
+	seq int
+}
+
+// topNHeap is a min-heap, its root is the first item to drop
+type topNHeap struct {
+	items []topNItem
+	less  func(a, b val.Value) bool
+}
+
+// lessItems orders later items before earlier ones with equal keys so these are dropped first
+func (h *topNHeap) lessItems(a, b topNItem) bool {
+	if h.less(a.key, b.key) {
+		return true
+	}
+	return !h.less(b.key, a.key) && a.seq > b.seq
+}
+
+func (h *topNHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *topNHeap) Less(i, j int) bool {
+	return h.lessItems(h.items[i], h.items[j])
+}
+
+func (h *topNHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *topNHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(topNItem))
+}
+
+func (h *topNHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+// sortKeyLess returns the ordering of sort keys of the same type as sample
+func sortKeyLess(sample val.Value) func(a, b val.Value) bool {
+	switch sample.(type) {
+	case val.Float:
+		return func(a, b val.Value) bool {
+			return a.(val.Float) < b.(val.Float)
+		}
+	case val.Bool:
+		return func(a, b val.Value) bool {
+			return bool(!a.(val.Bool) && b.(val.Bool))
+		}
+	case val.String:
+		return func(a, b val.Value) bool {
+			return a.(val.String) < b.(val.String)
+		}
+	case val.DateTime:
+		return func(a, b val.Value) bool {
+			return a.(val.DateTime).Time.Before(b.(val.DateTime).Time)
+		}
+	case val.Duration:
+		return func(a, b val.Value) bool {
+			return a.(val.Duration) < b.(val.Duration)
+		}
+	case val.Decimal:
+		return func(a, b val.Value) bool {
+			return a.(val.Decimal).Cmp(b.(val.Decimal)) < 0
+		}
+	case val.Bytes:
+		return func(a, b val.Value) bool {
+			return bytes.Compare(a.(val.Bytes), b.(val.Bytes)) < 0
+		}
+	case val.Blob:
+		return func(a, b val.Value) bool {
+			return a.(val.Blob) < b.(val.Blob)
+		}
+	case val.Int8:
+		return func(a, b val.Value) bool {
+			return a.(val.Int8) < b.(val.Int8)
+		}
+	case val.Int16:
+		return func(a, b val.Value) bool {
+			return a.(val.Int16) < b.(val.Int16)
+		}
+	case val.Int32:
+		return func(a, b val.Value) bool {
+			return a.(val.Int32) < b.(val.Int32)
+		}
+	case val.Int64:
+		return func(a, b val.Value) bool {
+			return a.(val.Int64) < b.(val.Int64)
+		}
+	case val.Uint8:
+		return func(a, b val.Value) bool {
+			return a.(val.Uint8) < b.(val.Uint8)
+		}
+	case val.Uint16:
+		return func(a, b val.Value) bool {
+			return a.(val.Uint16) < b.(val.Uint16)
+		}
+	case val.Uint32:
+		return func(a, b val.Value) bool {
+			return a.(val.Uint32) < b.(val.Uint32)
+		}
+	case val.Uint64:
+		return func(a, b val.Value) bool {
+			return a.(val.Uint64) < b.(val.Uint64)
+		}
+	}
+	log.Panicf("sortKeyLess: unexpected type: %T", sample)
+	return nil
+}
+
+// spillValue encodes what the binary codec would lose: meta values, union cases
+// that could collide with the ones used here and sub-second precision in dateTimes.
+// iterators are read into lists.
+func spillValue(v val.Value) (val.Value, err.Error) {
+	switch v := v.(type) {
+	case iteratorValue:
+		l, e := iteratorToList(v.iterator)
+		if e != nil {
+			return nil, e
+		}
+		return spillValue(l)
+	case val.Meta:
+		created, _ := spillValue(v.Created)
+		updated, _ := spillValue(v.Updated)
+		value, e := spillValue(v.Value)
+		if e != nil {
+			return nil, e
+		}
+		return val.Union{"meta", val.Tuple{v.Id, v.Model, created, updated, value}}, nil
+	case val.Union:
+		value, e := spillValue(v.Value)
+		if e != nil {
+			return nil, e
+		}
+		return val.Union{"union", val.Tuple{val.String(v.Case), value}}, nil
+	case val.DateTime:
+		return val.Union{"dateTime", val.String(v.Time.Format(time.RFC3339Nano))}, nil
+	case val.Tuple:
+		out := make(val.Tuple, len(v), len(v))
+		for i, w := range v {
+			s, e := spillValue(w)
+			if e != nil {
+				return nil, e
+			}
+			out[i] = s
+		}
+		return out, nil
+	case val.List:
+		out := make(val.List, len(v), len(v))
+		for i, w := range v {
+			s, e := spillValue(w)
+			if e != nil {
+				return nil, e
+			}
+			out[i] = s
+		}
+		return out, nil
+	case val.Set:
+		out := make(val.Set, len(v))
+		for k, w := range v {
+			s, e := spillValue(w)
+			if e != nil {
+				return nil, e
+			}
+			out[k] = s
+		}
+		return out, nil
+	case val.Struct:
+		out := val.NewStruct(v.Len())
+		e := (err.Error)(nil)
+		v.ForEach(func(k string, w val.Value) bool {
+			s, e_ := spillValue(w)
+			e = e_
+			out.Set(k, s)
+			return e == nil
+		})
+		return out, e
+	case val.Map:
+		out := val.NewMap(v.Len())
+		e := (err.Error)(nil)
+		v.ForEach(func(k string, w val.Value) bool {
+			s, e_ := spillValue(w)
+			e = e_
+			out.Set(k, s)
+			return e == nil
+		})
+		return out, e
+	}
+	return v, nil
+}
+
+// unspillValue reverses spillValue
+func unspillValue(v val.Value) val.Value {
+	switch v := v.(type) {
+	case val.Union:
+		switch v.Case {
+		case "meta":
+			t := v.Value.(val.Tuple)
+			return val.Meta{
+				Id:      t[0].(val.Ref),
+				Model:   t[1].(val.Ref),
+				Created: unspillValue(t[2]).(val.DateTime),
+				Updated: unspillValue(t[3]).(val.DateTime),
+				Value:   unspillValue(t[4]),
+			}
+		case "union":
+			t := v.Value.(val.Tuple)
+			return val.Union{string(t[0].(val.String)), unspillValue(t[1])}
+		case "dateTime":
+			t, e := time.Parse(time.RFC3339Nano, string(v.Value.(val.String)))
+			if e != nil {
+				log.Panicln(e)
+			}
+			return val.DateTime{t}
+		}
+		log.Panicf("unspillValue: unexpected case: %s", v.Case)
+	case val.Tuple:
+		out := make(val.Tuple, len(v), len(v))
+		for i, w := range v {
+			out[i] = unspillValue(w)
+		}
+		return out
+	case val.List:
+		out := make(val.List, len(v), len(v))
+		for i, w := range v {
+			out[i] = unspillValue(w)
+		}
+		return out
+	case val.Set:
+		out := make(val.Set, len(v))
+		for _, w := range v {
+			w = unspillValue(w)
+			out[val.Hash(w, nil).Sum64()] = w
+		}
+		return out
+	case val.Struct:
+		return v.Map(func(_ string, w val.Value) val.Value {
+			return unspillValue(w)
+		})
+	case val.Map:
+		return v.Map(func(_ string, w val.Value) val.Value {
+			return unspillValue(w)
+		})
+	}
+	return v
+}
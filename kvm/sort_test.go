@@ -0,0 +1,79 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"bytes"
+	"karma.run/codec/json"
+	"karma.run/codec/karma.v2"
+	"karma.run/config"
+	"karma.run/kvm/val"
+	"karma.run/kvm/xpr"
+	"testing"
+)
+
+func TestSortSpilledReadTwice(t *testing.T) {
+
+	defer func(items int) { config.SortSpillItems = items }(config.SortSpillItems)
+	config.SortSpillItems = 2
+
+	withTestVirtualMachine(t, func(vm *VirtualMachine) {
+
+		sorted := `{"memSort":[{"data":{"list":[{"int64":5},{"int64":3},{"int64":9},{"int64":1},{"int64":3},{"int64":7},{"int64":2}]}},{"function":[["v"],[{"scope":"v"}]]}]}`
+		program := `{"function":[[],[{"define":["s",` + sorted + `]},{"data":{"list":[` +
+			`{"expr":{"length":{"scope":"s"}}},{"expr":{"first":{"scope":"s"}}},{"expr":{"scope":"s"}},{"expr":{"scope":"s"}}]}}]]}`
+
+		v, e := json.Decode(json.JSON(program), xpr.LanguageModel, nil)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		res, _, ke := vm.ParseCompileAndExecute(v, nil, nil, nil)
+		if ke != nil {
+			t.Fatal(ke.String())
+		}
+
+		want := `[7,1,[1,2,3,3,5,7,9],[1,2,3,3,5,7,9]]`
+		if have := string(json.Encode(res)); have != want {
+			t.Errorf("want %s, have %s", want, have)
+		}
+	})
+}
+
+func TestSortRunSealed(t *testing.T) {
+
+	k, e := karma.NewKey(bytes.Repeat([]byte{7}, karma.MinKeySecretLength))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := karma.SetKeys(k); e != nil {
+		t.Fatal(e)
+	}
+	defer karma.SetKeys(nil)
+
+	items := []sortItem{{val.Int64(1), val.String("secret one")}, {val.Int64(2), val.String("secret two")}}
+	run, ke := writeSortRun(items)
+	if ke != nil {
+		t.Fatal(ke.String())
+	}
+	defer run.close()
+
+	bs := make([]byte, run.size)
+	if _, e := run.file.ReadAt(bs, 0); e != nil {
+		t.Fatal(e)
+	}
+	if bytes.Contains(bs, []byte("secret")) {
+		t.Errorf("run not sealed: %q", bs)
+	}
+
+	next := run.reader()
+	for _, want := range items {
+		have, ke := next()
+		if ke != nil {
+			t.Fatal(ke.String())
+		}
+		if !have.key.Equals(want.key) || !have.value.Equals(want.value) {
+			t.Errorf("want %v, have %v", want, have)
+		}
+	}
+}
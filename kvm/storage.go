@@ -0,0 +1,195 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"bytes"
+	"fmt"
+	"karma.run/codec/karma.v2"
+	"karma.run/kvm/mdl"
+	"karma.run/kvm/val"
+	"karma.run/store"
+	"sync/atomic"
+)
+
+// CompressAnnotation on a model, as outermost annotation, stores its values
+// compressed, see karma.Options.
+const CompressAnnotation = "compress"
+
+func compressed(m mdl.Model) bool {
+	for {
+		a, ok := m.(mdl.Annotation)
+		if !ok {
+			return false
+		}
+		if a.Value == CompressAnnotation {
+			return true
+		}
+		m = a.Model
+	}
+}
+
+// encode encodes v for persistence in the bucket of m, encrypted with the
+// current data key if there is one.
+func (vm VirtualMachine) encode(v val.Meta, m BucketModel) []byte {
+	return vm.encodeWith(v, m, karma.CurrentKey())
+}
+
+func (vm VirtualMachine) encodeWith(v val.Meta, m BucketModel, key *karma.Key) []byte {
+	if m.stored != nil {
+		v.Value = sealValues(m.Model, v.Value, key)
+	}
+	o := karma.Options{Compress: compressed(m.Model), Key: key}
+	return karma.EncodeWith(MaterializeMeta(v), vm.WrapModelInMeta(m.Bucket, m.storage()), o)
+}
+
+// decode decodes record bs of the bucket of m, with its encrypted values
+// decrypted or redacted as vm's user may read them.
+func (vm VirtualMachine) decode(bs []byte, m BucketModel) val.Meta {
+	v, _ := karma.Decode(bs, vm.WrapModelInMeta(m.Bucket, m.storage()))
+	mv := DematerializeMeta(v.(val.Struct))
+	if m.stored != nil {
+		mv.Value = openValues(m.Model, mv.Value, vm.redact)
+	}
+	return mv
+}
+
+// upToDate reports whether a record with header h is written as encodeWith
+// would write it.
+func upToDate(h karma.Header, compress bool, key *karma.Key) bool {
+	if h.Version != karma.Version || h.Compressed != compress || h.Encrypted != (key != nil) {
+		return false
+	}
+	return key == nil || h.KeyID == key.ID
+}
+
+// RewriteProgress counts the records seen and rewritten by RewriteRecords.
+// It may be read while RewriteRecords runs, using atomic loads.
+type RewriteProgress struct {
+	Records   int64
+	Rewritten int64
+}
+
+// RewriteRecords rewrites the records of all models that aren't written in
+// the current format, aren't compressed as their model asks for or aren't
+// encrypted with the current data key, e.g. after rotating it. It uses
+// write transactions of up to batch records each, so that other writers
+// aren't blocked for long. Values don't change, so caches stay valid.
+func RewriteRecords(dtbs store.DB, batch int, progress *RewriteProgress) error {
+
+	mids := []string(nil)
+	e := dtbs.View(func(tx store.Tx) error {
+		vm := VirtualMachine{RootBucket: tx.Bucket([]byte(`root`))}
+		return vm.RootBucket.Bucket([]byte(vm.MetaModelId())).ForEach(func(k, _ []byte) error {
+			mids = append(mids, string(k))
+			return nil
+		})
+	})
+	if e != nil {
+		return e
+	}
+
+	for _, mid := range mids {
+		from := []byte(nil)
+		for {
+			e := dtbs.Update(func(tx store.Tx) error {
+				vm := VirtualMachine{RootBucket: tx.Bucket([]byte(`root`))}
+				next, e := vm.rewriteBatch(mid, from, batch, progress)
+				from = next
+				return e
+			})
+			if e != nil {
+				return e
+			}
+			if from == nil {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// rewriteBatch rewrites the records of up to batch keys of bucket mid after
+// key from, returning the last key it looked at, nil if there are no more.
+func (vm VirtualMachine) rewriteBatch(mid string, from []byte, batch int, progress *RewriteProgress) ([]byte, error) {
+
+	bk := vm.RootBucket.Bucket([]byte(mid))
+	if bk == nil {
+		return nil, nil
+	}
+
+	model := BucketModel{Model: vm.MetaModel(), Bucket: mid}
+	if mid != vm.MetaModelId() {
+		bm, e := vm.Model(mid)
+		if e != nil {
+			return nil, e
+		}
+		model = bm
+	}
+	compress, key := compressed(model.Model), karma.CurrentKey()
+
+	type record struct {
+		key, value []byte
+		plaintext  val.Value // to index again with key, if model has encrypted values
+	}
+	rewrites, last := make([]record, 0, batch), []byte(nil)
+
+	c := bk.Cursor()
+	k, bs := c.First()
+	if from != nil {
+		if k, bs = c.Seek(from); bytes.Equal(k, from) {
+			k, bs = c.Next()
+		}
+	}
+	for n := 0; k != nil && n < batch; k, bs = c.Next() {
+		n++
+		last = append(last[:0], k...)
+		atomic.AddInt64(&progress.Records, 1)
+		if upToDate(karma.ReadHeader(bs), compress, key) {
+			continue
+		}
+		mv := vm.plaintext().decode(bs, model)
+		rewrites = append(rewrites, record{append([]byte(nil), k...), vm.encodeWith(mv, model, key), mv.Value})
+	}
+
+	for _, r := range rewrites { // not while iterating, Put would move the cursor
+		if e := bk.Put(r.key, r.value); e != nil {
+			return nil, e
+		}
+		if model.stored != nil && key != nil {
+			vm.indexEncrypted(mid, string(r.key), model.Model, r.plaintext, r.plaintext)
+		}
+		atomic.AddInt64(&progress.Rewritten, 1)
+	}
+
+	if k == nil {
+		return nil, nil
+	}
+	return last, nil
+}
+
+// CheckDataKeys returns an error if records are encrypted with a data key
+// that isn't loaded, e.g. after a wrong key file was given or an old key was
+// removed from it before the rewrite finished. It reads every record's header.
+func CheckDataKeys(dtbs store.DB) error {
+	return dtbs.View(func(tx store.Tx) error {
+		rb := tx.Bucket([]byte(`root`))
+		if rb == nil {
+			return nil
+		}
+		vm := VirtualMachine{RootBucket: rb}
+		return rb.Bucket([]byte(vm.MetaModelId())).ForEach(func(mid, _ []byte) error {
+			bk := rb.Bucket(mid)
+			if bk == nil {
+				return nil
+			}
+			return bk.ForEach(func(_, bs []byte) error {
+				if h := karma.ReadHeader(bs); h.Encrypted && !karma.HasKey(h.KeyID) {
+					return fmt.Errorf("records of model %s are encrypted with data key %08x, which isn't loaded", mid, h.KeyID)
+				}
+				return nil
+			})
+		})
+	})
+}
@@ -0,0 +1,152 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"bytes"
+	"fmt"
+	"karma.run/codec/karma.v2"
+	"karma.run/kvm/mdl"
+	"karma.run/kvm/val"
+	"karma.run/store"
+	"testing"
+)
+
+// rewriteModels are written with records in every layout RewriteRecords
+// should bring up to date. Ids are 16 bytes, as refs store them.
+var rewriteModels = map[string]val.Value{
+	"plainmodel000000": val.Union{"string", val.Struct{}},
+	"compressmodel000": val.Union{"annotation", val.StructFromMap(map[string]val.Value{
+		"value": val.String(CompressAnnotation),
+		"model": val.Union{"string", val.Struct{}},
+	})},
+}
+
+// rewriteLayouts encode a record of model m the way an older or differently
+// configured database would have written it.
+var rewriteLayouts = []struct {
+	name   string
+	encode func(vm VirtualMachine, v val.Meta, m BucketModel, old *karma.Key) []byte
+}{
+	{"current", func(vm VirtualMachine, v val.Meta, m BucketModel, old *karma.Key) []byte {
+		return vm.encode(v, m)
+	}},
+	{"version 1", func(vm VirtualMachine, v val.Meta, m BucketModel, old *karma.Key) []byte {
+		// without header and offset tables, the meta struct is its fields in order
+		sm, sv, bs := vm.WrapModelInMeta(m.Bucket, m.storage()).Concrete().(mdl.Struct), MaterializeMeta(v), []byte(nil)
+		for _, k := range sm.Keys() {
+			f, _ := sv.Get(k)
+			bs = append(bs, karma.Encode(f, sm.Field(k))[3:]...)
+		}
+		return bs
+	}},
+	{"version 2", func(vm VirtualMachine, v val.Meta, m BucketModel, old *karma.Key) []byte {
+		bs := karma.Encode(MaterializeMeta(v), vm.WrapModelInMeta(m.Bucket, m.storage()))
+		return append([]byte{0xff, 2}, bs[3:]...) // version 3 only added the flags
+	}},
+	{"compression toggled", func(vm VirtualMachine, v val.Meta, m BucketModel, old *karma.Key) []byte {
+		o := karma.Options{Compress: !compressed(m.Model), Key: karma.CurrentKey()}
+		return karma.EncodeWith(MaterializeMeta(v), vm.WrapModelInMeta(m.Bucket, m.storage()), o)
+	}},
+	{"old key", func(vm VirtualMachine, v val.Meta, m BucketModel, old *karma.Key) []byte {
+		return vm.encodeWith(v, m, old)
+	}},
+}
+
+func TestRewriteRecords(t *testing.T) {
+
+	current, e := karma.NewKey(bytes.Repeat([]byte{1}, karma.MinKeySecretLength))
+	if e != nil {
+		t.Fatal(e)
+	}
+	old, e := karma.NewKey(bytes.Repeat([]byte{2}, karma.MinKeySecretLength))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := karma.SetKeys(current, old); e != nil {
+		t.Fatal(e)
+	}
+	defer karma.SetKeys(nil)
+
+	db := store.NewMemory()
+	defer db.Close()
+
+	want := map[string]val.Value{}
+	e = db.Update(func(tx store.Tx) error {
+		rb, e := tx.CreateBucket([]byte(`root`))
+		if e != nil {
+			return e
+		}
+		vm := VirtualMachine{RootBucket: rb}
+		if ke := vm.InitDB(); ke != nil {
+			return ke
+		}
+		vm.UserID = vm.RootUserId()
+
+		for mid, mv := range rewriteModels {
+			if ke := vm.Write(vm.MetaModelId(), map[string]val.Meta{mid: vm.WrapValueInMeta(mv, mid, vm.MetaModelId())}); ke != nil {
+				return ke
+			}
+			m, ke := vm.Model(mid)
+			if ke != nil {
+				return ke
+			}
+			for i, l := range rewriteLayouts {
+				id := fmt.Sprintf("record%010d", i)
+				v := vm.WrapValueInMeta(val.String(l.name+" "+mid), id, mid)
+				if ke := vm.Write(mid, map[string]val.Meta{id: v}); ke != nil {
+					return ke
+				}
+				stored, ke := vm.Get(mid, id)
+				if ke != nil {
+					return ke
+				}
+				if e := rb.Bucket([]byte(mid)).Put([]byte(id), l.encode(vm, stored, m, old)); e != nil {
+					return e
+				}
+				want[mid+"/"+id] = MaterializeMeta(stored)
+			}
+		}
+		return nil
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	progress := RewriteProgress{}
+	if e := RewriteRecords(db, 2, &progress); e != nil {
+		t.Fatal(e)
+	}
+	if n := int64(len(rewriteModels) * (len(rewriteLayouts) - 1)); progress.Rewritten != n {
+		t.Errorf("expected %d records rewritten, have %d of %d", n, progress.Rewritten, progress.Records)
+	}
+
+	e = db.View(func(tx store.Tx) error {
+		vm := VirtualMachine{RootBucket: tx.Bucket([]byte(`root`))}
+		vm.UserID = vm.RootUserId()
+		for mid := range rewriteModels {
+			m, ke := vm.Model(mid)
+			if ke != nil {
+				return ke
+			}
+			for i, l := range rewriteLayouts {
+				id := fmt.Sprintf("record%010d", i)
+				bs := vm.RootBucket.Bucket([]byte(mid)).Get([]byte(id))
+				if h := karma.ReadHeader(bs); !upToDate(h, compressed(m.Model), current) {
+					t.Errorf("%s: record of %s not rewritten: %+v", l.name, mid, h)
+				}
+				have, ke := vm.Get(mid, id)
+				if ke != nil {
+					return ke
+				}
+				if w := want[mid+"/"+id]; !MaterializeMeta(have).Equals(w) {
+					t.Errorf("%s: record of %s changed: want %v, have %v", l.name, mid, w, MaterializeMeta(have))
+				}
+			}
+		}
+		return nil
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+}
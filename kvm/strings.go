@@ -0,0 +1,30 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode/utf8"
+)
+
+var normalizationForms = map[string]norm.Form{
+	"NFC":  norm.NFC,
+	"NFD":  norm.NFD,
+	"NFKC": norm.NFKC,
+	"NFKD": norm.NFKD,
+}
+
+// padString repeats padding on the left or right of s until it is width runes long.
+// padding is cut short if needed, s is returned as is if it is wide enough or padding is empty.
+func padString(s string, width int, padding string, left bool) string {
+	missing := width - utf8.RuneCountInString(s)
+	if missing <= 0 || padding == "" {
+		return s
+	}
+	pad := []rune(strings.Repeat(padding, missing/utf8.RuneCountInString(padding)+1))[:missing]
+	if left {
+		return string(pad) + s
+	}
+	return s + string(pad)
+}
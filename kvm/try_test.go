@@ -0,0 +1,72 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package kvm
+
+import (
+	"karma.run/codec/json"
+	"karma.run/kvm/err"
+	"karma.run/kvm/xpr"
+	"testing"
+)
+
+// createTag writes, so it may not be guarded by try or orElse
+const createTag = `{"create":[{"tag":{"string":"_tag"}},{"function":[["ref"],[{"data":{"struct":{"tag":{"string":"t"},"model":{"expr":{"tag":{"string":"_tag"}}}}}}]]}]}`
+
+var tryCases = []struct {
+	name    string
+	program string
+	writes  bool
+}{
+	{
+		name:    "try reading",
+		program: `{"try":{"value":{"length":{"all":{"tag":{"string":"_tag"}}}},"catch":{"function":[["e"],[{"int64":0}]]}}}`,
+	},
+	{
+		name:    "orElse reading",
+		program: `{"orElse":[{"length":{"all":{"tag":{"string":"_tag"}}}},{"int64":0}]}`,
+	},
+	{
+		name:    "try writing",
+		program: `{"try":{"value":` + createTag + `,"catch":{"function":[["e"],[{"tag":{"string":"_tag"}}]]}}}`,
+		writes:  true,
+	},
+	{
+		name:    "orElse writing",
+		program: `{"orElse":[` + createTag + `,{"tag":{"string":"_tag"}}]}`,
+		writes:  true,
+	},
+	{
+		name:    "orElse writing in a function",
+		program: `{"orElse":[{"mapList":[{"data":{"list":[{"int64":1}]}},{"function":[["i","v"],[` + createTag + `]]}]},{"data":{"list":[]}}]}`,
+		writes:  true,
+	},
+	{
+		name:    "try writing in catch",
+		program: `{"try":{"value":{"tag":{"string":"_tag"}},"catch":{"function":[["e"],[` + createTag + `]]}}}`,
+	},
+}
+
+func TestTryRejectsWrites(t *testing.T) {
+
+	withTestVirtualMachine(t, func(vm *VirtualMachine) {
+
+		for _, c := range tryCases {
+
+			v, e := json.Decode(json.JSON(`{"function":[[],[`+c.program+`]]}`), xpr.LanguageModel, nil)
+			if e != nil {
+				t.Fatalf("%s: %v", c.name, e)
+			}
+
+			_, ke := vm.Parse(v, nil, nil, nil)
+			if !c.writes {
+				if ke != nil {
+					t.Errorf("%s: %s", c.name, ke.String())
+				}
+				continue
+			}
+			if _, ok := ke.(err.CompilationError); !ok {
+				t.Errorf("%s: expected a compilation error, got %v", c.name, ke)
+			}
+		}
+	})
+}
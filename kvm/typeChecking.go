@@ -317,6 +317,34 @@ func _checkType(actual, expected mdl.Model, recs map[[2]*mdl.Recursion]struct{})
 		}
 		return nil
 
+	case mdl.Duration:
+		_, ok := actual.(mdl.Duration)
+		if !ok {
+			return TypeCheckingError{expected, actual, nil}
+		}
+		return nil
+
+	case mdl.Decimal:
+		_, ok := actual.(mdl.Decimal)
+		if !ok {
+			return TypeCheckingError{expected, actual, nil}
+		}
+		return nil
+
+	case mdl.Bytes:
+		_, ok := actual.(mdl.Bytes)
+		if !ok {
+			return TypeCheckingError{expected, actual, nil}
+		}
+		return nil
+
+	case mdl.Blob:
+		_, ok := actual.(mdl.Blob)
+		if !ok {
+			return TypeCheckingError{expected, actual, nil}
+		}
+		return nil
+
 	case mdl.Int8:
 		_, ok := actual.(mdl.Int8)
 		if !ok {
@@ -27,16 +27,29 @@ var (
 	FloatModel    = mdl.Float{}
 	StringModel   = mdl.String{}
 	DateTimeModel = mdl.DateTime{}
+	DurationModel = mdl.Duration{}
+	DecimalModel  = mdl.Decimal{}
 	NullModel     = mdl.Null{}
 )
 
+// CatchableErrorModels maps the cases of errors try and orElse can catch to the
+// model of their values. All other errors, e.g. internal ones, abort the request.
+var CatchableErrorModels = map[string]mdl.Model{
+	"objectNotFoundError":   mdl.Ref{},
+	"modelNotFoundError":    mdl.Ref{},
+	"permissionDeniedError": AnyModel,
+	"executionError":        mdl.StructFromMap(map[string]mdl.Model{"problem": StringModel}),
+}
+
 type ModelScope struct {
 	parent *ModelScope
 	scope  map[string]mdl.Model
+	call   string      // id of the persisted function this scope was opened for, if any
+	caller *ModelScope // scope of the call site, only used to detect recursive calls
 }
 
 func NewModelScope() *ModelScope {
-	return &ModelScope{nil, make(map[string]mdl.Model)}
+	return &ModelScope{nil, make(map[string]mdl.Model), "", nil}
 }
 
 func (s *ModelScope) GetLocal(k string) (mdl.Model, bool) {
@@ -67,6 +80,27 @@ func (s *ModelScope) Child() *ModelScope {
 	return c
 }
 
+// callee returns a fresh scope for typing the persisted function id.
+// Bindings of s are not visible in it.
+func (s *ModelScope) callee(id string) *ModelScope {
+	c := NewModelScope()
+	c.call, c.caller = id, s
+	return c
+}
+
+// calling reports whether the persisted function id is being typed further up the call chain.
+func (s *ModelScope) calling(id string) bool {
+	for ; s != nil; s = s.parent {
+		if s.call == id {
+			return true
+		}
+		if s.caller != nil {
+			return s.caller.calling(id)
+		}
+	}
+	return false
+}
+
 // for debugging purposes only
 func (s *ModelScope) Flat() map[string]mdl.Model {
 	if s == nil {
@@ -195,7 +229,7 @@ func (vm VirtualMachine) TypeExpression(node xpr.Expression, scope *ModelScope,
 		xm := x.Actual.Concrete()
 		if !isNumericModel(xm) {
 			return ZeroTypedExpression, err.CompilationError{
-				Problem: `expression must be numeric (int*, uint* or float)`,
+				Problem: `expression must be numeric (int*, uint*, float or decimal)`,
 				Program: xpr.ValueFromExpression(node.Expression),
 			}
 		}
@@ -210,7 +244,7 @@ func (vm VirtualMachine) TypeExpression(node xpr.Expression, scope *ModelScope,
 		xm := x.Actual.Concrete()
 		if !isNumericModel(xm) {
 			return ZeroTypedExpression, err.CompilationError{
-				Problem: `expression must be numeric (int*, uint* or float)`,
+				Problem: `expression must be numeric (int*, uint*, float or decimal)`,
 				Program: xpr.ValueFromExpression(node.Expression),
 			}
 		}
@@ -225,7 +259,7 @@ func (vm VirtualMachine) TypeExpression(node xpr.Expression, scope *ModelScope,
 		xm := x.Actual.Concrete()
 		if !isNumericModel(xm) {
 			return ZeroTypedExpression, err.CompilationError{
-				Problem: `expression must be numeric (int*, uint* or float)`,
+				Problem: `expression must be numeric (int*, uint*, float or decimal)`,
 				Program: xpr.ValueFromExpression(node.Expression),
 			}
 		}
@@ -240,7 +274,7 @@ func (vm VirtualMachine) TypeExpression(node xpr.Expression, scope *ModelScope,
 		xm := x.Actual.Concrete()
 		if !isNumericModel(xm) {
 			return ZeroTypedExpression, err.CompilationError{
-				Problem: `expression must be numeric (int*, uint* or float)`,
+				Problem: `expression must be numeric (int*, uint*, float or decimal)`,
 				Program: xpr.ValueFromExpression(node.Expression),
 			}
 		}
@@ -255,7 +289,7 @@ func (vm VirtualMachine) TypeExpression(node xpr.Expression, scope *ModelScope,
 		xm := x.Actual.Concrete()
 		if !isNumericModel(xm) {
 			return ZeroTypedExpression, err.CompilationError{
-				Problem: `expression must be numeric (int*, uint* or float)`,
+				Problem: `expression must be numeric (int*, uint*, float or decimal)`,
 				Program: xpr.ValueFromExpression(node.Expression),
 			}
 		}
@@ -270,7 +304,7 @@ func (vm VirtualMachine) TypeExpression(node xpr.Expression, scope *ModelScope,
 		xm := x.Actual.Concrete()
 		if !isNumericModel(xm) {
 			return ZeroTypedExpression, err.CompilationError{
-				Problem: `expression must be numeric (int*, uint* or float)`,
+				Problem: `expression must be numeric (int*, uint*, float or decimal)`,
 				Program: xpr.ValueFromExpression(node.Expression),
 			}
 		}
@@ -285,7 +319,7 @@ func (vm VirtualMachine) TypeExpression(node xpr.Expression, scope *ModelScope,
 		xm := x.Actual.Concrete()
 		if !isNumericModel(xm) {
 			return ZeroTypedExpression, err.CompilationError{
-				Problem: `expression must be numeric (int*, uint* or float)`,
+				Problem: `expression must be numeric (int*, uint*, float or decimal)`,
 				Program: xpr.ValueFromExpression(node.Expression),
 			}
 		}
@@ -300,7 +334,7 @@ func (vm VirtualMachine) TypeExpression(node xpr.Expression, scope *ModelScope,
 		xm := x.Actual.Concrete()
 		if !isNumericModel(xm) {
 			return ZeroTypedExpression, err.CompilationError{
-				Problem: `expression must be numeric (int*, uint* or float)`,
+				Problem: `expression must be numeric (int*, uint*, float or decimal)`,
 				Program: xpr.ValueFromExpression(node.Expression),
 			}
 		}
@@ -315,7 +349,7 @@ func (vm VirtualMachine) TypeExpression(node xpr.Expression, scope *ModelScope,
 		xm := x.Actual.Concrete()
 		if !isNumericModel(xm) {
 			return ZeroTypedExpression, err.CompilationError{
-				Problem: `expression must be numeric (int*, uint* or float)`,
+				Problem: `expression must be numeric (int*, uint*, float or decimal)`,
 				Program: xpr.ValueFromExpression(node.Expression),
 			}
 		}
@@ -1576,319 +1610,1205 @@ func (vm VirtualMachine) TypeExpression(node xpr.Expression, scope *ModelScope,
 		}
 		retNode = xpr.TypedExpression{node, expected, StringModel}
 
-	case xpr.ReverseList:
-		arg, e := vm.TypeExpression(node.Argument, scope, mdl.List{AnyModel})
+	case xpr.StringToUpper:
+
+		arg, e := vm.TypeExpression(node.Argument, scope, StringModel)
 		if e != nil {
-			return arg, e
+			return ZeroTypedExpression, e
 		}
 		node.Argument = arg
-		retNode = xpr.TypedExpression{node, expected, arg.Actual.Unwrap()} // get rid of constant wrapper in e.g. reverseList([1,2,3])
 
-	case xpr.ExtractStrings:
-		arg, e := vm.TypeExpression(node.Argument, scope, AnyModel)
+		retNode = xpr.TypedExpression{node, expected, StringModel}
+
+	case xpr.TrimString:
+
+		arg, e := vm.TypeExpression(node.Argument, scope, StringModel)
 		if e != nil {
-			return arg, e
+			return ZeroTypedExpression, e
 		}
 		node.Argument = arg
-		if ca, ok := arg.Actual.(ConstantModel); ok {
-			_ = ca // TODO: constant optimization
-		}
-		retNode = xpr.TypedExpression{node, expected, mdl.List{StringModel}}
 
-	case xpr.Delete:
-		arg, e := vm.TypeExpression(node.Argument, scope, mdl.Ref{""})
+		retNode = xpr.TypedExpression{node, expected, StringModel}
+
+	case xpr.ParseInt64:
+
+		arg, e := vm.TypeExpression(node.Argument, scope, StringModel)
 		if e != nil {
-			return arg, e
+			return ZeroTypedExpression, e
 		}
 		node.Argument = arg
-		mid := arg.Actual.Concrete().(mdl.Ref).Model
-		model, e := vm.Model(mid)
+
+		retNode = xpr.TypedExpression{node, expected, Int64Model}
+
+	case xpr.ParseFloat:
+
+		arg, e := vm.TypeExpression(node.Argument, scope, StringModel)
 		if e != nil {
 			return ZeroTypedExpression, e
 		}
-		unwrapped := UnwrapBucket(model)
-		retNode = xpr.TypedExpression{node, expected, unwrapped}
+		node.Argument = arg
 
-	case xpr.Literal:
-		actual, e := inferType(node.Value, expected)
+		retNode = xpr.TypedExpression{node, expected, FloatModel}
+
+	case xpr.Substring:
+
+		stryng, e := vm.TypeExpression(node.String, scope, StringModel)
 		if e != nil {
-			return ZeroTypedExpression, err.CompilationError{
-				Problem: `literal type mismatch`,
-				Program: node.Value,
-				Child_:  e,
-			}
+			return ZeroTypedExpression, e
 		}
-		retNode = xpr.TypedExpression{xpr.Literal{node.Value}, expected, ConstantModel{actual, node.Value}}
+		node.String = stryng
 
-	case xpr.ResolveAllRefs:
+		offset, e := vm.TypeExpression(node.Offset, scope, Int64Model)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Offset = offset
 
-		arg, e := vm.TypeExpression(node.Argument, scope, mdl.Any{})
+		length, e := vm.TypeExpression(node.Length, scope, Int64Model)
 		if e != nil {
-			return arg, e
+			return ZeroTypedExpression, e
 		}
-		node.Argument = arg
+		node.Length = length
 
-		rewritten := arg.Actual.Copy().Transform(func(m mdl.Model) mdl.Model {
-			if e != nil {
-				return m
-			}
-			if rf, ok := m.(mdl.Ref); ok {
-				m, e2 := vm.Model(rf.Model)
-				if e2 != nil {
-					e = e2
-				}
-				return UnwrapBucket(m)
-			}
-			return m
-		})
-		retNode = xpr.TypedExpression{node, expected, rewritten}
+		retNode = xpr.TypedExpression{node, expected, StringModel}
 
-	case xpr.First:
-		arg, e := vm.TypeExpression(node.Argument, scope, mdl.List{expected})
+	case xpr.StringReplace:
+
+		stryng, e := vm.TypeExpression(node.String, scope, StringModel)
 		if e != nil {
-			return arg, e
-		}
-		node.Argument = arg
-		model := arg.Actual.Concrete().(mdl.List).Elements
-		if ca, ok := arg.Actual.(ConstantModel); ok {
-			ls := ca.Value.(val.List)
-			if len(ls) == 0 {
-				return ZeroTypedExpression, err.CompilationError{
-					Problem: `first: empty list`,
-					Program: xpr.ValueFromExpression(arg),
-				}
-			}
-			model = ConstantModel{ca.Model.(mdl.List).Elements, ls[0]}
+			return ZeroTypedExpression, e
 		}
-		retNode = xpr.TypedExpression{node, expected, model}
+		node.String = stryng
 
-	case xpr.Get:
-		arg, e := vm.TypeExpression(node.Argument, scope, mdl.Ref{""})
+		search, e := vm.TypeExpression(node.Search, scope, StringModel)
 		if e != nil {
-			return arg, e
-		}
-		node.Argument = arg
-		mid := arg.Actual.Concrete().(mdl.Ref).Model
-		if mid == "" {
-			retNode = xpr.TypedExpression{node, expected, BucketModel{Model: AnyModel}}
-		} else {
-			model, e := vm.Model(mid)
-			if e != nil {
-				return ZeroTypedExpression, e
-			}
-			retNode = xpr.TypedExpression{node, expected, model}
+			return ZeroTypedExpression, e
 		}
+		node.Search = search
 
-	case xpr.Length:
-		arg, e := vm.TypeExpression(node.Argument, scope, mdl.List{AnyModel})
+		replacement, e := vm.TypeExpression(node.Replacement, scope, StringModel)
 		if e != nil {
-			return arg, e
-		}
-		node.Argument = arg
-		model := mdl.Model(Int64Model)
-		if ca, ok := arg.Actual.(ConstantModel); ok {
-			model = ConstantModel{model, val.Int64(len(ca.Value.(val.List)))}
+			return ZeroTypedExpression, e
 		}
-		retNode = xpr.TypedExpression{node, expected, model}
+		node.Replacement = replacement
 
-	case xpr.Not:
-		arg, e := vm.TypeExpression(node.Argument, scope, BoolModel)
+		retNode = xpr.TypedExpression{node, expected, StringModel}
+
+	case xpr.SplitString:
+
+		stryng, e := vm.TypeExpression(node.String, scope, StringModel)
 		if e != nil {
-			return arg, e
-		}
-		node.Argument = arg
-		model := mdl.Model(BoolModel)
-		if ca, ok := arg.Actual.(ConstantModel); ok {
-			model = ConstantModel{model, !ca.Value.(val.Bool)}
+			return ZeroTypedExpression, e
 		}
-		retNode = xpr.TypedExpression{node, expected, model}
+		node.String = stryng
 
-	case xpr.ModelOf:
-		arg, e := vm.TypeExpression(node.Argument, scope, AnyModel)
+		separator, e := vm.TypeExpression(node.Separator, scope, StringModel)
 		if e != nil {
-			return arg, e
+			return ZeroTypedExpression, e
 		}
-		node.Argument = arg
-		unwrapped := arg.Actual.Transform(UnwrapConstant).Transform(UnwrapBucket)
-		modelValue := mdl.ValueFromModel(vm.MetaModelId(), unwrapped, nil)
-		retNode = xpr.TypedExpression{node, expected, ConstantModel{vm.MetaModel(), modelValue}}
+		node.Separator = separator
 
-	case xpr.Metarialize:
+		retNode = xpr.TypedExpression{node, expected, mdl.List{StringModel}}
 
-		arg, e := vm.TypeExpression(node.Argument, scope, AnyModel)
+	case xpr.PadString:
+
+		stryng, e := vm.TypeExpression(node.String, scope, StringModel)
 		if e != nil {
-			return arg, e
+			return ZeroTypedExpression, e
 		}
-		node.Argument = arg
+		node.String = stryng
 
-		ba, ok := arg.Actual.(BucketModel)
-		if !ok {
-			return ZeroTypedExpression, err.CompilationError{
-				Problem: `metarialize: argument is not persistent`,
-				Program: xpr.ValueFromExpression(arg),
-			}
+		width, e := vm.TypeExpression(node.Width, scope, Int64Model)
+		if e != nil {
+			return ZeroTypedExpression, e
 		}
+		node.Width = width
 
-		model := vm.WrapModelInMeta(ba.Bucket, ba.Model)
-		retNode = xpr.TypedExpression{node, expected, model}
+		padding, e := vm.TypeExpression(node.Padding, scope, StringModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Padding = padding
 
-	case xpr.RefTo:
+		retNode = xpr.TypedExpression{node, expected, StringModel}
 
-		arg, e := vm.TypeExpression(node.Argument, scope, AnyModel)
+	case xpr.RepeatString:
+
+		stryng, e := vm.TypeExpression(node.String, scope, StringModel)
 		if e != nil {
-			return arg, e
+			return ZeroTypedExpression, e
 		}
-		node.Argument = arg
+		node.String = stryng
 
-		ba, ok := arg.Actual.(BucketModel)
-		if !ok {
-			return ZeroTypedExpression, err.CompilationError{
-				Problem: `refTo: argument is not persistent`,
-				Program: xpr.ValueFromExpression(arg),
-			}
+		count, e := vm.TypeExpression(node.Count, scope, Int64Model)
+		if e != nil {
+			return ZeroTypedExpression, e
 		}
+		node.Count = count
 
-		model := mdl.Ref{ba.Bucket}
-		retNode = xpr.TypedExpression{node, expected, model}
+		retNode = xpr.TypedExpression{node, expected, StringModel}
 
-	case xpr.If:
-		condition, e := vm.TypeExpression(node.Condition, scope, BoolModel)
-		if e != nil {
-			return condition, e
-		}
-		node.Condition = condition
-		then, e := vm.TypeExpression(node.Then, scope, AnyModel)
+	case xpr.StringStartsWith:
+
+		stryng, e := vm.TypeExpression(node.String, scope, StringModel)
 		if e != nil {
-			return then, e
+			return ZeroTypedExpression, e
 		}
-		node.Then = then
-		elze, e := vm.TypeExpression(node.Else, scope, AnyModel)
+		node.String = stryng
+
+		prefix, e := vm.TypeExpression(node.Prefix, scope, StringModel)
 		if e != nil {
-			return elze, e
+			return ZeroTypedExpression, e
 		}
-		node.Else = elze
-		// TODO: constant condition optimization
-		retNode = xpr.TypedExpression{node, expected, mdl.Either(UnwrapConstant(UnwrapBucket(then.Actual)), UnwrapConstant(UnwrapBucket(elze.Actual)), nil)}
+		node.Prefix = prefix
 
-	case xpr.With:
+		retNode = xpr.TypedExpression{node, expected, BoolModel}
 
-		value, e := vm.TypeExpression(node.Value, scope, AnyModel)
+	case xpr.StringEndsWith:
+
+		stryng, e := vm.TypeExpression(node.String, scope, StringModel)
 		if e != nil {
-			return value, e
+			return ZeroTypedExpression, e
 		}
-		node.Value = value
+		node.String = stryng
 
-		retrn, e := vm.TypeFunctionWithArguments(node.Return, scope, expected, value.Actual)
+		suffix, e := vm.TypeExpression(node.Suffix, scope, StringModel)
 		if e != nil {
 			return ZeroTypedExpression, e
 		}
-		node.Return = retrn
+		node.Suffix = suffix
 
-		retNode = xpr.TypedExpression{node, expected, retrn.Actual}
+		retNode = xpr.TypedExpression{node, expected, BoolModel}
 
-	case xpr.Update:
-		ref, e := vm.TypeExpression(node.Ref, scope, mdl.Ref{""})
+	case xpr.ReplaceRegex:
+
+		value, e := vm.TypeExpression(node.Value, scope, StringModel)
 		if e != nil {
-			return ref, e
+			return ZeroTypedExpression, e
 		}
-		node.Ref = ref
-		mid := ref.Actual.Concrete().(mdl.Ref).Model
-		if mid == vm.MetaModelId() {
+		node.Value = value
+
+		if _, e := regexp.Compile(node.Regex); e != nil {
 			return ZeroTypedExpression, err.CompilationError{
-				Problem: `update: models are immutable`,
-				Program: xpr.ValueFromExpression(ref),
+				Problem: `replaceRegex: regex does not compile`,
+				Program: xpr.ValueFromExpression(node),
 			}
 		}
-		subExpect, e := vm.Model(mid)
+
+		replacement, e := vm.TypeExpression(node.Replacement, scope, StringModel)
 		if e != nil {
 			return ZeroTypedExpression, e
 		}
-		value, e := vm.TypeExpression(node.Value, scope, subExpect.Model)
-		if e != nil {
-			return value, e
-		}
+		node.Replacement = replacement
+
+		retNode = xpr.TypedExpression{node, expected, StringModel}
+
+	case xpr.NormalizeString:
+
+		value, e := vm.TypeExpression(node.Value, scope, StringModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Value = value
+
+		retNode = xpr.TypedExpression{node, expected, StringModel}
+
+	case xpr.IntegerOperation:
+
+		model := integerModels[node.Type]
+
+		lhs, e := vm.TypeExpression(node.Left, scope, model)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Left = lhs
+
+		rhs, e := vm.TypeExpression(node.Right, scope, model)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Right = rhs
+
+		retNode = xpr.TypedExpression{node, expected, model}
+
+	case xpr.AbsInteger:
+
+		model := integerModels[node.Type]
+
+		arg, e := vm.TypeExpression(node.Argument, scope, model)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Argument = arg
+
+		retNode = xpr.TypedExpression{node, expected, model}
+
+	case xpr.ToIntegerChecked:
+		x, e := vm.TypeExpression(node.Expression, scope, AnyModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Expression = x
+		xm := x.Actual.Concrete()
+		if !isNumericModel(xm) {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: `expression must be numeric (int*, uint*, float or decimal)`,
+				Program: xpr.ValueFromExpression(node.Expression),
+			}
+		}
+		retNode = xpr.TypedExpression{node, expected, integerModels[node.Type]}
+
+	case xpr.ToDecimal:
+		x, e := vm.TypeExpression(node.Expression, scope, AnyModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Expression = x
+		xm := x.Actual.Concrete()
+		if !isNumericModel(xm) {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: `expression must be numeric (int*, uint*, float or decimal)`,
+				Program: xpr.ValueFromExpression(node.Expression),
+			}
+		}
+		retNode = xpr.TypedExpression{node, expected, DecimalModel}
+
+	case xpr.AddDecimal:
+		lhs, e := vm.TypeExpression(node[0], scope, DecimalModel)
+		if e != nil {
+			return lhs, e
+		}
+		node[0] = lhs
+		rhs, e := vm.TypeExpression(node[1], scope, DecimalModel)
+		if e != nil {
+			return rhs, e
+		}
+		node[1] = rhs
+		retNode = xpr.TypedExpression{node, expected, DecimalModel}
+
+	case xpr.SubDecimal:
+		lhs, e := vm.TypeExpression(node[0], scope, DecimalModel)
+		if e != nil {
+			return lhs, e
+		}
+		node[0] = lhs
+		rhs, e := vm.TypeExpression(node[1], scope, DecimalModel)
+		if e != nil {
+			return rhs, e
+		}
+		node[1] = rhs
+		retNode = xpr.TypedExpression{node, expected, DecimalModel}
+
+	case xpr.MulDecimal:
+		lhs, e := vm.TypeExpression(node[0], scope, DecimalModel)
+		if e != nil {
+			return lhs, e
+		}
+		node[0] = lhs
+		rhs, e := vm.TypeExpression(node[1], scope, DecimalModel)
+		if e != nil {
+			return rhs, e
+		}
+		node[1] = rhs
+		retNode = xpr.TypedExpression{node, expected, DecimalModel}
+
+	case xpr.DivDecimal:
+		lhs, e := vm.TypeExpression(node[0], scope, DecimalModel)
+		if e != nil {
+			return lhs, e
+		}
+		node[0] = lhs
+		rhs, e := vm.TypeExpression(node[1], scope, DecimalModel)
+		if e != nil {
+			return rhs, e
+		}
+		node[1] = rhs
+		retNode = xpr.TypedExpression{node, expected, DecimalModel}
+
+	case xpr.GtDecimal:
+		lhs, e := vm.TypeExpression(node[0], scope, DecimalModel)
+		if e != nil {
+			return lhs, e
+		}
+		node[0] = lhs
+		rhs, e := vm.TypeExpression(node[1], scope, DecimalModel)
+		if e != nil {
+			return rhs, e
+		}
+		node[1] = rhs
+		retNode = xpr.TypedExpression{node, expected, BoolModel}
+
+	case xpr.LtDecimal:
+		lhs, e := vm.TypeExpression(node[0], scope, DecimalModel)
+		if e != nil {
+			return lhs, e
+		}
+		node[0] = lhs
+		rhs, e := vm.TypeExpression(node[1], scope, DecimalModel)
+		if e != nil {
+			return rhs, e
+		}
+		node[1] = rhs
+		retNode = xpr.TypedExpression{node, expected, BoolModel}
+
+	case xpr.RoundDecimal:
+
+		value, e := vm.TypeExpression(node.Value, scope, DecimalModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Value = value
+
+		scale, e := vm.TypeExpression(node.Scale, scope, Int64Model)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Scale = scale
+
+		retNode = xpr.TypedExpression{node, expected, DecimalModel}
+
+	case xpr.ParseDuration:
+
+		arg, e := vm.TypeExpression(node.Argument, scope, StringModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Argument = arg
+
+		retNode = xpr.TypedExpression{node, expected, DurationModel}
+
+	case xpr.AddDuration:
+
+		dateTime, e := vm.TypeExpression(node.DateTime, scope, DateTimeModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.DateTime = dateTime
+
+		duration, e := vm.TypeExpression(node.Duration, scope, DurationModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Duration = duration
+
+		retNode = xpr.TypedExpression{node, expected, DateTimeModel}
+
+	case xpr.SubDuration:
+
+		dateTime, e := vm.TypeExpression(node.DateTime, scope, DateTimeModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.DateTime = dateTime
+
+		duration, e := vm.TypeExpression(node.Duration, scope, DurationModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Duration = duration
+
+		retNode = xpr.TypedExpression{node, expected, DateTimeModel}
+
+	case xpr.DateTimeDiff:
+
+		lhs, e := vm.TypeExpression(node[0], scope, DateTimeModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node[0] = lhs
+
+		rhs, e := vm.TypeExpression(node[1], scope, DateTimeModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node[1] = rhs
+
+		retNode = xpr.TypedExpression{node, expected, DurationModel}
+
+	case xpr.TruncateDateTime:
+
+		value, e := vm.TypeExpression(node.Value, scope, DateTimeModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Value = value
+
+		zone, e := vm.typeZone(node.Zone, scope, node)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Zone = zone
+
+		retNode = xpr.TypedExpression{node, expected, DateTimeModel}
+
+	case xpr.ExtractDateTime:
+
+		value, e := vm.TypeExpression(node.Value, scope, DateTimeModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Value = value
+
+		zone, e := vm.typeZone(node.Zone, scope, node)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Zone = zone
+
+		retNode = xpr.TypedExpression{node, expected, Int64Model}
+
+	case xpr.FormatDateTime:
+
+		value, e := vm.TypeExpression(node.Value, scope, DateTimeModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Value = value
+
+		layout, e := vm.TypeExpression(node.Layout, scope, StringModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Layout = layout
+
+		zone, e := vm.typeZone(node.Zone, scope, node)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Zone = zone
+
+		retNode = xpr.TypedExpression{node, expected, StringModel}
+
+	case xpr.ParseDateTime:
+
+		value, e := vm.TypeExpression(node.Value, scope, StringModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Value = value
+
+		layout, e := vm.TypeExpression(node.Layout, scope, StringModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Layout = layout
+
+		zone, e := vm.typeZone(node.Zone, scope, node)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Zone = zone
+
+		retNode = xpr.TypedExpression{node, expected, DateTimeModel}
+
+	case xpr.ReverseList:
+		arg, e := vm.TypeExpression(node.Argument, scope, mdl.List{AnyModel})
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+		retNode = xpr.TypedExpression{node, expected, arg.Actual.Unwrap()} // get rid of constant wrapper in e.g. reverseList([1,2,3])
+
+	case xpr.ExtractStrings:
+		arg, e := vm.TypeExpression(node.Argument, scope, AnyModel)
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+		if ca, ok := arg.Actual.(ConstantModel); ok {
+			_ = ca // TODO: constant optimization
+		}
+		retNode = xpr.TypedExpression{node, expected, mdl.List{StringModel}}
+
+	case xpr.Delete:
+		arg, e := vm.TypeExpression(node.Argument, scope, mdl.Ref{""})
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+		mid := arg.Actual.Concrete().(mdl.Ref).Model
+		model, e := vm.Model(mid)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		unwrapped := UnwrapBucket(model)
+		retNode = xpr.TypedExpression{node, expected, unwrapped}
+
+	case xpr.Literal:
+		actual, e := inferType(node.Value, expected)
+		if e != nil {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: `literal type mismatch`,
+				Program: node.Value,
+				Child_:  e,
+			}
+		}
+		retNode = xpr.TypedExpression{xpr.Literal{node.Value}, expected, ConstantModel{actual, node.Value}}
+
+	case xpr.ResolveAllRefs:
+
+		arg, e := vm.TypeExpression(node.Argument, scope, mdl.Any{})
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+
+		rewritten := arg.Actual.Copy().Transform(func(m mdl.Model) mdl.Model {
+			if e != nil {
+				return m
+			}
+			if rf, ok := m.(mdl.Ref); ok {
+				m, e2 := vm.Model(rf.Model)
+				if e2 != nil {
+					e = e2
+				}
+				return UnwrapBucket(m)
+			}
+			return m
+		})
+		retNode = xpr.TypedExpression{node, expected, rewritten}
+
+	case xpr.First:
+		arg, e := vm.TypeExpression(node.Argument, scope, mdl.List{expected})
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+		model := arg.Actual.Concrete().(mdl.List).Elements
+		if ca, ok := arg.Actual.(ConstantModel); ok {
+			ls := ca.Value.(val.List)
+			if len(ls) == 0 {
+				return ZeroTypedExpression, err.CompilationError{
+					Problem: `first: empty list`,
+					Program: xpr.ValueFromExpression(arg),
+				}
+			}
+			model = ConstantModel{ca.Model.(mdl.List).Elements, ls[0]}
+		}
+		retNode = xpr.TypedExpression{node, expected, model}
+
+	case xpr.Get:
+		arg, e := vm.TypeExpression(node.Argument, scope, mdl.Ref{""})
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+		mid := arg.Actual.Concrete().(mdl.Ref).Model
+		if mid == "" {
+			retNode = xpr.TypedExpression{node, expected, BucketModel{Model: AnyModel}}
+		} else {
+			model, e := vm.Model(mid)
+			if e != nil {
+				return ZeroTypedExpression, e
+			}
+			retNode = xpr.TypedExpression{node, expected, model}
+		}
+
+	case xpr.Length:
+		arg, e := vm.TypeExpression(node.Argument, scope, mdl.List{AnyModel})
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+		model := mdl.Model(Int64Model)
+		if ca, ok := arg.Actual.(ConstantModel); ok {
+			model = ConstantModel{model, val.Int64(len(ca.Value.(val.List)))}
+		}
+		retNode = xpr.TypedExpression{node, expected, model}
+
+	case xpr.Not:
+		arg, e := vm.TypeExpression(node.Argument, scope, BoolModel)
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+		model := mdl.Model(BoolModel)
+		if ca, ok := arg.Actual.(ConstantModel); ok {
+			model = ConstantModel{model, !ca.Value.(val.Bool)}
+		}
+		retNode = xpr.TypedExpression{node, expected, model}
+
+	case xpr.ModelOf:
+		arg, e := vm.TypeExpression(node.Argument, scope, AnyModel)
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+		unwrapped := arg.Actual.Transform(UnwrapConstant).Transform(UnwrapBucket)
+		modelValue := mdl.ValueFromModel(vm.MetaModelId(), unwrapped, nil)
+		retNode = xpr.TypedExpression{node, expected, ConstantModel{vm.MetaModel(), modelValue}}
+
+	case xpr.Metarialize:
+
+		arg, e := vm.TypeExpression(node.Argument, scope, AnyModel)
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+
+		ba, ok := arg.Actual.(BucketModel)
+		if !ok {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: `metarialize: argument is not persistent`,
+				Program: xpr.ValueFromExpression(arg),
+			}
+		}
+
+		model := vm.WrapModelInMeta(ba.Bucket, ba.Model)
+		retNode = xpr.TypedExpression{node, expected, model}
+
+	case xpr.RefTo:
+
+		arg, e := vm.TypeExpression(node.Argument, scope, AnyModel)
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+
+		ba, ok := arg.Actual.(BucketModel)
+		if !ok {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: `refTo: argument is not persistent`,
+				Program: xpr.ValueFromExpression(arg),
+			}
+		}
+
+		model := mdl.Ref{ba.Bucket}
+		retNode = xpr.TypedExpression{node, expected, model}
+
+	case xpr.If:
+		condition, e := vm.TypeExpression(node.Condition, scope, BoolModel)
+		if e != nil {
+			return condition, e
+		}
+		node.Condition = condition
+		then, e := vm.TypeExpression(node.Then, scope, AnyModel)
+		if e != nil {
+			return then, e
+		}
+		node.Then = then
+		elze, e := vm.TypeExpression(node.Else, scope, AnyModel)
+		if e != nil {
+			return elze, e
+		}
+		node.Else = elze
+		// constant conditions are taken care of by vm.Optimize
+		retNode = xpr.TypedExpression{node, expected, mdl.Either(UnwrapConstant(UnwrapBucket(then.Actual)), UnwrapConstant(UnwrapBucket(elze.Actual)), nil)}
+
+	case xpr.Try:
+		value, e := vm.TypeExpression(node.Value, scope, AnyModel)
+		if e != nil {
+			return value, e
+		}
+		if writes(value) {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: `try: value must not write to the database, its writes wouldn't be undone if an error is caught`,
+				Program: xpr.ValueFromExpression(node.Value),
+			}
+		}
+		node.Value = value
+		errorModel := mdl.NewUnion(len(CatchableErrorModels))
+		if len(node.Errors) == 0 {
+			for k, m := range CatchableErrorModels {
+				errorModel.Set(k, m)
+			}
+		}
+		for _, k := range node.Errors {
+			m, ok := CatchableErrorModels[k]
+			if !ok {
+				return ZeroTypedExpression, err.CompilationError{
+					Problem: fmt.Sprintf(`try: errors of case "%s" can not be caught`, k),
+					Program: xpr.ValueFromExpression(node),
+				}
+			}
+			errorModel.Set(k, m)
+		}
+		catch, e := vm.TypeFunctionWithArguments(node.Catch, scope, AnyModel, errorModel)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Catch = catch
+		retNode = xpr.TypedExpression{node, expected, mdl.Either(UnwrapConstant(UnwrapBucket(value.Actual)), UnwrapConstant(UnwrapBucket(catch.Actual)), nil)}
+
+	case xpr.OrElse:
+		value, e := vm.TypeExpression(node[0], scope, AnyModel)
+		if e != nil {
+			return value, e
+		}
+		if writes(value) {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: `orElse: value must not write to the database, its writes wouldn't be undone if an error is caught`,
+				Program: xpr.ValueFromExpression(node[0]),
+			}
+		}
+		node[0] = value
+		dfault, e := vm.TypeExpression(node[1], scope, AnyModel)
+		if e != nil {
+			return dfault, e
+		}
+		node[1] = dfault
+		retNode = xpr.TypedExpression{node, expected, mdl.Either(UnwrapConstant(UnwrapBucket(value.Actual)), UnwrapConstant(UnwrapBucket(dfault.Actual)), nil)}
+
+	case xpr.With:
+
+		value, e := vm.TypeExpression(node.Value, scope, AnyModel)
+		if e != nil {
+			return value, e
+		}
+		node.Value = value
+
+		retrn, e := vm.TypeFunctionWithArguments(node.Return, scope, expected, value.Actual)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Return = retrn
+
+		retNode = xpr.TypedExpression{node, expected, retrn.Actual}
+
+	case xpr.Call:
+
+		function, e := vm.TypeExpression(node.Function, scope, mdl.Ref{vm.ExpressionModelId()})
+		if e != nil {
+			return function, e
+		}
+		node.Function = function
+
+		ca, ok := function.Actual.(ConstantModel)
+		if !ok {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: `call: function must be a constant ref`,
+				Program: xpr.ValueFromExpression(function),
+			}
+		}
+
+		id := ca.Value.(val.Ref)[1]
+		if _, e := vm.Get(vm.ExpressionModelId(), id); e != nil {
+			return ZeroTypedExpression, e
+		}
+
+		entry, e := vm.callable(id, scope)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+
+		params := entry.function.Parameters()
+		if len(params) != len(node.Arguments) {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: fmt.Sprintf(`call: function takes %d arguments, have %d`, len(params), len(node.Arguments)),
+				Program: xpr.ValueFromExpression(node),
+			}
+		}
+
+		for i, sub := range node.Arguments {
+			subExpect := mdl.Model(AnyModel)
+			if m := entry.function.Arguments[i]; m != nil {
+				subExpect = UnwrapConstant(UnwrapBucket(m))
+			}
+			arg, e := vm.TypeExpression(sub, scope, subExpect)
+			if e != nil {
+				return arg, e
+			}
+			node.Arguments[i] = arg
+		}
+
+		retNode = xpr.TypedExpression{node, expected, entry.function.Actual}
+
+	case xpr.Update:
+		ref, e := vm.TypeExpression(node.Ref, scope, mdl.Ref{""})
+		if e != nil {
+			return ref, e
+		}
+		node.Ref = ref
+		mid := ref.Actual.Concrete().(mdl.Ref).Model
+		if mid == vm.MetaModelId() {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: `update: models are immutable`,
+				Program: xpr.ValueFromExpression(ref),
+			}
+		}
+		subExpect, e := vm.Model(mid)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		value, e := vm.TypeExpression(node.Value, scope, subExpect.Model)
+		if e != nil {
+			return value, e
+		}
 		node.Value = value
 		retNode = xpr.TypedExpression{node, expected, mdl.Ref{mid}}
 
 	case xpr.Create:
 
-		in, e := vm.TypeExpression(node.In, scope, mdl.Ref{vm.MetaModelId()})
+		in, e := vm.TypeExpression(node.In, scope, mdl.Ref{vm.MetaModelId()})
+		if e != nil {
+			return in, e
+		}
+		node.In = in
+
+		ci, ok := in.Actual.(ConstantModel)
+		if !ok {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: `create: model argument must be constant expression`,
+				Program: xpr.ValueFromExpression(in),
+			}
+		}
+
+		mid := ci.Value.(val.Ref)[1]
+		subExpect, e := vm.Model(mid)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+
+		subArg := mdl.NewStruct(1)
+		subArg.Set("self", mdl.Ref{mid})
+
+		value, e := vm.TypeFunctionWithArguments(node.Value, scope, subExpect.Model, subArg)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Value = value
+
+		retNode = xpr.TypedExpression{node, expected, mdl.Ref{mid}}
+
+	case xpr.InList:
+
+		in, e := vm.TypeExpression(node.In, scope, mdl.List{AnyModel})
+		if e != nil {
+			return in, e
+		}
+		node.In = in
+
+		subExpect := in.Actual.Concrete().(mdl.List).Elements
+
+		value, e := vm.TypeExpression(node.Value, scope, UnwrapBucket(subExpect))
+		if e != nil {
+			return value, e
+		}
+		node.Value = value
+
+		model := mdl.Model(BoolModel)
+		if cv, ok := value.Actual.(ConstantModel); ok {
+			if cl, ok := in.Actual.(ConstantModel); ok {
+				found := val.Bool(false)
+				for _, v := range cl.Value.(val.List) {
+					if cv.Value.Equals(v) {
+						found = true
+						break
+					}
+				}
+				model = ConstantModel{model, found}
+			}
+		}
+		retNode = xpr.TypedExpression{node, expected, model}
+
+	case xpr.FilterList:
+		value, e := vm.TypeExpression(node.Value, scope, mdl.List{AnyModel})
+		if e != nil {
+			return value, e
+		}
+		node.Value = value
+
+		subArg := value.Actual.Concrete().(mdl.List).Elements
+		filter, e := vm.TypeFunctionWithArguments(node.Filter, scope, BoolModel, mdl.Int64{}, subArg)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Filter = filter
+
+		retNode = xpr.TypedExpression{node, expected, value.Actual.Unwrap()} // get rid of constant wrapper in e.g. filterList([1,2,3], () => ...)
+
+	case xpr.AnyList, xpr.EveryList, xpr.TakeWhileList:
+
+		var value xpr.Expression
+		var predicate xpr.Function
+		switch node := node.(type) {
+		case xpr.AnyList:
+			value, predicate = node.Value, node.Predicate
+		case xpr.EveryList:
+			value, predicate = node.Value, node.Predicate
+		case xpr.TakeWhileList:
+			value, predicate = node.Value, node.Predicate
+		}
+
+		list, e := vm.TypeExpression(value, scope, mdl.List{AnyModel})
+		if e != nil {
+			return list, e
+		}
+
+		subArg := list.Actual.Concrete().(mdl.List).Elements
+		typed, e := vm.TypeFunctionWithArguments(predicate, scope, BoolModel, Int64Model, subArg)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+
+		switch node.(type) {
+		case xpr.AnyList:
+			retNode = xpr.TypedExpression{xpr.AnyList{list, typed}, expected, BoolModel}
+		case xpr.EveryList:
+			retNode = xpr.TypedExpression{xpr.EveryList{list, typed}, expected, BoolModel}
+		case xpr.TakeWhileList:
+			retNode = xpr.TypedExpression{xpr.TakeWhileList{list, typed}, expected, list.Actual.Unwrap()}
+		}
+
+	case xpr.ZipLists:
+		lhs, e := vm.TypeExpression(node[0], scope, mdl.List{AnyModel})
+		if e != nil {
+			return lhs, e
+		}
+		node[0] = lhs
+		rhs, e := vm.TypeExpression(node[1], scope, mdl.List{AnyModel})
+		if e != nil {
+			return rhs, e
+		}
+		node[1] = rhs
+		retNode = xpr.TypedExpression{node, expected, mdl.List{mdl.Tuple{
+			lhs.Actual.Concrete().(mdl.List).Elements,
+			rhs.Actual.Concrete().(mdl.List).Elements,
+		}}}
+
+	case xpr.ChunkList:
+		value, e := vm.TypeExpression(node.Value, scope, mdl.List{AnyModel})
+		if e != nil {
+			return value, e
+		}
+		node.Value = value
+
+		size, e := vm.TypeExpression(node.Size, scope, Int64Model)
+		if e != nil {
+			return size, e
+		}
+		node.Size = size
+
+		if cs, ok := size.Actual.(ConstantModel); ok && cs.Value.(val.Int64) < 1 {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: `chunkList: size must be positive`,
+				Program: xpr.ValueFromExpression(node),
+			}
+		}
+
+		retNode = xpr.TypedExpression{node, expected, mdl.List{mdl.List{value.Actual.Concrete().(mdl.List).Elements}}}
+
+	case xpr.DistinctList:
+		arg, e := vm.TypeExpression(node.Argument, scope, mdl.List{AnyModel})
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+		retNode = xpr.TypedExpression{node, expected, arg.Actual.Unwrap()}
+
+	case xpr.FlattenList:
+		arg, e := vm.TypeExpression(node.Argument, scope, mdl.List{mdl.List{AnyModel}})
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+		inner := UnwrapBucket(arg.Actual.Concrete().(mdl.List).Elements).Concrete().(mdl.List)
+		retNode = xpr.TypedExpression{node, expected, mdl.List{inner.Elements}}
+
+	case xpr.IndexOf:
+		in, e := vm.TypeExpression(node.In, scope, mdl.List{AnyModel})
+		if e != nil {
+			return in, e
+		}
+		node.In = in
+
+		value, e := vm.TypeExpression(node.Value, scope, UnwrapBucket(in.Actual.Concrete().(mdl.List).Elements))
+		if e != nil {
+			return value, e
+		}
+		node.Value = value
+
+		retNode = xpr.TypedExpression{node, expected, Int64Model}
+
+	case xpr.Range:
+		from, e := vm.TypeExpression(node.From, scope, Int64Model)
+		if e != nil {
+			return from, e
+		}
+		node.From = from
+
+		to, e := vm.TypeExpression(node.To, scope, Int64Model)
+		if e != nil {
+			return to, e
+		}
+		node.To = to
+
+		step, e := vm.TypeExpression(node.Step, scope, Int64Model)
+		if e != nil {
+			return step, e
+		}
+		node.Step = step
+
+		if cs, ok := step.Actual.(ConstantModel); ok && cs.Value.(val.Int64) == 0 {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: `range: step must not be zero`,
+				Program: xpr.ValueFromExpression(node),
+			}
+		}
+
+		retNode = xpr.TypedExpression{node, expected, mdl.List{Int64Model}}
+
+	case xpr.InSet:
+
+		in, e := vm.TypeExpression(node.In, scope, mdl.Set{AnyModel})
+		if e != nil {
+			return in, e
+		}
+		node.In = in
+
+		subExpect := in.Actual.Concrete().(mdl.Set).Elements
+
+		value, e := vm.TypeExpression(node.Value, scope, UnwrapBucket(subExpect))
+		if e != nil {
+			return value, e
+		}
+		node.Value = value
+
+		model := mdl.Model(BoolModel)
+		if cv, ok := value.Actual.(ConstantModel); ok {
+			if cs, ok := in.Actual.(ConstantModel); ok {
+				_, found := cs.Value.(val.Set)[val.Hash(cv.Value, nil).Sum64()]
+				model = ConstantModel{model, val.Bool(found)}
+			}
+		}
+		retNode = xpr.TypedExpression{node, expected, model}
+
+	case xpr.SetUnion, xpr.SetIntersection, xpr.SetDifference, xpr.IsSubset:
+
+		var args [2]xpr.Expression
+		switch node := node.(type) {
+		case xpr.SetUnion:
+			args = [2]xpr.Expression(node)
+		case xpr.SetIntersection:
+			args = [2]xpr.Expression(node)
+		case xpr.SetDifference:
+			args = [2]xpr.Expression(node)
+		case xpr.IsSubset:
+			args = [2]xpr.Expression(node)
+		}
+
+		lhs, e := vm.TypeExpression(args[0], scope, mdl.Set{AnyModel})
 		if e != nil {
-			return in, e
+			return lhs, e
+		}
+		rhs, e := vm.TypeExpression(args[1], scope, mdl.Set{AnyModel})
+		if e != nil {
+			return rhs, e
 		}
-		node.In = in
 
-		ci, ok := in.Actual.(ConstantModel)
-		if !ok {
-			return ZeroTypedExpression, err.CompilationError{
-				Problem: `create: model argument must be constant expression`,
-				Program: xpr.ValueFromExpression(in),
-			}
+		le, re := lhs.Actual.Concrete().(mdl.Set).Elements, rhs.Actual.Concrete().(mdl.Set).Elements
+
+		switch node.(type) {
+		case xpr.SetUnion:
+			retNode = xpr.TypedExpression{xpr.SetUnion{lhs, rhs}, expected, mdl.Set{mdl.Either(le, re, nil)}}
+		case xpr.SetIntersection:
+			retNode = xpr.TypedExpression{xpr.SetIntersection{lhs, rhs}, expected, mdl.Set{le}}
+		case xpr.SetDifference:
+			retNode = xpr.TypedExpression{xpr.SetDifference{lhs, rhs}, expected, mdl.Set{le}}
+		case xpr.IsSubset:
+			retNode = xpr.TypedExpression{xpr.IsSubset{lhs, rhs}, expected, BoolModel}
 		}
 
-		mid := ci.Value.(val.Ref)[1]
-		subExpect, e := vm.Model(mid)
+	case xpr.ListToSet:
+		arg, e := vm.TypeExpression(node.Argument, scope, mdl.List{AnyModel})
 		if e != nil {
-			return ZeroTypedExpression, e
+			return arg, e
 		}
+		node.Argument = arg
+		retNode = xpr.TypedExpression{node, expected, mdl.Set{arg.Actual.Concrete().(mdl.List).Elements}}
 
-		subArg := mdl.NewStruct(1)
-		subArg.Set("self", mdl.Ref{mid})
-
-		value, e := vm.TypeFunctionWithArguments(node.Value, scope, subExpect.Model, subArg)
+	case xpr.SetToList:
+		arg, e := vm.TypeExpression(node.Argument, scope, mdl.Set{AnyModel})
 		if e != nil {
-			return ZeroTypedExpression, e
+			return arg, e
 		}
-		node.Value = value
+		node.Argument = arg
+		retNode = xpr.TypedExpression{node, expected, mdl.List{arg.Actual.Concrete().(mdl.Set).Elements}}
 
-		retNode = xpr.TypedExpression{node, expected, mdl.Ref{mid}}
+	case xpr.MapKeys:
+		arg, e := vm.TypeExpression(node.Argument, scope, mdl.Map{AnyModel})
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+		retNode = xpr.TypedExpression{node, expected, mdl.List{StringModel}}
 
-	case xpr.InList:
+	case xpr.MapValues:
+		arg, e := vm.TypeExpression(node.Argument, scope, mdl.Map{AnyModel})
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+		retNode = xpr.TypedExpression{node, expected, mdl.List{arg.Actual.Concrete().(mdl.Map).Elements}}
 
-		in, e := vm.TypeExpression(node.In, scope, mdl.List{AnyModel})
+	case xpr.MapEntries:
+		arg, e := vm.TypeExpression(node.Argument, scope, mdl.Map{AnyModel})
 		if e != nil {
-			return in, e
+			return arg, e
 		}
-		node.In = in
+		node.Argument = arg
+		retNode = xpr.TypedExpression{node, expected, mdl.List{mdl.StructFromMap(map[string]mdl.Model{
+			"key":   StringModel,
+			"value": arg.Actual.Concrete().(mdl.Map).Elements,
+		})}}
 
-		subExpect := in.Actual.Concrete().(mdl.List).Elements
+	case xpr.MergeMaps:
+		left, e := vm.TypeExpression(node.Left, scope, mdl.Map{AnyModel})
+		if e != nil {
+			return left, e
+		}
+		node.Left = left
 
-		value, e := vm.TypeExpression(node.Value, scope, UnwrapBucket(subExpect))
+		right, e := vm.TypeExpression(node.Right, scope, mdl.Map{AnyModel})
 		if e != nil {
-			return value, e
+			return right, e
 		}
-		node.Value = value
+		node.Right = right
 
-		model := mdl.Model(BoolModel)
-		if cv, ok := value.Actual.(ConstantModel); ok {
-			if cl, ok := in.Actual.(ConstantModel); ok {
-				found := val.Bool(false)
-				for _, v := range cl.Value.(val.List) {
-					if cv.Value.Equals(v) {
-						found = true
-						break
-					}
-				}
-				model = ConstantModel{model, found}
+		le, re := left.Actual.Concrete().(mdl.Map).Elements, right.Actual.Concrete().(mdl.Map).Elements
+		model := mdl.Either(le, re, nil)
+
+		if node.Conflict != nil {
+			conflict, e := vm.TypeFunctionWithArguments(node.Conflict, scope, AnyModel, StringModel, le, re)
+			if e != nil {
+				return ZeroTypedExpression, e
 			}
+			node.Conflict = conflict
+			model = mdl.Either(model, conflict.Actual, nil)
 		}
-		retNode = xpr.TypedExpression{node, expected, model}
 
-	case xpr.FilterList:
-		value, e := vm.TypeExpression(node.Value, scope, mdl.List{AnyModel})
+		retNode = xpr.TypedExpression{node, expected, mdl.Map{model}}
+
+	case xpr.FilterMap:
+		value, e := vm.TypeExpression(node.Value, scope, mdl.Map{AnyModel})
 		if e != nil {
 			return value, e
 		}
 		node.Value = value
 
-		subArg := value.Actual.Concrete().(mdl.List).Elements
-		filter, e := vm.TypeFunctionWithArguments(node.Filter, scope, BoolModel, mdl.Int64{}, subArg)
+		subArg := value.Actual.Concrete().(mdl.Map).Elements
+		filter, e := vm.TypeFunctionWithArguments(node.Filter, scope, BoolModel, StringModel, subArg)
 		if e != nil {
 			return ZeroTypedExpression, e
 		}
 		node.Filter = filter
 
-		retNode = xpr.TypedExpression{node, expected, value.Actual.Unwrap()} // get rid of constant wrapper in e.g. filterList([1,2,3], () => ...)
+		retNode = xpr.TypedExpression{node, expected, value.Actual.Unwrap()}
+
+	case xpr.RemoveKey:
+		name, e := vm.TypeExpression(node.Name, scope, StringModel)
+		if e != nil {
+			return name, e
+		}
+		node.Name = name
+
+		in, e := vm.TypeExpression(node.In, scope, mdl.Map{AnyModel})
+		if e != nil {
+			return in, e
+		}
+		node.In = in
+
+		retNode = xpr.TypedExpression{node, expected, in.Actual.Unwrap()}
 
 	case xpr.AssertCase:
 
@@ -2749,6 +3669,234 @@ func (vm VirtualMachine) TypeExpression(node xpr.Expression, scope *ModelScope,
 		}
 		retNode = xpr.TypedExpression{node, expected, UnwrapConstant(value.Actual)}
 
+	case xpr.TopN:
+
+		value, e := vm.TypeExpression(node.Value, scope, mdl.List{AnyModel})
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Value = value
+
+		n, e := vm.TypeExpression(node.N, scope, Int64Model)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.N = n
+
+		subArg := value.Actual.Concrete().(mdl.List).Elements
+
+		key, e := vm.TypeFunctionWithArguments(node.Key, scope, AnyModel, subArg)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Key = key
+
+		if _, ok := key.Actual.Concrete().(mdl.Any); ok {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: fmt.Sprintf(`topN: key must return unambiguous type`),
+				Program: xpr.ValueFromFunction(key),
+			}
+		}
+		retNode = xpr.TypedExpression{node, expected, mdl.List{subArg}}
+
+	case xpr.GroupBy:
+
+		value, e := vm.TypeExpression(node.Value, scope, mdl.List{AnyModel})
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Value = value
+
+		subArg := value.Actual.Concrete().(mdl.List).Elements
+
+		key, e := vm.TypeFunctionWithArguments(node.Key, scope, StringModel, subArg)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Key = key
+
+		retNode = xpr.TypedExpression{node, expected, mdl.Map{mdl.List{subArg}}}
+
+	case xpr.Sum:
+		arg, model, e := vm.typeNumericList(node.Argument, scope, "sum")
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+		if ca, ok := arg.Actual.(ConstantModel); ok {
+			if v, e := sumValues(newListIterator(ca.Value.(val.List)), model.Zero()); e == nil {
+				model = ConstantModel{model, v}
+			}
+		}
+		retNode = xpr.TypedExpression{node, expected, model}
+
+	case xpr.Avg:
+		arg, _, e := vm.typeNumericList(node.Argument, scope, "avg")
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+		model := mdl.Model(FloatModel)
+		if ca, ok := arg.Actual.(ConstantModel); ok {
+			if v, e := avgValues(newListIterator(ca.Value.(val.List))); e == nil {
+				model = ConstantModel{model, v}
+			}
+		}
+		retNode = xpr.TypedExpression{node, expected, model}
+
+	case xpr.Min:
+		arg, model, e := vm.typeNumericList(node.Argument, scope, "min")
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+		if ca, ok := arg.Actual.(ConstantModel); ok {
+			if v, e := extremeValue(newListIterator(ca.Value.(val.List)), false); e == nil {
+				model = ConstantModel{model, v}
+			}
+		}
+		retNode = xpr.TypedExpression{node, expected, model}
+
+	case xpr.Max:
+		arg, model, e := vm.typeNumericList(node.Argument, scope, "max")
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+		if ca, ok := arg.Actual.(ConstantModel); ok {
+			if v, e := extremeValue(newListIterator(ca.Value.(val.List)), true); e == nil {
+				model = ConstantModel{model, v}
+			}
+		}
+		retNode = xpr.TypedExpression{node, expected, model}
+
+	case xpr.CountDistinct:
+		arg, e := vm.TypeExpression(node.Argument, scope, mdl.List{AnyModel})
+		if e != nil {
+			return arg, e
+		}
+		node.Argument = arg
+		model := mdl.Model(Int64Model)
+		if ca, ok := arg.Actual.(ConstantModel); ok {
+			if v, e := countDistinctValues(newListIterator(ca.Value.(val.List))); e == nil {
+				model = ConstantModel{model, v}
+			}
+		}
+		retNode = xpr.TypedExpression{node, expected, model}
+
+	case xpr.HashJoin:
+
+		left, e := vm.TypeExpression(node.Left, scope, mdl.List{AnyModel})
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Left = left
+
+		right, e := vm.TypeExpression(node.Right, scope, mdl.List{AnyModel})
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Right = right
+
+		leftArg := left.Actual.Concrete().(mdl.List).Elements
+		rightArg := right.Actual.Concrete().(mdl.List).Elements
+
+		leftKey, e := vm.TypeFunctionWithArguments(node.LeftKey, scope, AnyModel, leftArg)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.LeftKey = leftKey
+
+		rightKey, e := vm.TypeFunctionWithArguments(node.RightKey, scope, AnyModel, rightArg)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.RightKey = rightKey
+
+		model, e := joinModel(leftArg, rightArg, node.Merge, "hashJoin", node)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		retNode = xpr.TypedExpression{node, expected, mdl.List{model}}
+
+	case xpr.RefJoin:
+
+		left, e := vm.TypeExpression(node.Left, scope, mdl.List{AnyModel})
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		node.Left = left
+
+		leftArg := left.Actual.Concrete().(mdl.List).Elements
+		if _, ok := leftArg.(BucketModel); !ok {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: `refJoin: left argument must be a list of persisted objects`,
+				Program: xpr.ValueFromExpression(left),
+			}
+		}
+
+		in, e := vm.TypeExpression(node.In, scope, mdl.Ref{vm.MetaModelId()})
+		if e != nil {
+			return in, e
+		}
+		node.In = in
+
+		ci, ok := in.Actual.(ConstantModel)
+		if !ok {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: `refJoin: in argument must be constant expression`,
+				Program: xpr.ValueFromExpression(in),
+			}
+		}
+
+		rightArg, e := vm.Model(ci.Value.(val.Ref)[1])
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+
+		model, e := joinModel(leftArg, rightArg, node.Merge, "refJoin", node)
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+		retNode = xpr.TypedExpression{node, expected, mdl.List{model}}
+
+	case xpr.LookupEncrypted:
+
+		in, e := vm.TypeExpression(node.In, scope, mdl.Ref{vm.MetaModelId()})
+		if e != nil {
+			return in, e
+		}
+		node.In = in
+
+		ci, ok := in.Actual.(ConstantModel)
+		if !ok {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: `lookupEncrypted: in argument must be constant expression`,
+				Program: xpr.ValueFromExpression(in),
+			}
+		}
+
+		model, e := vm.Model(ci.Value.(val.Ref)[1])
+		if e != nil {
+			return ZeroTypedExpression, e
+		}
+
+		encrypted, ok := encryptedAt(model, node.Path)
+		if !ok {
+			return ZeroTypedExpression, err.CompilationError{
+				Problem: `lookupEncrypted: path must lead through struct fields to a value annotated "encrypted"`,
+				Program: xpr.ValueFromExpression(node),
+			}
+		}
+
+		value, e := vm.TypeExpression(node.Value, scope, encrypted)
+		if e != nil {
+			return value, e
+		}
+		node.Value = value
+
+		retNode = xpr.TypedExpression{node, expected, mdl.List{model}}
+
 	case xpr.MapSet:
 
 		value, e := vm.TypeExpression(node.Value, scope, mdl.Set{AnyModel})
@@ -2837,6 +3985,23 @@ func checkArgumentTypes(f xpr.TypedFunction, args ...mdl.Model) err.Error {
 
 }
 
+// typeNumericList types x as a list of numbers and returns their (concrete) model.
+// name is the name of the aggregate, used in error messages.
+func (vm VirtualMachine) typeNumericList(x xpr.Expression, scope *ModelScope, name string) (xpr.TypedExpression, mdl.Model, err.Error) {
+	arg, e := vm.TypeExpression(x, scope, mdl.List{AnyModel})
+	if e != nil {
+		return arg, nil, e
+	}
+	elements := arg.Actual.Concrete().(mdl.List).Elements.Concrete()
+	if !isNumericModel(elements) {
+		return ZeroTypedExpression, nil, err.CompilationError{
+			Problem: fmt.Sprintf(`%s: argument must be a list of numbers`, name),
+			Program: xpr.ValueFromExpression(arg),
+		}
+	}
+	return arg, elements, nil
+}
+
 func isNumericModel(m mdl.Model) bool {
 	switch m.Concrete().(type) {
 	case mdl.Float:
@@ -2857,6 +4022,8 @@ func isNumericModel(m mdl.Model) bool {
 		return true
 	case mdl.Uint64:
 		return true
+	case mdl.Decimal:
+		return true
 	}
 	return false
 }
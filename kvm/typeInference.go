@@ -276,6 +276,30 @@ func _inferType(value val.Value, expected mdl.Model) (mdl.Model, []TypeInference
 			return nil, []TypeInferenceError{TypeInferenceError{expected, value, nil}}
 		}
 		return m, nil
+	case mdl.Duration:
+		_, ok := value.(val.Duration)
+		if !ok {
+			return nil, []TypeInferenceError{TypeInferenceError{expected, value, nil}}
+		}
+		return m, nil
+	case mdl.Decimal:
+		_, ok := value.(val.Decimal)
+		if !ok {
+			return nil, []TypeInferenceError{TypeInferenceError{expected, value, nil}}
+		}
+		return m, nil
+	case mdl.Bytes:
+		_, ok := value.(val.Bytes)
+		if !ok {
+			return nil, []TypeInferenceError{TypeInferenceError{expected, value, nil}}
+		}
+		return m, nil
+	case mdl.Blob:
+		_, ok := value.(val.Blob)
+		if !ok {
+			return nil, []TypeInferenceError{TypeInferenceError{expected, value, nil}}
+		}
+		return m, nil
 	case mdl.Int8:
 		_, ok := value.(val.Int8)
 		if !ok {
@@ -0,0 +1,262 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package val
+
+import (
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Decimal is the exact number Unscaled * 10^-Scale.
+// decimals are immutable, Unscaled must not be modified once set.
+// the scale is kept as is, so 1.50 prints as 1.50 but equals 1.5.
+type Decimal struct {
+	Unscaled *big.Int
+	Scale    int32
+}
+
+func (v Decimal) Transform(f func(Value) Value) Value {
+	return f(v)
+}
+
+func (x Decimal) Copy() Value {
+	return x
+}
+
+func (d Decimal) Equals(v Value) bool {
+	w, ok := v.(Decimal)
+	return ok && d.Cmp(w) == 0
+}
+
+func (v Decimal) Primitive() bool {
+	return true
+}
+
+// MaxDecimalScale bounds the scale of decimals in both directions, as the
+// time and memory taken by printing and rescaling them grow with it.
+const MaxDecimalScale = 1000
+
+var bigTen = big.NewInt(10)
+
+func pow10(n int32) *big.Int {
+	return new(big.Int).Exp(bigTen, big.NewInt(int64(n)), nil)
+}
+
+func DecimalFromInt64(i int64) Decimal {
+	return Decimal{big.NewInt(i), 0}
+}
+
+func DecimalFromUint64(u uint64) Decimal {
+	return Decimal{new(big.Int).SetUint64(u), 0}
+}
+
+// DecimalFromFloat returns the shortest decimal that parses back to f.
+func DecimalFromFloat(f float64) (Decimal, bool) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return Decimal{}, false
+	}
+	return ParseDecimal(strconv.FormatFloat(f, 'g', -1, 64))
+}
+
+// ParseDecimal parses numbers like 12, -0.50 or 1.5e3. It fails for numbers
+// whose scale is beyond MaxDecimalScale.
+func ParseDecimal(s string) (Decimal, bool) {
+
+	exponent := int64(0)
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		e, err := strconv.ParseInt(s[i+1:], 10, 32)
+		if err != nil {
+			return Decimal{}, false
+		}
+		s, exponent = s[:i], e
+	}
+
+	digits := s
+	if len(digits) > 0 && (digits[0] == '-' || digits[0] == '+') {
+		digits = digits[1:]
+	}
+
+	scale := int64(0)
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		scale = int64(len(digits) - i - 1)
+		s = strings.Replace(s, ".", "", 1)
+		digits = digits[:i] + digits[i+1:]
+	}
+
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return Decimal{}, false
+	}
+
+	scale -= exponent
+	if scale < -MaxDecimalScale || scale > MaxDecimalScale {
+		return Decimal{}, false
+	}
+
+	u, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return Decimal{}, false
+	}
+	return Decimal{u, int32(scale)}, true
+}
+
+func (d Decimal) String() string {
+	if d.Scale <= 0 {
+		return new(big.Int).Mul(d.Unscaled, pow10(-d.Scale)).String()
+	}
+	s := new(big.Int).Abs(d.Unscaled).String()
+	if n := int(d.Scale) + 1 - len(s); n > 0 {
+		s = strings.Repeat("0", n) + s
+	}
+	s = s[:len(s)-int(d.Scale)] + "." + s[len(s)-int(d.Scale):]
+	if d.Unscaled.Sign() < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+func (d Decimal) Float() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+// Integer returns the integer part of d, truncated towards zero.
+func (d Decimal) Integer() *big.Int {
+	if d.Scale <= 0 {
+		return new(big.Int).Mul(d.Unscaled, pow10(-d.Scale))
+	}
+	return new(big.Int).Quo(d.Unscaled, pow10(d.Scale))
+}
+
+// IsInteger reports whether d has no fractional part.
+func (d Decimal) IsInteger() bool {
+	if d.Scale <= 0 {
+		return true
+	}
+	return new(big.Int).Rem(d.Unscaled, pow10(d.Scale)).Sign() == 0
+}
+
+// rescale returns the unscaled value of d at the greater scale s.
+func (d Decimal) rescale(s int32) *big.Int {
+	if s == d.Scale {
+		return d.Unscaled
+	}
+	return new(big.Int).Mul(d.Unscaled, pow10(s-d.Scale))
+}
+
+func maxScale(a, b Decimal) int32 {
+	if a.Scale > b.Scale {
+		return a.Scale
+	}
+	return b.Scale
+}
+
+func (d Decimal) Cmp(e Decimal) int {
+	s := maxScale(d, e)
+	return d.rescale(s).Cmp(e.rescale(s))
+}
+
+func (d Decimal) Add(e Decimal) Decimal {
+	s := maxScale(d, e)
+	return Decimal{new(big.Int).Add(d.rescale(s), e.rescale(s)), s}
+}
+
+func (d Decimal) Sub(e Decimal) Decimal {
+	s := maxScale(d, e)
+	return Decimal{new(big.Int).Sub(d.rescale(s), e.rescale(s)), s}
+}
+
+func (d Decimal) Mul(e Decimal) Decimal {
+	return Decimal{new(big.Int).Mul(d.Unscaled, e.Unscaled), d.Scale + e.Scale}
+}
+
+// Normalize strips trailing fractional zeros.
+func (d Decimal) Normalize() Decimal {
+	u, s := d.Unscaled, d.Scale
+	if u.Sign() == 0 {
+		return Decimal{u, 0}
+	}
+	q, r := new(big.Int), new(big.Int)
+	for s > 0 {
+		q.QuoRem(u, bigTen, r)
+		if r.Sign() != 0 {
+			break
+		}
+		u, s = new(big.Int).Set(q), s-1
+	}
+	return Decimal{u, s}
+}
+
+type RoundingMode string
+
+const (
+	RoundHalfEven RoundingMode = "halfEven"
+	RoundHalfUp   RoundingMode = "halfUp"   // ties away from zero
+	RoundHalfDown RoundingMode = "halfDown" // ties towards zero
+	RoundUp       RoundingMode = "up"       // away from zero
+	RoundDown     RoundingMode = "down"     // towards zero
+	RoundCeiling  RoundingMode = "ceiling"
+	RoundFloor    RoundingMode = "floor"
+)
+
+// roundQuotient returns num / den rounded to an integer according to mode.
+func roundQuotient(num, den *big.Int, mode RoundingMode) *big.Int {
+
+	q, r := new(big.Int).QuoRem(num, den, new(big.Int))
+	if r.Sign() == 0 {
+		return q
+	}
+
+	sign := num.Sign() * den.Sign()
+	// compares the remainder to half the divisor
+	twice := new(big.Int).Abs(r)
+	half := twice.Lsh(twice, 1).Cmp(new(big.Int).Abs(den))
+
+	away := false
+	switch mode {
+	case RoundUp:
+		away = true
+	case RoundDown:
+		away = false
+	case RoundCeiling:
+		away = sign > 0
+	case RoundFloor:
+		away = sign < 0
+	case RoundHalfUp:
+		away = half >= 0
+	case RoundHalfDown:
+		away = half > 0
+	default: // RoundHalfEven
+		away = half > 0 || (half == 0 && q.Bit(0) == 1)
+	}
+
+	if away {
+		q.Add(q, big.NewInt(int64(sign)))
+	}
+	return q
+}
+
+// Round returns d with exactly scale fractional digits.
+func (d Decimal) Round(scale int32, mode RoundingMode) Decimal {
+	if scale >= d.Scale {
+		return Decimal{d.rescale(scale), scale}
+	}
+	return Decimal{roundQuotient(d.Unscaled, pow10(d.Scale-scale), mode), scale}
+}
+
+// Quo returns d / e with scale fractional digits, rounded according to mode.
+// ok is false if e is zero.
+func (d Decimal) Quo(e Decimal, scale int32, mode RoundingMode) (q Decimal, ok bool) {
+	if e.Unscaled.Sign() == 0 {
+		return Decimal{}, false
+	}
+	// d / e = d.Unscaled * 10^(e.Scale + scale - d.Scale) / e.Unscaled, at scale
+	num, den := new(big.Int).Set(d.Unscaled), new(big.Int).Set(e.Unscaled)
+	if x := int64(e.Scale) + int64(scale) - int64(d.Scale); x >= 0 {
+		num.Mul(num, pow10(int32(x)))
+	} else {
+		den.Mul(den, pow10(int32(-x)))
+	}
+	return Decimal{roundQuotient(num, den, mode), scale}, true
+}
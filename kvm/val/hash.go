@@ -82,6 +82,24 @@ func Hash(v Value, h hash.Hash64) hash.Hash64 {
 		h.Write([]byte(`datetime`))
 		h.Write([]byte(v.Time.String()))
 		return h
+	case Duration:
+		h.Write([]byte(`duration`))
+		x := int64(v)
+		b := *(*[8]byte)((unsafe.Pointer)(&x))
+		h.Write(b[:])
+		return h
+	case Decimal:
+		h.Write([]byte(`decimal`))
+		h.Write([]byte(v.Normalize().String())) // equal decimals hash equally regardless of scale
+		return h
+	case Bytes:
+		h.Write([]byte(`bytes`))
+		h.Write(v)
+		return h
+	case Blob:
+		h.Write([]byte(`blob`))
+		h.Write([]byte(v))
+		return h
 	case null:
 		h.Write([]byte(`null`))
 		return h
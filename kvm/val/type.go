@@ -31,6 +31,10 @@ const (
 	TypeUint16
 	TypeUint32
 	TypeUint64
+	TypeDuration
+	TypeDecimal
+	TypeBytes
+	TypeBlob
 	lastType // internal marker
 )
 
@@ -54,7 +58,11 @@ const AnyType = TypeTuple |
 	TypeUint8 |
 	TypeUint16 |
 	TypeUint32 |
-	TypeUint64
+	TypeUint64 |
+	TypeDuration |
+	TypeDecimal |
+	TypeBytes |
+	TypeBlob
 
 func (t Type) String() string {
 	if t == 0 {
@@ -114,6 +122,14 @@ func typeToString(t Type) string {
 		return "uint32"
 	case TypeUint64:
 		return "uint64"
+	case TypeDuration:
+		return "duration"
+	case TypeDecimal:
+		return "decimal"
+	case TypeBytes:
+		return "bytes"
+	case TypeBlob:
+		return "blob"
 	}
 	panic(fmt.Sprintf("unhandled Type: %b", uint64(t)))
 }
@@ -162,6 +178,22 @@ func (DateTime) Type() Type {
 	return TypeDateTime
 }
 
+func (Duration) Type() Type {
+	return TypeDuration
+}
+
+func (Decimal) Type() Type {
+	return TypeDecimal
+}
+
+func (Bytes) Type() Type {
+	return TypeBytes
+}
+
+func (Blob) Type() Type {
+	return TypeBlob
+}
+
 func (null) Type() Type {
 	return TypeNull
 }
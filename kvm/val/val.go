@@ -3,6 +3,7 @@
 package val
 
 import (
+	"bytes"
 	"time"
 )
 
@@ -458,6 +459,76 @@ func (v DateTime) Primitive() bool {
 	return true
 }
 
+type Duration time.Duration
+
+func (v Duration) Transform(f func(Value) Value) Value {
+	return f(v)
+}
+
+func (x Duration) Copy() Value {
+	return x
+}
+
+func (s Duration) Equals(v Value) bool {
+	return s == v
+}
+
+func (v Duration) Primitive() bool {
+	return true
+}
+
+// Bytes must not be modified once set, Copy does not clone the slice.
+type Bytes []byte
+
+func (v Bytes) Transform(f func(Value) Value) Value {
+	return f(v)
+}
+
+func (x Bytes) Copy() Value {
+	return x
+}
+
+func (s Bytes) Equals(v Value) bool {
+	w, ok := v.(Bytes)
+	return ok && bytes.Equal(s, w)
+}
+
+func (v Bytes) Primitive() bool {
+	return true
+}
+
+// Blob is the hex encoded sha256 of a blob's content, which is stored separately.
+type Blob string
+
+func (v Blob) Transform(f func(Value) Value) Value {
+	return f(v)
+}
+
+func (x Blob) Copy() Value {
+	return x
+}
+
+func (s Blob) Equals(v Value) bool {
+	return s == v
+}
+
+func (v Blob) Primitive() bool {
+	return true
+}
+
+// Valid reports whether b looks like a sha256 sum, i.e. 64 lower case hex digits.
+func (b Blob) Valid() bool {
+	if len(b) != 64 {
+		return false
+	}
+	for _, c := range []byte(b) {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 var Null = null{}
 
 type null struct{}
@@ -338,6 +338,20 @@ func (x With) Transform(f func(Expression) Expression) Expression {
 	return f(With{x.Value.Transform(f), x.Return})
 }
 
+// Call applies the function persisted in ExpressionModel under Function (a ref)
+type Call struct {
+	Function  Expression
+	Arguments []Expression
+}
+
+func (x Call) Transform(f func(Expression) Expression) Expression {
+	args := make([]Expression, len(x.Arguments), len(x.Arguments))
+	for i, arg := range x.Arguments {
+		args[i] = arg.Transform(f)
+	}
+	return f(Call{x.Function.Transform(f), args})
+}
+
 type If struct {
 	Condition, Then, Else Expression
 }
@@ -1049,6 +1063,16 @@ func (x MemSort) Transform(f func(Expression) Expression) Expression {
 	return f(MemSort{x.Value.Transform(f), x.Order})
 }
 
+type TopN struct {
+	Value Expression
+	N     Expression
+	Key   Function
+}
+
+func (x TopN) Transform(f func(Expression) Expression) Expression {
+	return f(TopN{x.Value.Transform(f), x.N.Transform(f), x.Key})
+}
+
 type Define struct {
 	Name     string
 	Argument Expression
@@ -1193,3 +1217,525 @@ type MapEnum struct {
 func (x MapEnum) Transform(f func(Expression) Expression) Expression {
 	return f(MapEnum{x.Symbol.Transform(f), x.Default, x.HasDefault, x.Mapping})
 }
+
+type GroupBy struct {
+	Value Expression
+	Key   Function
+}
+
+func (x GroupBy) Transform(f func(Expression) Expression) Expression {
+	return f(GroupBy{x.Value.Transform(f), x.Key})
+}
+
+type Sum struct {
+	Argument Expression
+}
+
+func (x Sum) Transform(f func(Expression) Expression) Expression {
+	return f(Sum{x.Argument.Transform(f)})
+}
+
+type Avg struct {
+	Argument Expression
+}
+
+func (x Avg) Transform(f func(Expression) Expression) Expression {
+	return f(Avg{x.Argument.Transform(f)})
+}
+
+type Min struct {
+	Argument Expression
+}
+
+func (x Min) Transform(f func(Expression) Expression) Expression {
+	return f(Min{x.Argument.Transform(f)})
+}
+
+type Max struct {
+	Argument Expression
+}
+
+func (x Max) Transform(f func(Expression) Expression) Expression {
+	return f(Max{x.Argument.Transform(f)})
+}
+
+type CountDistinct struct {
+	Argument Expression
+}
+
+func (x CountDistinct) Transform(f func(Expression) Expression) Expression {
+	return f(CountDistinct{x.Argument.Transform(f)})
+}
+
+type HashJoin struct {
+	Left     Expression
+	Right    Expression
+	LeftKey  Function
+	RightKey Function
+	Merge    bool
+}
+
+func (x HashJoin) Transform(f func(Expression) Expression) Expression {
+	return f(HashJoin{x.Left.Transform(f), x.Right.Transform(f), x.LeftKey, x.RightKey, x.Merge})
+}
+
+type RefJoin struct {
+	Left  Expression
+	In    Expression
+	Via   string // "referrers" or "referred"
+	Merge bool
+}
+
+func (x RefJoin) Transform(f func(Expression) Expression) Expression {
+	return f(RefJoin{x.Left.Transform(f), x.In.Transform(f), x.Via, x.Merge})
+}
+
+type LookupEncrypted struct {
+	In    Expression
+	Path  []string // of struct fields to the encrypted value
+	Value Expression
+}
+
+func (x LookupEncrypted) Transform(f func(Expression) Expression) Expression {
+	return f(LookupEncrypted{x.In.Transform(f), x.Path, x.Value.Transform(f)})
+}
+
+type StringToUpper struct {
+	Argument Expression
+}
+
+func (x StringToUpper) Transform(f func(Expression) Expression) Expression {
+	return f(StringToUpper{x.Argument.Transform(f)})
+}
+
+type TrimString struct {
+	Argument Expression
+}
+
+func (x TrimString) Transform(f func(Expression) Expression) Expression {
+	return f(TrimString{x.Argument.Transform(f)})
+}
+
+type Substring struct {
+	String Expression
+	Offset Expression
+	Length Expression
+}
+
+func (x Substring) Transform(f func(Expression) Expression) Expression {
+	return f(Substring{x.String.Transform(f), x.Offset.Transform(f), x.Length.Transform(f)})
+}
+
+type StringReplace struct {
+	String      Expression
+	Search      Expression
+	Replacement Expression
+}
+
+func (x StringReplace) Transform(f func(Expression) Expression) Expression {
+	return f(StringReplace{x.String.Transform(f), x.Search.Transform(f), x.Replacement.Transform(f)})
+}
+
+type ReplaceRegex struct {
+	Value           Expression
+	Regex           string
+	MultiLine       bool
+	CaseInsensitive bool
+	Replacement     Expression // may reference capture groups as $1 or ${name}
+}
+
+func (x ReplaceRegex) Transform(f func(Expression) Expression) Expression {
+	return f(ReplaceRegex{x.Value.Transform(f), x.Regex, x.MultiLine, x.CaseInsensitive, x.Replacement.Transform(f)})
+}
+
+type SplitString struct {
+	String    Expression
+	Separator Expression
+}
+
+func (x SplitString) Transform(f func(Expression) Expression) Expression {
+	return f(SplitString{x.String.Transform(f), x.Separator.Transform(f)})
+}
+
+type PadString struct {
+	String  Expression
+	Width   Expression
+	Padding Expression
+	Left    bool
+}
+
+func (x PadString) Transform(f func(Expression) Expression) Expression {
+	return f(PadString{x.String.Transform(f), x.Width.Transform(f), x.Padding.Transform(f), x.Left})
+}
+
+type RepeatString struct {
+	String Expression
+	Count  Expression
+}
+
+func (x RepeatString) Transform(f func(Expression) Expression) Expression {
+	return f(RepeatString{x.String.Transform(f), x.Count.Transform(f)})
+}
+
+type StringStartsWith struct {
+	String Expression
+	Prefix Expression
+}
+
+func (x StringStartsWith) Transform(f func(Expression) Expression) Expression {
+	return f(StringStartsWith{x.String.Transform(f), x.Prefix.Transform(f)})
+}
+
+type StringEndsWith struct {
+	String Expression
+	Suffix Expression
+}
+
+func (x StringEndsWith) Transform(f func(Expression) Expression) Expression {
+	return f(StringEndsWith{x.String.Transform(f), x.Suffix.Transform(f)})
+}
+
+type NormalizeString struct {
+	Value Expression
+	Form  string // NFC, NFD, NFKC or NFKD
+}
+
+func (x NormalizeString) Transform(f func(Expression) Expression) Expression {
+	return f(NormalizeString{x.Value.Transform(f), x.Form})
+}
+
+type ParseInt64 struct {
+	Argument Expression
+}
+
+func (x ParseInt64) Transform(f func(Expression) Expression) Expression {
+	return f(ParseInt64{x.Argument.Transform(f)})
+}
+
+type ParseFloat struct {
+	Argument Expression
+}
+
+func (x ParseFloat) Transform(f func(Expression) Expression) Expression {
+	return f(ParseFloat{x.Argument.Transform(f)})
+}
+
+type AddDuration struct {
+	DateTime Expression
+	Duration Expression
+}
+
+func (x AddDuration) Transform(f func(Expression) Expression) Expression {
+	return f(AddDuration{x.DateTime.Transform(f), x.Duration.Transform(f)})
+}
+
+type SubDuration struct {
+	DateTime Expression
+	Duration Expression
+}
+
+func (x SubDuration) Transform(f func(Expression) Expression) Expression {
+	return f(SubDuration{x.DateTime.Transform(f), x.Duration.Transform(f)})
+}
+
+type DateTimeDiff [2]Expression
+
+func (x DateTimeDiff) Transform(f func(Expression) Expression) Expression {
+	return f(DateTimeDiff{x[0].Transform(f), x[1].Transform(f)})
+}
+
+type ParseDuration struct {
+	Argument Expression
+}
+
+func (x ParseDuration) Transform(f func(Expression) Expression) Expression {
+	return f(ParseDuration{x.Argument.Transform(f)})
+}
+
+type TruncateDateTime struct {
+	Value Expression
+	Unit  string     // minute, hour, day, week, month or year
+	Zone  Expression // IANA zone name, UTC if absent
+}
+
+func (x TruncateDateTime) Transform(f func(Expression) Expression) Expression {
+	return f(TruncateDateTime{x.Value.Transform(f), x.Unit, x.Zone.Transform(f)})
+}
+
+type ExtractDateTime struct {
+	Value     Expression
+	Component string     // year, month, day, hour, minute, second, weekday or yearDay
+	Zone      Expression // IANA zone name, UTC if absent
+}
+
+func (x ExtractDateTime) Transform(f func(Expression) Expression) Expression {
+	return f(ExtractDateTime{x.Value.Transform(f), x.Component, x.Zone.Transform(f)})
+}
+
+type FormatDateTime struct {
+	Value  Expression
+	Layout Expression // Go reference time layout
+	Zone   Expression // IANA zone name, UTC if absent
+}
+
+func (x FormatDateTime) Transform(f func(Expression) Expression) Expression {
+	return f(FormatDateTime{x.Value.Transform(f), x.Layout.Transform(f), x.Zone.Transform(f)})
+}
+
+type ParseDateTime struct {
+	Value  Expression
+	Layout Expression // Go reference time layout
+	Zone   Expression // IANA zone name, UTC if absent
+}
+
+func (x ParseDateTime) Transform(f func(Expression) Expression) Expression {
+	return f(ParseDateTime{x.Value.Transform(f), x.Layout.Transform(f), x.Zone.Transform(f)})
+}
+
+type ToDecimal struct {
+	Expression Expression
+}
+
+func (x ToDecimal) Transform(f func(Expression) Expression) Expression {
+	return f(ToDecimal{x.Expression.Transform(f)})
+}
+
+type AddDecimal [2]Expression
+
+func (x AddDecimal) Transform(f func(Expression) Expression) Expression {
+	return f(AddDecimal{x[0].Transform(f), x[1].Transform(f)})
+}
+
+type SubDecimal [2]Expression
+
+func (x SubDecimal) Transform(f func(Expression) Expression) Expression {
+	return f(SubDecimal{x[0].Transform(f), x[1].Transform(f)})
+}
+
+type MulDecimal [2]Expression
+
+func (x MulDecimal) Transform(f func(Expression) Expression) Expression {
+	return f(MulDecimal{x[0].Transform(f), x[1].Transform(f)})
+}
+
+type DivDecimal [2]Expression
+
+func (x DivDecimal) Transform(f func(Expression) Expression) Expression {
+	return f(DivDecimal{x[0].Transform(f), x[1].Transform(f)})
+}
+
+type GtDecimal [2]Expression
+
+func (x GtDecimal) Transform(f func(Expression) Expression) Expression {
+	return f(GtDecimal{x[0].Transform(f), x[1].Transform(f)})
+}
+
+type LtDecimal [2]Expression
+
+func (x LtDecimal) Transform(f func(Expression) Expression) Expression {
+	return f(LtDecimal{x[0].Transform(f), x[1].Transform(f)})
+}
+
+type RoundDecimal struct {
+	Value Expression
+	Scale Expression
+	Mode  string // see val.RoundingMode
+}
+
+func (x RoundDecimal) Transform(f func(Expression) Expression) Expression {
+	return f(RoundDecimal{x.Value.Transform(f), x.Scale.Transform(f), x.Mode})
+}
+
+type SetUnion [2]Expression
+
+func (x SetUnion) Transform(f func(Expression) Expression) Expression {
+	return f(SetUnion{x[0].Transform(f), x[1].Transform(f)})
+}
+
+type SetIntersection [2]Expression
+
+func (x SetIntersection) Transform(f func(Expression) Expression) Expression {
+	return f(SetIntersection{x[0].Transform(f), x[1].Transform(f)})
+}
+
+type SetDifference [2]Expression
+
+func (x SetDifference) Transform(f func(Expression) Expression) Expression {
+	return f(SetDifference{x[0].Transform(f), x[1].Transform(f)})
+}
+
+// IsSubset tests whether the first set is a subset of the second.
+type IsSubset [2]Expression
+
+func (x IsSubset) Transform(f func(Expression) Expression) Expression {
+	return f(IsSubset{x[0].Transform(f), x[1].Transform(f)})
+}
+
+type InSet struct {
+	Value, In Expression
+}
+
+func (x InSet) Transform(f func(Expression) Expression) Expression {
+	return f(InSet{x.Value.Transform(f), x.In.Transform(f)})
+}
+
+type ListToSet struct {
+	Argument Expression
+}
+
+func (x ListToSet) Transform(f func(Expression) Expression) Expression {
+	return f(ListToSet{x.Argument.Transform(f)})
+}
+
+type SetToList struct {
+	Argument Expression
+}
+
+func (x SetToList) Transform(f func(Expression) Expression) Expression {
+	return f(SetToList{x.Argument.Transform(f)})
+}
+
+type MapKeys struct {
+	Argument Expression
+}
+
+func (x MapKeys) Transform(f func(Expression) Expression) Expression {
+	return f(MapKeys{x.Argument.Transform(f)})
+}
+
+type MapValues struct {
+	Argument Expression
+}
+
+func (x MapValues) Transform(f func(Expression) Expression) Expression {
+	return f(MapValues{x.Argument.Transform(f)})
+}
+
+type MapEntries struct {
+	Argument Expression
+}
+
+func (x MapEntries) Transform(f func(Expression) Expression) Expression {
+	return f(MapEntries{x.Argument.Transform(f)})
+}
+
+type MergeMaps struct {
+	Left, Right Expression
+	Conflict    Function // (key, left, right), right wins if nil
+}
+
+func (x MergeMaps) Transform(f func(Expression) Expression) Expression {
+	return f(MergeMaps{x.Left.Transform(f), x.Right.Transform(f), x.Conflict})
+}
+
+type FilterMap struct {
+	Value  Expression
+	Filter Function // (key, value)
+}
+
+func (x FilterMap) Transform(f func(Expression) Expression) Expression {
+	return f(FilterMap{x.Value.Transform(f), x.Filter})
+}
+
+type RemoveKey struct {
+	Name, In Expression
+}
+
+func (x RemoveKey) Transform(f func(Expression) Expression) Expression {
+	return f(RemoveKey{x.Name.Transform(f), x.In.Transform(f)})
+}
+
+type AnyList struct {
+	Value     Expression
+	Predicate Function // (index, value)
+}
+
+func (x AnyList) Transform(f func(Expression) Expression) Expression {
+	return f(AnyList{x.Value.Transform(f), x.Predicate})
+}
+
+type EveryList struct {
+	Value     Expression
+	Predicate Function // (index, value)
+}
+
+func (x EveryList) Transform(f func(Expression) Expression) Expression {
+	return f(EveryList{x.Value.Transform(f), x.Predicate})
+}
+
+type TakeWhileList struct {
+	Value     Expression
+	Predicate Function // (index, value)
+}
+
+func (x TakeWhileList) Transform(f func(Expression) Expression) Expression {
+	return f(TakeWhileList{x.Value.Transform(f), x.Predicate})
+}
+
+type ZipLists [2]Expression
+
+func (x ZipLists) Transform(f func(Expression) Expression) Expression {
+	return f(ZipLists{x[0].Transform(f), x[1].Transform(f)})
+}
+
+type ChunkList struct {
+	Value, Size Expression
+}
+
+func (x ChunkList) Transform(f func(Expression) Expression) Expression {
+	return f(ChunkList{x.Value.Transform(f), x.Size.Transform(f)})
+}
+
+type DistinctList struct {
+	Argument Expression
+}
+
+func (x DistinctList) Transform(f func(Expression) Expression) Expression {
+	return f(DistinctList{x.Argument.Transform(f)})
+}
+
+type FlattenList struct {
+	Argument Expression
+}
+
+func (x FlattenList) Transform(f func(Expression) Expression) Expression {
+	return f(FlattenList{x.Argument.Transform(f)})
+}
+
+// IndexOf is the index of the first element equal to Value, or -1.
+type IndexOf struct {
+	Value, In Expression
+}
+
+func (x IndexOf) Transform(f func(Expression) Expression) Expression {
+	return f(IndexOf{x.Value.Transform(f), x.In.Transform(f)})
+}
+
+type Range struct {
+	From, To, Step Expression
+}
+
+func (x Range) Transform(f func(Expression) Expression) Expression {
+	return f(Range{x.From.Transform(f), x.To.Transform(f), x.Step.Transform(f)})
+}
+
+// Try evaluates Value, if that fails with a catchable error the result of Catch
+// applied to the error value is returned instead. If Errors is non-empty, only
+// errors of the listed cases are caught. Value must not write to the database.
+type Try struct {
+	Value  Expression
+	Catch  Function // (error)
+	Errors []string
+}
+
+func (x Try) Transform(f func(Expression) Expression) Expression {
+	return f(Try{x.Value.Transform(f), x.Catch, x.Errors})
+}
+
+// OrElse evaluates to its second expression if its first fails with a catchable error.
+// The first must not write to the database.
+type OrElse [2]Expression
+
+func (x OrElse) Transform(f func(Expression) Expression) Expression {
+	return f(OrElse{x[0].Transform(f), x[1].Transform(f)})
+}
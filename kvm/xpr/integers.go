@@ -0,0 +1,117 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package xpr
+
+import (
+	"karma.run/kvm/mdl"
+	"karma.run/kvm/val"
+	"strings"
+)
+
+var IntegerTypes = []string{"int8", "int16", "int32", "int64", "uint8", "uint16", "uint32", "uint64"}
+
+// binary operations available for every integer type, e.g. modInt8
+var integerOperations = []string{"mod", "min", "max", "pow", "shiftLeft", "shiftRight", "bitAnd", "bitOr", "bitXor"}
+
+// operations with an overflow checked variant, e.g. addInt8Checked
+var checkedIntegerOperations = []string{"add", "sub", "mul", "div", "pow", "shiftLeft"}
+
+// IntegerOperation is a binary operation on two integers of the same type.
+// if Checked is set, overflows raise an error instead of wrapping around.
+type IntegerOperation struct {
+	Op      string
+	Type    string
+	Checked bool
+	Left    Expression
+	Right   Expression
+}
+
+func (x IntegerOperation) Transform(f func(Expression) Expression) Expression {
+	return f(IntegerOperation{x.Op, x.Type, x.Checked, x.Left.Transform(f), x.Right.Transform(f)})
+}
+
+// AbsInteger is defined for signed integer types only.
+type AbsInteger struct {
+	Type     string
+	Checked  bool
+	Argument Expression
+}
+
+func (x AbsInteger) Transform(f func(Expression) Expression) Expression {
+	return f(AbsInteger{x.Type, x.Checked, x.Argument.Transform(f)})
+}
+
+// ToIntegerChecked converts a number to Type, failing instead of truncating.
+type ToIntegerChecked struct {
+	Type       string
+	Expression Expression
+}
+
+func (x ToIntegerChecked) Transform(f func(Expression) Expression) Expression {
+	return f(ToIntegerChecked{x.Type, x.Expression.Transform(f)})
+}
+
+func IsSignedIntegerType(t string) bool {
+	return !strings.HasPrefix(t, "uint")
+}
+
+func integerCase(op, t string, checked bool) string {
+	c := op + strings.ToUpper(t[:1]) + t[1:]
+	if checked {
+		c += "Checked"
+	}
+	return c
+}
+
+type integerCaseInfo struct {
+	op, t   string
+	checked bool
+}
+
+// language union case -> integer expression
+var integerCases = func() map[string]integerCaseInfo {
+	cases := make(map[string]integerCaseInfo)
+	add := func(op, t string, checked bool) {
+		cases[integerCase(op, t, checked)] = integerCaseInfo{op, t, checked}
+	}
+	for _, t := range IntegerTypes {
+		for _, op := range integerOperations {
+			add(op, t, false)
+		}
+		for _, op := range checkedIntegerOperations {
+			add(op, t, true)
+		}
+		if IsSignedIntegerType(t) {
+			add("abs", t, false)
+			add("abs", t, true)
+		}
+		add("to", t, true)
+	}
+	return cases
+}()
+
+func addIntegerModels(cases map[string]mdl.Model, expression mdl.Model) {
+	for c, info := range integerCases {
+		switch info.op {
+		case "abs", "to":
+			cases[c] = expression
+		default:
+			cases[c] = mdl.Tuple{expression, expression}
+		}
+	}
+}
+
+func integerExpressionFromValue(u val.Union) (Expression, bool) {
+	info, ok := integerCases[u.Case]
+	if !ok {
+		return nil, false
+	}
+	switch info.op {
+	case "abs":
+		return AbsInteger{info.t, info.checked, ExpressionFromValue(u.Value)}, true
+	case "to":
+		return ToIntegerChecked{info.t, ExpressionFromValue(u.Value)}, true
+	}
+	args := u.Value.(val.Tuple)
+	return IntegerOperation{info.op, info.t, info.checked, ExpressionFromValue(args[0]), ExpressionFromValue(args[1])}, true
+}
@@ -16,6 +16,10 @@ var LanguageModel = mdl.DefineRecursion("function", func(function *mdl.Recursion
 				"null":     mdl.Null{},
 				"bool":     mdl.Bool{},
 				"dateTime": mdl.DateTime{},
+				"duration": mdl.Duration{},
+				"decimal":  mdl.Decimal{},
+				"bytes":    mdl.Bytes{},
+				"blob":     mdl.String{},
 				"string":   mdl.String{},
 				"float":    mdl.Float{},
 				"int8":     mdl.Int8{},
@@ -40,12 +44,16 @@ var LanguageModel = mdl.DefineRecursion("function", func(function *mdl.Recursion
 			})
 		})
 
-		return mdl.UnionFromMap(map[string]mdl.Model{
+		cases := map[string]mdl.Model{
 
 			// convenience primitive constructors
 			"null":     mdl.Null{},
 			"bool":     mdl.Bool{},
 			"dateTime": mdl.DateTime{},
+			"duration": mdl.Duration{},
+			"decimal":  mdl.Decimal{},
+			"bytes":    mdl.Bytes{},
+			"blob":     mdl.String{},
 			"string":   mdl.String{},
 			"float":    mdl.Float{},
 			"int8":     mdl.Int8{},
@@ -83,19 +91,74 @@ var LanguageModel = mdl.DefineRecursion("function", func(function *mdl.Recursion
 			"resolveAllRefs": expression,
 			"reverseList":    expression,
 			"stringToLower":  expression,
+			"stringToUpper":  expression,
+			"trimString":     expression,
+			"parseInt64":     expression,
+			"parseFloat":     expression,
+			"parseDuration":  expression,
+			"toDecimal":      expression,
 			"tag":            expression,
 			"allReferrers":   expression,
 			"tagExists":      expression,
 			"zero":           mdl.EmptyStruct,
 
+			// aggregates
+			"sum":           expression,
+			"avg":           expression,
+			"min":           expression,
+			"max":           expression,
+			"countDistinct": expression,
+
 			"stringContains":  mdl.Tuple{expression, expression},
 			"substringIndex":  mdl.Tuple{expression, expression},
 			"memSortFunction": mdl.Tuple{expression, function},
 
+			// strings
+			"substring":        mdl.Tuple{expression, expression, expression}, // (string, offset, length) in runes
+			"stringReplace":    mdl.Tuple{expression, expression, expression}, // (string, search, replacement)
+			"splitString":      mdl.Tuple{expression, expression},             // (string, separator)
+			"padStringLeft":    mdl.Tuple{expression, expression, expression}, // (string, width, padding)
+			"padStringRight":   mdl.Tuple{expression, expression, expression}, // (string, width, padding)
+			"repeatString":     mdl.Tuple{expression, expression},             // (string, count)
+			"stringStartsWith": mdl.Tuple{expression, expression},
+			"stringEndsWith":   mdl.Tuple{expression, expression},
+
+			// dateTimes
+			"addDuration":  mdl.Tuple{expression, expression}, // (dateTime, duration)
+			"subDuration":  mdl.Tuple{expression, expression}, // (dateTime, duration)
+			"dateTimeDiff": mdl.Tuple{expression, expression}, // first minus second, as duration
+
+			// decimals
+			"addDecimal": mdl.Tuple{expression, expression},
+			"subDecimal": mdl.Tuple{expression, expression},
+			"mulDecimal": mdl.Tuple{expression, expression},
+			"divDecimal": mdl.Tuple{expression, expression}, // rounded half even to at least 16 fractional digits
+			"gtDecimal":  mdl.Tuple{expression, expression},
+			"ltDecimal":  mdl.Tuple{expression, expression},
+
+			// sets
+			"setUnion":        mdl.Tuple{expression, expression},
+			"setIntersection": mdl.Tuple{expression, expression},
+			"setDifference":   mdl.Tuple{expression, expression}, // first without second
+			"isSubset":        mdl.Tuple{expression, expression}, // first is subset of second
+			"listToSet":       expression,
+			"setToList":       expression,
+
+			// maps
+			"mapKeys":    expression,
+			"mapValues":  expression,
+			"mapEntries": expression,
+			"filterMap":  mdl.Tuple{expression, function}, // filter(key, value)
+
 			"leftFoldList":  mdl.Tuple{expression, expression, function}, // (list, initial, reducer)
 			"rightFoldList": mdl.Tuple{expression, expression, function}, // (list, initial, reducer)
-			// "someList":      mdl.Tuple{expression, function},
-			// "everyList":     mdl.Tuple{expression, function},
+			"anyList":       mdl.Tuple{expression, function},             // predicate(index, value)
+			"everyList":     mdl.Tuple{expression, function},             // predicate(index, value)
+			"takeWhileList": mdl.Tuple{expression, function},             // predicate(index, value)
+			"zipLists":      mdl.Tuple{expression, expression},
+			"chunkList":     mdl.Tuple{expression, expression}, // (list, size)
+			"distinctList":  expression,
+			"flattenList":   expression,
 
 			"toFloat":  expression,
 			"toInt8":   expression,
@@ -175,6 +238,7 @@ var LanguageModel = mdl.DefineRecursion("function", func(function *mdl.Recursion
 			"key":         mdl.Tuple{expression, expression},
 
 			"with":    mdl.Tuple{expression, function},
+			"call":    mdl.Tuple{expression, mdl.List{expression}}, // (ref, arguments)
 			"mapSet":  mdl.Tuple{expression, function},
 			"mapList": mdl.Tuple{expression, function},
 			"mapMap":  mdl.Tuple{expression, function},
@@ -190,6 +254,8 @@ var LanguageModel = mdl.DefineRecursion("function", func(function *mdl.Recursion
 			"create":     mdl.Tuple{expression, function},
 			"filterList": mdl.Tuple{expression, function},
 			"memSort":    mdl.Tuple{expression, function},
+			"topN":       mdl.Tuple{expression, expression, function}, // (list, n, key)
+			"groupBy":    mdl.Tuple{expression, function},             // (list, key)
 
 			"createMultiple": mdl.Tuple{expression, mdl.Map{function}},
 			"resolveRefs":    mdl.Tuple{expression, mdl.Set{expression}},
@@ -226,6 +292,46 @@ var LanguageModel = mdl.DefineRecursion("function", func(function *mdl.Recursion
 				"from": expression,
 				"in":   expression,
 			}),
+			"hashJoin": mdl.StructFromMap(map[string]mdl.Model{
+				"left":     expression,
+				"right":    expression,
+				"leftKey":  function,
+				"rightKey": function,
+				"merge":    mdl.Optional{mdl.Bool{}}, // if true then joined structs are merged instead of paired
+			}),
+			"refJoin": mdl.StructFromMap(map[string]mdl.Model{
+				"left":  expression,
+				"in":    expression,
+				"via":   mdl.Enum{"referrers": struct{}{}, "referred": struct{}{}},
+				"merge": mdl.Optional{mdl.Bool{}},
+			}),
+			"lookupEncrypted": mdl.StructFromMap(map[string]mdl.Model{
+				"in":    expression,
+				"path":  mdl.List{mdl.String{}}, // of struct fields to a value annotated "encrypted"
+				"value": expression,
+			}),
+			"inSet": mdl.StructFromMap(map[string]mdl.Model{
+				"value": expression,
+				"in":    expression,
+			}),
+			"mergeMaps": mdl.StructFromMap(map[string]mdl.Model{
+				"left":     expression,
+				"right":    expression,
+				"conflict": mdl.Optional{function}, // (key, left, right), right wins if absent
+			}),
+			"removeKey": mdl.StructFromMap(map[string]mdl.Model{
+				"name": expression,
+				"in":   expression,
+			}),
+			"indexOf": mdl.StructFromMap(map[string]mdl.Model{
+				"value": expression,
+				"in":    expression,
+			}),
+			"range": mdl.StructFromMap(map[string]mdl.Model{
+				"from": expression,
+				"to":   expression,               // exclusive
+				"step": mdl.Optional{expression}, // defaults to 1
+			}),
 			"inList": mdl.StructFromMap(map[string]mdl.Model{
 				"value": expression,
 				"in":    expression,
@@ -236,6 +342,52 @@ var LanguageModel = mdl.DefineRecursion("function", func(function *mdl.Recursion
 				"caseInsensitive": mdl.Bool{},
 				"multiLine":       mdl.Bool{},
 			}),
+			"replaceRegex": mdl.StructFromMap(map[string]mdl.Model{
+				"value":           expression,
+				"regex":           mdl.String{},
+				"caseInsensitive": mdl.Bool{},
+				"multiLine":       mdl.Bool{},
+				"replacement":     expression,
+			}),
+			"normalizeString": mdl.StructFromMap(map[string]mdl.Model{
+				"value": expression,
+				"form":  mdl.Enum{"NFC": struct{}{}, "NFD": struct{}{}, "NFKC": struct{}{}, "NFKD": struct{}{}},
+			}),
+			"roundDecimal": mdl.StructFromMap(map[string]mdl.Model{
+				"value": expression,
+				"scale": expression, // number of fractional digits, may be negative
+				"mode": mdl.Optional{mdl.Enum{
+					"halfEven": struct{}{}, "halfUp": struct{}{}, "halfDown": struct{}{},
+					"up": struct{}{}, "down": struct{}{}, "ceiling": struct{}{}, "floor": struct{}{},
+				}}, // defaults to halfEven
+			}),
+			"truncateDateTime": mdl.StructFromMap(map[string]mdl.Model{
+				"value": expression,
+				"unit": mdl.Enum{
+					"minute": struct{}{}, "hour": struct{}{}, "day": struct{}{},
+					"week": struct{}{}, "month": struct{}{}, "year": struct{}{},
+				},
+				"zone": mdl.Optional{expression}, // IANA zone name, defaults to UTC
+			}),
+			"extractDateTime": mdl.StructFromMap(map[string]mdl.Model{
+				"value": expression,
+				"component": mdl.Enum{
+					"year": struct{}{}, "month": struct{}{}, "day": struct{}{},
+					"hour": struct{}{}, "minute": struct{}{}, "second": struct{}{},
+					"weekday": struct{}{}, "yearDay": struct{}{},
+				},
+				"zone": mdl.Optional{expression},
+			}),
+			"formatDateTime": mdl.StructFromMap(map[string]mdl.Model{
+				"value":  expression,
+				"layout": expression, // Go reference time layout, e.g. "2006-01-02"
+				"zone":   mdl.Optional{expression},
+			}),
+			"parseDateTime": mdl.StructFromMap(map[string]mdl.Model{
+				"value":  expression,
+				"layout": expression,
+				"zone":   mdl.Optional{expression},
+			}),
 			"searchRegex": mdl.StructFromMap(map[string]mdl.Model{
 				"value":           expression,
 				"regex":           mdl.String{},
@@ -281,6 +433,13 @@ var LanguageModel = mdl.DefineRecursion("function", func(function *mdl.Recursion
 				"else":      expression,
 			}),
 
+			"try": mdl.StructFromMap(map[string]mdl.Model{
+				"value":  expression,
+				"catch":  function,                             // (error)
+				"errors": mdl.Optional{mdl.List{mdl.String{}}}, // error cases to catch, all if absent
+			}),
+			"orElse": mdl.Tuple{expression, expression}, // (value, default)
+
 			"assertCase": mdl.StructFromMap(map[string]mdl.Model{
 				"case":  mdl.String{},
 				"value": expression,
@@ -299,7 +458,12 @@ var LanguageModel = mdl.DefineRecursion("function", func(function *mdl.Recursion
 				"strings":   expression,
 				"separator": expression,
 			}),
-		})
+		}
+
+		// modInt8, bitAndUint16, addInt64Checked, toInt32Checked etc.
+		addIntegerModels(cases, expression)
+
+		return mdl.UnionFromMap(cases)
 	})
 
 	arguments := mdl.List{mdl.String{}}
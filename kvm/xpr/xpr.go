@@ -58,6 +58,10 @@ func ExpressionFromValue(v val.Value) Expression {
 	case "null", // convenience primitive constructors
 		"bool",
 		"dateTime",
+		"duration",
+		"decimal",
+		"bytes",
+		"blob",
 		"string",
 		"float",
 		"int8",
@@ -120,6 +124,70 @@ func ExpressionFromValue(v val.Value) Expression {
 		args := u.Value.(val.Tuple)
 		return SubstringIndex{ExpressionFromValue(args[0]), ExpressionFromValue(args[1])}
 
+	case "substring":
+		args := u.Value.(val.Tuple)
+		return Substring{ExpressionFromValue(args[0]), ExpressionFromValue(args[1]), ExpressionFromValue(args[2])}
+
+	case "stringReplace":
+		args := u.Value.(val.Tuple)
+		return StringReplace{ExpressionFromValue(args[0]), ExpressionFromValue(args[1]), ExpressionFromValue(args[2])}
+
+	case "splitString":
+		args := u.Value.(val.Tuple)
+		return SplitString{ExpressionFromValue(args[0]), ExpressionFromValue(args[1])}
+
+	case "padStringLeft", "padStringRight":
+		args := u.Value.(val.Tuple)
+		return PadString{ExpressionFromValue(args[0]), ExpressionFromValue(args[1]), ExpressionFromValue(args[2]), u.Case == "padStringLeft"}
+
+	case "repeatString":
+		args := u.Value.(val.Tuple)
+		return RepeatString{ExpressionFromValue(args[0]), ExpressionFromValue(args[1])}
+
+	case "stringStartsWith":
+		args := u.Value.(val.Tuple)
+		return StringStartsWith{ExpressionFromValue(args[0]), ExpressionFromValue(args[1])}
+
+	case "stringEndsWith":
+		args := u.Value.(val.Tuple)
+		return StringEndsWith{ExpressionFromValue(args[0]), ExpressionFromValue(args[1])}
+
+	case "addDuration":
+		args := u.Value.(val.Tuple)
+		return AddDuration{ExpressionFromValue(args[0]), ExpressionFromValue(args[1])}
+
+	case "subDuration":
+		args := u.Value.(val.Tuple)
+		return SubDuration{ExpressionFromValue(args[0]), ExpressionFromValue(args[1])}
+
+	case "dateTimeDiff":
+		args := u.Value.(val.Tuple)
+		return DateTimeDiff{ExpressionFromValue(args[0]), ExpressionFromValue(args[1])}
+
+	case "addDecimal":
+		args := u.Value.(val.Tuple)
+		return AddDecimal{ExpressionFromValue(args[0]), ExpressionFromValue(args[1])}
+
+	case "subDecimal":
+		args := u.Value.(val.Tuple)
+		return SubDecimal{ExpressionFromValue(args[0]), ExpressionFromValue(args[1])}
+
+	case "mulDecimal":
+		args := u.Value.(val.Tuple)
+		return MulDecimal{ExpressionFromValue(args[0]), ExpressionFromValue(args[1])}
+
+	case "divDecimal":
+		args := u.Value.(val.Tuple)
+		return DivDecimal{ExpressionFromValue(args[0]), ExpressionFromValue(args[1])}
+
+	case "gtDecimal":
+		args := u.Value.(val.Tuple)
+		return GtDecimal{ExpressionFromValue(args[0]), ExpressionFromValue(args[1])}
+
+	case "ltDecimal":
+		args := u.Value.(val.Tuple)
+		return LtDecimal{ExpressionFromValue(args[0]), ExpressionFromValue(args[1])}
+
 	case "memSortFunction":
 		args := u.Value.(val.Tuple)
 		return MemSortFunction{ExpressionFromValue(args[0]), FunctionFromValue(args[1])}
@@ -475,9 +543,42 @@ func ExpressionFromValue(v val.Value) Expression {
 	case "stringToLower":
 		return StringToLower{ExpressionFromValue(u.Value)}
 
+	case "stringToUpper":
+		return StringToUpper{ExpressionFromValue(u.Value)}
+
+	case "trimString":
+		return TrimString{ExpressionFromValue(u.Value)}
+
+	case "parseInt64":
+		return ParseInt64{ExpressionFromValue(u.Value)}
+
+	case "parseFloat":
+		return ParseFloat{ExpressionFromValue(u.Value)}
+
+	case "parseDuration":
+		return ParseDuration{ExpressionFromValue(u.Value)}
+
+	case "toDecimal":
+		return ToDecimal{ExpressionFromValue(u.Value)}
+
 	case "reverseList":
 		return ReverseList{ExpressionFromValue(u.Value)}
 
+	case "sum":
+		return Sum{ExpressionFromValue(u.Value)}
+
+	case "avg":
+		return Avg{ExpressionFromValue(u.Value)}
+
+	case "min":
+		return Min{ExpressionFromValue(u.Value)}
+
+	case "max":
+		return Max{ExpressionFromValue(u.Value)}
+
+	case "countDistinct":
+		return CountDistinct{ExpressionFromValue(u.Value)}
+
 	case "tagExists":
 		return TagExists{ExpressionFromValue(u.Value)}
 
@@ -530,6 +631,30 @@ func ExpressionFromValue(v val.Value) Expression {
 		arg := u.Value.(val.Tuple)
 		return With{ExpressionFromValue(arg[0]), FunctionFromValue(arg[1])}
 
+	case "try":
+		arg := u.Value.(val.Struct)
+		try := Try{Value: ExpressionFromValue(arg.Field("value")), Catch: FunctionFromValue(arg.Field("catch"))}
+		if ers, ok := arg.Field("errors").(val.List); ok {
+			try.Errors = make([]string, len(ers), len(ers))
+			for i, er := range ers {
+				try.Errors[i] = string(er.(val.String))
+			}
+		}
+		return try
+
+	case "orElse":
+		arg := u.Value.(val.Tuple)
+		return OrElse{ExpressionFromValue(arg[0]), ExpressionFromValue(arg[1])}
+
+	case "call":
+		arg := u.Value.(val.Tuple)
+		list := arg[1].(val.List)
+		args := make([]Expression, len(list), len(list))
+		for i, sub := range list {
+			args[i] = ExpressionFromValue(sub)
+		}
+		return Call{ExpressionFromValue(arg[0]), args}
+
 	case "update":
 		arg := u.Value.(val.Struct)
 		return Update{ExpressionFromValue(arg.Field("ref")), ExpressionFromValue(arg.Field("value"))}
@@ -618,10 +743,131 @@ func ExpressionFromValue(v val.Value) Expression {
 		arg := u.Value.(val.Struct)
 		return Referrers{ExpressionFromValue(arg.Field("of")), ExpressionFromValue(arg.Field("in"))}
 
+	case "hashJoin":
+		arg := u.Value.(val.Struct)
+		return HashJoin{
+			Left:     ExpressionFromValue(arg.Field("left")),
+			Right:    ExpressionFromValue(arg.Field("right")),
+			LeftKey:  FunctionFromValue(arg.Field("leftKey")),
+			RightKey: FunctionFromValue(arg.Field("rightKey")),
+			Merge:    arg.Field("merge") == val.Bool(true),
+		}
+
+	case "refJoin":
+		arg := u.Value.(val.Struct)
+		return RefJoin{
+			Left:  ExpressionFromValue(arg.Field("left")),
+			In:    ExpressionFromValue(arg.Field("in")),
+			Via:   string(arg.Field("via").(val.Symbol)),
+			Merge: arg.Field("merge") == val.Bool(true),
+		}
+
+	case "lookupEncrypted":
+		arg := u.Value.(val.Struct)
+		path := arg.Field("path").(val.List)
+		x := LookupEncrypted{
+			In:    ExpressionFromValue(arg.Field("in")),
+			Path:  make([]string, len(path)),
+			Value: ExpressionFromValue(arg.Field("value")),
+		}
+		for i, f := range path {
+			x.Path[i] = string(f.(val.String))
+		}
+		return x
+
 	case "inList":
 		arg := u.Value.(val.Struct)
 		return InList{ExpressionFromValue(arg.Field("value")), ExpressionFromValue(arg.Field("in"))}
 
+	case "anyList":
+		arg := u.Value.(val.Tuple)
+		return AnyList{ExpressionFromValue(arg[0]), FunctionFromValue(arg[1])}
+
+	case "everyList":
+		arg := u.Value.(val.Tuple)
+		return EveryList{ExpressionFromValue(arg[0]), FunctionFromValue(arg[1])}
+
+	case "takeWhileList":
+		arg := u.Value.(val.Tuple)
+		return TakeWhileList{ExpressionFromValue(arg[0]), FunctionFromValue(arg[1])}
+
+	case "zipLists":
+		arg := u.Value.(val.Tuple)
+		return ZipLists{ExpressionFromValue(arg[0]), ExpressionFromValue(arg[1])}
+
+	case "chunkList":
+		arg := u.Value.(val.Tuple)
+		return ChunkList{ExpressionFromValue(arg[0]), ExpressionFromValue(arg[1])}
+
+	case "distinctList":
+		return DistinctList{ExpressionFromValue(u.Value)}
+
+	case "flattenList":
+		return FlattenList{ExpressionFromValue(u.Value)}
+
+	case "indexOf":
+		arg := u.Value.(val.Struct)
+		return IndexOf{ExpressionFromValue(arg.Field("value")), ExpressionFromValue(arg.Field("in"))}
+
+	case "range":
+		arg := u.Value.(val.Struct)
+		step := Expression(Literal{val.Int64(1)})
+		if arg.Field("step") != val.Null {
+			step = ExpressionFromValue(arg.Field("step"))
+		}
+		return Range{ExpressionFromValue(arg.Field("from")), ExpressionFromValue(arg.Field("to")), step}
+
+	case "inSet":
+		arg := u.Value.(val.Struct)
+		return InSet{ExpressionFromValue(arg.Field("value")), ExpressionFromValue(arg.Field("in"))}
+
+	case "setUnion":
+		arg := u.Value.(val.Tuple)
+		return SetUnion{ExpressionFromValue(arg[0]), ExpressionFromValue(arg[1])}
+
+	case "setIntersection":
+		arg := u.Value.(val.Tuple)
+		return SetIntersection{ExpressionFromValue(arg[0]), ExpressionFromValue(arg[1])}
+
+	case "setDifference":
+		arg := u.Value.(val.Tuple)
+		return SetDifference{ExpressionFromValue(arg[0]), ExpressionFromValue(arg[1])}
+
+	case "isSubset":
+		arg := u.Value.(val.Tuple)
+		return IsSubset{ExpressionFromValue(arg[0]), ExpressionFromValue(arg[1])}
+
+	case "listToSet":
+		return ListToSet{ExpressionFromValue(u.Value)}
+
+	case "setToList":
+		return SetToList{ExpressionFromValue(u.Value)}
+
+	case "mapKeys":
+		return MapKeys{ExpressionFromValue(u.Value)}
+
+	case "mapValues":
+		return MapValues{ExpressionFromValue(u.Value)}
+
+	case "mapEntries":
+		return MapEntries{ExpressionFromValue(u.Value)}
+
+	case "mergeMaps":
+		arg := u.Value.(val.Struct)
+		merge := MergeMaps{Left: ExpressionFromValue(arg.Field("left")), Right: ExpressionFromValue(arg.Field("right"))}
+		if conflict := arg.Field("conflict"); conflict != val.Null {
+			merge.Conflict = FunctionFromValue(conflict)
+		}
+		return merge
+
+	case "filterMap":
+		arg := u.Value.(val.Tuple)
+		return FilterMap{ExpressionFromValue(arg[0]), FunctionFromValue(arg[1])}
+
+	case "removeKey":
+		arg := u.Value.(val.Struct)
+		return RemoveKey{ExpressionFromValue(arg.Field("name")), ExpressionFromValue(arg.Field("in"))}
+
 	case "filterList":
 		arg := u.Value.(val.Tuple)
 		return FilterList{ExpressionFromValue(arg[0]), FunctionFromValue(arg[1])}
@@ -730,6 +976,67 @@ func ExpressionFromValue(v val.Value) Expression {
 			bool(arg.Field("caseInsensitive").(val.Bool)),
 		}
 
+	case "replaceRegex":
+		arg := u.Value.(val.Struct)
+		return ReplaceRegex{
+			ExpressionFromValue(arg.Field("value")),
+			string(arg.Field("regex").(val.String)),
+			bool(arg.Field("multiLine").(val.Bool)),
+			bool(arg.Field("caseInsensitive").(val.Bool)),
+			ExpressionFromValue(arg.Field("replacement")),
+		}
+
+	case "normalizeString":
+		arg := u.Value.(val.Struct)
+		return NormalizeString{
+			ExpressionFromValue(arg.Field("value")),
+			string(arg.Field("form").(val.Symbol)),
+		}
+
+	case "roundDecimal":
+		arg := u.Value.(val.Struct)
+		mode := "halfEven"
+		if m := arg.Field("mode"); m != val.Null {
+			mode = string(m.(val.Symbol))
+		}
+		return RoundDecimal{
+			ExpressionFromValue(arg.Field("value")),
+			ExpressionFromValue(arg.Field("scale")),
+			mode,
+		}
+
+	case "truncateDateTime":
+		arg := u.Value.(val.Struct)
+		return TruncateDateTime{
+			ExpressionFromValue(arg.Field("value")),
+			string(arg.Field("unit").(val.Symbol)),
+			zoneExpressionFromValue(arg.Field("zone")),
+		}
+
+	case "extractDateTime":
+		arg := u.Value.(val.Struct)
+		return ExtractDateTime{
+			ExpressionFromValue(arg.Field("value")),
+			string(arg.Field("component").(val.Symbol)),
+			zoneExpressionFromValue(arg.Field("zone")),
+		}
+
+	case "formatDateTime":
+		arg := u.Value.(val.Struct)
+		return FormatDateTime{
+			ExpressionFromValue(arg.Field("value")),
+			ExpressionFromValue(arg.Field("layout")),
+			zoneExpressionFromValue(arg.Field("zone")),
+		}
+
+	case "parseDateTime":
+		arg := u.Value.(val.Struct)
+		return ParseDateTime{
+			ExpressionFromValue(arg.Field("value")),
+			ExpressionFromValue(arg.Field("layout")),
+			zoneExpressionFromValue(arg.Field("zone")),
+		}
+
 	case "switchModelRef":
 		arg := u.Value.(val.Struct)
 		css := arg.Field("cases").(val.Set)
@@ -786,6 +1093,13 @@ func ExpressionFromValue(v val.Value) Expression {
 			Cases: cases,
 		}
 
+	case "groupBy":
+		arg := u.Value.(val.Tuple)
+		return GroupBy{
+			Value: ExpressionFromValue(arg[0]),
+			Key:   FunctionFromValue(arg[1]),
+		}
+
 	case "memSort":
 		arg := u.Value.(val.Tuple)
 		return MemSort{
@@ -793,6 +1107,14 @@ func ExpressionFromValue(v val.Value) Expression {
 			Order: FunctionFromValue(arg[1]),
 		}
 
+	case "topN":
+		arg := u.Value.(val.Tuple)
+		return TopN{
+			Value: ExpressionFromValue(arg[0]),
+			N:     ExpressionFromValue(arg[1]),
+			Key:   FunctionFromValue(arg[2]),
+		}
+
 	case "leftFoldList":
 		arg := u.Value.(val.Tuple)
 		return LeftFoldList{
@@ -809,12 +1131,23 @@ func ExpressionFromValue(v val.Value) Expression {
 		}
 
 	default:
+		if x, ok := integerExpressionFromValue(u); ok {
+			return x
+		}
 		panic(fmt.Sprintf("unhandled expression: %s", u.Case))
 
 	}
 
 }
 
+// zone arguments of dateTime expressions are optional and default to UTC
+func zoneExpressionFromValue(v val.Value) Expression {
+	if v == val.Null {
+		return Literal{val.String("UTC")}
+	}
+	return ExpressionFromValue(v)
+}
+
 func DataExpressionFromValue(v val.Value) Expression {
 
 	switch u := v.(val.Union); u.Case {
@@ -831,6 +1164,18 @@ func DataExpressionFromValue(v val.Value) Expression {
 	case "dateTime":
 		return Literal{u.Value}
 
+	case "duration":
+		return Literal{u.Value}
+
+	case "decimal":
+		return Literal{u.Value}
+
+	case "bytes":
+		return Literal{u.Value}
+
+	case "blob":
+		return Literal{val.Blob(u.Value.(val.String))}
+
 	case "string":
 		return Literal{u.Value}
 
@@ -1342,9 +1687,192 @@ func ValueFromExpression(x Expression) val.Value {
 	case StringToLower:
 		return val.Union{"stringToLower", ValueFromExpression(node.Argument)}
 
+	case StringToUpper:
+		return val.Union{"stringToUpper", ValueFromExpression(node.Argument)}
+
+	case TrimString:
+		return val.Union{"trimString", ValueFromExpression(node.Argument)}
+
+	case ParseInt64:
+		return val.Union{"parseInt64", ValueFromExpression(node.Argument)}
+
+	case ParseFloat:
+		return val.Union{"parseFloat", ValueFromExpression(node.Argument)}
+
+	case ParseDuration:
+		return val.Union{"parseDuration", ValueFromExpression(node.Argument)}
+
+	case ToDecimal:
+		return val.Union{"toDecimal", ValueFromExpression(node.Expression)}
+
+	case AddDecimal:
+		return val.Union{"addDecimal", val.Tuple{ValueFromExpression(node[0]), ValueFromExpression(node[1])}}
+
+	case SubDecimal:
+		return val.Union{"subDecimal", val.Tuple{ValueFromExpression(node[0]), ValueFromExpression(node[1])}}
+
+	case MulDecimal:
+		return val.Union{"mulDecimal", val.Tuple{ValueFromExpression(node[0]), ValueFromExpression(node[1])}}
+
+	case DivDecimal:
+		return val.Union{"divDecimal", val.Tuple{ValueFromExpression(node[0]), ValueFromExpression(node[1])}}
+
+	case GtDecimal:
+		return val.Union{"gtDecimal", val.Tuple{ValueFromExpression(node[0]), ValueFromExpression(node[1])}}
+
+	case LtDecimal:
+		return val.Union{"ltDecimal", val.Tuple{ValueFromExpression(node[0]), ValueFromExpression(node[1])}}
+
+	case RoundDecimal:
+		return val.Union{"roundDecimal", val.StructFromMap(map[string]val.Value{
+			"value": ValueFromExpression(node.Value),
+			"scale": ValueFromExpression(node.Scale),
+			"mode":  val.Symbol(node.Mode),
+		})}
+
+	case IntegerOperation:
+		return val.Union{integerCase(node.Op, node.Type, node.Checked), val.Tuple{
+			ValueFromExpression(node.Left),
+			ValueFromExpression(node.Right),
+		}}
+
+	case AbsInteger:
+		return val.Union{integerCase("abs", node.Type, node.Checked), ValueFromExpression(node.Argument)}
+
+	case ToIntegerChecked:
+		return val.Union{integerCase("to", node.Type, true), ValueFromExpression(node.Expression)}
+
+	case AddDuration:
+		return val.Union{"addDuration", val.Tuple{
+			ValueFromExpression(node.DateTime),
+			ValueFromExpression(node.Duration),
+		}}
+
+	case SubDuration:
+		return val.Union{"subDuration", val.Tuple{
+			ValueFromExpression(node.DateTime),
+			ValueFromExpression(node.Duration),
+		}}
+
+	case DateTimeDiff:
+		return val.Union{"dateTimeDiff", val.Tuple{
+			ValueFromExpression(node[0]),
+			ValueFromExpression(node[1]),
+		}}
+
+	case TruncateDateTime:
+		return val.Union{"truncateDateTime", val.StructFromMap(map[string]val.Value{
+			"value": ValueFromExpression(node.Value),
+			"unit":  val.Symbol(node.Unit),
+			"zone":  ValueFromExpression(node.Zone),
+		})}
+
+	case ExtractDateTime:
+		return val.Union{"extractDateTime", val.StructFromMap(map[string]val.Value{
+			"value":     ValueFromExpression(node.Value),
+			"component": val.Symbol(node.Component),
+			"zone":      ValueFromExpression(node.Zone),
+		})}
+
+	case FormatDateTime:
+		return val.Union{"formatDateTime", val.StructFromMap(map[string]val.Value{
+			"value":  ValueFromExpression(node.Value),
+			"layout": ValueFromExpression(node.Layout),
+			"zone":   ValueFromExpression(node.Zone),
+		})}
+
+	case ParseDateTime:
+		return val.Union{"parseDateTime", val.StructFromMap(map[string]val.Value{
+			"value":  ValueFromExpression(node.Value),
+			"layout": ValueFromExpression(node.Layout),
+			"zone":   ValueFromExpression(node.Zone),
+		})}
+
+	case Substring:
+		return val.Union{"substring", val.Tuple{
+			ValueFromExpression(node.String),
+			ValueFromExpression(node.Offset),
+			ValueFromExpression(node.Length),
+		}}
+
+	case StringReplace:
+		return val.Union{"stringReplace", val.Tuple{
+			ValueFromExpression(node.String),
+			ValueFromExpression(node.Search),
+			ValueFromExpression(node.Replacement),
+		}}
+
+	case SplitString:
+		return val.Union{"splitString", val.Tuple{
+			ValueFromExpression(node.String),
+			ValueFromExpression(node.Separator),
+		}}
+
+	case PadString:
+		caze := "padStringRight"
+		if node.Left {
+			caze = "padStringLeft"
+		}
+		return val.Union{caze, val.Tuple{
+			ValueFromExpression(node.String),
+			ValueFromExpression(node.Width),
+			ValueFromExpression(node.Padding),
+		}}
+
+	case RepeatString:
+		return val.Union{"repeatString", val.Tuple{
+			ValueFromExpression(node.String),
+			ValueFromExpression(node.Count),
+		}}
+
+	case StringStartsWith:
+		return val.Union{"stringStartsWith", val.Tuple{
+			ValueFromExpression(node.String),
+			ValueFromExpression(node.Prefix),
+		}}
+
+	case StringEndsWith:
+		return val.Union{"stringEndsWith", val.Tuple{
+			ValueFromExpression(node.String),
+			ValueFromExpression(node.Suffix),
+		}}
+
+	case ReplaceRegex:
+		arg := val.NewStruct(5)
+		arg.Set("value", ValueFromExpression(node.Value))
+		arg.Set("regex", val.String(node.Regex))
+		arg.Set("multiLine", val.Bool(node.MultiLine))
+		arg.Set("caseInsensitive", val.Bool(node.CaseInsensitive))
+		arg.Set("replacement", ValueFromExpression(node.Replacement))
+		return val.Union{"replaceRegex", arg}
+
+	case NormalizeString:
+		return val.Union{"normalizeString", val.StructFromMap(map[string]val.Value{
+			"value": ValueFromExpression(node.Value),
+			"form":  val.Symbol(node.Form),
+		})}
+
 	case ReverseList:
 		return val.Union{"reverseList", ValueFromExpression(node.Argument)}
 
+	case Sum:
+		return val.Union{"sum", ValueFromExpression(node.Argument)}
+
+	case Avg:
+		return val.Union{"avg", ValueFromExpression(node.Argument)}
+
+	case Min:
+		return val.Union{"min", ValueFromExpression(node.Argument)}
+
+	case Max:
+		return val.Union{"max", ValueFromExpression(node.Argument)}
+
+	case CountDistinct:
+		return val.Union{"countDistinct", ValueFromExpression(node.Argument)}
+
+	case GroupBy:
+		return val.Union{"groupBy", val.Tuple{ValueFromExpression(node.Value), ValueFromFunction(node.Key)}}
+
 	case ExtractStrings:
 		return val.Union{"extractStrings", ValueFromExpression(node.Argument)}
 
@@ -1388,6 +1916,30 @@ func ValueFromExpression(x Expression) val.Value {
 			ValueFromFunction(node.Return),
 		}}
 
+	case Try:
+		arg := val.StructFromMap(map[string]val.Value{
+			"value": ValueFromExpression(node.Value),
+			"catch": ValueFromFunction(node.Catch),
+		})
+		if len(node.Errors) > 0 {
+			ers := make(val.List, len(node.Errors), len(node.Errors))
+			for i, er := range node.Errors {
+				ers[i] = val.String(er)
+			}
+			arg.Set("errors", ers)
+		}
+		return val.Union{"try", arg}
+
+	case OrElse:
+		return val.Union{"orElse", val.Tuple{ValueFromExpression(node[0]), ValueFromExpression(node[1])}}
+
+	case Call:
+		args := make(val.List, len(node.Arguments), len(node.Arguments))
+		for i, sub := range node.Arguments {
+			args[i] = ValueFromExpression(sub)
+		}
+		return val.Union{"call", val.Tuple{ValueFromExpression(node.Function), args}}
+
 	case Update:
 		return val.Union{"update", val.StructFromMap(map[string]val.Value{
 			"ref":   ValueFromExpression(node.Ref),
@@ -1406,6 +1958,92 @@ func ValueFromExpression(x Expression) val.Value {
 	case FilterList:
 		return val.Union{"filterList", val.Tuple{ValueFromExpression(node.Value), ValueFromFunction(node.Filter)}}
 
+	case AnyList:
+		return val.Union{"anyList", val.Tuple{ValueFromExpression(node.Value), ValueFromFunction(node.Predicate)}}
+
+	case EveryList:
+		return val.Union{"everyList", val.Tuple{ValueFromExpression(node.Value), ValueFromFunction(node.Predicate)}}
+
+	case TakeWhileList:
+		return val.Union{"takeWhileList", val.Tuple{ValueFromExpression(node.Value), ValueFromFunction(node.Predicate)}}
+
+	case ZipLists:
+		return val.Union{"zipLists", val.Tuple{ValueFromExpression(node[0]), ValueFromExpression(node[1])}}
+
+	case ChunkList:
+		return val.Union{"chunkList", val.Tuple{ValueFromExpression(node.Value), ValueFromExpression(node.Size)}}
+
+	case DistinctList:
+		return val.Union{"distinctList", ValueFromExpression(node.Argument)}
+
+	case FlattenList:
+		return val.Union{"flattenList", ValueFromExpression(node.Argument)}
+
+	case IndexOf:
+		return val.Union{"indexOf", val.StructFromMap(map[string]val.Value{
+			"in":    ValueFromExpression(node.In),
+			"value": ValueFromExpression(node.Value),
+		})}
+
+	case Range:
+		return val.Union{"range", val.StructFromMap(map[string]val.Value{
+			"from": ValueFromExpression(node.From),
+			"to":   ValueFromExpression(node.To),
+			"step": ValueFromExpression(node.Step),
+		})}
+
+	case InSet:
+		return val.Union{"inSet", val.StructFromMap(map[string]val.Value{
+			"in":    ValueFromExpression(node.In),
+			"value": ValueFromExpression(node.Value),
+		})}
+
+	case SetUnion:
+		return val.Union{"setUnion", val.Tuple{ValueFromExpression(node[0]), ValueFromExpression(node[1])}}
+
+	case SetIntersection:
+		return val.Union{"setIntersection", val.Tuple{ValueFromExpression(node[0]), ValueFromExpression(node[1])}}
+
+	case SetDifference:
+		return val.Union{"setDifference", val.Tuple{ValueFromExpression(node[0]), ValueFromExpression(node[1])}}
+
+	case IsSubset:
+		return val.Union{"isSubset", val.Tuple{ValueFromExpression(node[0]), ValueFromExpression(node[1])}}
+
+	case ListToSet:
+		return val.Union{"listToSet", ValueFromExpression(node.Argument)}
+
+	case SetToList:
+		return val.Union{"setToList", ValueFromExpression(node.Argument)}
+
+	case MapKeys:
+		return val.Union{"mapKeys", ValueFromExpression(node.Argument)}
+
+	case MapValues:
+		return val.Union{"mapValues", ValueFromExpression(node.Argument)}
+
+	case MapEntries:
+		return val.Union{"mapEntries", ValueFromExpression(node.Argument)}
+
+	case MergeMaps:
+		arg := val.StructFromMap(map[string]val.Value{
+			"left":  ValueFromExpression(node.Left),
+			"right": ValueFromExpression(node.Right),
+		})
+		if node.Conflict != nil {
+			arg.Set("conflict", ValueFromFunction(node.Conflict))
+		}
+		return val.Union{"mergeMaps", arg}
+
+	case FilterMap:
+		return val.Union{"filterMap", val.Tuple{ValueFromExpression(node.Value), ValueFromFunction(node.Filter)}}
+
+	case RemoveKey:
+		return val.Union{"removeKey", val.StructFromMap(map[string]val.Value{
+			"name": ValueFromExpression(node.Name),
+			"in":   ValueFromExpression(node.In),
+		})}
+
 	case AssertCase:
 		return val.Union{"assertCase", val.StructFromMap(map[string]val.Value{
 			"case":  val.String(node.Case),
@@ -1487,6 +2125,34 @@ func ValueFromExpression(x Expression) val.Value {
 			"in": ValueFromExpression(node.In),
 		})}
 
+	case HashJoin:
+		return val.Union{"hashJoin", val.StructFromMap(map[string]val.Value{
+			"left":     ValueFromExpression(node.Left),
+			"right":    ValueFromExpression(node.Right),
+			"leftKey":  ValueFromFunction(node.LeftKey),
+			"rightKey": ValueFromFunction(node.RightKey),
+			"merge":    val.Bool(node.Merge),
+		})}
+
+	case RefJoin:
+		return val.Union{"refJoin", val.StructFromMap(map[string]val.Value{
+			"left":  ValueFromExpression(node.Left),
+			"in":    ValueFromExpression(node.In),
+			"via":   val.Symbol(node.Via),
+			"merge": val.Bool(node.Merge),
+		})}
+
+	case LookupEncrypted:
+		path := make(val.List, len(node.Path))
+		for i, f := range node.Path {
+			path[i] = val.String(f)
+		}
+		return val.Union{"lookupEncrypted", val.StructFromMap(map[string]val.Value{
+			"in":    ValueFromExpression(node.In),
+			"path":  path,
+			"value": ValueFromExpression(node.Value),
+		})}
+
 	case After:
 		return val.Union{"after", val.Tuple{
 			ValueFromExpression(node[0]),
@@ -1615,10 +2281,10 @@ func ValueFromExpression(x Expression) val.Value {
 		return val.Union{"switchCase", val.Tuple{ValueFromExpression(node.Value), cases}}
 
 	case MemSort:
-		return val.Union{"memSort", val.StructFromMap(map[string]val.Value{
-			"value":      ValueFromExpression(node.Value),
-			"expression": ValueFromFunction(node.Order),
-		})}
+		return val.Union{"memSort", val.Tuple{ValueFromExpression(node.Value), ValueFromFunction(node.Order)}}
+
+	case TopN:
+		return val.Union{"topN", val.Tuple{ValueFromExpression(node.Value), ValueFromExpression(node.N), ValueFromFunction(node.Key)}}
 
 	case ConcatLists:
 		return val.Union{"concatLists", val.Tuple{
@@ -1667,6 +2333,14 @@ func ValueFromExpression(x Expression) val.Value {
 	panic(fmt.Sprintf("unhandled case: %T", x))
 }
 
+// data refs are plain string tuples in LanguageModel, see DataExpressionFromValue
+func refComponentValue(x Expression) val.Value {
+	if node, ok := x.(TypedExpression); ok {
+		return refComponentValue(node.Expression)
+	}
+	return x.(Literal).Value
+}
+
 func DataValueFromExpression(x Expression) val.Value {
 
 	switch node := x.(type) {
@@ -1675,7 +2349,7 @@ func DataValueFromExpression(x Expression) val.Value {
 
 	case NewRef:
 		arg := make(val.Tuple, 2, 2)
-		arg[0], arg[1] = DataValueFromExpression(node.Model), DataValueFromExpression(node.Id)
+		arg[0], arg[1] = refComponentValue(node.Model), refComponentValue(node.Id)
 		return val.Union{"ref", arg}
 
 	case NewStruct:
@@ -1784,6 +2458,18 @@ func DataValueFromExpression(x Expression) val.Value {
 		case val.DateTime:
 			return val.Union{"dateTime", v}
 
+		case val.Duration:
+			return val.Union{"duration", v}
+
+		case val.Decimal:
+			return val.Union{"decimal", v}
+
+		case val.Bytes:
+			return val.Union{"bytes", v}
+
+		case val.Blob:
+			return val.Union{"blob", val.String(v)}
+
 		case val.Symbol:
 			return val.Union{"symbol", val.String(v)}
 
@@ -8,7 +8,6 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"flag"
-	bolt "github.com/coreos/bbolt"
 	"golang.org/x/crypto/acme/autocert"
 	"karma.run/api"
 	_ "karma.run/codec/binary"
@@ -16,6 +15,7 @@ import (
 	"karma.run/config"
 	"karma.run/db"
 	"karma.run/kvm"
+	"karma.run/store"
 	"log"
 	"net/http"
 	"strings"
@@ -44,6 +44,17 @@ func main() {
 		}
 	}
 
+	if e := kvm.LoadRoleLimits(config.RoleLimits); e != nil {
+		log.Fatalln("failed parsing --role-limits:", e)
+	}
+
+	kvm.LoadPlaintextRoles(config.PlaintextRoles)
+	kvm.LoadBlobUploadRoles(config.BlobUploadRoles)
+
+	if e := db.LoadDataKeys(); e != nil {
+		log.Fatalln("failed loading --data-key-file:", e)
+	}
+
 	{ // init database if necessary
 
 		db, e := db.Open()
@@ -51,7 +62,7 @@ func main() {
 			log.Fatalln(e)
 		}
 		rootBytes := []byte(`root`)
-		e = db.Update(func(tx *bolt.Tx) error {
+		e = db.Update(func(tx store.Tx) error {
 			if tx.Bucket(rootBytes) != nil {
 				log.Println("data file already initialized")
 				return nil
@@ -67,6 +78,12 @@ func main() {
 		if e != nil {
 			log.Fatalln(e)
 		}
+		if e := kvm.CheckDataKeys(db); e != nil {
+			log.Fatalln("failed checking --data-key-file:", e)
+		}
+		if e := api.CheckBlobDataKeys(db); e != nil {
+			log.Fatalln("failed checking --data-key-file:", e)
+		}
 	}
 
 	log.Println("starting karma.run...")
@@ -0,0 +1,260 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package store
+
+import (
+	bolt "github.com/coreos/bbolt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// NewBolt returns db as DB. Its transactions implement io.WriterTo, writing
+// a compacted copy of the data file.
+func NewBolt(db *bolt.DB) DB {
+	return boltDB{db}
+}
+
+type boltDB struct {
+	db *bolt.DB
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+type boltBucket struct {
+	bk *bolt.Bucket
+}
+
+// boltError returns the error of this package that bolt's e corresponds to.
+func boltError(e error) error {
+	switch e {
+	case bolt.ErrDatabaseNotOpen:
+		return ErrDatabaseNotOpen
+	case bolt.ErrTxNotWritable:
+		return ErrTxNotWritable
+	case bolt.ErrTxClosed:
+		return ErrTxClosed
+	case bolt.ErrBucketNotFound:
+		return ErrBucketNotFound
+	case bolt.ErrBucketExists:
+		return ErrBucketExists
+	case bolt.ErrBucketNameRequired:
+		return ErrBucketNameRequired
+	case bolt.ErrKeyRequired:
+		return ErrKeyRequired
+	case bolt.ErrIncompatibleValue:
+		return ErrIncompatibleValue
+	}
+	return e
+}
+
+func boltTxFunc(f func(Tx) error) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		return f(boltTx{tx})
+	}
+}
+
+func (d boltDB) Begin(writable bool) (Tx, error) {
+	tx, e := d.db.Begin(writable)
+	if e != nil {
+		return nil, boltError(e)
+	}
+	return boltTx{tx}, nil
+}
+
+func (d boltDB) View(f func(Tx) error) error {
+	return boltError(d.db.View(boltTxFunc(f)))
+}
+
+func (d boltDB) Update(f func(Tx) error) error {
+	return boltError(d.db.Update(boltTxFunc(f)))
+}
+
+func (d boltDB) Batch(f func(Tx) error) error {
+	return boltError(d.db.Batch(boltTxFunc(f)))
+}
+
+func (d boltDB) Close() error {
+	return boltError(d.db.Close())
+}
+
+// bucket returns bk as Bucket, nil if it is nil.
+func bucket(bk *bolt.Bucket) Bucket {
+	if bk == nil {
+		return nil
+	}
+	return boltBucket{bk}
+}
+
+func (t boltTx) ID() int {
+	return t.tx.ID()
+}
+
+func (t boltTx) Writable() bool {
+	return t.tx.Writable()
+}
+
+func (t boltTx) Bucket(name []byte) Bucket {
+	return bucket(t.tx.Bucket(name))
+}
+
+func (t boltTx) CreateBucket(name []byte) (Bucket, error) {
+	bk, e := t.tx.CreateBucket(name)
+	return bucket(bk), boltError(e)
+}
+
+func (t boltTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	bk, e := t.tx.CreateBucketIfNotExists(name)
+	return bucket(bk), boltError(e)
+}
+
+func (t boltTx) DeleteBucket(name []byte) error {
+	return boltError(t.tx.DeleteBucket(name))
+}
+
+func (t boltTx) OnCommit(f func()) {
+	t.tx.OnCommit(f)
+}
+
+func (t boltTx) Commit() error {
+	return boltError(t.tx.Commit())
+}
+
+func (t boltTx) Rollback() error {
+	return boltError(t.tx.Rollback())
+}
+
+// WriteTo writes a data file holding the data t sees, compacted into a
+// temporary file next to the data file first. Unlike a copy of the data file,
+// it doesn't hold the pages bolt freed, which keep deleted and overwritten
+// data, e.g. records from before they were encrypted, until they are reused.
+func (t boltTx) WriteTo(w io.Writer) (int64, error) {
+
+	tmp, e := ioutil.TempFile(filepath.Dir(t.tx.DB().Path()), filepath.Base(t.tx.DB().Path())+".export.")
+	if e != nil {
+		return 0, e
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	dst, e := bolt.Open(tmp.Name(), 0600, nil)
+	if e != nil {
+		return 0, e
+	}
+	if e := compact(dst, t.tx); e != nil {
+		dst.Close()
+		return 0, e
+	}
+	if e := dst.Close(); e != nil {
+		return 0, e
+	}
+
+	return io.Copy(w, tmp)
+}
+
+// bytes of keys and values compact copies per write transaction
+const compactBatchBytes = 64 * 1024 * 1024
+
+// compact copies the buckets of src to the empty dst, in write transactions
+// of up to compactBatchBytes each.
+func compact(dst *bolt.DB, src *bolt.Tx) error {
+
+	tx, e := dst.Begin(true)
+	if e != nil {
+		return e
+	}
+	defer func() { tx.Rollback() }() // the last one, if it failed
+
+	// bucketAt returns the bucket at path in tx, which changes on each commit.
+	bucketAt := func(path [][]byte) *bolt.Bucket {
+		b := tx.Bucket(path[0])
+		for _, name := range path[1:] {
+			b = b.Bucket(name)
+		}
+		return b
+	}
+
+	n := 0
+	var copyBucket func(path [][]byte, b *bolt.Bucket) error
+	copyBucket = func(path [][]byte, b *bolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			if n += len(k) + len(v); n > compactBatchBytes {
+				if e := tx.Commit(); e != nil {
+					return e
+				}
+				if tx, e = dst.Begin(true); e != nil {
+					return e
+				}
+				n = 0
+			}
+			if v != nil {
+				return bucketAt(path).Put(k, v) // valid as long as src
+			}
+			if _, e := bucketAt(path).CreateBucket(k); e != nil {
+				return e
+			}
+			return copyBucket(append(path[:len(path):len(path)], k), b.Bucket(k))
+		})
+	}
+
+	e = src.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if _, e := tx.CreateBucket(name); e != nil {
+			return e
+		}
+		return copyBucket([][]byte{name}, b)
+	})
+	if e != nil {
+		return e
+	}
+
+	return tx.Commit()
+}
+
+func (b boltBucket) Tx() Tx {
+	return boltTx{b.bk.Tx()}
+}
+
+func (b boltBucket) Bucket(name []byte) Bucket {
+	return bucket(b.bk.Bucket(name))
+}
+
+func (b boltBucket) CreateBucket(name []byte) (Bucket, error) {
+	bk, e := b.bk.CreateBucket(name)
+	return bucket(bk), boltError(e)
+}
+
+func (b boltBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	bk, e := b.bk.CreateBucketIfNotExists(name)
+	return bucket(bk), boltError(e)
+}
+
+func (b boltBucket) DeleteBucket(name []byte) error {
+	return boltError(b.bk.DeleteBucket(name))
+}
+
+func (b boltBucket) Get(key []byte) []byte {
+	return b.bk.Get(key)
+}
+
+func (b boltBucket) Put(key, value []byte) error {
+	return boltError(b.bk.Put(key, value))
+}
+
+func (b boltBucket) Delete(key []byte) error {
+	return boltError(b.bk.Delete(key))
+}
+
+func (b boltBucket) ForEach(f func(k, v []byte) error) error {
+	return b.bk.ForEach(f) // f's errors are passed through as they are
+}
+
+func (b boltBucket) Cursor() Cursor {
+	return b.bk.Cursor()
+}
+
+func (b boltBucket) KeyN() int {
+	return b.bk.Stats().KeyN
+}
@@ -0,0 +1,401 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package store
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// NewMemory returns an empty DB held in memory, e.g. for tests, which can
+// use one each and run in parallel. Committed data is never modified: writable
+// transactions copy the buckets they modify, so that read-only ones see the
+// data as of when they began without locking.
+func NewMemory() DB {
+	return &memory{root: &node{}}
+}
+
+type memory struct {
+	writer sync.Mutex // held by the open writable transaction
+
+	lock   sync.RWMutex // guards the fields below
+	root   *node
+	id     int // of the last committed transaction
+	closed bool
+}
+
+// node is the content of a bucket.
+type node struct {
+	entries []entry // sorted by key
+}
+
+type entry struct {
+	key   []byte
+	value []byte
+	node  *node // of a nested bucket, nil for values
+}
+
+type memoryTx struct {
+	db       *memory
+	id       int
+	writable bool
+	closed   bool
+	root     *memoryBucket
+	copies   map[*node]*node    // nodes copied by the transaction, to their copy
+	owned    map[*node]struct{} // copies and new nodes, which it may modify
+	onCommit []func()
+}
+
+type memoryBucket struct {
+	tx     *memoryTx
+	parent *memoryBucket // nil for the root of tx
+	name   []byte
+	node   *node // as of when the bucket was opened, see current
+}
+
+type memoryCursor struct {
+	bucket *memoryBucket
+	key    []byte // positioned at, nil if none
+}
+
+func (m *memory) Begin(writable bool) (Tx, error) {
+	if writable {
+		m.writer.Lock()
+	}
+	m.lock.RLock()
+	root, id, closed := m.root, m.id, m.closed
+	m.lock.RUnlock()
+	if closed {
+		if writable {
+			m.writer.Unlock()
+		}
+		return nil, ErrDatabaseNotOpen
+	}
+	tx := &memoryTx{db: m, id: id, writable: writable}
+	tx.root = &memoryBucket{tx: tx, node: root}
+	if writable {
+		tx.id++
+		tx.copies, tx.owned = map[*node]*node{}, map[*node]struct{}{}
+	}
+	return tx, nil
+}
+
+func (m *memory) View(f func(Tx) error) error {
+	tx, e := m.Begin(false)
+	if e != nil {
+		return e
+	}
+	defer tx.Rollback()
+	return f(tx)
+}
+
+func (m *memory) Update(f func(Tx) error) error {
+	tx, e := m.Begin(true)
+	if e != nil {
+		return e
+	}
+	defer func() {
+		if !tx.(*memoryTx).closed { // f panicked or failed
+			tx.Rollback()
+		}
+	}()
+	if e := f(tx); e != nil {
+		return e
+	}
+	return tx.Commit()
+}
+
+// Batch is Update, as writable transactions are cheap.
+func (m *memory) Batch(f func(Tx) error) error {
+	return m.Update(f)
+}
+
+func (m *memory) Close() error {
+	m.writer.Lock() // waiting for the writable transaction, if any
+	defer m.writer.Unlock()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return ErrDatabaseNotOpen
+	}
+	m.closed = true
+	return nil
+}
+
+func (t *memoryTx) ID() int {
+	return t.id
+}
+
+func (t *memoryTx) Writable() bool {
+	return t.writable
+}
+
+func (t *memoryTx) Bucket(name []byte) Bucket {
+	return t.root.Bucket(name)
+}
+
+func (t *memoryTx) CreateBucket(name []byte) (Bucket, error) {
+	return t.root.CreateBucket(name)
+}
+
+func (t *memoryTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	return t.root.CreateBucketIfNotExists(name)
+}
+
+func (t *memoryTx) DeleteBucket(name []byte) error {
+	return t.root.DeleteBucket(name)
+}
+
+func (t *memoryTx) OnCommit(f func()) {
+	t.onCommit = append(t.onCommit, f)
+}
+
+func (t *memoryTx) Commit() error {
+	if t.closed {
+		return ErrTxClosed
+	}
+	if !t.writable {
+		return ErrTxNotWritable
+	}
+	t.db.lock.Lock()
+	t.db.root, t.db.id = t.root.current(), t.id
+	t.db.lock.Unlock()
+	t.close()
+	for _, f := range t.onCommit {
+		f()
+	}
+	return nil
+}
+
+func (t *memoryTx) Rollback() error {
+	if t.closed {
+		return ErrTxClosed
+	}
+	t.close()
+	return nil
+}
+
+func (t *memoryTx) close() {
+	t.closed = true
+	if t.writable {
+		t.db.writer.Unlock()
+	}
+}
+
+// current returns the node of b, which tx may have copied since b was opened.
+func (b *memoryBucket) current() *node {
+	if c, ok := b.tx.copies[b.node]; ok {
+		return c
+	}
+	return b.node
+}
+
+// modifiable returns the node of b, copying it and its parents first unless
+// tx may modify them.
+func (b *memoryBucket) modifiable() (*node, error) {
+	if b.tx.closed {
+		return nil, ErrTxClosed
+	}
+	if !b.tx.writable {
+		return nil, ErrTxNotWritable
+	}
+	n := b.current()
+	if _, ok := b.tx.owned[n]; ok {
+		return n, nil
+	}
+	c := &node{entries: append([]entry(nil), n.entries...)}
+	b.tx.copies[n], b.tx.owned[c] = c, struct{}{}
+	if b.parent != nil {
+		p, e := b.parent.modifiable()
+		if e != nil {
+			return nil, e
+		}
+		if i, ok := p.find(b.name); ok && p.entries[i].node == n {
+			p.entries[i].node = c
+		}
+	}
+	return c, nil
+}
+
+// find returns the index of key in n, or where to insert it.
+func (n *node) find(key []byte) (int, bool) {
+	i := sort.Search(len(n.entries), func(i int) bool {
+		return bytes.Compare(n.entries[i].key, key) >= 0
+	})
+	return i, i < len(n.entries) && bytes.Equal(n.entries[i].key, key)
+}
+
+func (n *node) insert(i int, e entry) {
+	n.entries = append(n.entries, entry{})
+	copy(n.entries[i+1:], n.entries[i:])
+	n.entries[i] = e
+}
+
+func (n *node) remove(i int) {
+	n.entries = append(n.entries[:i], n.entries[i+1:]...)
+}
+
+func (b *memoryBucket) Tx() Tx {
+	return b.tx
+}
+
+func (b *memoryBucket) Bucket(name []byte) Bucket {
+	n := b.current()
+	i, ok := n.find(name)
+	if !ok || n.entries[i].node == nil {
+		return nil
+	}
+	return &memoryBucket{tx: b.tx, parent: b, name: n.entries[i].key, node: n.entries[i].node}
+}
+
+func (b *memoryBucket) CreateBucket(name []byte) (Bucket, error) {
+	if len(name) == 0 {
+		return nil, ErrBucketNameRequired
+	}
+	n, e := b.modifiable()
+	if e != nil {
+		return nil, e
+	}
+	i, ok := n.find(name)
+	if ok && n.entries[i].node != nil {
+		return nil, ErrBucketExists
+	}
+	if ok {
+		return nil, ErrIncompatibleValue
+	}
+	c := &node{}
+	b.tx.owned[c] = struct{}{}
+	n.insert(i, entry{key: append([]byte(nil), name...), node: c})
+	return &memoryBucket{tx: b.tx, parent: b, name: n.entries[i].key, node: c}, nil
+}
+
+func (b *memoryBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	bk, e := b.CreateBucket(name)
+	if e == ErrBucketExists {
+		return b.Bucket(name), nil
+	}
+	return bk, e
+}
+
+func (b *memoryBucket) DeleteBucket(name []byte) error {
+	n, e := b.modifiable()
+	if e != nil {
+		return e
+	}
+	i, ok := n.find(name)
+	if !ok {
+		return ErrBucketNotFound
+	}
+	if n.entries[i].node == nil {
+		return ErrIncompatibleValue
+	}
+	n.remove(i)
+	return nil
+}
+
+func (b *memoryBucket) Get(key []byte) []byte {
+	n := b.current()
+	if i, ok := n.find(key); ok {
+		return n.entries[i].value
+	}
+	return nil
+}
+
+func (b *memoryBucket) Put(key, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyRequired
+	}
+	n, e := b.modifiable()
+	if e != nil {
+		return e
+	}
+	i, ok := n.find(key)
+	if ok && n.entries[i].node != nil {
+		return ErrIncompatibleValue
+	}
+	value = append(make([]byte, 0, len(value)), value...) // not nil, which Get returns for buckets
+	if ok {
+		n.entries[i].value = value
+	} else {
+		n.insert(i, entry{key: append([]byte(nil), key...), value: value})
+	}
+	return nil
+}
+
+func (b *memoryBucket) Delete(key []byte) error {
+	n, e := b.modifiable()
+	if e != nil {
+		return e
+	}
+	i, ok := n.find(key)
+	if !ok {
+		return nil
+	}
+	if n.entries[i].node != nil {
+		return ErrIncompatibleValue
+	}
+	n.remove(i)
+	return nil
+}
+
+func (b *memoryBucket) ForEach(f func(k, v []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if e := f(k, v); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (b *memoryBucket) Cursor() Cursor {
+	return &memoryCursor{bucket: b}
+}
+
+func (b *memoryBucket) KeyN() int {
+	return b.current().keyN()
+}
+
+func (n *node) keyN() int {
+	k := len(n.entries)
+	for _, e := range n.entries {
+		if e.node != nil {
+			k += e.node.keyN()
+		}
+	}
+	return k
+}
+
+// at positions c at entry i of n.
+func (c *memoryCursor) at(n *node, i int) ([]byte, []byte) {
+	if i >= len(n.entries) {
+		c.key = nil
+		return nil, nil
+	}
+	c.key = n.entries[i].key
+	return c.key, n.entries[i].value
+}
+
+func (c *memoryCursor) First() ([]byte, []byte) {
+	return c.at(c.bucket.current(), 0)
+}
+
+// Next positions c at the key after the current one, looking it up again so
+// that the bucket may be modified in between.
+func (c *memoryCursor) Next() ([]byte, []byte) {
+	if c.key == nil {
+		return nil, nil
+	}
+	n := c.bucket.current()
+	i := sort.Search(len(n.entries), func(i int) bool {
+		return bytes.Compare(n.entries[i].key, c.key) > 0
+	})
+	return c.at(n, i)
+}
+
+func (c *memoryCursor) Seek(seek []byte) ([]byte, []byte) {
+	n := c.bucket.current()
+	i, _ := n.find(seek)
+	return c.at(n, i)
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package store
+
+import (
+	"errors"
+)
+
+// DB is an embedded key-value store of nested buckets, with serializable
+// transactions of one writer and any number of readers. It follows the
+// semantics of bolt, see NewBolt, so that other engines like NewMemory can
+// take its place.
+type DB interface {
+	// Begin starts a transaction, only one writable one may be open at a time.
+	Begin(writable bool) (Tx, error)
+	// View runs f in a read-only transaction.
+	View(f func(Tx) error) error
+	// Update runs f in a writable transaction, committing it if f returns nil.
+	Update(f func(Tx) error) error
+	// Batch is like Update, but may run f in a transaction shared with other
+	// concurrent calls to Batch. f may be called more than once.
+	Batch(f func(Tx) error) error
+	Close() error
+}
+
+// Tx is a transaction of a DB. Keys and values it returns are only valid
+// until it is closed, and must not be modified. Neither transactions nor the
+// buckets and cursors they return are safe for concurrent use, read-only ones
+// included.
+type Tx interface {
+	// ID is the id of the transaction, that of the last committed one for
+	// read-only transactions and one more for writable ones.
+	ID() int
+	Writable() bool
+	// Bucket returns the top-level bucket name, nil if it doesn't exist.
+	Bucket(name []byte) Bucket
+	CreateBucket(name []byte) (Bucket, error)
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	DeleteBucket(name []byte) error
+	// OnCommit registers f to be called after the transaction committed.
+	OnCommit(f func())
+	Commit() error
+	Rollback() error
+}
+
+// Bucket is a sorted collection of keys with either values or nested buckets.
+// Values passed to Put must not be modified until the transaction is closed.
+type Bucket interface {
+	Tx() Tx
+	// Bucket returns nested bucket name, nil if it doesn't exist.
+	Bucket(name []byte) Bucket
+	CreateBucket(name []byte) (Bucket, error)
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	DeleteBucket(name []byte) error
+	// Get returns the value of key, nil if it doesn't exist or is a bucket.
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// ForEach calls f with every key in order and its value, nil for nested
+	// buckets, stopping at the first error.
+	ForEach(f func(k, v []byte) error) error
+	// Cursor returns a cursor over the keys. Creating one counts as using the
+	// transaction, so goroutines sharing it must not do so concurrently.
+	Cursor() Cursor
+	// KeyN returns the number of keys, those of nested buckets included.
+	KeyN() int
+}
+
+// Cursor iterates over the keys of a bucket in order. Its methods return the
+// key and value they position it at, nil keys past the last one and nil
+// values for nested buckets.
+type Cursor interface {
+	First() ([]byte, []byte)
+	Next() ([]byte, []byte)
+	// Seek positions the cursor at key seek or the first key after it.
+	Seek(seek []byte) ([]byte, []byte)
+}
+
+var (
+	ErrDatabaseNotOpen    = errors.New("database not open")
+	ErrTxNotWritable      = errors.New("tx not writable")
+	ErrTxClosed           = errors.New("tx closed")
+	ErrBucketNotFound     = errors.New("bucket not found")
+	ErrBucketExists       = errors.New("bucket already exists")
+	ErrBucketNameRequired = errors.New("bucket name required")
+	ErrKeyRequired        = errors.New("key required")
+	ErrIncompatibleValue  = errors.New("incompatible value")
+)
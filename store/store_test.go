@@ -0,0 +1,278 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package store
+
+import (
+	"fmt"
+	bolt "github.com/coreos/bbolt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// engines run every test against each engine, which must behave the same.
+var engines = map[string]func(t *testing.T) (DB, func()){
+	"bolt": func(t *testing.T) (DB, func()) {
+		tmp, e := ioutil.TempFile("", "karma-store-test-")
+		if e != nil {
+			t.Fatal(e)
+		}
+		tmp.Close()
+		// remapping a grown file waits for read-only transactions to close
+		db, e := bolt.Open(tmp.Name(), 0600, &bolt.Options{InitialMmapSize: 1 << 20})
+		if e != nil {
+			t.Fatal(e)
+		}
+		return NewBolt(db), func() {
+			db.Close()
+			os.Remove(tmp.Name())
+		}
+	},
+	"memory": func(t *testing.T) (DB, func()) {
+		db := NewMemory()
+		return db, func() { db.Close() }
+	},
+}
+
+func forEachEngine(t *testing.T, f func(t *testing.T, db DB)) {
+	for name, open := range engines {
+		t.Run(name, func(t *testing.T) {
+			db, close := open(t)
+			defer close()
+			f(t, db)
+		})
+	}
+}
+
+// dump returns the keys, values and nested buckets of b, in order.
+func dump(b Bucket) string {
+	s := []string{}
+	b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			s = append(s, string(k)+"{"+dump(b.Bucket(k))+"}")
+		} else {
+			s = append(s, string(k)+"="+string(v))
+		}
+		return nil
+	})
+	return strings.Join(s, " ")
+}
+
+func TestBuckets(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, db DB) {
+		e := db.Update(func(tx Tx) error {
+			rb, e := tx.CreateBucket([]byte("root"))
+			if e != nil {
+				return e
+			}
+			for _, k := range []string{"c", "a", "b"} {
+				if e := rb.Put([]byte(k), []byte(k+k)); e != nil {
+					return e
+				}
+			}
+			nb, e := rb.CreateBucketIfNotExists([]byte("n"))
+			if e != nil {
+				return e
+			}
+			if e := nb.Put([]byte("x"), []byte("1")); e != nil {
+				return e
+			}
+			if _, e := rb.CreateBucket([]byte("n")); e != ErrBucketExists {
+				return fmt.Errorf("CreateBucket of existing bucket: %v", e)
+			}
+			if _, e := rb.CreateBucket([]byte("a")); e != ErrIncompatibleValue {
+				return fmt.Errorf("CreateBucket of value: %v", e)
+			}
+			if e := rb.Put([]byte("n"), []byte("v")); e != ErrIncompatibleValue {
+				return fmt.Errorf("Put of bucket: %v", e)
+			}
+			if e := rb.DeleteBucket([]byte("missing")); e != ErrBucketNotFound {
+				return fmt.Errorf("DeleteBucket of missing bucket: %v", e)
+			}
+			if b := rb.Bucket([]byte("a")); b != nil {
+				return fmt.Errorf("Bucket of value: %v", b)
+			}
+			return nil
+		})
+		if e != nil {
+			t.Fatal(e)
+		}
+		db.View(func(tx Tx) error {
+			rb := tx.Bucket([]byte("root"))
+			if s := dump(rb); s != "a=aa b=bb c=cc n{x=1}" {
+				t.Fatal(s)
+			}
+			if rb.Get([]byte("n")) != nil || rb.Get([]byte("d")) != nil {
+				t.Fatal("Get of bucket or missing key")
+			}
+			if n := rb.KeyN(); n != 5 {
+				t.Fatal(n)
+			}
+			if e := rb.Put([]byte("d"), []byte("dd")); e != ErrTxNotWritable {
+				t.Fatalf("Put in read-only transaction: %v", e)
+			}
+			return nil
+		})
+	})
+}
+
+func TestCursor(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, db DB) {
+		db.Update(func(tx Tx) error {
+			rb, _ := tx.CreateBucket([]byte("root"))
+			for i := 0; i < 100; i += 2 {
+				rb.Put([]byte(fmt.Sprintf("%03d", i)), []byte{byte(i)})
+			}
+			c, s := rb.Cursor(), []string{}
+			for k, v := c.Seek([]byte("091")); k != nil; k, v = c.Next() {
+				s = append(s, fmt.Sprintf("%s:%d", k, v[0]))
+			}
+			if j := strings.Join(s, " "); j != "092:92 094:94 096:96 098:98" {
+				t.Fatal(j)
+			}
+			if k, _ := c.Seek([]byte("099")); k != nil {
+				t.Fatal(string(k))
+			}
+			if k, _ := c.First(); string(k) != "000" {
+				t.Fatal(string(k))
+			}
+			return nil
+		})
+	})
+}
+
+func TestTransactions(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, db DB) {
+		db.Update(func(tx Tx) error {
+			rb, _ := tx.CreateBucket([]byte("root"))
+			nb, _ := rb.CreateBucket([]byte("n"))
+			return nb.Put([]byte("k"), []byte("committed"))
+		})
+
+		read, e := db.Begin(false)
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer read.Rollback()
+		id := read.ID()
+
+		committed := false
+		e = db.Update(func(tx Tx) error {
+			if tx.ID() != id+1 {
+				t.Fatalf("writable transaction %d after %d", tx.ID(), id)
+			}
+			tx.OnCommit(func() { committed = true })
+			nb := tx.Bucket([]byte("root")).Bucket([]byte("n"))
+			other := tx.Bucket([]byte("root")).Bucket([]byte("n")) // sees writes through nb
+			if e := nb.Put([]byte("k"), []byte("updated")); e != nil {
+				return e
+			}
+			if v := other.Get([]byte("k")); string(v) != "updated" {
+				t.Fatal(string(v))
+			}
+			return nil
+		})
+		if e != nil || !committed {
+			t.Fatal(e, committed)
+		}
+
+		e = db.Update(func(tx Tx) error {
+			tx.Bucket([]byte("root")).Bucket([]byte("n")).Put([]byte("k"), []byte("rolled back"))
+			return fmt.Errorf("roll back")
+		})
+		if e == nil || e.Error() != "roll back" {
+			t.Fatal(e)
+		}
+
+		if v := read.Bucket([]byte("root")).Bucket([]byte("n")).Get([]byte("k")); string(v) != "committed" {
+			t.Fatal("read-only transaction sees later commit:", string(v))
+		}
+		db.View(func(tx Tx) error {
+			if v := tx.Bucket([]byte("root")).Bucket([]byte("n")).Get([]byte("k")); string(v) != "updated" {
+				t.Fatal(string(v))
+			}
+			return nil
+		})
+	})
+}
+
+func TestSynchronized(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, db DB) {
+		db.Update(func(tx Tx) error {
+			rb, _ := tx.CreateBucket([]byte("root"))
+			for i := 0; i < 100; i++ {
+				rb.Put([]byte(fmt.Sprintf("%03d", i)), []byte{byte(i)})
+			}
+			return nil
+		})
+		db.View(func(tx Tx) error {
+			rb := Synchronized(tx.Bucket([]byte("root")))
+			wg, sums := sync.WaitGroup{}, make([]int, 8)
+			for g := range sums {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					c := rb.Cursor()
+					for k, v := c.First(); k != nil; k, v = c.Next() {
+						sums[g] += int(v[0]) + int(rb.Get(k)[0])
+					}
+				}(g)
+			}
+			wg.Wait()
+			for _, s := range sums {
+				if s != 2*99*100/2 {
+					t.Fatal(s)
+				}
+			}
+			return nil
+		})
+	})
+}
+
+func TestBoltExport(t *testing.T) {
+	db, close := engines["bolt"](t)
+	defer close()
+	db.Update(func(tx Tx) error {
+		rb, _ := tx.CreateBucket([]byte("root"))
+		rb.Put([]byte("a"), []byte("aa"))
+		nb, _ := rb.CreateBucket([]byte("n"))
+		nb.Put([]byte("x"), []byte("plaintext"))
+		return nil
+	})
+	db.Update(func(tx Tx) error {
+		return tx.Bucket([]byte("root")).Bucket([]byte("n")).Put([]byte("x"), []byte("1"))
+	})
+
+	tmp, e := ioutil.TempFile("", "karma-store-test-")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.Remove(tmp.Name())
+	e = db.View(func(tx Tx) error {
+		_, e := tx.(io.WriterTo).WriteTo(tmp)
+		return e
+	})
+	tmp.Close()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	bs, _ := ioutil.ReadFile(tmp.Name())
+	if strings.Contains(string(bs), "plaintext") {
+		t.Fatal("export holds overwritten value")
+	}
+	bdb, e := bolt.Open(tmp.Name(), 0600, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer bdb.Close()
+	NewBolt(bdb).View(func(tx Tx) error {
+		if s := dump(tx.Bucket([]byte("root"))); s != "a=aa n{x=1}" {
+			t.Fatal(s)
+		}
+		return nil
+	})
+}
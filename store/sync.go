@@ -0,0 +1,189 @@
+// Copyright 2017 karma.run AG. All rights reserved.
+// Use of this source code is governed by an AGPL license that can be found in the LICENSE file.
+package store
+
+import (
+	"sync"
+)
+
+// Synchronized returns b with its methods, and those of the transaction,
+// buckets and cursors they return, serialized by a mutex, so that goroutines
+// may share its transaction. Keys and values it returns stay valid as long as
+// they would without it.
+func Synchronized(b Bucket) Bucket {
+	if s, ok := b.(syncBucket); ok {
+		return s
+	}
+	return syncBucket{b, &sync.Mutex{}}
+}
+
+type syncTx struct {
+	tx   Tx
+	lock *sync.Mutex
+}
+
+type syncBucket struct {
+	bk   Bucket
+	lock *sync.Mutex
+}
+
+type syncCursor struct {
+	c    Cursor
+	lock *sync.Mutex
+}
+
+// synchronized returns bk as syncBucket sharing lock, nil if it is nil.
+func synchronized(bk Bucket, lock *sync.Mutex) Bucket {
+	if bk == nil {
+		return nil
+	}
+	return syncBucket{bk, lock}
+}
+
+func (t syncTx) ID() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.tx.ID()
+}
+
+func (t syncTx) Writable() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.tx.Writable()
+}
+
+func (t syncTx) Bucket(name []byte) Bucket {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return synchronized(t.tx.Bucket(name), t.lock)
+}
+
+func (t syncTx) CreateBucket(name []byte) (Bucket, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	bk, e := t.tx.CreateBucket(name)
+	return synchronized(bk, t.lock), e
+}
+
+func (t syncTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	bk, e := t.tx.CreateBucketIfNotExists(name)
+	return synchronized(bk, t.lock), e
+}
+
+func (t syncTx) DeleteBucket(name []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.tx.DeleteBucket(name)
+}
+
+func (t syncTx) OnCommit(f func()) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.tx.OnCommit(f)
+}
+
+func (t syncTx) Commit() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.tx.Commit()
+}
+
+func (t syncTx) Rollback() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.tx.Rollback()
+}
+
+func (b syncBucket) Tx() Tx {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return syncTx{b.bk.Tx(), b.lock}
+}
+
+func (b syncBucket) Bucket(name []byte) Bucket {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return synchronized(b.bk.Bucket(name), b.lock)
+}
+
+func (b syncBucket) CreateBucket(name []byte) (Bucket, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	bk, e := b.bk.CreateBucket(name)
+	return synchronized(bk, b.lock), e
+}
+
+func (b syncBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	bk, e := b.bk.CreateBucketIfNotExists(name)
+	return synchronized(bk, b.lock), e
+}
+
+func (b syncBucket) DeleteBucket(name []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.bk.DeleteBucket(name)
+}
+
+func (b syncBucket) Get(key []byte) []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.bk.Get(key)
+}
+
+func (b syncBucket) Put(key, value []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.bk.Put(key, value)
+}
+
+func (b syncBucket) Delete(key []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.bk.Delete(key)
+}
+
+// ForEach holds the lock only while moving to the next key, so that f may use
+// the transaction.
+func (b syncBucket) ForEach(f func(k, v []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if e := f(k, v); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (b syncBucket) Cursor() Cursor {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return syncCursor{b.bk.Cursor(), b.lock}
+}
+
+func (b syncBucket) KeyN() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.bk.KeyN()
+}
+
+func (c syncCursor) First() ([]byte, []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.c.First()
+}
+
+func (c syncCursor) Next() ([]byte, []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.c.Next()
+}
+
+func (c syncCursor) Seek(seek []byte) ([]byte, []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.c.Seek(seek)
+}